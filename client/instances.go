@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -21,6 +22,9 @@ type Instance struct {
 		Locale            string `json:"locale"`
 		Dev               bool   `json:"dev"`
 		BytesDiskQuota    int64  `json:"disk_quota,string,omitempty"`
+		VersionsMaxCount  int    `json:"versions_max_count,omitempty"`
+		VersionsMaxAge    int64  `json:"versions_max_age,omitempty"`
+		TrashMaxAge       int64  `json:"trash_max_age,omitempty"`
 		IndexViewsVersion int    `json:"indexes_version"`
 		PassphraseHash    []byte `json:"passphrase_hash,omitempty"`
 		RegisterToken     []byte `json:"register_token,omitempty"`
@@ -39,6 +43,10 @@ type InstanceOptions struct {
 	Apps       []string
 	Dev        bool
 	Passphrase string
+
+	VersionsMaxCount int
+	VersionsMaxAge   time.Duration
+	TrashMaxAge      time.Duration
 }
 
 // TokenOptions is a struct holding all the options to generate a token.
@@ -120,13 +128,23 @@ func (c *Client) ModifyInstance(domain string, opts *InstanceOptions) (*Instance
 	if !validDomain(domain) {
 		return nil, fmt.Errorf("Invalid domain: %s", domain)
 	}
+	q := url.Values{
+		"Locale":    {opts.Locale},
+		"DiskQuota": {strconv.FormatInt(opts.DiskQuota, 10)},
+	}
+	if opts.VersionsMaxCount != 0 {
+		q.Add("VersionsMaxCount", strconv.Itoa(opts.VersionsMaxCount))
+	}
+	if opts.VersionsMaxAge != 0 {
+		q.Add("VersionsMaxAge", opts.VersionsMaxAge.String())
+	}
+	if opts.TrashMaxAge != 0 {
+		q.Add("TrashMaxAge", opts.TrashMaxAge.String())
+	}
 	res, err := c.Req(&request.Options{
-		Method: "PATCH",
-		Path:   "/instances/" + domain,
-		Queries: url.Values{
-			"Locale":    {opts.Locale},
-			"DiskQuota": {strconv.FormatInt(opts.DiskQuota, 10)},
-		},
+		Method:  "PATCH",
+		Path:    "/instances/" + domain,
+		Queries: q,
 	})
 	if err != nil {
 		return nil, err
@@ -197,6 +215,46 @@ func (c *Client) RegisterOAuthClient(opts *OAuthClientOptions) (string, error) {
 	return string(b), nil
 }
 
+// AppPassword is the username and password of an app password, used by the
+// clients that can only do HTTP basic authentication.
+type AppPassword struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CreateAppPassword generates a new app password for the specified instance.
+func (c *Client) CreateAppPassword(domain, label string) (*AppPassword, error) {
+	q := url.Values{
+		"Domain": {domain},
+		"Label":  {label},
+	}
+	res, err := c.Req(&request.Options{
+		Method:  "POST",
+		Path:    "/instances/app_passwords",
+		Queries: q,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var pass AppPassword
+	if err = json.NewDecoder(res.Body).Decode(&pass); err != nil {
+		return nil, err
+	}
+	return &pass, nil
+}
+
+// DestroyAppPassword revokes an app password of the specified instance.
+func (c *Client) DestroyAppPassword(domain, username string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/instances/app_passwords/" + username,
+		Queries:    url.Values{"Domain": {domain}},
+		NoResponse: true,
+	})
+	return err
+}
+
 func readInstance(res *http.Response) (*Instance, error) {
 	in := &Instance{}
 	if err := readJSONAPI(res.Body, &in, nil); err != nil {
@@ -208,3 +266,60 @@ func readInstance(res *http.Response) (*Instance, error) {
 func validDomain(domain string) bool {
 	return !strings.ContainsAny(domain, " /?#@\t\r\n")
 }
+
+// EncryptFilesInstance enables the encryption of the files of the specified
+// instance. It returns the job that encrypts the contents already stored.
+func (c *Client) EncryptFilesInstance(domain string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/encrypt-files",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err = readJSONAPI(res.Body, &job, nil); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// AddMissingTriggersInstance creates the default triggers that the specified
+// instance does not have yet. It returns the triggers that have been created.
+func (c *Client) AddMissingTriggersInstance(domain string) ([]map[string]interface{}, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/triggers",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var triggers []map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&triggers); err != nil {
+		return nil, err
+	}
+	return triggers, nil
+}
+
+// FsckInstance checks the consistency of the filesystem of the specified
+// instance, and repairs it if asked. It returns the inconsistencies found.
+func (c *Client) FsckInstance(domain string, repair bool) ([]map[string]interface{}, error) {
+	method := "GET"
+	if repair {
+		method = "POST"
+	}
+	res, err := c.Req(&request.Options{
+		Method: method,
+		Path:   "/instances/" + domain + "/fsck",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var logs []map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
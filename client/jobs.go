@@ -0,0 +1,180 @@
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// Job is the JSON-API representation of a job
+type Job struct {
+	ID    string `json:"id"`
+	Attrs struct {
+		Domain    string    `json:"domain"`
+		Worker    string    `json:"worker"`
+		State     string    `json:"state"`
+		QueuedAt  time.Time `json:"queued_at"`
+		StartedAt time.Time `json:"started_at"`
+		Error     string    `json:"error,omitempty"`
+	} `json:"attributes"`
+}
+
+// JobsListOptions holds the filters for listing the jobs. The empty values
+// mean no filter.
+type JobsListOptions struct {
+	Worker        string
+	State         string
+	QueuedAfter   time.Time
+	QueuedBefore  time.Time
+	StartedAfter  time.Time
+	StartedBefore time.Time
+	// Limit is the maximal number of jobs to return (0 means all of them)
+	Limit int
+}
+
+// jobsPageSize is the number of jobs fetched with each request
+const jobsPageSize = 100
+
+// ListJobs returns the jobs of the instance that match the filters, from the
+// most recently queued to the oldest.
+func (c *Client) ListJobs(opts *JobsListOptions) ([]*Job, error) {
+	q := url.Values{}
+	if opts.Worker != "" {
+		q.Set("worker", opts.Worker)
+	}
+	if opts.State != "" {
+		q.Set("state", opts.State)
+	}
+	dates := map[string]time.Time{
+		"queued_after":   opts.QueuedAfter,
+		"queued_before":  opts.QueuedBefore,
+		"started_after":  opts.StartedAfter,
+		"started_before": opts.StartedBefore,
+	}
+	for param, date := range dates {
+		if !date.IsZero() {
+			q.Set(param, date.Format(time.RFC3339))
+		}
+	}
+	pageSize := jobsPageSize
+	if opts.Limit > 0 && opts.Limit < pageSize {
+		pageSize = opts.Limit
+	}
+	q.Set("page[limit]", strconv.Itoa(pageSize))
+
+	var list []*Job
+	path := "/jobs"
+	for {
+		res, err := c.Req(&request.Options{
+			Method:  "GET",
+			Path:    path,
+			Queries: q,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var doc struct {
+			Data  []*Job `json:"data"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		if err = request.ReadJSON(res.Body, &doc); err != nil {
+			return nil, err
+		}
+		list = append(list, doc.Data...)
+		if opts.Limit > 0 && len(list) >= opts.Limit {
+			return list[:opts.Limit], nil
+		}
+		if doc.Links.Next == "" {
+			return list, nil
+		}
+		next, err := url.Parse(doc.Links.Next)
+		if err != nil {
+			return nil, err
+		}
+		path = next.Path
+		q = next.Query()
+	}
+}
+
+// DeadLetter is the JSON-API representation of a job in the dead-letter queue
+// of its worker type.
+type DeadLetter struct {
+	ID    string `json:"id"`
+	Attrs struct {
+		Domain  string `json:"domain"`
+		Worker  string `json:"worker"`
+		Message struct {
+			Data []byte `json:"Data"`
+			Type string `json:"Type"`
+		} `json:"message"`
+		Error     string    `json:"error"`
+		Attempts  int       `json:"attempts"`
+		QueuedAt  time.Time `json:"queued_at"`
+		StartedAt time.Time `json:"started_at"`
+		FailedAt  time.Time `json:"failed_at"`
+	} `json:"attributes"`
+}
+
+// ListDeadLetters returns the jobs of the dead-letter queue of a worker type,
+// from the most recent failure to the oldest.
+func (c *Client) ListDeadLetters(workerType string) ([]*DeadLetter, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/jobs/dead-letters/" + url.QueryEscape(workerType),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []*DeadLetter
+	if err = readJSONAPI(res.Body, &list, nil); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetDeadLetter returns a job of the dead-letter queue of a worker type.
+func (c *Client) GetDeadLetter(workerType, jobID string) (*DeadLetter, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/jobs/dead-letters/" + url.QueryEscape(workerType) + "/" + url.QueryEscape(jobID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err = readJSONAPI(res.Body, &dl, nil); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// RetryDeadLetter removes a job from the dead-letter queue of a worker type,
+// and pushes a new job with the same message. It returns the new job.
+func (c *Client) RetryDeadLetter(workerType, jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/jobs/dead-letters/" + url.QueryEscape(workerType) + "/" + url.QueryEscape(jobID) + "/retry",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err = readJSONAPI(res.Body, &job, nil); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// DiscardDeadLetter removes a job from the dead-letter queue of a worker type.
+func (c *Client) DiscardDeadLetter(workerType, jobID string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/jobs/dead-letters/" + url.QueryEscape(workerType) + "/" + url.QueryEscape(jobID),
+		NoResponse: true,
+	})
+	return err
+}
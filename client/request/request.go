@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 const defaultUserAgent = "go-cozy-client"
@@ -53,6 +54,9 @@ type (
 		Status string `json:"status"`
 		Title  string `json:"title"`
 		Detail string `json:"detail"`
+		// RetryAfter is the delay given by the Retry-After header of the
+		// response, if any
+		RetryAfter time.Duration `json:"-"`
 	}
 )
 
@@ -169,21 +173,44 @@ func parseError(opts *Options, res *http.Response) (err error) {
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &Error{
-			Status: http.StatusText(res.StatusCode),
-			Title:  http.StatusText(res.StatusCode),
-			Detail: err.Error(),
+			Status:     http.StatusText(res.StatusCode),
+			Title:      http.StatusText(res.StatusCode),
+			Detail:     err.Error(),
+			RetryAfter: ParseRetryAfter(res.Header.Get("Retry-After")),
 		}
 	}
 	if opts.ParseError == nil {
 		return &Error{
-			Status: http.StatusText(res.StatusCode),
-			Title:  http.StatusText(res.StatusCode),
-			Detail: string(b),
+			Status:     http.StatusText(res.StatusCode),
+			Title:      http.StatusText(res.StatusCode),
+			Detail:     string(b),
+			RetryAfter: ParseRetryAfter(res.Header.Get("Retry-After")),
 		}
 	}
 	return opts.ParseError(res, b)
 }
 
+// ParseRetryAfter returns the delay given by the value of a Retry-After
+// header, either as a number of seconds or as an HTTP date. It returns 0 if
+// the value is empty or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(time.Now()); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
 // ErrSSEParse is used when an error occured while parsing the SSE stream.
 var ErrSSEParse = errors.New("could not parse event stream")
 
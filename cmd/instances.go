@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -27,6 +28,7 @@ var flagApps []string
 var flagDev bool
 var flagPassphrase string
 var flagForce bool
+var flagRepair bool
 var flagExpire time.Duration
 
 // instanceCmdGroup represents the instances command
@@ -165,6 +167,88 @@ instance of the given domain. Set the quota to 0 to remove the quota.
 	},
 }
 
+var versionsInstanceCmd = &cobra.Command{
+	Use:   "set-versions-retention [domain] [max-count] [max-age]",
+	Short: "Change the retention policy of the old versions of the files",
+	Long: `
+cozy-stack instances set-versions-retention allows to change how many old
+versions of the files are kept for the instance of the given domain, and for
+how long. The space used by these versions is charged on the disk-quota.
+
+By default, 20 versions are kept for each file, for 30 days. Set the count to
+-1 to disable the versioning. When the max-age is not given, the old versions
+are kept for 30 days.
+`,
+	Example: "$ cozy-stack instances set-versions-retention cozy.tools:8080 10 720h",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 && len(args) != 3 {
+			return cmd.Help()
+		}
+		maxCount, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("Could not parse max-count: %s", err)
+		}
+		var maxAge time.Duration
+		if len(args) == 3 {
+			maxAge, err = time.ParseDuration(args[2])
+			if err != nil {
+				return fmt.Errorf("Could not parse max-age: %s", err)
+			}
+		}
+		domain := args[0]
+		c := newAdminClient()
+		in, err := c.GetInstance(domain)
+		if err != nil {
+			return err
+		}
+		_, err = c.ModifyInstance(domain, &client.InstanceOptions{
+			DiskQuota:        in.Attrs.BytesDiskQuota,
+			VersionsMaxCount: maxCount,
+			VersionsMaxAge:   maxAge,
+		})
+		return err
+	},
+}
+
+var trashRetentionInstanceCmd = &cobra.Command{
+	Use:   "set-trash-retention [domain] [max-age]",
+	Short: "Change how long the items are kept in the trash",
+	Long: `
+cozy-stack instances set-trash-retention allows to change how long the files
+and directories put in the trash are kept for the instance of the given
+domain, before being destroyed automatically.
+
+By default, the items are kept until the trash is cleared. Set the max-age to
+0 to go back to this behavior.
+`,
+	Example: "$ cozy-stack instances set-trash-retention cozy.tools:8080 168h",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		maxAge, err := time.ParseDuration(args[1])
+		if err != nil {
+			return fmt.Errorf("Could not parse max-age: %s", err)
+		}
+		// A zero max-age is not sent by the client, so a negative one is
+		// sent to disable the purge.
+		if maxAge == 0 {
+			maxAge = -1
+		}
+		domain := args[0]
+		c := newAdminClient()
+		in, err := c.GetInstance(domain)
+		if err != nil {
+			return err
+		}
+		_, err = c.ModifyInstance(domain, &client.InstanceOptions{
+			DiskQuota:   in.Attrs.BytesDiskQuota,
+			TrashMaxAge: maxAge,
+		})
+		return err
+	},
+}
+
 var lsInstanceCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "List instances",
@@ -342,17 +426,161 @@ var oauthClientInstanceCmd = &cobra.Command{
 	},
 }
 
+var appPasswordInstanceCmd = &cobra.Command{
+	Use:   "app-password [domain] [label]",
+	Short: "Generate a new app password",
+	Long: `
+cozy-stack instances app-password generates a new password that can be used
+with HTTP basic authentication to access the files of the instance, for
+example by a WebDAV client. The password can't be retrieved later.
+`,
+	Example: "$ cozy-stack instances app-password cozy.tools:8080 \"my laptop\"",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		pass, err := c.CreateAppPassword(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("username: %s\npassword: %s\n", pass.Username, pass.Password)
+		return err
+	},
+}
+
+var revokeAppPasswordInstanceCmd = &cobra.Command{
+	Use:   "revoke-app-password [domain] [username]",
+	Short: "Revoke an app password",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.DestroyAppPassword(args[0], args[1])
+	},
+}
+
+var fsckInstanceCmd = &cobra.Command{
+	Use:   "fsck [domain]",
+	Short: "Check and repair the filesystem of an instance",
+	Long: `
+cozy-stack instances fsck checks the consistency between the index of the
+files in CouchDB and their content in the storage. Each inconsistency is
+printed as a JSON object on its own line.
+
+With the --repair flag, the inconsistencies that can be fixed are repaired.
+`,
+	Example: "$ cozy-stack instances fsck cozy.tools:8080 --repair",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		logs, err := c.FsckInstance(args[0], flagRepair)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, log := range logs {
+			if err = enc.Encode(log); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var encryptFilesInstanceCmd = &cobra.Command{
+	Use:   "encrypt-files [domain]",
+	Short: "Encrypt the files of an instance",
+	Long: `
+cozy-stack instances encrypt-files enables the encryption of the files of an
+instance, and pushes a job that encrypts the contents that are already stored.
+The fs.encryption_key of the configuration must be set.
+
+It can be run again if the job has failed: the contents that are already
+encrypted are skipped. When all the contents have been encrypted, the contents
+that are not encrypted are refused.
+`,
+	Example: "$ cozy-stack instances encrypt-files cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		job, err := c.EncryptFilesInstance(args[0])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("The contents are encrypted by the job %s\n", job.ID)
+		return err
+	},
+}
+
+var addTriggersInstanceCmd = &cobra.Command{
+	Use:   "add-missing-triggers [domain]",
+	Short: "Create the default triggers missing on the instances",
+	Long: `
+cozy-stack instances add-missing-triggers creates the default triggers (like
+the purge of the trash or the scrub of the files) that an instance does not
+have yet, for the instances created before these triggers were added. Each
+created trigger is printed as a JSON object on its own line.
+
+Without a domain, it is done for all the instances.
+`,
+	Example: "$ cozy-stack instances add-missing-triggers cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		var domains []string
+		if len(args) == 1 {
+			domains = args
+		} else {
+			list, err := c.ListInstances()
+			if err != nil {
+				return err
+			}
+			for _, i := range list {
+				domains = append(domains, i.Attrs.Domain)
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, domain := range domains {
+			triggers, err := c.AddMissingTriggersInstance(domain)
+			if err != nil {
+				return fmt.Errorf("Failed to add the triggers of %s: %s", domain, err)
+			}
+			for _, trigger := range triggers {
+				if err = enc.Encode(trigger); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
 func init() {
 	instanceCmdGroup.AddCommand(showInstanceCmd)
 	instanceCmdGroup.AddCommand(addInstanceCmd)
 	instanceCmdGroup.AddCommand(cleanInstanceCmd)
 	instanceCmdGroup.AddCommand(lsInstanceCmd)
 	instanceCmdGroup.AddCommand(quotaInstanceCmd)
+	instanceCmdGroup.AddCommand(versionsInstanceCmd)
+	instanceCmdGroup.AddCommand(trashRetentionInstanceCmd)
 	instanceCmdGroup.AddCommand(destroyInstanceCmd)
 	instanceCmdGroup.AddCommand(appTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(cliTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthClientInstanceCmd)
+	instanceCmdGroup.AddCommand(appPasswordInstanceCmd)
+	instanceCmdGroup.AddCommand(revokeAppPasswordInstanceCmd)
+	instanceCmdGroup.AddCommand(fsckInstanceCmd)
+	instanceCmdGroup.AddCommand(encryptFilesInstanceCmd)
+	instanceCmdGroup.AddCommand(addTriggersInstanceCmd)
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", instance.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagTimezone, "tz", "", "The timezone for the user")
 	addInstanceCmd.Flags().StringVar(&flagEmail, "email", "", "The email of the owner")
@@ -365,5 +593,6 @@ func init() {
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
+	fsckInstanceCmd.Flags().BoolVar(&flagRepair, "repair", false, "Repair the inconsistencies that can be fixed")
 	RootCmd.AddCommand(instanceCmdGroup)
 }
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cozy/cozy-stack/client"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/spf13/cobra"
+)
+
+var errJobsMissingDomain = errors.New("Missing --domain flag")
+
+var flagJobsDomain string
+var flagJobsWorker string
+var flagJobsState string
+var flagJobsQueuedAfter string
+var flagJobsQueuedBefore string
+var flagJobsStartedAfter string
+var flagJobsStartedBefore string
+var flagJobsLimit int
+
+var jobsCmdGroup = &cobra.Command{
+	Use:   "jobs [command]",
+	Short: "Interact with the jobs of a cozy",
+	Long: `
+cozy-stack jobs allows to interact with the jobs of a cozy.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var lsJobsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the jobs of a cozy, from the most recent to the oldest.",
+	Long: `
+cozy-stack jobs ls lists the jobs of a cozy, from the most recently queued to
+the oldest. They can be filtered by worker type, state and dates.
+The dates are in the RFC 3339 format, like 2017-06-01T12:00:00Z.
+`,
+	Example: "$ cozy-stack jobs ls --domain cozy.tools:8080 --worker konnector --state errored",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagJobsDomain == "" {
+			errPrintfln("%s", errJobsMissingDomain)
+			return cmd.Help()
+		}
+		opts := &client.JobsListOptions{
+			Worker: flagJobsWorker,
+			State:  flagJobsState,
+			Limit:  flagJobsLimit,
+		}
+		dates := map[*time.Time]string{
+			&opts.QueuedAfter:   flagJobsQueuedAfter,
+			&opts.QueuedBefore:  flagJobsQueuedBefore,
+			&opts.StartedAfter:  flagJobsStartedAfter,
+			&opts.StartedBefore: flagJobsStartedBefore,
+		}
+		for date, flag := range dates {
+			if flag == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, flag)
+			if err != nil {
+				return err
+			}
+			*date = t
+		}
+		c := newClient(flagJobsDomain, consts.Jobs)
+		list, err := c.ListJobs(opts)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, job := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				job.ID,
+				job.Attrs.Worker,
+				job.Attrs.State,
+				job.Attrs.QueuedAt.Format(time.RFC3339),
+				job.Attrs.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var deadLettersCmdGroup = &cobra.Command{
+	Use:   "dead-letters [command]",
+	Short: "Manage the jobs that have failed for all their executions",
+	Long: `
+cozy-stack jobs dead-letters allows to list, inspect, retry or discard the jobs
+of the dead-letter queue of a worker type: the jobs that have failed for all
+their executions. Only the most recent failures are kept.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var lsDeadLettersCmd = &cobra.Command{
+	Use:     "ls [worker]",
+	Short:   "List the dead letters of a worker type",
+	Example: "$ cozy-stack jobs dead-letters ls konnector",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		list, err := c.ListDeadLetters(args[0])
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, dl := range list {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				dl.ID,
+				dl.Attrs.Domain,
+				dl.Attrs.Attempts,
+				dl.Attrs.FailedAt.Format(time.RFC3339),
+				dl.Attrs.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var showDeadLetterCmd = &cobra.Command{
+	Use:     "show [worker] [job-id]",
+	Short:   "Show a dead letter with its message",
+	Example: "$ cozy-stack jobs dead-letters show konnector 6f8b1d3e0a6d4c2b9f0e7a5d1c3b2a10",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		dl, err := c.GetDeadLetter(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "id:\t%s\n", dl.ID)
+		fmt.Fprintf(w, "domain:\t%s\n", dl.Attrs.Domain)
+		fmt.Fprintf(w, "worker:\t%s\n", dl.Attrs.Worker)
+		fmt.Fprintf(w, "attempts:\t%d\n", dl.Attrs.Attempts)
+		fmt.Fprintf(w, "queued_at:\t%s\n", dl.Attrs.QueuedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "started_at:\t%s\n", dl.Attrs.StartedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "failed_at:\t%s\n", dl.Attrs.FailedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "error:\t%s\n", dl.Attrs.Error)
+		fmt.Fprintf(w, "message:\t%s\n", dl.Attrs.Message.Data)
+		return w.Flush()
+	},
+}
+
+var retryDeadLetterCmd = &cobra.Command{
+	Use:     "retry [worker] [job-id]",
+	Short:   "Push again a dead letter in the queue, with the same message",
+	Example: "$ cozy-stack jobs dead-letters retry konnector 6f8b1d3e0a6d4c2b9f0e7a5d1c3b2a10",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		job, err := c.RetryDeadLetter(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Job %s has been pushed again as job %s\n", args[1], job.ID)
+		return nil
+	},
+}
+
+var discardDeadLetterCmd = &cobra.Command{
+	Use:     "discard [worker] [job-id]",
+	Short:   "Remove a dead letter from the queue",
+	Example: "$ cozy-stack jobs dead-letters discard konnector 6f8b1d3e0a6d4c2b9f0e7a5d1c3b2a10",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.DiscardDeadLetter(args[0], args[1])
+	},
+}
+
+func init() {
+	jobsCmdGroup.PersistentFlags().StringVar(&flagJobsDomain, "domain", "", "specify the domain name of the instance")
+
+	lsJobsCmd.Flags().StringVar(&flagJobsWorker, "worker", "", "only list the jobs of this worker type")
+	lsJobsCmd.Flags().StringVar(&flagJobsState, "state", "", "only list the jobs in this state (queued, running, done, errored or cancelled)")
+	lsJobsCmd.Flags().StringVar(&flagJobsQueuedAfter, "queued-after", "", "only list the jobs queued after this date")
+	lsJobsCmd.Flags().StringVar(&flagJobsQueuedBefore, "queued-before", "", "only list the jobs queued before this date")
+	lsJobsCmd.Flags().StringVar(&flagJobsStartedAfter, "started-after", "", "only list the jobs started after this date")
+	lsJobsCmd.Flags().StringVar(&flagJobsStartedBefore, "started-before", "", "only list the jobs started before this date")
+	lsJobsCmd.Flags().IntVar(&flagJobsLimit, "limit", 20, "maximal number of jobs to list (0 for all)")
+
+	deadLettersCmdGroup.AddCommand(lsDeadLettersCmd)
+	deadLettersCmdGroup.AddCommand(showDeadLetterCmd)
+	deadLettersCmdGroup.AddCommand(retryDeadLetterCmd)
+	deadLettersCmdGroup.AddCommand(discardDeadLetterCmd)
+
+	jobsCmdGroup.AddCommand(lsJobsCmd)
+	jobsCmdGroup.AddCommand(deadLettersCmdGroup)
+	RootCmd.AddCommand(jobsCmdGroup)
+}
@@ -8,9 +8,14 @@ import (
 	"time"
 
 	"github.com/cozy/swift"
+	minio "github.com/minio/minio-go"
 	"github.com/spf13/afero"
 )
 
+// s3PartSize is the size of the parts used to upload the files of the
+// applications in S3.
+const s3PartSize = 16 * 1024 * 1024
+
 // FileServer interface defines a way to access and serve the application's
 // data files.
 type FileServer interface {
@@ -24,6 +29,12 @@ type swiftServer struct {
 	container string
 }
 
+type s3Server struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
 type aferoServer struct {
 	mkPath func(slug, version, file string) string
 	fs     afero.Fs
@@ -64,6 +75,49 @@ func (s *swiftServer) makeObjectName(slug, version, file string) string {
 	return path.Join(slug, version, file)
 }
 
+// NewS3FileServer returns provides the apps.FileServer implementation
+// using a S3 bucket as file server.
+func NewS3FileServer(c *minio.Client, bucket string, appsType AppType) FileServer {
+	return &s3Server{
+		c:      c,
+		bucket: bucket,
+		prefix: containerName(appsType),
+	}
+}
+
+func (s *s3Server) Open(slug, version, file string) (io.ReadCloser, error) {
+	objName := s.makeObjectName(slug, version, file)
+	o, err := s.c.GetObject(s.bucket, objName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	if _, err = o.Stat(); err != nil {
+		o.Close() // #nosec
+		return nil, wrapS3Err(err)
+	}
+	return o, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+	objName := s.makeObjectName(slug, version, file)
+	o, err := s.c.GetObject(s.bucket, objName, minio.GetObjectOptions{})
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	defer o.Close()
+	info, err := o.Stat()
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	w.Header().Set("Etag", info.ETag)
+	http.ServeContent(w, req, objName, info.LastModified, o)
+	return nil
+}
+
+func (s *s3Server) makeObjectName(slug, version, file string) string {
+	return path.Join(s.prefix, slug, version, file)
+}
+
 // NewAferoFileServer returns a simple wrapper of the afero.Fs interface that
 // provides the apps.FileServer interface.
 //
@@ -140,3 +194,10 @@ func wrapSwiftErr(err error) error {
 	}
 	return err
 }
+
+func wrapS3Err(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return os.ErrNotExist
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log/syslog"
@@ -64,6 +65,9 @@ const (
 	SchemeMem = "mem"
 	// SchemeSwift is the URL scheme used to configure a swift filesystem.
 	SchemeSwift = "swift"
+	// SchemeS3 is the URL scheme used to configure a S3-compatible
+	// filesystem.
+	SchemeS3 = "s3"
 )
 
 // AdminSecretFileName is the name of the file containing the administration
@@ -99,7 +103,12 @@ type Config struct {
 
 // Fs contains the configuration values of the file-system
 type Fs struct {
-	URL string
+	URL   string
+	Dedup bool
+	// EncryptionKey is the master key used to wrap the keys of the instances
+	// for the encryption of their files at rest. It is nil if the encryption
+	// is disabled.
+	EncryptionKey []byte
 }
 
 // CouchDB contains the configuration values of the database
@@ -233,6 +242,20 @@ func Setup(cfgFile string) (err error) {
 	return UseViper(viper.GetViper())
 }
 
+// readEncryptionKey reads the master key for the encryption of the files, a
+// 32 bytes key encoded in base64 in the given file.
+func readEncryptionKey(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid encryption key in %s", filename)
+	}
+	return key, nil
+}
+
 func envMap() map[string]string {
 	env := make(map[string]string)
 	for _, i := range os.Environ() {
@@ -253,6 +276,13 @@ func UseViper(v *viper.Viper) error {
 	if err != nil {
 		return err
 	}
+
+	var encryptionKey []byte
+	if keyFile := v.GetString("fs.encryption_key"); keyFile != "" {
+		if encryptionKey, err = readEncryptionKey(keyFile); err != nil {
+			return err
+		}
+	}
 	if couchURL.Path == "" {
 		couchURL.Path = "/"
 	}
@@ -266,7 +296,9 @@ func UseViper(v *viper.Viper) error {
 		Assets:     v.GetString("assets"),
 		NoReply:    v.GetString("mail.noreply_address"),
 		Fs: Fs{
-			URL: fsURL.String(),
+			URL:           fsURL.String(),
+			Dedup:         v.GetBool("fs.dedup"),
+			EncryptionKey: encryptionKey,
 		},
 		CouchDB: CouchDB{
 			URL: couchURL.String(),
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+var s3Client *minio.Client
+var s3Bucket string
+
+// InitS3Connection initialize the global S3 client, for a URL like
+// s3://endpoint/bucket?AccessKeyID=...&SecretAccessKey=...&Region=...
+// The bucket is created if it does not exist. This is not a thread-safe
+// method.
+func InitS3Connection(s3URL *url.URL) error {
+	q := s3URL.Query()
+
+	bucket := strings.Trim(s3URL.Path, "/")
+	if bucket == "" {
+		return fmt.Errorf("s3: no bucket specified in %s", s3URL.String())
+	}
+
+	// The connection is made with TLS, unless explicitly disabled, like for a
+	// local MinIO server.
+	secure := q.Get("Secure") != "false"
+	region := q.Get("Region")
+
+	client, err := minio.NewWithRegion(s3URL.Host, q.Get("AccessKeyID"),
+		q.Get("SecretAccessKey"), secure, region)
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		log.Errorf("[s3] Could not access the bucket %s on %s: %s",
+			bucket, s3URL.Host, err)
+		return err
+	}
+	if !exists {
+		if err = client.MakeBucket(bucket, region); err != nil {
+			log.Errorf("[s3] Could not create the bucket %s on %s: %s",
+				bucket, s3URL.Host, err)
+			return err
+		}
+	}
+
+	s3Client = client
+	s3Bucket = bucket
+	log.Infof("[s3] Successfully connected to the bucket %s on %s", bucket, s3URL.Host)
+	return nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration.
+func GetS3Client() *minio.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Connection()")
+	}
+	return s3Client
+}
+
+// GetS3Bucket returns the name of the bucket where the files are stored.
+func GetS3Bucket() string {
+	if s3Client == nil {
+		panic("Called GetS3Bucket() before InitS3Connection()")
+	}
+	return s3Bucket
+}
@@ -10,6 +10,9 @@ const Instances = "instances"
 const (
 	// Apps doc type for client-side application manifests
 	Apps = "io.cozy.apps"
+	// AppPasswords doc type for the passwords used by the clients that can
+	// only do HTTP basic authentication, like the WebDAV clients
+	AppPasswords = "io.cozy.apppasswords"
 	// Konnectors doc type for konnector application manifests
 	Konnectors = "io.cozy.konnectors"
 	// KonnectorResults doc type for konnector last execution result.
@@ -20,12 +23,29 @@ const (
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the old versions of the files
+	FilesVersions = "io.cozy.files.versions"
+	// FilesUploads doc type for the sessions of resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
+	// FilesBlobs doc type for the references to the contents shared by
+	// several files
+	FilesBlobs = "io.cozy.files.blobs"
+	// FilesSearch doc type for the entries of the full-text search index of
+	// the files
+	FilesSearch = "io.cozy.files.search"
+	// FilesLocks doc type for the edit locks on the files
+	FilesLocks = "io.cozy.files.locks"
+	// FilesSizes doc type for the recursive statistics of the directories
+	FilesSizes = "io.cozy.files.sizes"
 	// Intents doc type for intents persisted in couchdb
 	Intents = "io.cozy.intents"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for realt time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobDeadLetters doc type for the jobs that have failed for all their
+	// executions
+	JobDeadLetters = "io.cozy.jobs.dead_letters"
 	// OAuthAccessCodes doc type for OAuth2 access codes
 	OAuthAccessCodes = "io.cozy.oauth.access_codes"
 	// OAuthClients doc type for OAuth2 clients
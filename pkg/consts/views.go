@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 4
+const IndexViewsVersion int = 12
 
 // GlobalIndexes is the index list required on the global databases to run
 // properly.
@@ -26,6 +26,13 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(Files, "dir-children", []string{"dir_id", "_id"}),
 	// Used to lookup a directory given its path
 	mango.IndexOnFields(Files, "dir-by-path", []string{"path"}),
+
+	// Used to find the jobs that are queued or running
+	mango.IndexOnFields(Jobs, "by-state", []string{"state"}),
+	// Used to list the jobs, from the most recent to the oldest. The _id is
+	// used to sort the jobs queued at the same time.
+	mango.IndexOnFields(Jobs, "by-queued-at-and-id", []string{"queued_at", "_id"}),
+	mango.IndexOnFields(Jobs, "by-worker-queued-at-and-id", []string{"worker", "queued_at", "_id"}),
 }
 
 // DiskUsageView is the view used for computing the disk usage
@@ -42,6 +49,95 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// DirStatsView is the view used for computing the size, the number of files
+// and the last modification of the files of the directories. The values are
+// reduced by directory, and a directory with its sub-directories can be
+// queried with their ids as keys.
+var DirStatsView = &couchdb.View{
+	Name:    "dir-stats",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file') {
+    emit(doc.dir_id, [+doc.size, 1, doc.updated_at || '']);
+  }
+}
+`,
+	Reduce: `
+function(keys, values, rereduce) {
+  var size = 0, count = 0, updated = '';
+  for (var i = 0; i < values.length; i++) {
+    size += values[i][0];
+    count += values[i][1];
+    if (values[i][2] > updated) {
+      updated = values[i][2];
+    }
+  }
+  return [size, count, updated];
+}
+`,
+}
+
+// VersionsDiskUsageView is the view used for computing the disk usage of
+// the old versions of the files
+var VersionsDiskUsageView = &couchdb.View{
+	Name:    "versions-disk-usage",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit(doc._id, +doc.size);
+}
+`,
+	Reduce: "_sum",
+}
+
+// VersionsByFileView is the view used for fetching the old versions of a
+// given file
+var VersionsByFileView = &couchdb.View{
+	Name:    "versions-by-file",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit(doc.file_id);
+}`,
+}
+
+// VersionsByCreatedAtView is the view used for fetching the old versions of
+// the files that have been created before a given date
+var VersionsByCreatedAtView = &couchdb.View{
+	Name:    "versions-by-created-at",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit(doc.created_at);
+}`,
+}
+
+// UploadsByExpirationView is the view used for fetching the upload sessions
+// by their expiration date
+var UploadsByExpirationView = &couchdb.View{
+	Name:    "uploads-by-expiration",
+	Doctype: FilesUploads,
+	Map: `
+function(doc) {
+  emit(doc.expires_at);
+}`,
+}
+
+// FilesSearchView is the view used for finding the files whose name, tags,
+// metadata or content contain a word
+var FilesSearchView = &couchdb.View{
+	Name:    "search-by-term",
+	Doctype: FilesSearch,
+	Map: `
+function(doc) {
+  var terms = (doc.terms || []).concat(doc.content_terms || []);
+  for (var i = 0; i < terms.length; i++) {
+    emit(terms[i]);
+  }
+}`,
+}
+
 // FilesReferencedByView is the view used for fetching files referenced by a
 // given document
 var FilesReferencedByView = &couchdb.View{
@@ -145,8 +241,14 @@ function(doc) {
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
+	DirStatsView,
 	FilesReferencedByView,
 	FilesByParentView,
+	VersionsDiskUsageView,
+	VersionsByFileView,
+	VersionsByCreatedAtView,
+	UploadsByExpirationView,
+	FilesSearchView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	SharedWithMePermissionsView,
@@ -16,6 +16,10 @@ type ChangesFeedStyle string
 const (
 	// ChangesModeNormal is the only mode supported by cozy-stack
 	ChangesModeNormal ChangesFeedMode = "normal"
+	// ChangesModeLongpoll waits for a change before sending the response. The
+	// timeout of the request must be lower than the timeout of the couchdb
+	// client.
+	ChangesModeLongpoll ChangesFeedMode = "longpoll"
 	// ChangesStyleAllDocs pass all revisions including conflicts
 	ChangesStyleAllDocs ChangesFeedStyle = "all_docs"
 	// ChangesStyleMainOnly only pass the winning revision
@@ -115,6 +119,7 @@ type Change struct {
 	DocID   string  `json:"id"`
 	Seq     string  `json:"seq"`
 	Doc     JSONDoc `json:"doc"`
+	Deleted bool    `json:"deleted,omitempty"`
 	Changes []struct {
 		Rev string `json:"rev"`
 	} `json:"changes"`
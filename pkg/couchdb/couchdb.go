@@ -355,6 +355,24 @@ func AllDoctypes(db Database) ([]string, error) {
 	return doctypes, nil
 }
 
+// AllDatabasesOfDoctype returns the list of the prefixed databases (ie the
+// instances) that have a database for the given doctype.
+func AllDatabasesOfDoctype(doctype string) ([]Database, error) {
+	var dbs []string
+	if err := makeRequest(GlobalDB, "GET", "/_all_dbs", nil, &dbs); err != nil {
+		return nil, err
+	}
+	suffix := "/" + escapeCouchdbName(doctype)
+	var databases []Database
+	for _, dbname := range dbs {
+		if strings.HasSuffix(dbname, suffix) {
+			prefix := strings.TrimSuffix(dbname, suffix)
+			databases = append(databases, SimpleDatabasePrefix(prefix))
+		}
+	}
+	return databases, nil
+}
+
 // GetDoc fetch a document by its docType and ID, out is filled with
 // the document by json.Unmarshal-ing
 func GetDoc(db Database, doctype, id string, out Doc) error {
@@ -472,11 +490,21 @@ func UpdateDoc(db Database, doc Doc) error {
 	return nil
 }
 
-// BulkUpdateDoc is used to update several docs in one call, as a bulk.
-func BulkUpdateDoc(db Database, docs []Doc) error {
+// BulkUpdateDoc is used to update several docs in one call, as a bulk. The
+// old versions of the documents can be given in olddocs, in the same order,
+// to be emitted through rtevent (olddocs can be nil).
+//
+// If some documents can't be updated, for example because of a conflict, the
+// other documents are still updated and an error is returned for the first
+// failure. The revision of the documents that have not been updated is left
+// untouched.
+func BulkUpdateDoc(db Database, docs, olddocs []Doc) error {
 	if len(docs) == 0 {
 		return errors.New("BulkUpdateDoc needs at least one doc")
 	}
+	if olddocs != nil && len(olddocs) != len(docs) {
+		return errors.New("BulkUpdateDoc needs as many old docs as docs")
+	}
 	doctype := docs[0].DocType()
 	url := docURL(db, doctype, "_bulk_docs")
 	body := struct {
@@ -489,13 +517,46 @@ func BulkUpdateDoc(db Database, docs []Doc) error {
 	if len(res) != len(docs) {
 		return errors.New("BulkUpdateDoc receive an unexpected number of responses")
 	}
+	var failure *Error
 	for i, doc := range docs {
+		if res[i].Error != "" {
+			if failure == nil {
+				failure = bulkError(res[i])
+			}
+			continue
+		}
 		doc.SetRev(res[i].Rev)
-		rtevent(db, realtime.EventUpdate, doc, nil)
+		var olddoc Doc
+		if olddocs != nil {
+			olddoc = olddocs[i]
+		}
+		rtevent(db, realtime.EventUpdate, doc, olddoc)
+	}
+	if failure != nil {
+		return failure
 	}
 	return nil
 }
 
+// bulkError returns the error for a document that has been refused in a
+// _bulk_docs request.
+func bulkError(res updateResponse) *Error {
+	status := http.StatusInternalServerError
+	switch res.Error {
+	case "conflict":
+		status = http.StatusConflict
+	case "forbidden":
+		status = http.StatusForbidden
+	case "unauthorized":
+		status = http.StatusUnauthorized
+	}
+	return &Error{
+		StatusCode: status,
+		Name:       res.Error,
+		Reason:     res.Reason,
+	}
+}
+
 // CreateNamedDoc persist a document with an ID.
 // if the document already exist, it will return a 409 error.
 // The document ID should be fillled.
@@ -756,9 +817,11 @@ type IndexCreationResponse struct {
 }
 
 type updateResponse struct {
-	ID  string `json:"id"`
-	Rev string `json:"rev"`
-	Ok  bool   `json:"ok"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
 }
 
 type findResponse struct {
@@ -817,6 +880,7 @@ type ViewRequest struct {
 	InclusiveEnd bool `json:"inclusive_end,omitempty" url:"inclusive_end,omitempty"`
 
 	Reduce     bool `json:"reduce" url:"reduce"`
+	Group      bool `json:"group,omitempty" url:"group,omitempty"`
 	GroupLevel int  `json:"group_level,omitempty" url:"group_level,omitempty"`
 }
 
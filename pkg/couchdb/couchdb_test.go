@@ -152,7 +152,7 @@ func TestBulkUpdateDocs(t *testing.T) {
 	for i, doc := range results {
 		docs[i] = doc
 	}
-	err = BulkUpdateDoc(TestPrefix, docs)
+	err = BulkUpdateDoc(TestPrefix, docs, nil)
 	assert.NoError(t, err)
 
 	err = GetAllDocs(TestPrefix, TestDoctype, &AllDocsRequest{Limit: 2}, &results)
@@ -163,6 +163,31 @@ func TestBulkUpdateDocs(t *testing.T) {
 	}
 }
 
+func TestBulkUpdateDocsConflict(t *testing.T) {
+	doc1 := &testDoc{Test: "bulk_conflict_1"}
+	doc2 := &testDoc{Test: "bulk_conflict_2"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc1))
+	assert.NoError(t, CreateDoc(TestPrefix, doc2))
+	rev1, rev2 := doc1.Rev(), doc2.Rev()
+
+	doc1.TestRev = "1-0123456789abcdef0123456789abcdef"
+	doc1.Test = "bulk_conflict_1_updated"
+	doc2.Test = "bulk_conflict_2_updated"
+	err := BulkUpdateDoc(TestPrefix, []Doc{doc1, doc2}, nil)
+	if assert.Error(t, err) {
+		assert.True(t, IsConflictError(err))
+	}
+	assert.Equal(t, "1-0123456789abcdef0123456789abcdef", doc1.Rev())
+	assert.NotEqual(t, rev2, doc2.Rev())
+
+	var saved testDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc1.ID(), &saved))
+	assert.Equal(t, rev1, saved.Rev())
+	assert.Equal(t, "bulk_conflict_1", saved.Test)
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc2.ID(), &saved))
+	assert.Equal(t, "bulk_conflict_2_updated", saved.Test)
+}
+
 func TestDefineIndex(t *testing.T) {
 	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "my-index", []string{"fieldA", "fieldB"}))
 	assert.NoError(t, err)
@@ -124,6 +124,16 @@ func IsFileExists(err error) bool {
 	return couchErr.Name == "file_exists"
 }
 
+// IsNoUsableIndexError checks if the given error is returned by couchdb
+// for a mango query when the index to use does not exist
+func IsNoUsableIndexError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "no_index" || couchErr.Name == "no_usable_index"
+}
+
 // IsConflictError checks if the given error is a couch conflict error
 func IsConflictError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
@@ -27,6 +27,8 @@ import (
 	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/leonelquinteros/gotext"
@@ -66,6 +68,9 @@ var (
 	ErrMissingPassphrase = errors.New("Missing new passphrase")
 	// ErrInvalidPassphrase is returned when the passphrase is invalid
 	ErrInvalidPassphrase = errors.New("Invalid passphrase")
+	// ErrMissingEncryptionKey is returned when the files of an instance are
+	// encrypted, but there is no master key in the configuration
+	ErrMissingEncryptionKey = errors.New("No encryption key in the configuration")
 )
 
 // An Instance has the informations relatives to the logical cozy instance,
@@ -80,6 +85,17 @@ type Instance struct {
 
 	BytesDiskQuota int64 `json:"disk_quota,string,omitempty"` // The total size in bytes allowed to the user
 
+	// Retention policy for the old versions of the files. The default policy
+	// of the vfs is used when the count is zero, and the versioning is
+	// disabled when it is negative. When the count is set without a max age,
+	// the default max age of the vfs is used.
+	VersionsMaxCount int           `json:"versions_max_count,omitempty"`
+	VersionsMaxAge   time.Duration `json:"versions_max_age,omitempty"`
+
+	// Duration after which the items put in the trash are destroyed. The
+	// purge of the trash is disabled unless this duration is positive.
+	TrashMaxAge time.Duration `json:"trash_max_age,omitempty"`
+
 	IndexViewsVersion int `json:"indexes_version"`
 
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
@@ -100,6 +116,15 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
+	// DataKey is the key used to encrypt the contents of the files, itself
+	// encrypted with the master key of the configuration. It is empty if the
+	// files of the instance are not encrypted.
+	DataKey []byte `json:"data_key,omitempty"`
+	// FilesEncrypted is true when all the contents of the files have been
+	// written or migrated in encrypted form. A content that is not encrypted
+	// is then refused, as it can only have been put there by tampering with
+	// the storage.
+	FilesEncrypted bool `json:"files_encrypted,omitempty"`
 
 	vfs vfs.VFS
 }
@@ -156,16 +181,22 @@ func (i *Instance) makeVFS() error {
 	if i.vfs != nil {
 		return nil
 	}
+	key, err := i.dataKey()
+	if err != nil {
+		return err
+	}
 	fsURL := config.FsURL()
 	mutex := lock.ReadWrite(i.Domain)
 	index := vfs.NewCouchdbIndexer(i)
 	disk := vfs.DiskThresholder(i)
-	var err error
+	plain := !i.FilesEncrypted
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(index, disk, mutex, fsURL, i.Domain)
+		i.vfs, err = vfsafero.New(index, disk, mutex, fsURL, i.Domain, key, plain)
 	case config.SchemeSwift:
-		i.vfs, err = vfsswift.New(index, disk, mutex, i.Domain)
+		i.vfs, err = vfsswift.New(index, disk, mutex, i.Domain, key, plain)
+	case config.SchemeS3:
+		i.vfs, err = vfss3.New(index, disk, mutex, i.Domain, key, plain)
 	default:
 		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
@@ -190,6 +221,8 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 		return apps.NewAferoCopier(baseFS)
 	case config.SchemeSwift:
 		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3:
+		return apps.NewS3Copier(config.GetS3Client(), config.GetS3Bucket(), appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -206,6 +239,8 @@ func (i *Instance) AppsFileServer() apps.FileServer {
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp)
+	case config.SchemeS3:
+		return apps.NewS3FileServer(config.GetS3Client(), config.GetS3Bucket(), apps.Webapp)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -222,6 +257,8 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector)
+	case config.SchemeS3:
+		return apps.NewS3FileServer(config.GetS3Client(), config.GetS3Bucket(), apps.Konnector)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -229,25 +266,122 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 
 // ThumbsFS returns the hidden filesystem for storing the thumbnails of the
 // photos/image
-func (i *Instance) ThumbsFS() vfs.Thumbser {
+func (i *Instance) ThumbsFS() (vfs.Thumbser, error) {
+	key, err := i.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	plain := !i.FilesEncrypted
 	fsURL := config.FsURL()
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
+		var baseFS afero.Fs = afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.Domain, vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		if key != nil {
+			baseFS = vfscrypt.NewFs(baseFS, key, plain)
+		}
+		return vfsafero.NewThumbsFs(baseFS), nil
 	case config.SchemeSwift:
-		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain)
+		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain, key, plain), nil
+	case config.SchemeS3:
+		return vfss3.NewThumbsFs(config.GetS3Client(), config.GetS3Bucket(), i.Domain, key, plain), nil
 	default:
-		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
+		return nil, fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
 }
 
+// dataKey returns the key used to encrypt the contents of the files, or nil
+// if they are not encrypted.
+func (i *Instance) dataKey() ([]byte, error) {
+	if len(i.DataKey) == 0 {
+		return nil, nil
+	}
+	master := config.GetConfig().Fs.EncryptionKey
+	if master == nil {
+		return nil, ErrMissingEncryptionKey
+	}
+	return vfscrypt.UnwrapKey(master, i.DataKey)
+}
+
+// EnableEncryption generates the key used to encrypt the contents of the
+// files of the instance, if it has not been done yet. The new contents are
+// encrypted, but the contents already stored have to be migrated with
+// EncryptFiles.
+func (i *Instance) EnableEncryption() error {
+	if len(i.DataKey) > 0 {
+		return nil
+	}
+	master := config.GetConfig().Fs.EncryptionKey
+	if master == nil {
+		return ErrMissingEncryptionKey
+	}
+	key, err := vfscrypt.WrapKey(master, vfscrypt.GenerateKey())
+	if err != nil {
+		return err
+	}
+	i.DataKey = key
+	if err = Update(i); err != nil {
+		return err
+	}
+	i.vfs = nil
+	return i.makeVFS()
+}
+
+// EncryptFiles enables the encryption of the files of the instance, and
+// encrypts the contents already stored. It returns the number of contents
+// that have been encrypted. It can be called again safely, for example after
+// an interruption, as the contents already encrypted are skipped. When all
+// the contents have been encrypted, the contents that are not encrypted are
+// refused.
+func (i *Instance) EncryptFiles() (int, error) {
+	if err := i.EnableEncryption(); err != nil {
+		return 0, err
+	}
+	count, err := i.VFS().EncryptContents()
+	if err != nil || i.FilesEncrypted {
+		return count, err
+	}
+	i.FilesEncrypted = true
+	if err = Update(i); err != nil {
+		return count, err
+	}
+	i.vfs = nil
+	return count, i.makeVFS()
+}
+
 // DiskQuota returns the number of bytes allowed on the disk to the user.
 func (i *Instance) DiskQuota() int64 {
 	return i.BytesDiskQuota
 }
 
+// VersionsRetention returns the policy used to decide which old versions of
+// the files are kept.
+func (i *Instance) VersionsRetention() vfs.VersionsRetention {
+	if i.VersionsMaxCount == 0 {
+		return vfs.DefaultVersionsRetention
+	}
+	if i.VersionsMaxCount < 0 {
+		return vfs.VersionsRetention{}
+	}
+	retention := vfs.VersionsRetention{
+		MaxCount: i.VersionsMaxCount,
+		MaxAge:   i.VersionsMaxAge,
+	}
+	if retention.MaxAge == 0 {
+		retention.MaxAge = vfs.DefaultVersionsMaxAge
+	}
+	return retention
+}
+
+// TrashRetention returns the duration after which the items put in the trash
+// are destroyed, or zero if they are kept until the trash is cleared.
+func (i *Instance) TrashRetention() time.Duration {
+	if i.TrashMaxAge < 0 {
+		return 0
+	}
+	return i.TrashMaxAge
+}
+
 // Scheme returns the scheme used for URLs. It is https by default and http
 // for development instances.
 func (i *Instance) Scheme() string {
@@ -393,6 +527,13 @@ func Create(opts *Options) (*Instance, error) {
 	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(OauthSecretLen)
 	i.CLISecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	if master := config.GetConfig().Fs.EncryptionKey; master != nil {
+		var err error
+		if i.DataKey, err = vfscrypt.WrapKey(master, vfscrypt.GenerateKey()); err != nil {
+			return nil, err
+		}
+		i.FilesEncrypted = true
+	}
 
 	if err := couchdb.CreateDB(couchdb.GlobalDB, consts.Instances); !couchdb.IsFileExists(err) {
 		if err != nil {
@@ -493,6 +634,15 @@ func Get(domain string) (*Instance, error) {
 	if i.IndexViewsVersion != consts.IndexViewsVersion {
 		i.Logger().Infof("Indexes outdated: wanted %d; got %d",
 			consts.IndexViewsVersion, i.IndexViewsVersion)
+		// The dates of the jobs were stored with a local offset before the
+		// version 12 of the indexes, and they can't be sorted with them
+		if i.IndexViewsVersion < 12 {
+			if _, err = jobs.NormalizeDates(i); err != nil {
+				i.Logger().Errorf("Could not normalize the dates of the jobs: %s",
+					err.Error())
+				return nil, err
+			}
+		}
 		if err = i.defineViewsAndIndex(); err != nil {
 			i.Logger().Errorf("Could not re-define indexes and views: %s",
 				err.Error())
@@ -369,6 +369,44 @@ func TestInstanceDestroy(t *testing.T) {
 	}
 }
 
+func TestAddMissingTriggers(t *testing.T) {
+	domain := "test.cozycloud.cc.triggers"
+	instance.Destroy(domain)
+	inst, err := instance.Create(&instance.Options{
+		Domain: domain,
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy(domain)
+
+	added, err := inst.AddMissingTriggers()
+	assert.NoError(t, err)
+	assert.Len(t, added, 0)
+
+	sched := stack.GetScheduler()
+	triggers, err := sched.GetAll(domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, trigger := range triggers {
+		if trigger.Infos().WorkerType == "files-scrub" {
+			assert.NoError(t, sched.Delete(domain, trigger.ID()))
+		}
+	}
+
+	added, err = inst.AddMissingTriggers()
+	assert.NoError(t, err)
+	if assert.Len(t, added, 1) {
+		assert.Equal(t, "files-scrub", added[0].WorkerType)
+		assert.Equal(t, "@cron", added[0].Type)
+	}
+	triggers, err = sched.GetAll(domain)
+	assert.NoError(t, err)
+	assert.Len(t, triggers, len(instance.Triggers(domain)))
+}
+
 func TestTranslate(t *testing.T) {
 	instance.LoadLocale("fr", `
 msgid "english"
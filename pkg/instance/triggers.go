@@ -1,16 +1,98 @@
 package instance
 
-import "github.com/cozy/cozy-stack/pkg/scheduler"
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/cozy/cozy-stack/pkg/scheduler"
+	"github.com/cozy/cozy-stack/pkg/stack"
+)
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(domain string) []scheduler.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
 	return []scheduler.TriggerInfos{
+		// Create/update/remove thumbnails when a file that can have a preview
+		// (image, PDF, video, text, office document) is created/updated/removed
 		{
 			Domain:     domain,
 			Type:       "@event",
 			WorkerType: "thumbnail",
-			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image,application,video,text:class",
+		},
+		// Keep the full-text search index up to date with the files
+		{
+			Domain:     domain,
+			Type:       "@event",
+			WorkerType: "search-index",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED",
+		},
+		// Remove the upload sessions that have expired
+		{
+			Domain:     domain,
+			Type:       "@every",
+			WorkerType: "uploads-gc",
+			Arguments:  "1h",
+		},
+		// Destroy the items put in the trash for too long, if a retention has
+		// been configured for the instance, once a day at a random time to
+		// spread the load between the instances
+		{
+			Domain:     domain,
+			Type:       "@cron",
+			WorkerType: "trash-purge",
+			Arguments:  fmt.Sprintf("0 %d %d * * *", rand.Intn(60), rand.Intn(24)),
 		},
+		// Destroy the old versions of the files that are older than the
+		// retention policy, once a day
+		{
+			Domain:     domain,
+			Type:       "@cron",
+			WorkerType: "versions-purge",
+			Arguments:  fmt.Sprintf("0 %d %d * * *", rand.Intn(60), rand.Intn(24)),
+		},
+		// Check the integrity of the contents of the files, once a week
+		{
+			Domain:     domain,
+			Type:       "@cron",
+			WorkerType: "files-scrub",
+			Arguments:  fmt.Sprintf("0 %d %d * * %d", rand.Intn(60), rand.Intn(24), rand.Intn(7)),
+		},
+	}
+}
+
+// AddMissingTriggers creates the triggers of the list above that the instance
+// does not have yet, as the instances created before a trigger was added to
+// the list don't have it. A trigger is considered present if the instance
+// already has a trigger of the same type for the same worker. It returns the
+// triggers that have been created.
+func (i *Instance) AddMissingTriggers() ([]*scheduler.TriggerInfos, error) {
+	sched := stack.GetScheduler()
+	existing, err := sched.GetAll(i.Domain)
+	if err != nil {
+		return nil, err
+	}
+	var added []*scheduler.TriggerInfos
+	for _, trigger := range Triggers(i.Domain) {
+		found := false
+		for _, t := range existing {
+			infos := t.Infos()
+			if infos.Type == trigger.Type && infos.WorkerType == trigger.WorkerType {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		infos := trigger
+		t, err := scheduler.NewTrigger(&infos)
+		if err != nil {
+			return added, err
+		}
+		if err = sched.Add(t); err != nil {
+			return added, err
+		}
+		added = append(added, t.Infos())
 	}
+	return added, nil
 }
@@ -19,6 +19,8 @@ const (
 	Done = "done"
 	// Errored state
 	Errored = "errored"
+	// Cancelled state
+	Cancelled = "cancelled"
 )
 
 const (
@@ -46,6 +48,30 @@ type (
 
 		// GetJobsInfos returns the informations about a job.
 		GetJobInfos(domain, jobID string) (*JobInfos, error)
+
+		// CancelJob cancels a job: it is removed from its queue if it is still
+		// queued, or its execution is stopped if it is running.
+		CancelJob(domain, jobID string) error
+
+		// ListJobs returns a page of the jobs of a domain that match the filter,
+		// from the most recently queued to the oldest. The cursor is updated
+		// for the next page.
+		ListJobs(domain string, filter *Filter, cursor *couchdb.StartKeyCursor) ([]*JobInfos, error)
+
+		// DeadLetters returns the jobs of the dead-letter queue of a worker
+		// type, i.e. the jobs that have failed for all their executions, from
+		// the most recent failure to the oldest.
+		DeadLetters(workerType string) ([]*DeadLetter, error)
+
+		// GetDeadLetter returns a job of the dead-letter queue of a worker type.
+		GetDeadLetter(workerType, jobID string) (*DeadLetter, error)
+
+		// RetryDeadLetter removes a job from the dead-letter queue and pushes a
+		// new job with the same message and options.
+		RetryDeadLetter(workerType, jobID string) (*JobInfos, error)
+
+		// DiscardDeadLetter removes a job from the dead-letter queue.
+		DiscardDeadLetter(workerType, jobID string) error
 	}
 
 	// State represent the state of a job.
@@ -69,9 +95,17 @@ type (
 		State      State       `json:"state"`
 		QueuedAt   time.Time   `json:"queued_at"`
 		StartedAt  time.Time   `json:"started_at,omitempty"`
+		Progress   *Progress   `json:"progress,omitempty"`
 		Error      string      `json:"error,omitempty"`
 	}
 
+	// Progress is the advancement of a running job, for the workers that
+	// report it.
+	Progress struct {
+		Done  int64 `json:"done"`
+		Total int64 `json:"total"`
+	}
+
 	// JobRequest struct is used to represent a new job request.
 	JobRequest struct {
 		Domain     string
@@ -82,9 +116,11 @@ type (
 
 	// JobOptions struct contains the execution properties of the jobs.
 	JobOptions struct {
-		MaxExecCount int           `json:"max_exec_count"`
-		MaxExecTime  time.Duration `json:"max_exec_time"`
-		Timeout      time.Duration `json:"timeout"`
+		MaxExecCount  int           `json:"max_exec_count"`
+		MaxExecTime   time.Duration `json:"max_exec_time"`
+		Timeout       time.Duration `json:"timeout"`
+		RetryDelay    time.Duration `json:"retry_delay,omitempty"`
+		MaxRetryDelay time.Duration `json:"max_retry_delay,omitempty"`
 	}
 )
 
@@ -141,7 +177,7 @@ func NewJobInfos(req *JobRequest) *JobInfos {
 		Message:    req.Message,
 		Options:    req.Options,
 		State:      Queued,
-		QueuedAt:   time.Now(),
+		QueuedAt:   time.Now().UTC(),
 	}
 }
 
@@ -177,13 +213,14 @@ func (m *Message) Unmarshal(msg interface{}) error {
 
 func (w *WorkerConfig) clone() *WorkerConfig {
 	return &WorkerConfig{
-		WorkerFunc:   w.WorkerFunc,
-		WorkerCommit: w.WorkerCommit,
-		Concurrency:  w.Concurrency,
-		MaxExecCount: w.MaxExecCount,
-		MaxExecTime:  w.MaxExecTime,
-		Timeout:      w.Timeout,
-		RetryDelay:   w.RetryDelay,
+		WorkerFunc:    w.WorkerFunc,
+		WorkerCommit:  w.WorkerCommit,
+		Concurrency:   w.Concurrency,
+		MaxExecCount:  w.MaxExecCount,
+		MaxExecTime:   w.MaxExecTime,
+		Timeout:       w.Timeout,
+		RetryDelay:    w.RetryDelay,
+		MaxRetryDelay: w.MaxRetryDelay,
 	}
 }
 
@@ -0,0 +1,126 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// deadLettersRetention is the maximal number of jobs kept in the dead-letter
+// queue of a worker type. When it is full, the oldest failures are dropped.
+var deadLettersRetention = 1000
+
+// DeadLetter is a job that has failed for all its executions. It is kept in
+// the dead-letter queue of its worker type, where it can be inspected, pushed
+// again in the queue or discarded.
+type DeadLetter struct {
+	JobID      string      `json:"job_id"`
+	Domain     string      `json:"domain"`
+	WorkerType string      `json:"worker"`
+	Message    *Message    `json:"message"`
+	Options    *JobOptions `json:"options,omitempty"`
+	Error      string      `json:"error"`
+	Attempts   int         `json:"attempts"`
+	QueuedAt   time.Time   `json:"queued_at"`
+	StartedAt  time.Time   `json:"started_at"`
+	FailedAt   time.Time   `json:"failed_at"`
+
+	// Permanent is true if the worker has failed with a permanent error: the
+	// job has not been retried, and retrying it should fail again.
+	Permanent bool `json:"permanent,omitempty"`
+}
+
+func newDeadLetter(infos *JobInfos, attempts int, permanent bool) *DeadLetter {
+	return &DeadLetter{
+		JobID:      infos.JobID,
+		Domain:     infos.Domain,
+		WorkerType: infos.WorkerType,
+		Message:    infos.Message,
+		Options:    infos.Options,
+		Error:      infos.Error,
+		Attempts:   attempts,
+		Permanent:  permanent,
+		QueuedAt:   infos.QueuedAt,
+		StartedAt:  infos.StartedAt,
+		FailedAt:   time.Now().UTC(),
+	}
+}
+
+// Request returns the request for pushing again the job, with the same
+// message and options.
+func (dl *DeadLetter) Request() *JobRequest {
+	return &JobRequest{
+		Domain:     dl.Domain,
+		WorkerType: dl.WorkerType,
+		Message:    dl.Message,
+		Options:    dl.Options,
+	}
+}
+
+// memDeadLetters is the in-memory implementation of the dead-letter queues,
+// with the most recent failures first.
+type memDeadLetters struct {
+	mu    sync.Mutex
+	lists map[string][]*DeadLetter
+}
+
+func newMemDeadLetters() *memDeadLetters {
+	return &memDeadLetters{lists: make(map[string][]*DeadLetter)}
+}
+
+func (d *memDeadLetters) Add(dl *DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := append([]*DeadLetter{dl}, d.lists[dl.WorkerType]...)
+	if len(list) > deadLettersRetention {
+		list = list[:deadLettersRetention]
+	}
+	d.lists[dl.WorkerType] = list
+}
+
+func (d *memDeadLetters) List(workerType string) []*DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]*DeadLetter, len(d.lists[workerType]))
+	copy(list, d.lists[workerType])
+	return list
+}
+
+func (d *memDeadLetters) Get(workerType, jobID string) (*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dl := range d.lists[workerType] {
+		if dl.JobID == jobID {
+			return dl, nil
+		}
+	}
+	return nil, ErrNotFoundDeadLetter
+}
+
+func (d *memDeadLetters) Remove(workerType, jobID string) (*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := d.lists[workerType]
+	for i, dl := range list {
+		if dl.JobID == jobID {
+			d.lists[workerType] = append(list[:i:i], list[i+1:]...)
+			return dl, nil
+		}
+	}
+	return nil, ErrNotFoundDeadLetter
+}
+
+// findDeadLetter returns the dead letter for the given job in a list of JSON
+// encoded dead letters, with its raw value.
+func findDeadLetter(vals []string, jobID string) (*DeadLetter, string, error) {
+	for _, val := range vals {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(val), &dl); err != nil {
+			continue
+		}
+		if dl.JobID == jobID {
+			return &dl, val, nil
+		}
+	}
+	return nil, "", ErrNotFoundDeadLetter
+}
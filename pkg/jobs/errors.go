@@ -5,6 +5,12 @@ import "errors"
 var (
 	// ErrNotFoundJob is used when the job could not be found
 	ErrNotFoundJob = errors.New("jobs: not found")
+	// ErrFinishedJob is used when a job cannot be cancelled because it has
+	// already been executed
+	ErrFinishedJob = errors.New("jobs: the job is already finished")
+	// ErrNotFoundDeadLetter is used when a job is not in the dead-letter queue
+	// of its worker type
+	ErrNotFoundDeadLetter = errors.New("jobs: not found in the dead letters")
 	// ErrQueueClosed is used to indicate the queue is closed
 	ErrQueueClosed = errors.New("jobs: queue is closed")
 	// ErrUnknownWorker the asked worker does not exist
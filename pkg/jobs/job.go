@@ -20,6 +20,13 @@ type (
 		// No mutex, a Job is expected to be used from only one goroutine at a time
 		infos   *JobInfos
 		storage *couchStorage
+		// release is an optional function called when the job has been
+		// handled by a worker, to remove it from the jobs being processed by
+		// the broker
+		release func()
+		// deadLetter is an optional function called when the job has failed
+		// for all its executions, to put it in the dead-letter queue
+		deadLetter func(dl *DeadLetter)
 	}
 )
 
@@ -65,7 +72,7 @@ func (j *Job) Logger() *logrus.Entry {
 func (j *Job) AckConsumed() error {
 	job := *j.infos
 	j.Logger().Debugf("[jobs] ack_consume %s ", job.ID())
-	job.StartedAt = time.Now()
+	job.StartedAt = time.Now().UTC()
 	job.State = Running
 	j.infos = &job
 	return j.persist()
@@ -92,10 +99,68 @@ func (j *Job) Nack(err error) error {
 	return j.persist()
 }
 
+// Cancel sets the job infos state to Cancelled and persists the new job infos.
+func (j *Job) Cancel() error {
+	job := *j.infos
+	j.Logger().Debugf("[jobs] cancel %s ", job.ID())
+	job.State = Cancelled
+	j.infos = &job
+	return j.persist()
+}
+
+// SetProgress sets the advancement of the job and persists the new job infos.
+func (j *Job) SetProgress(done, total int64) error {
+	job := *j.infos
+	job.Progress = &Progress{Done: done, Total: total}
+	j.infos = &job
+	return j.persist()
+}
+
+// done is called when the worker has finished with the job, even if it has
+// failed.
+func (j *Job) done() {
+	if j.release != nil {
+		j.release()
+	}
+}
+
+// sendToDeadLetters is called when the job has failed for all its
+// executions, with the number of executions, or with a permanent error.
+func (j *Job) sendToDeadLetters(attempts int, permanent bool) {
+	if j.deadLetter != nil {
+		j.deadLetter(newDeadLetter(j.infos, attempts, permanent))
+	}
+}
+
 func (j *Job) persist() error {
 	return j.storage.Update(j.infos)
 }
 
+// cancelJob marks a job as cancelled if it is still queued, or calls
+// cancelRunning if it is running.
+func cancelJob(storage *couchStorage, infos *JobInfos, cancelRunning func(domain, jobID string) error) error {
+	for {
+		switch infos.State {
+		case Cancelled:
+			return nil
+		case Done, Errored:
+			return ErrFinishedJob
+		case Running:
+			return cancelRunning(infos.Domain, infos.JobID)
+		}
+		cancelled := *infos
+		cancelled.State = Cancelled
+		err := storage.Update(&cancelled)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+		// The job has just been taken by a worker
+		if infos, err = storage.Get(infos.Domain, infos.JobID); err != nil {
+			return err
+		}
+	}
+}
+
 // Marshal should not be used for a Job
 func (j *Job) Marshal() ([]byte, error) {
 	return nil, errors.New("should not be marshaled")
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// dateFilterLayout is the layout used for the bounds of the filters on dates.
+// The dates of the jobs are compared as strings by CouchDB, and a date
+// without the timezone is lower than all the dates of the same second.
+const dateFilterLayout = "2006-01-02T15:04:05"
+
+// Filter is used to select the jobs of a domain. The zero values mean no
+// filter. The After bounds are inclusive, the Before bounds are exclusive, and
+// they have a precision of a second.
+type Filter struct {
+	WorkerType    string
+	State         State
+	QueuedAfter   time.Time
+	QueuedBefore  time.Time
+	StartedAfter  time.Time
+	StartedBefore time.Time
+}
+
+// findJobsRequest is a mango request with a sort on several fields, which
+// is not supported by couchdb.FindRequest.
+type findJobsRequest struct {
+	Selector mango.Filter `json:"selector"`
+	UseIndex string       `json:"use_index"`
+	Sort     []mango.Map  `json:"sort"`
+	Limit    int          `json:"limit"`
+}
+
+// IsValidState returns true if the given state is one of the states of a
+// job.
+func IsValidState(state State) bool {
+	switch state {
+	case Queued, Running, Done, Errored, Cancelled:
+		return true
+	}
+	return false
+}
+
+func formatDateFilter(t time.Time) string {
+	return t.UTC().Format(dateFilterLayout)
+}
+
+// List returns the jobs of a domain that match the filter, from the most
+// recently queued to the oldest. The cursor is used to fetch the next page,
+// and it is updated for the page after this one.
+func (c *couchStorage) List(domain string, filter *Filter, cursor *couchdb.StartKeyCursor) ([]*JobInfos, error) {
+	filters := []mango.Filter{mango.Equal("domain", domain)}
+	useIndex := "by-queued-at-and-id"
+	sort := []mango.Map{{"queued_at": mango.Desc}, {"_id": mango.Desc}}
+	if filter.WorkerType != "" {
+		filters = append(filters, mango.Equal("worker", filter.WorkerType))
+		useIndex = "by-worker-queued-at-and-id"
+		sort = []mango.Map{{"worker": mango.Desc}, {"queued_at": mango.Desc}, {"_id": mango.Desc}}
+	}
+	if filter.State != "" {
+		filters = append(filters, mango.Equal("state", filter.State))
+	}
+	// A condition on queued_at is always needed for using the index
+	if !filter.QueuedAfter.IsZero() {
+		filters = append(filters, mango.Gte("queued_at", formatDateFilter(filter.QueuedAfter)))
+	} else {
+		filters = append(filters, mango.Gt("queued_at", nil))
+	}
+	if !filter.QueuedBefore.IsZero() {
+		filters = append(filters, mango.Lt("queued_at", formatDateFilter(filter.QueuedBefore)))
+	}
+	// The jobs that have not been started have a zero date, which is lower
+	// than all the bounds
+	if !filter.StartedAfter.IsZero() || !filter.StartedBefore.IsZero() {
+		filters = append(filters, mango.Gt("started_at", time.Time{}.Format(time.RFC3339)))
+	}
+	if !filter.StartedAfter.IsZero() {
+		filters = append(filters, mango.Gte("started_at", formatDateFilter(filter.StartedAfter)))
+	}
+	if !filter.StartedBefore.IsZero() {
+		filters = append(filters, mango.Lt("started_at", formatDateFilter(filter.StartedBefore)))
+	}
+	// The jobs queued at the same time are sorted by their identifiers
+	if cursor.NextKey != nil && cursor.NextKey != "" {
+		filters = append(filters,
+			mango.Lte("queued_at", cursor.NextKey),
+			mango.Or(
+				mango.Lt("queued_at", cursor.NextKey),
+				mango.Lte("_id", cursor.NextDocID),
+			))
+	}
+
+	req := &findJobsRequest{
+		Selector: mango.And(filters...),
+		UseIndex: useIndex,
+		Sort:     sort,
+		Limit:    cursor.Limit + 1,
+	}
+	var jobs []*JobInfos
+	err := couchdb.FindDocsRaw(c.db, consts.Jobs, req, &jobs)
+	if couchdb.IsNoUsableIndexError(err) {
+		// The indexes may have not been created yet, for example on the
+		// global database used by the in-memory broker
+		if err = couchdb.DefineIndexes(c.db, consts.IndexesByDoctype(consts.Jobs)); err != nil {
+			return nil, err
+		}
+		err = couchdb.FindDocsRaw(c.db, consts.Jobs, req, &jobs)
+	}
+	if couchdb.IsNoDatabaseError(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) > cursor.Limit {
+		next := jobs[cursor.Limit]
+		cursor.Done = false
+		cursor.NextKey = next.QueuedAt
+		cursor.NextDocID = next.JobID
+		jobs = jobs[:cursor.Limit]
+	} else {
+		cursor.Done = true
+		cursor.NextKey = nil
+		cursor.NextDocID = ""
+	}
+	return jobs, nil
+}
+
+// localOffsetRegexp matches the dates stored with a local offset, instead of
+// UTC.
+const localOffsetRegexp = "[+-][0-9]{2}:[0-9]{2}$"
+
+// NormalizeDates rewrites in UTC the dates of the jobs of a database that
+// have been stored with a local offset by the previous versions of the stack.
+// The dates are compared as strings by CouchDB to list the jobs, so they must
+// all be in UTC to be sorted correctly. It returns the number of updated jobs.
+func NormalizeDates(db couchdb.Database) (int, error) {
+	const limit = 100
+	n := 0
+	for {
+		var jobs []*JobInfos
+		req := &couchdb.FindRequest{
+			Selector: mango.Or(
+				mango.Map{"queued_at": mango.Map{"$regex": localOffsetRegexp}},
+				mango.Map{"started_at": mango.Map{"$regex": localOffsetRegexp}},
+			),
+			Limit: limit,
+		}
+		err := couchdb.FindDocs(db, consts.Jobs, req, &jobs)
+		if couchdb.IsNoDatabaseError(err) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		for _, infos := range jobs {
+			infos.QueuedAt = infos.QueuedAt.UTC()
+			infos.StartedAt = infos.StartedAt.UTC()
+			if err = couchdb.UpdateDoc(db, infos); err != nil {
+				return n, err
+			}
+			n++
+		}
+		// The updated jobs no longer match the selector
+		if len(jobs) < limit {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListStartedBefore(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("cozy.local")
+	storage := &couchStorage{db: db}
+
+	started := NewJobInfos(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-started",
+	})
+	started.StartedAt = time.Now().UTC()
+	assert.NoError(t, couchdb.CreateDoc(db, started))
+	defer couchdb.DeleteDoc(db, started)
+	queued := NewJobInfos(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-started",
+	})
+	assert.NoError(t, couchdb.CreateDoc(db, queued))
+	defer couchdb.DeleteDoc(db, queued)
+
+	filter := &Filter{
+		WorkerType:    "test-started",
+		StartedBefore: time.Now().Add(time.Hour),
+	}
+	cursor := couchdb.NewKeyCursor(10, nil, "").(*couchdb.StartKeyCursor)
+	jobs, err := storage.List("cozy.local", filter, cursor)
+	assert.NoError(t, err)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, started.JobID, jobs[0].JobID)
+	}
+}
+
+func TestNormalizeDates(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("cozy.local")
+	paris := time.FixedZone("Paris", 2*3600)
+	queuedAt := time.Date(2017, 10, 10, 12, 0, 0, 0, paris)
+
+	// A job stored by a previous version of the stack
+	old := NewJobInfos(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-normalize",
+	})
+	old.QueuedAt = queuedAt
+	old.StartedAt = queuedAt.Add(time.Second)
+	assert.NoError(t, couchdb.CreateDoc(db, old))
+	defer couchdb.DeleteDoc(db, old)
+
+	n, err := NormalizeDates(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var infos JobInfos
+	assert.NoError(t, couchdb.GetDoc(db, consts.Jobs, old.JobID, &infos))
+	assert.True(t, infos.QueuedAt.Equal(queuedAt))
+	assert.Equal(t, time.UTC, infos.QueuedAt.Location())
+	assert.Equal(t, time.UTC, infos.StartedAt.Location())
+	old.JobRev = infos.JobRev
+
+	n, err = NormalizeDates(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -20,7 +20,8 @@ type (
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
 	memBroker struct {
-		queues map[string]*memQueue
+		queues      map[string]*memQueue
+		deadLetters *memDeadLetters
 	}
 )
 
@@ -62,6 +63,20 @@ func (q *memQueue) send() {
 	}
 }
 
+// Remove removes a job from the queue. It returns false if the job was not
+// in the queue.
+func (q *memQueue) Remove(jobID string) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(Job).infos.JobID == jobID {
+			q.list.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
 // Len returns the length of the queue
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
@@ -85,7 +100,10 @@ func NewMemBroker(nbWorkers int, ws WorkersList) Broker {
 		}
 		w.Start(q.Jobs)
 	}
-	return &memBroker{queues: queues}
+	return &memBroker{
+		queues:      queues,
+		deadLetters: newMemDeadLetters(),
+	}
 }
 
 // PushJob will produce a new Job with the given options and enqueue the job in
@@ -98,8 +116,9 @@ func (b *memBroker) PushJob(req *JobRequest) (*JobInfos, error) {
 	}
 	infos := NewJobInfos(req)
 	j := Job{
-		infos:   infos,
-		storage: globalStorage,
+		infos:      infos,
+		storage:    globalStorage,
+		deadLetter: b.deadLetters.Add,
 	}
 	if err := globalStorage.Create(infos); err != nil {
 		return nil, err
@@ -125,6 +144,70 @@ func (b *memBroker) GetJobInfos(domain, jobID string) (*JobInfos, error) {
 	return globalStorage.Get(domain, jobID)
 }
 
+// CancelJob cancels a job: it is removed from its queue if it is still queued,
+// or its context is cancelled if it is running.
+func (b *memBroker) CancelJob(domain, jobID string) error {
+	infos, err := globalStorage.Get(domain, jobID)
+	if err != nil {
+		return err
+	}
+	if q, ok := b.queues[infos.WorkerType]; ok {
+		q.Remove(jobID)
+	}
+	return cancelJob(globalStorage, infos, func(domain, jobID string) error {
+		cancelRunningJob(domain, jobID)
+		return nil
+	})
+}
+
+// ListJobs returns a page of the jobs of a domain that match the filter.
+func (b *memBroker) ListJobs(domain string, filter *Filter, cursor *couchdb.StartKeyCursor) ([]*JobInfos, error) {
+	return globalStorage.List(domain, filter, cursor)
+}
+
+// DeadLetters returns the jobs of the dead-letter queue of a worker type.
+func (b *memBroker) DeadLetters(workerType string) ([]*DeadLetter, error) {
+	if _, ok := b.queues[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	return b.deadLetters.List(workerType), nil
+}
+
+// GetDeadLetter returns a job of the dead-letter queue of a worker type.
+func (b *memBroker) GetDeadLetter(workerType, jobID string) (*DeadLetter, error) {
+	if _, ok := b.queues[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	return b.deadLetters.Get(workerType, jobID)
+}
+
+// RetryDeadLetter removes a job from the dead-letter queue and pushes it
+// again.
+func (b *memBroker) RetryDeadLetter(workerType, jobID string) (*JobInfos, error) {
+	if _, ok := b.queues[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	dl, err := b.deadLetters.Remove(workerType, jobID)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := b.PushJob(dl.Request())
+	if err != nil {
+		b.deadLetters.Add(dl)
+		return nil, err
+	}
+	return infos, nil
+}
+
+// DiscardDeadLetter removes a job from the dead-letter queue.
+func (b *memBroker) DiscardDeadLetter(workerType, jobID string) error {
+	if _, ok := b.queues[workerType]; !ok {
+		return ErrUnknownWorker
+	}
+	_, err := b.deadLetters.Remove(workerType, jobID)
+	return err
+}
+
 var (
 	_ Broker = &memBroker{}
 )
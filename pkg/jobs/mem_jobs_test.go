@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
@@ -267,3 +268,197 @@ func TestPanic(t *testing.T) {
 	assert.NoError(t, err)
 	w.Wait()
 }
+
+func TestMemDeadLetters(t *testing.T) {
+	var count int
+	var mu sync.Mutex
+	succeeded := make(chan struct{})
+	broker := NewMemBroker(1, WorkersList{
+		"dead": {
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				mu.Lock()
+				count++
+				n := count
+				mu.Unlock()
+				if n <= 2 {
+					return errors.New("boom")
+				}
+				succeeded <- struct{}{}
+				return nil
+			},
+		},
+	})
+
+	msg, _ := NewMessage(JSONEncoding, "dead")
+	infos, err := broker.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "dead",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+
+	var list []*DeadLetter
+	for i := 0; i < 100; i++ {
+		list, err = broker.DeadLetters("dead")
+		if err != nil || len(list) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	if !assert.Len(t, list, 1) {
+		return
+	}
+	dl := list[0]
+	assert.Equal(t, infos.JobID, dl.JobID)
+	assert.Equal(t, "cozy.local", dl.Domain)
+	assert.Equal(t, "boom", dl.Error)
+	assert.Equal(t, 2, dl.Attempts)
+	assert.Equal(t, msg, dl.Message)
+	assert.False(t, dl.FailedAt.IsZero())
+
+	dl, err = broker.GetDeadLetter("dead", infos.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, infos.JobID, dl.JobID)
+
+	retried, err := broker.RetryDeadLetter("dead", infos.JobID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, infos.JobID, retried.JobID)
+	assert.Equal(t, msg, retried.Message)
+	<-succeeded
+
+	list, err = broker.DeadLetters("dead")
+	assert.NoError(t, err)
+	assert.Len(t, list, 0)
+	_, err = broker.GetDeadLetter("dead", infos.JobID)
+	assert.Equal(t, ErrNotFoundDeadLetter, err)
+	assert.Equal(t, ErrNotFoundDeadLetter, broker.DiscardDeadLetter("dead", infos.JobID))
+	_, err = broker.DeadLetters("unknown")
+	assert.Equal(t, ErrUnknownWorker, err)
+}
+
+func TestMemDeadLettersRetention(t *testing.T) {
+	retention := deadLettersRetention
+	deadLettersRetention = 2
+	defer func() { deadLettersRetention = retention }()
+
+	d := newMemDeadLetters()
+	for i := 0; i < 3; i++ {
+		d.Add(&DeadLetter{JobID: strconv.Itoa(i), WorkerType: "test"})
+	}
+	list := d.List("test")
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "2", list[0].JobID)
+		assert.Equal(t, "1", list[1].JobID)
+	}
+
+	dl, err := d.Remove("test", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", dl.JobID)
+	list = d.List("test")
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "1", list[0].JobID)
+	}
+	_, err = d.Remove("test", "2")
+	assert.Equal(t, ErrNotFoundDeadLetter, err)
+}
+
+func TestPermanentErrorNotRetried(t *testing.T) {
+	var count int
+	var mu sync.Mutex
+	broker := NewMemBroker(1, WorkersList{
+		"permanent": {
+			Concurrency:  1,
+			MaxExecCount: 3,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				mu.Lock()
+				count++
+				mu.Unlock()
+				return Permanent(errors.New("invalid message"))
+			},
+		},
+	})
+	_, err := broker.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "permanent",
+		Message:    nil,
+	})
+	assert.NoError(t, err)
+
+	var list []*DeadLetter
+	for i := 0; i < 100; i++ {
+		list, err = broker.DeadLetters("permanent")
+		if err != nil || len(list) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, 1, list[0].Attempts)
+		assert.Equal(t, "invalid message", list[0].Error)
+		assert.True(t, list[0].Permanent)
+	}
+	mu.Lock()
+	assert.Equal(t, 1, count)
+	mu.Unlock()
+}
+
+func TestRetryAfter(t *testing.T) {
+	var w sync.WaitGroup
+	var first time.Time
+	var elapsed time.Duration
+	broker := NewMemBroker(1, WorkersList{
+		"retry-after": {
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				if first.IsZero() {
+					first = time.Now()
+					return RetryAfter(errors.New("too many requests"), 50*time.Millisecond)
+				}
+				elapsed = time.Since(first)
+				w.Done()
+				return nil
+			},
+		},
+	})
+	w.Add(1)
+	_, err := broker.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "retry-after",
+		Message:    nil,
+	})
+	assert.NoError(t, err)
+	w.Wait()
+	assert.True(t, elapsed >= 50*time.Millisecond)
+}
+
+func TestBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	max := 100 * time.Millisecond
+	for retry := 1; retry <= 10; retry++ {
+		bound := base << uint(retry-1)
+		if bound > max {
+			bound = max
+		}
+		for i := 0; i < 20; i++ {
+			delay := backoff(base, max, retry)
+			assert.True(t, delay >= 0)
+			assert.True(t, delay <= bound)
+		}
+	}
+	assert.Equal(t, time.Duration(0), backoff(0, max, 3))
+
+	w := &Worker{Conf: &WorkerConfig{RetryDelay: base, MaxRetryDelay: max}}
+	conf := w.defaultedConf(&JobOptions{RetryDelay: time.Millisecond})
+	assert.Equal(t, base, conf.RetryDelay)
+	conf = w.defaultedConf(&JobOptions{RetryDelay: time.Second})
+	assert.Equal(t, time.Second, conf.RetryDelay)
+	assert.Equal(t, time.Second, conf.MaxRetryDelay)
+}
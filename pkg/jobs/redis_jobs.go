@@ -1,42 +1,130 @@
 package jobs
 
 import (
+	"encoding/json"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/go-redis/redis"
 )
 
 var log = logger.WithNamespace("redis-job")
 
-const redisPrefix = "j/"
+const (
+	// redisPrefix is the prefix of the lists used as queues, one per worker
+	// type. The values are "domain/jobID".
+	redisPrefix = "j/"
+	// redisProcessingPrefix is the prefix of the lists of the jobs being
+	// processed by a node (a cozy-stack process), one per node and worker
+	// type: "j-processing/nodeID/workerType". The values are "domain/jobID".
+	redisProcessingPrefix = "j-processing/"
+	// redisNodesKey is the key of the sorted set of the nodes, with the
+	// timestamp of their last heartbeat as score.
+	redisNodesKey = "j-nodes"
+	// redisReconcileKey is the key of the lock taken by a node when it
+	// reconciles the jobs in CouchDB with the queues.
+	redisReconcileKey = "j-reconcile"
+	// redisReconciledKey is the key set when the jobs in CouchDB have been
+	// reconciled with the queues. It is lost with the other data if redis
+	// loses them, and the reconciliation is then done again.
+	redisReconciledKey = "j-reconciled"
+	// redisCancelChannel is the pub/sub channel used to ask the nodes to
+	// cancel a running job. The messages are "domain/jobID".
+	redisCancelChannel = "j-cancel"
+	// redisDeadLettersPrefix is the prefix of the lists used as dead-letter
+	// queues, one per worker type. The values are the dead letters encoded in
+	// JSON, the most recent first.
+	redisDeadLettersPrefix = "j-dead/"
+)
+
+var (
+	// redisBRPopTimeout is the maximal duration of a blocking pop on a queue,
+	// to check from time to time if the broker has been stopped.
+	redisBRPopTimeout = 30 * time.Second
+	// redisHeartbeatInterval is the interval between two heartbeats of a
+	// node, and between two checks for the dead nodes.
+	redisHeartbeatInterval = 10 * time.Second
+	// redisVisibilityTimeout is the time after which a node without heartbeat
+	// is considered as dead, and the jobs it was processing are requeued.
+	redisVisibilityTimeout = 60 * time.Second
+	// redisReconcileTimeout is the maximal duration of the lock for the
+	// reconciliation.
+	redisReconcileTimeout = 10 * time.Minute
+)
+
+// luaRequeueJobs is the lua script used to move back to their queues the
+// jobs of the nodes whose last heartbeat is older than the first argument.
+// The other arguments are the worker types. It returns the number of
+// requeued jobs.
+const luaRequeueJobs = `
+local n = 0
+local nodes = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+for _, node in ipairs(nodes) do
+  for i = 2, #ARGV do
+    local key = "` + redisProcessingPrefix + `" .. node .. "/" .. ARGV[i]
+    local v = redis.call("LPOP", key)
+    while v do
+      redis.call("RPUSH", "` + redisPrefix + `" .. ARGV[i], v)
+      n = n + 1
+      v = redis.call("LPOP", key)
+    end
+  end
+  redis.call("ZREM", KEYS[1], node)
+end
+return n`
 
 type redisBroker struct {
-	client  *redis.Client
-	queues  map[string]chan Job
-	running bool
+	client *redis.Client
+	// popClient is used for the blocking pops on the queues. Each pop keeps a
+	// connection busy, so they have their own pool, with a connection for
+	// each worker type, and they can't starve the pool of client.
+	popClient *redis.Client
+	workers   WorkersList
+	queues    map[string]chan Job
+	nodeID    string
+	running   bool
+	stopped   chan struct{}
+	pubsub    *redis.PubSub
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
 // the jobs among several cozy-stack processes.
 func NewRedisBroker(nbWorkers int, client *redis.Client) Broker {
 	broker := &redisBroker{
-		client: client,
+		client:  client,
+		workers: GetWorkersList(),
 	}
 	if nbWorkers > 0 {
 		setNbSlots(nbWorkers)
-		broker.Start(GetWorkersList())
+		ws := GetWorkersList()
+		broker.Start(ws)
+		go func() {
+			n, err := broker.reconcileOnce(ws)
+			if err != nil {
+				log.Errorf("Cannot reconcile the jobs: %s", err)
+			} else if n > 0 {
+				log.Infof("%d jobs have been pushed again in the queues", n)
+			}
+		}()
 	}
 	return broker
 }
 
 // Start polling jobs from redis queues
 func (b *redisBroker) Start(ws WorkersList) {
+	b.workers = ws
 	b.queues = make(map[string]chan Job)
-	var keys []string
+	b.nodeID = utils.RandomString(16)
+	b.running = true
+	opts := *b.client.Options()
+	opts.PoolSize = len(ws)
+	b.popClient = redis.NewClient(&opts)
 	for workerType, conf := range ws {
 		ch := make(chan Job)
 		b.queues[workerType] = ch
@@ -45,44 +133,71 @@ func (b *redisBroker) Start(ws WorkersList) {
 			Conf: conf,
 		}
 		w.Start(ch)
-		keys = append(keys, redisPrefix+workerType)
+		go b.pollLoop(workerType, ch)
 	}
-	b.running = true
-	go b.pollLoop(keys)
+	if err := b.heartbeat(); err != nil {
+		log.Warnf("Cannot send the heartbeat of node %s: %s", b.nodeID, err)
+	}
+	b.stopped = make(chan struct{})
+	b.pubsub = b.client.Subscribe(redisCancelChannel)
+	go b.cancelLoop(b.pubsub.Channel())
+	go b.heartbeatLoop(ws)
 }
 
 func (b *redisBroker) Stop() {
 	b.running = false
+	if b.stopped != nil {
+		close(b.stopped)
+	}
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	if b.popClient != nil {
+		b.popClient.Close()
+	}
 }
 
-var redisBRPopTimeout = 30 * time.Second
-
-func (b *redisBroker) pollLoop(keys []string) {
+// pollLoop takes the jobs from the queue of a worker type. A job is moved
+// atomically to the processing list of the node, so that it can be requeued
+// if the node dies before it has been handled.
+func (b *redisBroker) pollLoop(workerType string, ch chan<- Job) {
+	key := redisPrefix + workerType
+	processing := b.processingKey(workerType)
 	for {
 		if !b.running {
 			return
 		}
-		results, err := b.client.BRPop(redisBRPopTimeout, keys...).Result()
-		if err != nil || len(results) < 2 {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-
-		workerType := results[0][len(redisPrefix):]
-		ch, ok := b.queues[workerType]
-		if !ok {
-			log.Warnf("Unknown workerType: %s", workerType)
+		val, err := b.popClient.BRPopLPush(key, processing, redisBRPopTimeout).Result()
+		if err != nil {
+			if !b.running {
+				return
+			}
+			if err != redis.Nil {
+				log.Warnf("Cannot poll the queue of %s: %s", workerType, err)
+				time.Sleep(100 * time.Millisecond)
+			}
 			continue
 		}
 
-		parts := strings.SplitN(results[1], "/", 2)
+		release := b.releaser(processing, val)
+		parts := strings.SplitN(val, "/", 2)
 		if len(parts) != 2 {
-			log.Warnf("Invalid key %s", results[1])
+			log.Warnf("Invalid key %s", val)
+			release()
 			continue
 		}
 		infos, err := b.GetJobInfos(parts[0], parts[1])
 		if err != nil {
 			log.Warnf("Cannot find job %s on domain %s: %s", parts[1], parts[0], err)
+			if err != ErrNotFoundJob {
+				// Give another chance to the job, for example if CouchDB was
+				// not reachable for a moment
+				if err = b.client.RPush(key, val).Err(); err != nil {
+					log.Errorf("Cannot requeue job %s: %s", val, err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			release()
 			continue
 		}
 
@@ -91,11 +206,222 @@ func (b *redisBroker) pollLoop(keys []string) {
 			storage: &couchStorage{
 				db: couchdb.SimpleDatabasePrefix(parts[0]),
 			},
+			release:    release,
+			deadLetter: b.addDeadLetter,
 		}
 		ch <- job
 	}
 }
 
+// processingKey returns the key of the list of the jobs of a worker type
+// being processed by this node.
+func (b *redisBroker) processingKey(workerType string) string {
+	return redisProcessingPrefix + b.nodeID + "/" + workerType
+}
+
+// releaser returns the function that removes a job from the processing list
+// of the node, once it has been handled.
+func (b *redisBroker) releaser(key, val string) func() {
+	return func() {
+		if err := b.client.LRem(key, 1, val).Err(); err != nil {
+			log.Warnf("Cannot release job %s: %s", val, err)
+		}
+	}
+}
+
+// addDeadLetter puts a job in the dead-letter queue of its worker type, and
+// drops the oldest failures if the queue is full.
+func (b *redisBroker) addDeadLetter(dl *DeadLetter) {
+	val, err := json.Marshal(dl)
+	if err != nil {
+		log.Errorf("Cannot encode the dead letter for job %s: %s", dl.JobID, err)
+		return
+	}
+	key := redisDeadLettersPrefix + dl.WorkerType
+	if err = b.client.LPush(key, val).Err(); err != nil {
+		log.Errorf("Cannot add job %s to the dead letters: %s", dl.JobID, err)
+		return
+	}
+	if err = b.client.LTrim(key, 0, int64(deadLettersRetention-1)).Err(); err != nil {
+		log.Warnf("Cannot trim the dead letters of %s: %s", dl.WorkerType, err)
+	}
+}
+
+// cancelLoop cancels the jobs running on this node when it is asked on the
+// pub/sub channel.
+func (b *redisBroker) cancelLoop(ch <-chan *redis.Message) {
+	for msg := range ch {
+		parts := strings.SplitN(msg.Payload, "/", 2)
+		if len(parts) != 2 {
+			log.Warnf("Invalid key %s", msg.Payload)
+			continue
+		}
+		if cancelRunningJob(parts[0], parts[1]) {
+			log.Infof("Job %s on domain %s has been cancelled", parts[1], parts[0])
+		}
+	}
+}
+
+func (b *redisBroker) heartbeatLoop(ws WorkersList) {
+	ticker := time.NewTicker(redisHeartbeatInterval)
+	for {
+		select {
+		case <-b.stopped:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if err := b.heartbeat(); err != nil {
+				log.Warnf("Cannot send the heartbeat of node %s: %s", b.nodeID, err)
+			}
+			n, err := b.requeueJobs(ws, time.Now())
+			if err != nil {
+				log.Warnf("Cannot requeue the jobs of the dead nodes: %s", err)
+			} else if n > 0 {
+				log.Infof("%d jobs of dead nodes have been requeued", n)
+			}
+		}
+	}
+}
+
+// heartbeat tells the other nodes that this node is still alive.
+func (b *redisBroker) heartbeat() error {
+	return b.client.ZAdd(redisNodesKey, redis.Z{
+		Score:  float64(time.Now().UTC().Unix()),
+		Member: b.nodeID,
+	}).Err()
+}
+
+// requeueJobs moves back to their queues the jobs of the nodes that have not
+// sent a heartbeat for the visibility timeout: they are considered as dead.
+// The nodes have the same worker types, so only the processing lists of the
+// given worker types are looked at.
+func (b *redisBroker) requeueJobs(ws WorkersList, now time.Time) (int, error) {
+	args := []interface{}{now.Add(-redisVisibilityTimeout).UTC().Unix()}
+	for workerType := range ws {
+		args = append(args, workerType)
+	}
+	res, err := b.client.Eval(luaRequeueJobs, []string{redisNodesKey}, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, errors.New("Unexpected response from redis")
+	}
+	return int(n), nil
+}
+
+// reconcileOnce reconciles the jobs in CouchDB with the queues, if it has not
+// already been done. Looking at the jobs of all the instances is expensive,
+// so it is done only for a new redis, or a redis that has lost its data.
+func (b *redisBroker) reconcileOnce(ws WorkersList) (int, error) {
+	done, err := b.client.Exists(redisReconciledKey).Result()
+	if err != nil || done > 0 {
+		return 0, err
+	}
+	return b.reconcile(ws)
+}
+
+// reconcile pushes again in their queues the jobs that are queued or running
+// for CouchDB, but that are unknown to redis: they are neither in a queue, nor
+// in the processing list of a node. It can happen when redis has lost some
+// data. Only the jobs for the given worker types, and queued for more than the
+// visibility timeout, are pushed. It returns the number of pushed jobs.
+func (b *redisBroker) reconcile(ws WorkersList) (int, error) {
+	ok, err := b.client.SetNX(redisReconcileKey, b.nodeID, redisReconcileTimeout).Result()
+	if err != nil || !ok {
+		// Another node is already reconciling the jobs
+		return 0, err
+	}
+	defer b.client.Del(redisReconcileKey)
+
+	known := make(map[string]struct{})
+	for workerType := range ws {
+		vals, err := b.client.LRange(redisPrefix+workerType, 0, -1).Result()
+		if err != nil {
+			return 0, err
+		}
+		for _, val := range vals {
+			known[workerType+"/"+val] = struct{}{}
+		}
+	}
+	nodes, err := b.client.ZRange(redisNodesKey, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, node := range nodes {
+		for workerType := range ws {
+			key := redisProcessingPrefix + node + "/" + workerType
+			vals, err := b.client.LRange(key, 0, -1).Result()
+			if err != nil {
+				return 0, err
+			}
+			for _, val := range vals {
+				known[workerType+"/"+val] = struct{}{}
+			}
+		}
+	}
+
+	dbs, err := couchdb.AllDatabasesOfDoctype(consts.Jobs)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, db := range dbs {
+		jobs, err := findUnfinishedJobs(db)
+		if err != nil {
+			log.Warnf("Cannot find the jobs for %s: %s", db.Prefix(), err)
+			continue
+		}
+		for _, infos := range jobs {
+			if _, ok := ws[infos.WorkerType]; !ok {
+				continue
+			}
+			if time.Since(infos.QueuedAt) < redisVisibilityTimeout {
+				continue
+			}
+			val := infos.Domain + "/" + infos.JobID
+			if _, ok := known[infos.WorkerType+"/"+val]; ok {
+				continue
+			}
+			if err := b.client.RPush(redisPrefix+infos.WorkerType, val).Err(); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, b.client.Set(redisReconciledKey, time.Now().UTC().Format(time.RFC3339), 0).Err()
+}
+
+// findUnfinishedJobs returns the jobs of a database that are queued or
+// running.
+func findUnfinishedJobs(db couchdb.Database) ([]*JobInfos, error) {
+	if err := couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Jobs)); err != nil {
+		return nil, err
+	}
+	const limit = 1000
+	var jobs []*JobInfos
+	for _, state := range []State{Queued, Running} {
+		for skip := 0; ; skip += limit {
+			var results []*JobInfos
+			req := &couchdb.FindRequest{
+				UseIndex: "by-state",
+				Selector: mango.Equal("state", state),
+				Limit:    limit,
+				Skip:     skip,
+			}
+			if err := couchdb.FindDocs(db, consts.Jobs, req, &results); err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, results...)
+			if len(results) < limit {
+				break
+			}
+		}
+	}
+	return jobs, nil
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(req *JobRequest) (*JobInfos, error) {
@@ -121,6 +447,113 @@ func (b *redisBroker) QueueLen(workerType string) (int, error) {
 	return int(l), err
 }
 
+// CancelJob cancels a job: it is removed from its queue if it is still queued,
+// or the node that executes it is asked to cancel its context if it is
+// running.
+func (b *redisBroker) CancelJob(domain, jobID string) error {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	infos, err := storage.Get(domain, jobID)
+	if err != nil {
+		return err
+	}
+	key := redisPrefix + infos.WorkerType
+	val := infos.Domain + "/" + infos.JobID
+	if err = b.client.LRem(key, 0, val).Err(); err != nil {
+		return err
+	}
+	return cancelJob(storage, infos, func(domain, jobID string) error {
+		return b.client.Publish(redisCancelChannel, domain+"/"+jobID).Err()
+	})
+}
+
+// ListJobs returns a page of the jobs of a domain that match the filter.
+func (b *redisBroker) ListJobs(domain string, filter *Filter, cursor *couchdb.StartKeyCursor) ([]*JobInfos, error) {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	return storage.List(domain, filter, cursor)
+}
+
+// DeadLetters returns the jobs of the dead-letter queue of a worker type.
+func (b *redisBroker) DeadLetters(workerType string) ([]*DeadLetter, error) {
+	if _, ok := b.workers[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	vals, err := b.client.LRange(redisDeadLettersPrefix+workerType, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*DeadLetter, 0, len(vals))
+	for _, val := range vals {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(val), &dl); err != nil {
+			log.Warnf("Invalid dead letter %s: %s", val, err)
+			continue
+		}
+		list = append(list, &dl)
+	}
+	return list, nil
+}
+
+// GetDeadLetter returns a job of the dead-letter queue of a worker type.
+func (b *redisBroker) GetDeadLetter(workerType, jobID string) (*DeadLetter, error) {
+	if _, ok := b.workers[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	vals, err := b.client.LRange(redisDeadLettersPrefix+workerType, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	dl, _, err := findDeadLetter(vals, jobID)
+	return dl, err
+}
+
+// RetryDeadLetter removes a job from the dead-letter queue and pushes it
+// again.
+func (b *redisBroker) RetryDeadLetter(workerType, jobID string) (*JobInfos, error) {
+	if _, ok := b.workers[workerType]; !ok {
+		return nil, ErrUnknownWorker
+	}
+	dl, err := b.removeDeadLetter(workerType, jobID)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := b.PushJob(dl.Request())
+	if err != nil {
+		b.addDeadLetter(dl)
+		return nil, err
+	}
+	return infos, nil
+}
+
+// DiscardDeadLetter removes a job from the dead-letter queue.
+func (b *redisBroker) DiscardDeadLetter(workerType, jobID string) error {
+	if _, ok := b.workers[workerType]; !ok {
+		return ErrUnknownWorker
+	}
+	_, err := b.removeDeadLetter(workerType, jobID)
+	return err
+}
+
+func (b *redisBroker) removeDeadLetter(workerType, jobID string) (*DeadLetter, error) {
+	key := redisDeadLettersPrefix + workerType
+	vals, err := b.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	dl, val, err := findDeadLetter(vals, jobID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := b.client.LRem(key, 1, val).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		// It has been removed by another call in the meantime
+		return nil, ErrNotFoundDeadLetter
+	}
+	return dl, nil
+}
+
 // GetJobInfos returns the informations about a job.
 func (b *redisBroker) GetJobInfos(domain, jobID string) (*JobInfos, error) {
 	var infos JobInfos
@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
 )
@@ -107,6 +109,269 @@ func TestRedisJobs(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+func TestRedisRequeueJobsOfDeadNode(t *testing.T) {
+	var w sync.WaitGroup
+	var workersTestList = WorkersList{
+		"test-requeue": {
+			Concurrency: 1,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				w.Done()
+				return nil
+			},
+		},
+	}
+
+	// A node has taken a job, and has crashed before acking it
+	broker := &redisBroker{client: client}
+	msg, _ := NewMessage(JSONEncoding, "crash")
+	infos, err := broker.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-requeue",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	val := infos.Domain + "/" + infos.JobID
+	assert.NoError(t, client.RPop(redisPrefix+"test-requeue").Err())
+	assert.NoError(t, client.LPush(redisProcessingPrefix+"dead-node/test-requeue", val).Err())
+	assert.NoError(t, client.ZAdd(redisNodesKey, redis.Z{
+		Score:  float64(time.Now().Add(-2 * redisVisibilityTimeout).Unix()),
+		Member: "dead-node",
+	}).Err())
+
+	// The jobs of a node that is still alive are not requeued
+	n, err := broker.requeueJobs(workersTestList, time.Now().Add(-2*redisVisibilityTimeout))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = broker.requeueJobs(workersTestList, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, n >= 1)
+	l, err := broker.QueueLen("test-requeue")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, l)
+	l2, err := client.LLen(redisProcessingPrefix + "dead-node/test-requeue").Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, l2)
+
+	// The job can be executed by another node
+	w.Add(1)
+	broker.Start(workersTestList)
+	w.Wait()
+	broker.Stop()
+	time.Sleep(100 * time.Millisecond)
+	l2, err = client.LLen(redisProcessingPrefix + broker.nodeID + "/test-requeue").Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, l2)
+	done, err := broker.GetJobInfos(infos.Domain, infos.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Done, done.State)
+}
+
+func TestRedisCancelJob(t *testing.T) {
+	started := make(chan struct{})
+	var workersTestList = WorkersList{
+		"test-cancel": {
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      1 * time.Minute,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+	}
+	broker1 := &redisBroker{client: client}
+	broker2 := &redisBroker{client: client}
+	broker1.Start(workersTestList)
+	defer broker1.Stop()
+
+	msg, _ := NewMessage(JSONEncoding, "cancel")
+	running, err := broker2.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-cancel",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	<-started
+	queued, err := broker2.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-cancel",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+
+	// A queued job is removed from its queue
+	assert.NoError(t, broker2.CancelJob("cozy.local", queued.JobID))
+	infos, err := broker2.GetJobInfos("cozy.local", queued.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, infos.State)
+	l, err := broker2.QueueLen("test-cancel")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, l)
+
+	// A running job is cancelled by the node that executes it
+	assert.NoError(t, broker2.CancelJob("cozy.local", running.JobID))
+	for i := 0; i < 100; i++ {
+		infos, err = broker2.GetJobInfos("cozy.local", running.JobID)
+		if err != nil || infos.State == Cancelled {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, infos.State)
+
+	assert.Equal(t, ErrNotFoundJob, broker2.CancelJob("cozy.local", "not-a-job"))
+}
+
+func TestRedisReconcile(t *testing.T) {
+	var workersTestList = WorkersList{
+		"test-reconcile": {
+			Concurrency: 1,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				return nil
+			},
+		},
+	}
+	broker := &redisBroker{client: client}
+	assert.NoError(t, client.Del(redisPrefix+"test-reconcile").Err())
+
+	// A job that has been lost by redis
+	msg, _ := NewMessage(JSONEncoding, "lost")
+	lost := NewJobInfos(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-reconcile",
+		Message:    msg,
+	})
+	lost.QueuedAt = time.Now().Add(-2 * redisVisibilityTimeout)
+	db := couchdb.SimpleDatabasePrefix("cozy.local")
+	assert.NoError(t, couchdb.CreateDoc(db, lost))
+
+	// A job still in its queue
+	msg, _ = NewMessage(JSONEncoding, "queued")
+	queued, err := broker.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-reconcile",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	queued.QueuedAt = time.Now().Add(-2 * redisVisibilityTimeout)
+	assert.NoError(t, couchdb.UpdateDoc(db, queued))
+
+	n, err := broker.reconcile(workersTestList)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	vals, err := client.LRange(redisPrefix+"test-reconcile", 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Len(t, vals, 2)
+	assert.Contains(t, vals, "cozy.local/"+lost.JobID)
+	assert.Contains(t, vals, "cozy.local/"+queued.JobID)
+
+	// Nothing more is pushed the second time
+	n, err = broker.reconcile(workersTestList)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The reconciliation is not done again when the stack is restarted
+	assert.NoError(t, client.Del(redisPrefix+"test-reconcile").Err())
+	n, err = broker.reconcileOnce(workersTestList)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, client.Del(redisReconciledKey).Err())
+	n, err = broker.reconcileOnce(workersTestList)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.NoError(t, client.Del(redisPrefix+"test-reconcile").Err())
+	assert.NoError(t, couchdb.DeleteDoc(db, lost))
+	assert.NoError(t, couchdb.DeleteDoc(db, queued))
+}
+
+func TestRedisDeadLetters(t *testing.T) {
+	var workersTestList = WorkersList{
+		"test-dead": {
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				return errors.New("boom")
+			},
+		},
+	}
+	assert.NoError(t, client.Del(redisDeadLettersPrefix+"test-dead").Err())
+	broker1 := &redisBroker{client: client}
+	broker2 := &redisBroker{client: client, workers: workersTestList}
+	broker1.Start(workersTestList)
+
+	_, err := broker2.DeadLetters("unknown")
+	assert.Equal(t, ErrUnknownWorker, err)
+	_, err = broker2.RetryDeadLetter("unknown", "1")
+	assert.Equal(t, ErrUnknownWorker, err)
+
+	msg, _ := NewMessage(JSONEncoding, "dead")
+	infos, err := broker2.PushJob(&JobRequest{
+		Domain:     "cozy.local",
+		WorkerType: "test-dead",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+
+	var list []*DeadLetter
+	for i := 0; i < 100; i++ {
+		list, err = broker2.DeadLetters("test-dead")
+		if err != nil || len(list) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker1.Stop()
+	assert.NoError(t, err)
+	if !assert.Len(t, list, 1) {
+		return
+	}
+	assert.Equal(t, infos.JobID, list[0].JobID)
+	assert.Equal(t, "boom", list[0].Error)
+	assert.Equal(t, 2, list[0].Attempts)
+	assert.Equal(t, msg, list[0].Message)
+
+	dl, err := broker2.GetDeadLetter("test-dead", infos.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, infos.JobID, dl.JobID)
+
+	// The job is pushed again in the queue, with the same message
+	retried, err := broker2.RetryDeadLetter("test-dead", infos.JobID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, infos.JobID, retried.JobID)
+	assert.Equal(t, msg, retried.Message)
+	l, err := broker2.QueueLen("test-dead")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, l)
+	assert.NoError(t, client.Del(redisPrefix+"test-dead").Err())
+	_, err = broker2.GetDeadLetter("test-dead", infos.JobID)
+	assert.Equal(t, ErrNotFoundDeadLetter, err)
+
+	// The oldest failures are dropped when the queue is full
+	retention := deadLettersRetention
+	deadLettersRetention = 2
+	defer func() { deadLettersRetention = retention }()
+	for _, id := range []string{"1", "2", "3"} {
+		broker2.addDeadLetter(&DeadLetter{JobID: id, WorkerType: "test-dead"})
+	}
+	list, err = broker2.DeadLetters("test-dead")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "3", list[0].JobID)
+		assert.Equal(t, "2", list[1].JobID)
+	}
+
+	assert.NoError(t, broker2.DiscardDeadLetter("test-dead", "3"))
+	assert.Equal(t, ErrNotFoundDeadLetter, broker2.DiscardDeadLetter("test-dead", "3"))
+	list, err = broker2.DeadLetters("test-dead")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
 func TestMain(m *testing.M) {
 	redisBRPopTimeout = 1 * time.Second
 	config.UseTestFile()
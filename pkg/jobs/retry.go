@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"math/rand"
+	"time"
+)
+
+// permanentError is an error returned by a worker for a job that must not be
+// retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// retryAfterError is an error returned by a worker for a job that can be
+// retried, but not before the given delay.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+
+// Permanent can be used by a WorkerFunc to wrap an error for which retrying
+// the job is pointless, like an invalid message.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// RetryAfter can be used by a WorkerFunc to wrap an error for which the job
+// can be retried, but only after the given delay, like when a remote server
+// has answered with a Retry-After header. The job is not retried if the delay
+// exceeds its maximal execution time.
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err, delay}
+}
+
+// IsPermanent returns true if the error has been wrapped with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// retryAfterDelay returns the delay given to RetryAfter, or 0 if the error
+// has not been wrapped with it.
+func retryAfterDelay(err error) time.Duration {
+	if e, ok := err.(*retryAfterError); ok {
+		return e.delay
+	}
+	return 0
+}
+
+// backoff returns the delay before the given retry (starting at 1): it is a
+// random duration between 0 and the base delay doubled for each previous
+// retry, capped to max. This "full jitter" avoids that the jobs which have
+// failed at the same time are retried together.
+func backoff(base, max time.Duration, retry int) time.Duration {
+	delay := base
+	for i := 1; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
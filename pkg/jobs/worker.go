@@ -3,8 +3,8 @@ package jobs
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -16,14 +16,17 @@ const (
 	ContextDomainKey contextKey = iota
 	// ContextWorkerKey is used to store the workerID string
 	ContextWorkerKey
+	// contextJobKey is used to store the job being executed
+	contextJobKey
 )
 
 var (
-	defaultConcurrency  = runtime.NumCPU()
-	defaultMaxExecCount = 3
-	defaultMaxExecTime  = 60 * time.Second
-	defaultRetryDelay   = 60 * time.Millisecond
-	defaultTimeout      = 10 * time.Second
+	defaultConcurrency   = runtime.NumCPU()
+	defaultMaxExecCount  = 3
+	defaultMaxExecTime   = 60 * time.Second
+	defaultRetryDelay    = 60 * time.Millisecond
+	defaultMaxRetryDelay = 30 * time.Second
+	defaultTimeout       = 10 * time.Second
 )
 
 type (
@@ -44,7 +47,10 @@ type (
 		MaxExecCount int           `json:"max_exec_count"`
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
-		RetryDelay   time.Duration `json:"retry_delay"`
+		// RetryDelay is the base delay of the exponential backoff between two
+		// executions, and MaxRetryDelay is its cap
+		RetryDelay    time.Duration `json:"retry_delay"`
+		MaxRetryDelay time.Duration `json:"max_retry_delay"`
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -58,6 +64,13 @@ type (
 
 var slots chan struct{}
 
+// runningJobs are the functions to cancel the jobs executed by the workers of
+// this process, indexed by domain and job id.
+var (
+	runningJobs   = make(map[string]context.CancelFunc)
+	runningJobsMu sync.Mutex
+)
+
 func setNbSlots(nb int) {
 	slots = make(chan struct{}, nb)
 	for i := 0; i < nb; i++ {
@@ -73,6 +86,16 @@ func NewWorkerContext(domain, workerID string) context.Context {
 	return ctx
 }
 
+// SetProgress records the advancement of the job executed with the given
+// worker context. It does nothing if the context is not the one of a job.
+func SetProgress(ctx context.Context, done, total int64) error {
+	job, ok := ctx.Value(contextJobKey).(*Job)
+	if !ok {
+		return nil
+	}
+	return job.SetProgress(done, total)
+}
+
 // Start is used to start the worker consumption of messages from its queue.
 func (w *Worker) Start(jobs chan Job) {
 	w.jobs = jobs
@@ -85,39 +108,78 @@ func (w *Worker) Start(jobs chan Job) {
 
 func (w *Worker) work(workerID string) {
 	for job := range w.jobs {
-		domain := job.Domain()
-		if domain == "" {
-			log.Errorf("[job] %s: missing domain from job request", workerID)
-			continue
-		}
-		parentCtx := NewWorkerContext(domain, workerID)
-		infos := job.Infos()
-		if err := job.AckConsumed(); err != nil {
-			log.Errorf("[job] %s: error acking consume job %s: %s",
-				workerID, infos.ID(), err.Error())
-			continue
-		}
-		t := &task{
-			ctx:      parentCtx,
-			infos:    infos,
-			conf:     w.defaultedConf(infos.Options),
-			workerID: workerID,
-		}
-		var err error
-		if err = t.run(); err != nil {
-			log.Errorf("[job] %s: error while performing job %s: %s",
-				workerID, infos.ID(), err.Error())
-			err = job.Nack(err)
-		} else {
-			err = job.Ack()
-		}
-		if err != nil {
-			log.Errorf("[job] %s: error while acking job done %s: %s",
-				workerID, infos.ID(), err.Error())
-		}
+		w.runJob(workerID, job)
 	}
 }
 
+func (w *Worker) runJob(workerID string, job Job) {
+	defer job.done()
+	domain := job.Domain()
+	if domain == "" {
+		log.Errorf("[job] %s: missing domain from job request", workerID)
+		return
+	}
+	infos := job.Infos()
+	if infos.State == Cancelled {
+		return
+	}
+	// The cancel function is registered before the job is marked as running,
+	// so that it can be found by cancelJob
+	parentCtx, cancel := context.WithCancel(NewWorkerContext(domain, workerID))
+	key := domain + "/" + infos.ID()
+	runningJobsMu.Lock()
+	runningJobs[key] = cancel
+	runningJobsMu.Unlock()
+	defer func() {
+		runningJobsMu.Lock()
+		delete(runningJobs, key)
+		runningJobsMu.Unlock()
+		cancel()
+	}()
+	if err := job.AckConsumed(); err != nil {
+		log.Errorf("[job] %s: error acking consume job %s: %s",
+			workerID, infos.ID(), err.Error())
+		return
+	}
+	t := &task{
+		ctx:      context.WithValue(parentCtx, contextJobKey, &job),
+		infos:    infos,
+		conf:     w.defaultedConf(infos.Options),
+		workerID: workerID,
+	}
+	err := t.run()
+	switch {
+	case err == nil:
+		err = job.Ack()
+	case parentCtx.Err() == context.Canceled || err == context.Canceled:
+		// A cancelled job has not failed, it is not a dead letter
+		log.Infof("[job] %s: job %s has been cancelled", workerID, infos.ID())
+		err = job.Cancel()
+	default:
+		log.Errorf("[job] %s: error while performing job %s: %s",
+			workerID, infos.ID(), err.Error())
+		permanent := IsPermanent(err)
+		err = job.Nack(err)
+		job.sendToDeadLetters(t.execCount, permanent)
+	}
+	if err != nil {
+		log.Errorf("[job] %s: error while acking job done %s: %s",
+			workerID, infos.ID(), err.Error())
+	}
+}
+
+// cancelRunningJob cancels the context of a job executed by a worker of this
+// process. It returns false if the job is not running here.
+func cancelRunningJob(domain, jobID string) bool {
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	cancel, ok := runningJobs[domain+"/"+jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
 func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	c := w.Conf.clone()
 	if c.Concurrency == 0 {
@@ -132,6 +194,9 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	if c.RetryDelay == 0 {
 		c.RetryDelay = defaultRetryDelay
 	}
+	if c.MaxRetryDelay == 0 {
+		c.MaxRetryDelay = defaultMaxRetryDelay
+	}
 	if c.Timeout == 0 {
 		c.Timeout = defaultTimeout
 	}
@@ -147,6 +212,16 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	if opts.Timeout > 0 && opts.Timeout < c.Timeout {
 		c.Timeout = opts.Timeout
 	}
+	// The options can only slow down the retries
+	if opts.RetryDelay > c.RetryDelay {
+		c.RetryDelay = opts.RetryDelay
+	}
+	if opts.MaxRetryDelay > c.MaxRetryDelay {
+		c.MaxRetryDelay = opts.MaxRetryDelay
+	}
+	if c.MaxRetryDelay < c.RetryDelay {
+		c.MaxRetryDelay = c.RetryDelay
+	}
 	return c
 }
 
@@ -155,9 +230,10 @@ type task struct {
 	infos *JobInfos
 	conf  *WorkerConfig
 
-	workerID  string
-	startTime time.Time
-	execCount int
+	workerID   string
+	startTime  time.Time
+	execCount  int
+	retryAfter time.Duration
 }
 
 func (t *task) run() (err error) {
@@ -181,7 +257,11 @@ func (t *task) run() (err error) {
 				t.workerID, t.infos.ID(), err.Error(), delay)
 		}
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+				return t.ctx.Err()
+			}
 		}
 		log.Debugf("[job] %s: executing job %s(%d) (timeout %s)",
 			t.workerID, t.infos.ID(), t.execCount, timeout)
@@ -194,7 +274,15 @@ func (t *task) run() (err error) {
 		// its cancelation function in any case. Failure to do so may keep the
 		// context and its parent alive longer than necessary.
 		cancel()
+		// A cancelled job is not retried
+		if t.ctx.Err() != nil {
+			return err
+		}
 		t.execCount++
+		if IsPermanent(err) {
+			return err
+		}
+		t.retryAfter = retryAfterDelay(err)
 	}
 	return nil
 }
@@ -233,12 +321,11 @@ func (t *task) nextDelay() (bool, time.Duration, time.Duration) {
 	if t.execCount == 0 {
 		// on first execution, execute immediately
 		nextDelay = 0
+	} else if t.retryAfter > 0 {
+		// the worker has asked for a delay before the next execution
+		nextDelay = t.retryAfter
 	} else {
-		nextDelay = c.RetryDelay << uint(t.execCount-1)
-
-		// fuzzDelay number between delay * (1 +/- 0.1)
-		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay = nextDelay + time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+		nextDelay = backoff(c.RetryDelay, c.MaxRetryDelay, t.execCount)
 	}
 
 	if execTime+nextDelay > c.MaxExecTime {
@@ -0,0 +1,286 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/go-redis/redis"
+)
+
+const editLockNS = "editlocks:"
+
+var (
+	// ErrLocked is returned when a document is locked by another holder
+	ErrLocked = errors.New("The document is locked")
+	// ErrNotLocked is returned when a document is not locked
+	ErrNotLocked = errors.New("The document is not locked")
+)
+
+// EditLock is an advisory lock on a document, for the collaborative editors.
+// It is held by the client that knows its token, until it is released or it
+// expires.
+type EditLock struct {
+	Token     string    `json:"token,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EditLocker manages the edit locks of the documents of an instance.
+type EditLocker interface {
+	// Acquire takes the lock on the document for the given duration. It
+	// returns ErrLocked if the document is already locked.
+	Acquire(docID, owner string, ttl time.Duration) (*EditLock, error)
+	// Refresh extends the lock held with the given token. It returns
+	// ErrNotLocked if the document is not locked, and ErrLocked if the lock
+	// has another token.
+	Refresh(docID, token string, ttl time.Duration) (*EditLock, error)
+	// Release removes the lock held with the given token.
+	Release(docID, token string) error
+	// Break removes the lock on the document, whatever its holder.
+	Break(docID string) error
+	// Get returns the lock on the document, or nil if it is not locked.
+	Get(docID string) (*EditLock, error)
+}
+
+// EditLocks returns the locker for the edit locks of the given domain
+func EditLocks(domain string) EditLocker {
+	if c := getClient(); c != nil {
+		return &redisEditLocker{client: c, prefix: editLockNS + domain + "/"}
+	}
+	return &memEditLocker{prefix: domain + "/"}
+}
+
+// CheckEditLock returns ErrLocked if the document is locked and the given
+// token is not the one of the lock. It must be called before each change of
+// a file, as the edit locks are only advisory.
+func CheckEditLock(domain, docID, token string) error {
+	l, err := EditLocks(domain).Get(docID)
+	if err != nil {
+		return err
+	}
+	if l == nil || l.Token == token {
+		return nil
+	}
+	return ErrLocked
+}
+
+func newEditLock(owner string, ttl time.Duration) *EditLock {
+	return &EditLock{
+		Token:     utils.RandomString(lockTokenSize),
+		Owner:     owner,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+}
+
+var (
+	memEditLocks   = make(map[string]*EditLock)
+	memEditLocksMu sync.Mutex
+)
+
+type memEditLocker struct {
+	prefix string
+}
+
+// get returns the lock of the document if it has not expired. It must be
+// called with memEditLocksMu held.
+func (m *memEditLocker) get(docID string) *EditLock {
+	key := m.prefix + docID
+	l, ok := memEditLocks[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(l.ExpiresAt) {
+		delete(memEditLocks, key)
+		return nil
+	}
+	return l
+}
+
+// pruneMemEditLocks removes the expired locks of all the instances. It must
+// be called with memEditLocksMu held.
+func pruneMemEditLocks(now time.Time) {
+	for key, l := range memEditLocks {
+		if now.After(l.ExpiresAt) {
+			delete(memEditLocks, key)
+		}
+	}
+}
+
+func (m *memEditLocker) Acquire(docID, owner string, ttl time.Duration) (*EditLock, error) {
+	memEditLocksMu.Lock()
+	defer memEditLocksMu.Unlock()
+	pruneMemEditLocks(time.Now())
+	if m.get(docID) != nil {
+		return nil, ErrLocked
+	}
+	l := newEditLock(owner, ttl)
+	memEditLocks[m.prefix+docID] = l
+	cloned := *l
+	return &cloned, nil
+}
+
+func (m *memEditLocker) Refresh(docID, token string, ttl time.Duration) (*EditLock, error) {
+	memEditLocksMu.Lock()
+	defer memEditLocksMu.Unlock()
+	l := m.get(docID)
+	if l == nil {
+		return nil, ErrNotLocked
+	}
+	if l.Token != token {
+		return nil, ErrLocked
+	}
+	l.ExpiresAt = time.Now().Add(ttl)
+	cloned := *l
+	return &cloned, nil
+}
+
+func (m *memEditLocker) Release(docID, token string) error {
+	memEditLocksMu.Lock()
+	defer memEditLocksMu.Unlock()
+	l := m.get(docID)
+	if l == nil {
+		return ErrNotLocked
+	}
+	if l.Token != token {
+		return ErrLocked
+	}
+	delete(memEditLocks, m.prefix+docID)
+	return nil
+}
+
+func (m *memEditLocker) Break(docID string) error {
+	memEditLocksMu.Lock()
+	defer memEditLocksMu.Unlock()
+	if m.get(docID) == nil {
+		return ErrNotLocked
+	}
+	delete(memEditLocks, m.prefix+docID)
+	return nil
+}
+
+func (m *memEditLocker) Get(docID string) (*EditLock, error) {
+	memEditLocksMu.Lock()
+	defer memEditLocksMu.Unlock()
+	l := m.get(docID)
+	if l == nil {
+		return nil, nil
+	}
+	cloned := *l
+	return &cloned, nil
+}
+
+// The locks are stored in redis as JSON, with the same expiration as the
+// lock. The scripts compare the tokens to update or delete them atomically.
+const (
+	luaEditGet     = `return redis.call("get", KEYS[1])`
+	luaEditRefresh = `local v = redis.call("get", KEYS[1])
+if not v then return 0 end
+if cjson.decode(v).token ~= ARGV[1] then return -1 end
+redis.call("set", KEYS[1], ARGV[2], "px", ARGV[3])
+return 1`
+	luaEditRelease = `local v = redis.call("get", KEYS[1])
+if not v then return 0 end
+if cjson.decode(v).token ~= ARGV[1] then return -1 end
+redis.call("del", KEYS[1])
+return 1`
+	luaEditBreak = `return redis.call("del", KEYS[1])`
+)
+
+type redisEditLocker struct {
+	client subRedisInterface
+	prefix string
+}
+
+func (r *redisEditLocker) Acquire(docID, owner string, ttl time.Duration) (*EditLock, error) {
+	l := newEditLock(owner, ttl)
+	value, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := r.client.SetNX(r.prefix+docID, value, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	return l, nil
+}
+
+func (r *redisEditLocker) Refresh(docID, token string, ttl time.Duration) (*EditLock, error) {
+	l, err := r.Get(docID)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, ErrNotLocked
+	}
+	l.ExpiresAt = time.Now().Add(ttl)
+	value, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	px := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	res, err := r.client.Eval(luaEditRefresh, []string{r.prefix + docID}, token, value, px).Result()
+	if err != nil {
+		return nil, err
+	}
+	if err = editResult(res); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (r *redisEditLocker) Release(docID, token string) error {
+	res, err := r.client.Eval(luaEditRelease, []string{r.prefix + docID}, token).Result()
+	if err != nil {
+		return err
+	}
+	return editResult(res)
+}
+
+func (r *redisEditLocker) Break(docID string) error {
+	res, err := r.client.Eval(luaEditBreak, []string{r.prefix + docID}).Result()
+	if err != nil {
+		return err
+	}
+	if res == int64(0) {
+		return ErrNotLocked
+	}
+	return nil
+}
+
+func (r *redisEditLocker) Get(docID string) (*EditLock, error) {
+	res, err := r.client.Eval(luaEditGet, []string{r.prefix + docID}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := res.(string)
+	if !ok {
+		return nil, nil
+	}
+	var l EditLock
+	if err = json.Unmarshal([]byte(value), &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// editResult converts the result of the refresh and release scripts to an
+// error.
+func editResult(res interface{}) error {
+	switch res {
+	case int64(0):
+		return ErrNotLocked
+	case int64(-1):
+		return ErrLocked
+	}
+	return nil
+}
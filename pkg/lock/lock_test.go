@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 )
@@ -122,6 +123,79 @@ func TestRedisLock(t *testing.T) {
 	}
 }
 
+func testEditLocker(t *testing.T, l EditLocker) {
+	if got, err := l.Get("doc"); err != nil || got != nil {
+		t.Fatalf("expected no lock, got %v (%v)", got, err)
+	}
+	held, err := l.Acquire("doc", "editor-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire("doc", "editor-2", time.Minute); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	got, err := l.Get("doc")
+	if err != nil || got == nil || got.Token != held.Token || got.Owner != "editor-1" {
+		t.Fatalf("unexpected lock %v (%v)", got, err)
+	}
+	if _, err = l.Refresh("doc", "bad-token", time.Minute); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	refreshed, err := l.Refresh("doc", held.Token, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refreshed.ExpiresAt.After(held.ExpiresAt) {
+		t.Fatalf("expected the lock to be extended")
+	}
+	if err = l.Release("doc", "bad-token"); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err = l.Release("doc", held.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Release("doc", held.Token); err != ErrNotLocked {
+		t.Fatalf("expected ErrNotLocked, got %v", err)
+	}
+
+	if _, err = l.Acquire("doc", "editor-2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Break("doc"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = l.Get("doc"); err != nil || got != nil {
+		t.Fatalf("expected no lock, got %v (%v)", got, err)
+	}
+
+	if _, err = l.Acquire("expiring", "editor-1", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err = l.Acquire("expiring", "editor-2", time.Minute); err != nil {
+		t.Fatalf("expected the lock to have expired, got %v", err)
+	}
+	if err = l.Break("expiring"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemEditLock(t *testing.T) {
+	backurl := config.GetConfig().Lock.URL
+	config.GetConfig().Lock.URL = ""
+	globalRedisClient = nil
+	defer func() { config.GetConfig().Lock.URL = backurl }()
+	testEditLocker(t, EditLocks("test-mem"))
+}
+
+func TestRedisEditLock(t *testing.T) {
+	backurl := config.GetConfig().Lock.URL
+	config.GetConfig().Lock.URL = "redis://localhost:6379/0"
+	globalRedisClient = nil
+	defer func() { config.GetConfig().Lock.URL = backurl }()
+	testEditLocker(t, EditLocks("test-redis"))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	if testing.Short() {
@@ -0,0 +1,185 @@
+package permissions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// AppPassword is a long-lived secret that can be used with HTTP basic
+// authentication by the clients that can't do the OAuth dance, like the
+// WebDAV clients of the desktop file managers. The identifier of the document
+// is used as the username, and the password is only stored hashed.
+//
+// An app password gives access to all the files of the instance.
+type AppPassword struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Label     string    `json:"label"`
+	Hash      []byte    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// appPasswordCacheTTL is how long a successful verification of an app
+// password is remembered. The WebDAV clients send the credentials with each
+// request, and scrypt is too slow to be run every time.
+const appPasswordCacheTTL = 5 * time.Minute
+
+// After appPasswordMaxFailures failed verifications of an app password from
+// the same client, the next attempts of this client are rejected without
+// running scrypt, until appPasswordFailuresWindow has elapsed since the first
+// failure. The other clients are not locked out.
+const (
+	appPasswordMaxFailures    = 10
+	appPasswordFailuresWindow = 5 * time.Minute
+)
+
+type appPasswordFailures struct {
+	count int
+	since time.Time
+}
+
+var (
+	appPasswordsMu       sync.Mutex
+	appPasswordsVerified = make(map[string]time.Time)
+	appPasswordsFailures = make(map[string]*appPasswordFailures)
+)
+
+// ID implements jsonapi.Doc
+func (a *AppPassword) ID() string { return a.DocID }
+
+// Rev implements jsonapi.Doc
+func (a *AppPassword) Rev() string { return a.DocRev }
+
+// DocType implements jsonapi.Doc
+func (a *AppPassword) DocType() string { return consts.AppPasswords }
+
+// Clone implements couchdb.Doc
+func (a *AppPassword) Clone() couchdb.Doc {
+	cloned := *a
+	cloned.Hash = make([]byte, len(a.Hash))
+	copy(cloned.Hash, a.Hash)
+	return &cloned
+}
+
+// SetID implements jsonapi.Doc
+func (a *AppPassword) SetID(id string) { a.DocID = id }
+
+// SetRev implements jsonapi.Doc
+func (a *AppPassword) SetRev(rev string) { a.DocRev = rev }
+
+// CreateAppPassword generates a new app password with the given label. The
+// password in clear is returned, as it can't be retrieved later.
+func CreateAppPassword(db couchdb.Database, label string) (*AppPassword, string, error) {
+	password := hex.EncodeToString(crypto.GenerateRandomBytes(16))
+	hash, err := crypto.GenerateFromPassphrase([]byte(password))
+	if err != nil {
+		return nil, "", err
+	}
+	doc := &AppPassword{
+		Label:     label,
+		Hash:      hash,
+		CreatedAt: time.Now(),
+	}
+	if err = couchdb.CreateDoc(db, doc); err != nil {
+		return nil, "", err
+	}
+	return doc, password, nil
+}
+
+// DestroyAppPassword revokes the app password with the given identifier.
+func DestroyAppPassword(db couchdb.Database, id string) error {
+	var doc AppPassword
+	if err := couchdb.GetDoc(db, consts.AppPasswords, id, &doc); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, &doc)
+}
+
+// GetForAppPassword checks the given app password, sent by the given client
+// (its IP address), and creates a non-persisted permissions doc with a full
+// access to the files.
+func GetForAppPassword(db couchdb.Database, id, password, client string) (*Permission, error) {
+	var doc AppPassword
+	err := couchdb.GetDoc(db, consts.AppPasswords, id, &doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyAppPassword(db, &doc, password, client); err != nil {
+		return nil, err
+	}
+	pdoc := &Permission{
+		Type:     TypeAppPassword,
+		SourceID: consts.AppPasswords + "/" + doc.ID(),
+		Permissions: Set{
+			Rule{
+				Verbs: Verbs(GET, POST, PUT, PATCH, DELETE),
+				Type:  consts.Files,
+			},
+		},
+	}
+	return pdoc, nil
+}
+
+// verifyAppPassword checks the password against the hash of the app password.
+// The successful verifications are cached with a key derived from the
+// credentials and the revision of the document, and the failures are counted
+// by client to reject the brute-force attempts.
+func verifyAppPassword(db couchdb.Database, doc *AppPassword, password, client string) error {
+	key := db.Prefix() + "/" + doc.ID()
+	failuresKey := key + "/" + client
+	sum := sha256.Sum256([]byte(key + "/" + doc.Rev() + "/" + password))
+	verifiedKey := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	appPasswordsMu.Lock()
+	pruneAppPasswordsCache(now)
+	if _, ok := appPasswordsVerified[verifiedKey]; ok {
+		appPasswordsMu.Unlock()
+		return nil
+	}
+	if f, ok := appPasswordsFailures[failuresKey]; ok && f.count >= appPasswordMaxFailures {
+		appPasswordsMu.Unlock()
+		return ErrTooManyAttempts
+	}
+	appPasswordsMu.Unlock()
+
+	_, err := crypto.CompareHashAndPassphrase(doc.Hash, []byte(password))
+
+	appPasswordsMu.Lock()
+	defer appPasswordsMu.Unlock()
+	if err != nil {
+		f, ok := appPasswordsFailures[failuresKey]
+		if !ok {
+			f = &appPasswordFailures{since: now}
+			appPasswordsFailures[failuresKey] = f
+		}
+		f.count++
+		return ErrInvalidToken
+	}
+	appPasswordsVerified[verifiedKey] = now.Add(appPasswordCacheTTL)
+	return nil
+}
+
+// pruneAppPasswordsCache removes the expired entries. It must be called with
+// appPasswordsMu held.
+func pruneAppPasswordsCache(now time.Time) {
+	for key, expiresAt := range appPasswordsVerified {
+		if now.After(expiresAt) {
+			delete(appPasswordsVerified, key)
+		}
+	}
+	for key, f := range appPasswordsFailures {
+		if now.Sub(f.since) > appPasswordFailuresWindow {
+			delete(appPasswordsFailures, key)
+		}
+	}
+}
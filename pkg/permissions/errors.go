@@ -35,6 +35,11 @@ var (
 	ErrOnlyAppCanCreateSubSet = echo.NewHTTPError(http.StatusForbidden,
 		"Only apps can create sharing permissions")
 
+	// ErrTooManyAttempts is used when an app password has been used with a
+	// wrong password too many times recently
+	ErrTooManyAttempts = echo.NewHTTPError(http.StatusTooManyRequests,
+		"Too many attempts")
+
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
@@ -41,6 +41,9 @@ const (
 
 	// TypeCLI if the value of Permission.Type for a command-line permission doc
 	TypeCLI = "cli"
+
+	// TypeAppPassword if the value of Permission.Type for an app password
+	TypeAppPassword = "app-password"
 )
 
 // ID implements jsonapi.Doc
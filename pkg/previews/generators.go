@@ -0,0 +1,219 @@
+package previews
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// The text previews show the beginning of the file, in a page with a
+// monospace font.
+const (
+	textMaxLines   = 40
+	textMaxColumn  = 100
+	textReadSize   = textMaxLines * textMaxColumn * 4
+	textMargin     = 20
+	textLineHeight = 16
+)
+
+var officeMimes = []string{
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.oasis.opendocument.presentation",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+func init() {
+	Register("image/*", &Generator{
+		MaxSize: 100 << 20,
+		Timeout: 30 * time.Second,
+		Render:  renderImage,
+	})
+	Register("application/pdf", &Generator{
+		Commands: []string{"pdftoppm"},
+		MaxSize:  200 << 20,
+		Timeout:  30 * time.Second,
+		Render:   renderPDF,
+	})
+	Register("video/*", &Generator{
+		Commands: []string{"ffmpeg"},
+		MaxSize:  2 << 30,
+		Timeout:  2 * time.Minute,
+		Render:   renderVideo,
+	})
+	Register("text/plain", &Generator{
+		Timeout: 15 * time.Second,
+		Render:  renderText,
+	})
+	office := &Generator{
+		Commands: []string{"soffice"},
+		MaxSize:  50 << 20,
+		Timeout:  2 * time.Minute,
+		Render:   renderOffice,
+	}
+	for _, mime := range officeMimes {
+		Register(mime, office)
+	}
+}
+
+// The images are their own previews.
+func renderImage(ctx context.Context, in io.Reader, out io.Writer) error {
+	_, err := io.Copy(out, in)
+	return err
+}
+
+// The first page of a PDF is rendered by pdftoppm, from poppler-utils.
+func renderPDF(ctx context.Context, in io.Reader, out io.Writer) error {
+	args := []string{
+		"-f", "1", "-l", "1", // Only the first page
+		"-singlefile",       // Without the page number in the output name
+		"-scale-to", "1920", // At the size of the large thumbnails
+		"-png", // In PNG, as the thumbnails are made from it
+		"-",    // Takes the PDF from stdin, and writes on stdout
+	}
+	cmd := exec.CommandContext(ctx, "pdftoppm", args...) // #nosec
+	cmd.Stdin = in
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// A frame of the video is captured by ffmpeg. The video is copied in a
+// temporary file first, as the containers like MP4 may have their index at
+// the end and can't be read from a pipe.
+func renderVideo(ctx context.Context, in io.Reader, out io.Writer) error {
+	tmp, err := ioutil.TempFile("", "cozy-preview")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if errc := tmp.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"-v", "error",
+		"-i", tmp.Name(),
+		"-vf", "thumbnail", // Pick a representative frame of the beginning
+		"-frames:v", "1",
+		"-f", "image2pipe", "-vcodec", "png", "-",
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...) // #nosec
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// The first lines of a text file are drawn on a white page. It is done in Go
+// to not let ImageMagick interpret the text (@file, escapes, etc.).
+func renderText(ctx context.Context, in io.Reader, out io.Writer) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(in, textReadSize))
+	if err != nil {
+		return err
+	}
+	face := basicfont.Face7x13
+	width := 2*textMargin + textMaxColumn*face.Advance
+	height := 2*textMargin + textMaxLines*textLineHeight
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+	d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
+	for i, line := range textSnippet(buf) {
+		d.Dot = fixed.P(textMargin, textMargin+(i+1)*textLineHeight)
+		d.DrawString(line)
+	}
+	return png.Encode(out, img)
+}
+
+// textSnippet returns the first lines of a text, cut to fit in a page, and
+// without the control characters.
+func textSnippet(buf []byte) []string {
+	// The last rune may have been truncated by the limited read
+	for i := 0; i < utf8.UTFMax-1 && len(buf) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(buf); r != utf8.RuneError || size != 1 {
+			break
+		}
+		buf = buf[:len(buf)-1]
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() && len(lines) < textMaxLines {
+		line := strings.Map(func(r rune) rune {
+			switch {
+			case r == '\t':
+				return ' '
+			case unicode.IsControl(r):
+				return -1
+			}
+			return r
+		}, scanner.Text())
+		if utf8.RuneCountInString(line) > textMaxColumn {
+			line = string([]rune(line)[:textMaxColumn])
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// The office documents are converted by LibreOffice, which renders their
+// first page.
+func renderOffice(ctx context.Context, in io.Reader, out io.Writer) error {
+	dir, err := ioutil.TempDir("", "cozy-preview")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "document")
+	f, err := os.Create(src)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	args := []string{
+		// A profile per conversion, as LibreOffice can't share it between
+		// several processes
+		"-env:UserInstallation=file://" + filepath.Join(dir, "profile"),
+		"--headless",
+		"--convert-to", "png",
+		"--outdir", dir,
+		src,
+	}
+	cmd := exec.CommandContext(ctx, "soffice", args...) // #nosec
+	if err = cmd.Run(); err != nil {
+		return err
+	}
+	preview, err := os.Open(src + ".png")
+	if err != nil {
+		return err
+	}
+	defer preview.Close()
+	_, err = io.Copy(out, preview)
+	return err
+}
@@ -0,0 +1,87 @@
+// Package previews renders an image of the content of a file, from which the
+// thumbnails of the file are made: the image itself for the photos, the first
+// page of a PDF, a frame of a video, etc. The generators are registered by
+// mime type, with a budget to not exhaust the workers on huge files.
+package previews
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generator is the configuration of a preview generator for a kind of files.
+type Generator struct {
+	// Commands are the external commands needed by the generator. It is not
+	// used if one of them is not installed.
+	Commands []string
+	// MaxSize is the maximal size of the files, in bytes, for which a preview
+	// is generated.
+	MaxSize int64
+	// Timeout is the maximal duration for generating the preview of a file.
+	Timeout time.Duration
+	// Render writes an image of the preview of the content to out, in a
+	// format understood by ImageMagick.
+	Render func(ctx context.Context, in io.Reader, out io.Writer) error
+}
+
+// generators are the registered generators, by mime type. A mime type can be
+// a wildcard on the class, like image/*.
+var generators = map[string]*Generator{}
+
+// Register adds a generator for the files of the given mime type.
+func Register(mime string, g *Generator) {
+	if _, ok := generators[mime]; ok {
+		panic(fmt.Errorf("A preview generator for %s is already defined", mime))
+	}
+	generators[mime] = g
+}
+
+// Find returns the generator for the files of the given mime type, or nil if
+// the files of this type have no preview.
+func Find(mime string) *Generator {
+	g, ok := generators[mime]
+	if !ok {
+		if i := strings.Index(mime, "/"); i >= 0 {
+			g, ok = generators[mime[:i]+"/*"]
+		}
+	}
+	if !ok || !installed(g.Commands) {
+		return nil
+	}
+	return g
+}
+
+// Allow returns true if the preview of a file with the given size can be
+// generated.
+func (g *Generator) Allow(size int64) bool {
+	return g.MaxSize <= 0 || size <= g.MaxSize
+}
+
+var (
+	commandsMu sync.Mutex
+	commands   = map[string]bool{}
+)
+
+// installed returns true if all the given commands are in the PATH. The
+// lookups are cached.
+func installed(cmds []string) bool {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	for _, cmd := range cmds {
+		ok, found := commands[cmd]
+		if !found {
+			_, err := exec.LookPath(cmd)
+			ok = err == nil
+			commands[cmd] = ok
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package previews
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	assert.NotNil(t, Find("image/png"))
+	assert.NotNil(t, Find("image/jpeg"))
+	assert.NotNil(t, Find("text/plain"))
+	assert.Nil(t, Find("text/html"))
+	assert.Nil(t, Find("application/zip"))
+	assert.Nil(t, Find(""))
+
+	assert.Panics(t, func() {
+		Register("image/*", &Generator{Render: renderImage})
+	})
+
+	Register("application/x-previews-test", &Generator{
+		Commands: []string{"cozy-previews-test-not-installed"},
+		Render:   renderImage,
+	})
+	assert.Nil(t, Find("application/x-previews-test"))
+}
+
+func TestAllow(t *testing.T) {
+	g := &Generator{MaxSize: 100}
+	assert.True(t, g.Allow(100))
+	assert.False(t, g.Allow(101))
+	g = &Generator{}
+	assert.True(t, g.Allow(1<<40))
+}
+
+func TestTextSnippet(t *testing.T) {
+	lines := textSnippet([]byte("foo\tbar\r\n\x1bbaz\n\n" + strings.Repeat("é", 150) + "\nlast"))
+	if assert.Len(t, lines, 5) {
+		assert.Equal(t, "foo bar", lines[0])
+		assert.Equal(t, "baz", lines[1])
+		assert.Equal(t, "", lines[2])
+		assert.Equal(t, strings.Repeat("é", textMaxColumn), lines[3])
+		assert.Equal(t, "last", lines[4])
+	}
+
+	// A rune truncated by the limited read is removed
+	lines = textSnippet([]byte("café")[:4])
+	assert.Equal(t, []string{"caf"}, lines)
+
+	lines = textSnippet([]byte(strings.Repeat("line\n", 2*textMaxLines)))
+	assert.Len(t, lines, textMaxLines)
+}
+
+func TestRenderText(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := renderText(context.Background(), strings.NewReader("Hello world"), out)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg, err := png.DecodeConfig(out)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2*textMargin+textMaxColumn*7, cfg.Width)
+		assert.Equal(t, 2*textMargin+textMaxLines*textLineHeight, cfg.Height)
+	}
+}
@@ -56,6 +56,30 @@ func (b *mockBroker) GetJobInfos(domain, id string) (*jobs.JobInfos, error) {
 	return nil, errors.New("Not implemented")
 }
 
+func (b *mockBroker) CancelJob(domain, id string) error {
+	return errors.New("Not implemented")
+}
+
+func (b *mockBroker) ListJobs(domain string, filter *jobs.Filter, cursor *couchdb.StartKeyCursor) ([]*jobs.JobInfos, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) DeadLetters(workerType string) ([]*jobs.DeadLetter, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) GetDeadLetter(workerType, id string) (*jobs.DeadLetter, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) RetryDeadLetter(workerType, id string) (*jobs.JobInfos, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) DiscardDeadLetter(workerType, id string) error {
+	return errors.New("Not implemented")
+}
+
 func TestRedisSchedulerWithTimeTriggers(t *testing.T) {
 	var wAt sync.WaitGroup
 	var wIn sync.WaitGroup
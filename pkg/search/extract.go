@@ -0,0 +1,87 @@
+package search
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// maxContentSize is the maximal size of a file whose content is indexed.
+const maxContentSize = 50 << 20
+
+// maxTextSize is the maximal size of the text extracted from the content of a
+// file that is indexed.
+const maxTextSize = 1 << 20
+
+// contentTerms returns the words of the text extracted from the content of a
+// file, for the plain-text files and the PDFs. The content is only an
+// addition to the other fields: a file whose content can't be read is still
+// indexed with its name, tags and metadata.
+func contentTerms(ctx context.Context, fs vfs.VFS, doc *vfs.FileDoc) []string {
+	if doc.ByteSize > maxContentSize {
+		return nil
+	}
+	var text string
+	var err error
+	switch {
+	case doc.Mime == "application/pdf":
+		text, err = extractPDF(ctx, fs, doc)
+	case strings.HasPrefix(doc.Mime, "text/"):
+		text, err = extractText(fs, doc)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	terms := Tokenize(text)
+	if len(terms) > maxContentTerms {
+		terms = terms[:maxContentTerms]
+	}
+	return terms
+}
+
+func extractText(fs vfs.VFS, doc *vfs.FileDoc) (string, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(f, maxTextSize))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// The text of the PDFs is extracted with pdftotext, from poppler-utils.
+func extractPDF(ctx context.Context, fs vfs.VFS, doc *vfs.FileDoc) (string, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cmd := exec.CommandContext(ctx, "pdftotext", "-q", "-", "-") // #nosec
+	cmd.Stdin = f
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(out, maxTextSize))
+	// The rest of the output is discarded to let the command finish
+	io.Copy(ioutil.Discard, out) // #nosec
+	if errw := cmd.Wait(); errw != nil && err == nil {
+		err = errw
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
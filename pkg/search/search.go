@@ -0,0 +1,234 @@
+// Package search is a full-text search over the files of an instance. The
+// names, tags, metadata and the text extracted from the content of the files
+// are split in words, kept in an index document per file in CouchDB, and a
+// view is used to find the files matching some words.
+package search
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// maxTermLength is the maximal length of an indexed word. The longer words
+// are more likely to be hashes or encoded data than something to search.
+const maxTermLength = 64
+
+// MinQueryTermLength is the minimal length of a word of a query. The shorter
+// words match the prefix of too many indexed words, and are ignored.
+const MinQueryTermLength = 3
+
+// ErrQueryTooShort is used when all the words of a query are shorter than
+// MinQueryTermLength.
+var ErrQueryTooShort = errors.New("The words of the query must have at least 3 characters")
+
+// maxContentTerms is the maximal number of distinct words indexed for the
+// content of a file, to keep the index documents small.
+const maxContentTerms = 10000
+
+// Entry is the document of the index for a file. Its identifier is the same
+// as the one of the file.
+type Entry struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// Words of the name, tags and metadata of the file
+	Terms []string `json:"terms"`
+	// Words of the content of the file, extracted for the content with the
+	// given md5sum
+	ContentTerms []string `json:"content_terms,omitempty"`
+	MD5Sum       []byte   `json:"md5sum,omitempty"`
+}
+
+// ID returns the entry qualified identifier
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev returns the entry revision
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType returns the entry document type
+func (e *Entry) DocType() string { return consts.FilesSearch }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	cloned.Terms = make([]string, len(e.Terms))
+	copy(cloned.Terms, e.Terms)
+	cloned.ContentTerms = make([]string, len(e.ContentTerms))
+	copy(cloned.ContentTerms, e.ContentTerms)
+	cloned.MD5Sum = make([]byte, len(e.MD5Sum))
+	copy(cloned.MD5Sum, e.MD5Sum)
+	return &cloned
+}
+
+// SetID changes the entry qualified identifier
+func (e *Entry) SetID(id string) { e.DocID = id }
+
+// SetRev changes the entry revision
+func (e *Entry) SetRev(rev string) { e.DocRev = rev }
+
+// Tokenize splits a text in lower-cased words, without duplicates.
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]struct{}, len(fields))
+	terms := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if len(field) > maxTermLength {
+			continue
+		}
+		if _, ok := seen[field]; ok {
+			continue
+		}
+		seen[field] = struct{}{}
+		terms = append(terms, field)
+	}
+	return terms
+}
+
+// Index adds or updates the entry of a file in the index. The content is
+// only read again if it has changed since the last indexing.
+func Index(ctx context.Context, db couchdb.Database, fs vfs.VFS, doc *vfs.FileDoc) error {
+	entry := &Entry{}
+	err := couchdb.GetDoc(db, consts.FilesSearch, doc.ID(), entry)
+	exists := err == nil
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+
+	entry.DocID = doc.ID()
+	entry.Terms = fileTerms(doc)
+	if !exists || !bytes.Equal(entry.MD5Sum, doc.MD5Sum) {
+		entry.ContentTerms = contentTerms(ctx, fs, doc)
+		entry.MD5Sum = doc.MD5Sum
+	}
+
+	if exists {
+		return couchdb.UpdateDoc(db, entry)
+	}
+	return couchdb.CreateNamedDocWithDB(db, entry)
+}
+
+// Remove deletes the entry of a file from the index.
+func Remove(db couchdb.Database, fileID string) error {
+	entry := &Entry{}
+	err := couchdb.GetDoc(db, consts.FilesSearch, fileID, entry)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, entry)
+}
+
+// IndexAll indexes all the files of the VFS that are not in the trash.
+func IndexAll(ctx context.Context, db couchdb.Database, fs vfs.VFS) error {
+	_, files, err := fs.AllDirsAndFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if file.Trashed {
+			continue
+		}
+		if err = Index(ctx, db, fs, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the identifiers of the files that match all the words of
+// the query, sorted. A word of the query matches the indexed words starting
+// with it, and the words shorter than MinQueryTermLength are ignored.
+func Search(db couchdb.Database, query string) ([]string, error) {
+	all := Tokenize(query)
+	if len(all) == 0 {
+		return nil, nil
+	}
+	terms := make([]string, 0, len(all))
+	for _, term := range all {
+		if utf8.RuneCountInString(term) >= MinQueryTermLength {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, ErrQueryTooShort
+	}
+
+	var matches map[string]struct{}
+	for _, term := range terms {
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(db, consts.FilesSearchView, &couchdb.ViewRequest{
+			StartKey: term,
+			EndKey:   term + "\uffff",
+		}, &res)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids := make(map[string]struct{}, len(res.Rows))
+		for _, row := range res.Rows {
+			if _, ok := matches[row.ID]; matches == nil || ok {
+				ids[row.ID] = struct{}{}
+			}
+		}
+		matches = ids
+		if len(matches) == 0 {
+			return nil, nil
+		}
+	}
+
+	results := make([]string, 0, len(matches))
+	for id := range matches {
+		results = append(results, id)
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+func fileTerms(doc *vfs.FileDoc) []string {
+	texts := []string{doc.DocName}
+	texts = append(texts, doc.Tags...)
+	for _, v := range doc.Metadata {
+		texts = append(texts, metadataText(v))
+	}
+	return Tokenize(strings.Join(texts, " "))
+}
+
+func metadataText(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		texts := make([]string, 0, len(v))
+		for _, value := range v {
+			texts = append(texts, metadataText(value))
+		}
+		return strings.Join(texts, " ")
+	case []interface{}:
+		texts := make([]string, len(v))
+		for i, value := range v {
+			texts[i] = metadataText(value)
+		}
+		return strings.Join(texts, " ")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,38 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{}, Tokenize(""))
+	assert.Equal(t, []string{"hello", "world"}, Tokenize("Hello, world! HELLO"))
+	assert.Equal(t, []string{"report", "2017", "pdf"}, Tokenize("report_2017.pdf"))
+	assert.Equal(t, []string{"café", "déjà", "vu"}, Tokenize("Café (déjà-vu)"))
+
+	long := strings.Repeat("a", maxTermLength+1)
+	assert.Equal(t, []string{"short"}, Tokenize(long+" short"))
+}
+
+func TestFileTerms(t *testing.T) {
+	doc := &vfs.FileDoc{
+		DocName: "Holidays.jpg",
+		Tags:    []string{"summer", "family"},
+		Metadata: vfs.Metadata{
+			"gps": map[string]interface{}{"city": "Paris"},
+			"people": []interface{}{
+				"Alice",
+				nil,
+			},
+		},
+	}
+	terms := fileTerms(doc)
+	for _, term := range []string{"holidays", "jpg", "summer", "family", "paris", "alice"} {
+		assert.Contains(t, terms, term)
+	}
+	assert.Len(t, terms, 6)
+}
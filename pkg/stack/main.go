@@ -25,12 +25,17 @@ security features. Please do not use this binary as your production server.
 `)
 	}
 
-	// Init the main global connection to the swift server
+	// Init the main global connection to the swift or S3 server
 	fsURL := config.FsURL()
-	if fsURL.Scheme == config.SchemeSwift {
+	switch fsURL.Scheme {
+	case config.SchemeSwift:
 		if err := config.InitSwiftConnection(fsURL); err != nil {
 			return err
 		}
+	case config.SchemeS3:
+		if err := config.InitS3Connection(fsURL); err != nil {
+			return err
+		}
 	}
 	return startJobSystem()
 }
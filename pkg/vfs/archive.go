@@ -1,26 +1,49 @@
 package vfs
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
+	"crypto/md5" // #nosec
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 )
 
-// ZipMime is the content-type for zip archives
-const ZipMime = "application/zip"
+// The formats of the archives that can be downloaded
+const (
+	ZipArchive   = "zip"
+	TarArchive   = "tar"
+	TarGzArchive = "tar.gz"
+)
+
+// The content-types of the archives
+const (
+	ZipMime   = "application/zip"
+	TarMime   = "application/x-tar"
+	TarGzMime = "application/gzip"
+)
 
-// Archive is the data to create a zip archive
+// Archive is the data to create a zip, tar or tar.gz archive
 type Archive struct {
 	Name   string   `json:"name"`
 	Secret string   `json:"-"`
 	Files  []string `json:"files"`
+	// Format is the format of the archive: zip (by default), tar or tar.gz
+	Format string `json:"format,omitempty"`
+	// Resumable is true to store the entries of a zip archive without
+	// compression, so that the size of the archive is known in advance and
+	// it can be downloaded partially, to resume a download. The tar archives
+	// are always resumable, and the tar.gz archives never are.
+	Resumable bool `json:"resumable,omitempty"`
 
 	// archiveEntries cache
 	entries []ArchiveEntry
@@ -83,23 +106,48 @@ func (a *Archive) GetEntries(fs VFS) ([]ArchiveEntry, error) {
 	return a.entries, nil
 }
 
-// Serve creates on the fly the zip archive and streams in a http response
-func (a *Archive) Serve(fs VFS, w http.ResponseWriter) error {
-	header := w.Header()
-	header.Set("Content-Type", ZipMime)
-	header.Set("Content-Disposition", ContentDisposition("attachment", a.Name+".zip"))
+// IsValidFormat returns true if the format of the archive is supported.
+func (a *Archive) IsValidFormat() bool {
+	switch a.Format {
+	case "", ZipArchive, TarArchive, TarGzArchive:
+		return true
+	}
+	return false
+}
 
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+// Extension returns the extension of the file name of the archive.
+func (a *Archive) Extension() string {
+	switch a.Format {
+	case TarArchive:
+		return ".tar"
+	case TarGzArchive:
+		return ".tar.gz"
+	}
+	return ".zip"
+}
 
+func (a *Archive) mime() string {
+	switch a.Format {
+	case TarArchive:
+		return TarMime
+	case TarGzArchive:
+		return TarGzMime
+	}
+	return ZipMime
+}
+
+// archiveFiles returns the files to put in the archive, with their names in
+// the archive.
+func (a *Archive) archiveFiles(fs VFS) ([]*archiveFile, error) {
 	entries, err := a.GetEntries(fs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var files []*archiveFile
 	for _, entry := range entries {
 		base := filepath.Dir(entry.root)
-		walk(fs, entry.root, entry.Dir, entry.File, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		err = walk(fs, entry.root, entry.Dir, entry.File, func(name string, dir *DirDoc, file *FileDoc, err error) error {
 			if err != nil {
 				return err
 			}
@@ -110,23 +158,117 @@ func (a *Archive) Serve(fs VFS, w http.ResponseWriter) error {
 			if err != nil {
 				return fmt.Errorf("Invalid filepath <%s>: %s", name, err)
 			}
-			ze, err := zw.Create(a.Name + "/" + name)
-			if err != nil {
-				return fmt.Errorf("Can't create zip entry <%s>: %s", name, err)
-			}
-			f, err := fs.OpenFile(file)
-			if err != nil {
-				return fmt.Errorf("Can't open file <%s>: %s", name, err)
-			}
-			defer f.Close()
-			_, err = io.Copy(ze, f)
-			return err
+			files = append(files, &archiveFile{name: a.Name + "/" + name, doc: file})
+			return nil
 		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// etag returns an ETag for the archive, that changes when a file of the
+// archive is modified. It is used to resume a download only if the content
+// of the archive is still the same.
+func (a *Archive) etag(files []*archiveFile) string {
+	h := md5.New() // #nosec
+	fmt.Fprintf(h, "%s\n%s\n%t\n", a.Name, a.Format, a.Resumable)
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\n%s\n%s\n", file.name, file.doc.ID(), file.doc.Rev())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// Serve creates on the fly the archive and streams it in a http response.
+// The entries of the zip archives are compressed, unless the archive is
+// resumable. The size of the resumable zip archives and of the tar archives
+// is computed in advance, and these archives can be downloaded partially with
+// a Range request, to resume a download.
+func (a *Archive) Serve(fs VFS, w http.ResponseWriter, req *http.Request) error {
+	files, err := a.archiveFiles(fs)
+	if err != nil {
+		return err
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", a.mime())
+	header.Set("Content-Disposition", ContentDisposition("attachment", a.Name+a.Extension()))
+
+	if a.Format == TarGzArchive {
+		return serveTarGz(fs, w, files)
+	}
+	if !a.Resumable && a.Format != TarArchive {
+		return serveZipDeflate(fs, w, files)
 	}
 
+	var r *archiveReader
+	if a.Format == TarArchive {
+		r, err = newTarReader(fs, files)
+		if err != nil {
+			return err
+		}
+	} else {
+		r = newZipReader(fs, files)
+	}
+	defer r.Close()
+	header.Set("Etag", a.etag(files))
+	http.ServeContent(w, req, "", time.Time{}, r)
 	return nil
 }
 
+// serveZipDeflate streams a zip archive with compressed entries.
+func serveZipDeflate(fs VFS, w io.Writer, files []*archiveFile) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		fh := &zip.FileHeader{
+			Name:   file.name,
+			Method: zip.Deflate,
+		}
+		fh.SetModTime(file.doc.UpdatedAt)
+		fh.SetMode(file.doc.Mode())
+		ze, err := zw.CreateHeader(fh)
+		if err != nil {
+			return fmt.Errorf("Can't create zip entry <%s>: %s", file.name, err)
+		}
+		if err = copyArchiveFile(fs, ze, file); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// serveTarGz streams a tar.gz archive.
+func serveTarGz(fs VFS, w io.Writer, files []*archiveFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		if err := tw.WriteHeader(tarFileHeader(file)); err != nil {
+			return fmt.Errorf("Can't create tar entry <%s>: %s", file.name, err)
+		}
+		if err := copyArchiveFile(fs, tw, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func copyArchiveFile(fs VFS, w io.Writer, file *archiveFile) error {
+	f, err := fs.OpenFile(file.doc)
+	if err != nil {
+		return fmt.Errorf("Can't open file <%s>: %s", file.name, err)
+	}
+	defer f.Close()
+	n, err := io.Copy(w, io.LimitReader(f, file.doc.ByteSize))
+	if err == nil && n != file.doc.ByteSize {
+		err = errArchiveContent
+	}
+	return err
+}
+
 // ID makes Archive a jsonapi.Object
 func (a *Archive) ID() string { return a.Secret }
 
@@ -0,0 +1,514 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// archiveFile is a file put in an archive, with its name in the archive.
+type archiveFile struct {
+	name string
+	doc  *FileDoc
+
+	// the checksum of the content, for the zip archives
+	crc    uint32
+	hasCRC bool
+}
+
+// archivePart is a part of the bytes of an archive: some fixed bytes, some
+// bytes built only when they are read, or the content of a file.
+type archivePart struct {
+	size  int64
+	data  []byte
+	build func() ([]byte, error)
+	file  *archiveFile
+}
+
+// archiveReader reads an archive whose layout has been computed in advance.
+// It can seek in the archive, so it can be used to serve a part of the
+// archive, and only the files in this part are read.
+type archiveReader struct {
+	fs      VFS
+	parts   []*archivePart
+	offsets []int64
+	size    int64
+	pos     int64
+
+	// the file currently opened, and the checksum of its content if it has
+	// been read from its start
+	cur  *archivePart
+	f    File
+	fpos int64
+	crc  hash.Hash32
+}
+
+var errArchiveContent = errors.New("The content of a file doesn't match its size")
+
+func newArchiveReader(fs VFS, parts []*archivePart) *archiveReader {
+	r := &archiveReader{
+		fs:      fs,
+		parts:   parts,
+		offsets: make([]int64, len(parts)),
+	}
+	for i, part := range parts {
+		r.offsets[i] = r.size
+		r.size += part.size
+	}
+	return r
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.parts), func(i int) bool {
+		return r.offsets[i]+r.parts[i].size > r.pos
+	})
+	part := r.parts[i]
+	off := r.pos - r.offsets[i]
+	if rest := part.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	var n int
+	var err error
+	switch {
+	case part.file != nil:
+		n, err = r.readFile(part, p, off)
+	case part.data == nil && part.build != nil:
+		if part.data, err = part.build(); err == nil && int64(len(part.data)) != part.size {
+			err = errArchiveContent
+		}
+		if err == nil {
+			n = copy(p, part.data[off:])
+		}
+	default:
+		n = copy(p, part.data[off:])
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *archiveReader) readFile(part *archivePart, p []byte, off int64) (int, error) {
+	if r.cur != part || r.fpos != off {
+		r.closeFile()
+		f, err := r.fs.OpenFile(part.file.doc)
+		if err != nil {
+			return 0, err
+		}
+		r.cur, r.f, r.fpos = part, f, off
+		if off == 0 {
+			r.crc = crc32.NewIEEE()
+		} else if _, err = f.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(r.f, p)
+	r.fpos += int64(n)
+	if r.crc != nil {
+		r.crc.Write(p[:n]) // #nosec
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errArchiveContent
+	}
+	if err != nil {
+		r.closeFile()
+		return n, err
+	}
+	if r.fpos == part.size {
+		if r.crc != nil {
+			part.file.setChecksum(r.crc.Sum32())
+		}
+		r.closeFile()
+	}
+	return n, nil
+}
+
+func (r *archiveReader) closeFile() {
+	if r.f != nil {
+		r.f.Close() // #nosec
+	}
+	r.cur, r.f, r.fpos, r.crc = nil, nil, 0, nil
+}
+
+// checksum returns the checksum of the content of a file. If the file has
+// not been read from its start, and its checksum is not in the store, it is
+// read to compute the checksum.
+func (r *archiveReader) checksum(file *archiveFile) (uint32, error) {
+	if file.hasCRC {
+		return file.crc, nil
+	}
+	if len(file.doc.MD5Sum) > 0 {
+		crc, ok, err := GetStore().GetChecksum(file.doc.MD5Sum, file.doc.ByteSize)
+		if err == nil && ok {
+			file.crc, file.hasCRC = crc, true
+			return crc, nil
+		}
+	}
+	h := crc32.NewIEEE()
+	if file.doc.ByteSize > 0 {
+		f, err := r.fs.OpenFile(file.doc)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		n, err := io.Copy(h, io.LimitReader(f, file.doc.ByteSize))
+		if err != nil {
+			return 0, err
+		}
+		if n != file.doc.ByteSize {
+			return 0, errArchiveContent
+		}
+	}
+	file.setChecksum(h.Sum32())
+	return file.crc, nil
+}
+
+// setChecksum sets the checksum of the content of a file, and keeps it in the
+// store for the next downloads of an archive with this file.
+func (file *archiveFile) setChecksum(crc uint32) {
+	file.crc, file.hasCRC = crc, true
+	if len(file.doc.MD5Sum) > 0 {
+		GetStore().AddChecksum(file.doc.MD5Sum, file.doc.ByteSize, crc) // #nosec
+	}
+}
+
+func (r *archiveReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek: invalid offset")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *archiveReader) Close() error {
+	r.closeFile()
+	return nil
+}
+
+// Constants of the zip format, see
+// https://pkware.cachefly.net/webdocs/casestudies/APPNOTE.TXT
+const (
+	zipLocalHeaderSig   = 0x04034b50
+	zipCentralHeaderSig = 0x02014b50
+	zipEndSig           = 0x06054b50
+	zip64EndSig         = 0x06064b50
+	zip64LocatorSig     = 0x07064b50
+	zipDescriptorSig    = 0x08074b50
+	zipLocalHeaderLen   = 30
+	zipCentralHeaderLen = 46
+	zipEndLen           = 22
+	zip64EndLen         = 56
+	zip64LocatorLen     = 20
+	zipDescriptorLen    = 16
+	zip64DescriptorLen  = 24
+	zip64ExtraLen       = 28
+	zipVersion20        = 20
+	zipVersion45        = 45
+	zipCreatorUnix      = 3
+	zipFlagDescriptor   = 0x8
+	zipFlagUTF8         = 0x800
+	zipMaxUint16        = 1<<16 - 1
+	zipMaxUint32        = 1<<32 - 1
+	zip64ExtraID        = 0x0001
+	unixRegularFile     = 0100000
+)
+
+// zipEntry is the position of a file in a zip archive.
+type zipEntry struct {
+	file   *archiveFile
+	offset int64
+	zip64  bool
+}
+
+// newZipReader computes the layout of a zip archive whose entries are stored
+// without compression. The checksums of the files are written after their
+// content, in a data descriptor, so they are computed while the files are
+// read. The zip64 extensions are used for the files and archives larger than
+// 4GB.
+func newZipReader(fs VFS, files []*archiveFile) *archiveReader {
+	var parts []*archivePart
+	var r *archiveReader
+	entries := make([]*zipEntry, len(files))
+	var offset int64
+	for i, file := range files {
+		size := file.doc.ByteSize
+		entry := &zipEntry{
+			file:   file,
+			offset: offset,
+			zip64:  size >= zipMaxUint32,
+		}
+		entries[i] = entry
+		header := zipLocalHeader(entry)
+		descriptorLen := zipDescriptorLen
+		if entry.zip64 {
+			descriptorLen = zip64DescriptorLen
+		}
+		parts = append(parts,
+			&archivePart{size: int64(len(header)), data: header},
+			&archivePart{size: size, file: file},
+			&archivePart{size: int64(descriptorLen), build: func() ([]byte, error) {
+				crc, err := r.checksum(entry.file)
+				if err != nil {
+					return nil, err
+				}
+				return zipDescriptor(entry, crc), nil
+			}},
+		)
+		offset += int64(len(header)) + size + int64(descriptorLen)
+	}
+
+	var directoryLen int64
+	for _, entry := range entries {
+		directoryLen += int64(zipCentralHeaderLen + len(entry.file.name))
+		if entry.zip64 || entry.offset >= zipMaxUint32 {
+			directoryLen += zip64ExtraLen
+		}
+	}
+	directoryOffset := offset
+	zip64 := len(entries) >= zipMaxUint16 ||
+		directoryLen >= zipMaxUint32 || directoryOffset >= zipMaxUint32
+	endLen := int64(zipEndLen)
+	if zip64 {
+		endLen += zip64EndLen + zip64LocatorLen
+	}
+	parts = append(parts, &archivePart{size: directoryLen + endLen, build: func() ([]byte, error) {
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			crc, err := r.checksum(entry.file)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(zipCentralHeader(entry, crc))
+		}
+		buf.Write(zipEnd(len(entries), directoryLen, directoryOffset, zip64))
+		return buf.Bytes(), nil
+	}})
+
+	r = newArchiveReader(fs, parts)
+	return r
+}
+
+// zipWriter is a little helper to write the little-endian fields of the zip
+// records.
+type zipWriter []byte
+
+func (b *zipWriter) uint16(v uint16) {
+	*b = append(*b, byte(v), byte(v>>8))
+}
+
+func (b *zipWriter) uint32(v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	*b = append(*b, buf[:]...)
+}
+
+func (b *zipWriter) uint64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	*b = append(*b, buf[:]...)
+}
+
+func (b *zipWriter) bytes(v []byte) {
+	*b = append(*b, v...)
+}
+
+func zipLocalHeader(entry *zipEntry) []byte {
+	version := uint16(zipVersion20)
+	if entry.zip64 {
+		version = zipVersion45
+	}
+	date, tim := zipTime(entry.file.doc.UpdatedAt)
+	b := make(zipWriter, 0, zipLocalHeaderLen+len(entry.file.name))
+	b.uint32(zipLocalHeaderSig)
+	b.uint16(version)
+	b.uint16(zipFlagDescriptor | zipFlagUTF8)
+	b.uint16(0) // method: stored
+	b.uint16(tim)
+	b.uint16(date)
+	// The checksum and the sizes are in the data descriptor
+	b.uint32(0)
+	b.uint32(0)
+	b.uint32(0)
+	b.uint16(uint16(len(entry.file.name)))
+	b.uint16(0) // extra length
+	b.bytes([]byte(entry.file.name))
+	return b
+}
+
+func zipDescriptor(entry *zipEntry, crc uint32) []byte {
+	size := entry.file.doc.ByteSize
+	b := make(zipWriter, 0, zip64DescriptorLen)
+	b.uint32(zipDescriptorSig)
+	b.uint32(crc)
+	if entry.zip64 {
+		b.uint64(uint64(size))
+		b.uint64(uint64(size))
+	} else {
+		b.uint32(uint32(size))
+		b.uint32(uint32(size))
+	}
+	return b
+}
+
+func zipCentralHeader(entry *zipEntry, crc uint32) []byte {
+	doc := entry.file.doc
+	size := doc.ByteSize
+	withExtra := entry.zip64 || entry.offset >= zipMaxUint32
+	version := uint16(zipVersion20)
+	if withExtra {
+		version = zipVersion45
+	}
+	date, tim := zipTime(doc.UpdatedAt)
+	b := make(zipWriter, 0, zipCentralHeaderLen+len(entry.file.name)+zip64ExtraLen)
+	b.uint32(zipCentralHeaderSig)
+	b.uint16(zipCreatorUnix<<8 | version)
+	b.uint16(version)
+	b.uint16(zipFlagDescriptor | zipFlagUTF8)
+	b.uint16(0) // method: stored
+	b.uint16(tim)
+	b.uint16(date)
+	b.uint32(crc)
+	if withExtra {
+		b.uint32(zipMaxUint32)
+		b.uint32(zipMaxUint32)
+	} else {
+		b.uint32(uint32(size))
+		b.uint32(uint32(size))
+	}
+	b.uint16(uint16(len(entry.file.name)))
+	if withExtra {
+		b.uint16(zip64ExtraLen)
+	} else {
+		b.uint16(0)
+	}
+	b.uint16(0) // comment length
+	b.uint16(0) // disk number
+	b.uint16(0) // internal attributes
+	b.uint32((unixRegularFile | uint32(doc.Mode().Perm())) << 16)
+	if entry.offset >= zipMaxUint32 {
+		b.uint32(zipMaxUint32)
+	} else {
+		b.uint32(uint32(entry.offset))
+	}
+	b.bytes([]byte(entry.file.name))
+	if withExtra {
+		b.uint16(zip64ExtraID)
+		b.uint16(zip64ExtraLen - 4)
+		b.uint64(uint64(size))
+		b.uint64(uint64(size))
+		b.uint64(uint64(entry.offset))
+	}
+	return b
+}
+
+func zipEnd(count int, directoryLen, directoryOffset int64, zip64 bool) []byte {
+	b := make(zipWriter, 0, zip64EndLen+zip64LocatorLen+zipEndLen)
+	if zip64 {
+		b.uint32(zip64EndSig)
+		b.uint64(zip64EndLen - 12) // size of the remaining record
+		b.uint16(zipCreatorUnix<<8 | zipVersion45)
+		b.uint16(zipVersion45)
+		b.uint32(0) // number of this disk
+		b.uint32(0) // disk with the central directory
+		b.uint64(uint64(count))
+		b.uint64(uint64(count))
+		b.uint64(uint64(directoryLen))
+		b.uint64(uint64(directoryOffset))
+
+		b.uint32(zip64LocatorSig)
+		b.uint32(0) // disk with the zip64 end record
+		b.uint64(uint64(directoryOffset + directoryLen))
+		b.uint32(1) // total number of disks
+
+		// The values are in the zip64 record
+		count = zipMaxUint16
+		directoryLen = zipMaxUint32
+		directoryOffset = zipMaxUint32
+	}
+	b.uint32(zipEndSig)
+	b.uint16(0) // number of this disk
+	b.uint16(0) // disk with the central directory
+	b.uint16(uint16(count))
+	b.uint16(uint16(count))
+	b.uint32(uint32(directoryLen))
+	b.uint32(uint32(directoryOffset))
+	b.uint16(0) // comment length
+	return b
+}
+
+// zipTime returns the MS-DOS date and time of t. The zip format has no time
+// zone, so the time is given in UTC.
+func zipTime(t time.Time) (date, tim uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tim = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return
+}
+
+// tarBlockSize is the size of the blocks of a tar archive.
+const tarBlockSize = 512
+
+// newTarReader computes the layout of a tar archive.
+func newTarReader(fs VFS, files []*archiveFile) (*archiveReader, error) {
+	var parts []*archivePart
+	for _, file := range files {
+		header, err := tarHeader(file)
+		if err != nil {
+			return nil, err
+		}
+		size := file.doc.ByteSize
+		parts = append(parts,
+			&archivePart{size: int64(len(header)), data: header},
+			&archivePart{size: size, file: file},
+		)
+		if pad := (tarBlockSize - size%tarBlockSize) % tarBlockSize; pad > 0 {
+			parts = append(parts, &archivePart{size: pad, data: make([]byte, pad)})
+		}
+	}
+	// The end of the archive is marked by two empty blocks
+	parts = append(parts, &archivePart{size: 2 * tarBlockSize, data: make([]byte, 2*tarBlockSize)})
+	return newArchiveReader(fs, parts), nil
+}
+
+// tarHeader returns the bytes of the header of a file in a tar archive.
+func tarHeader(file *archiveFile) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(tarFileHeader(file)); err != nil {
+		return nil, err
+	}
+	// The writer is not closed, as it would complain that the content of the
+	// file is missing, but the header has been written.
+	return buf.Bytes(), nil
+}
+
+func tarFileHeader(file *archiveFile) *tar.Header {
+	return &tar.Header{
+		Name:     file.name,
+		Mode:     int64(file.doc.Mode()),
+		Size:     file.doc.ByteSize,
+		ModTime:  file.doc.UpdatedAt,
+		Typeflag: tar.TypeReg,
+	}
+}
@@ -0,0 +1,69 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// BlobsDirName is the path of the directory where the contents shared by
+// several files are stored, when the deduplication is enabled
+const BlobsDirName = "/.cozy_blobs"
+
+// Blob is the document used to count the references to a content stored only
+// once for several files and versions of an instance. Its identifier is the
+// hexadecimal sha256 of the content.
+type Blob struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	ByteSize int64 `json:"size,string"`
+	Refs     int   `json:"refs"`
+
+	// ReleasedAt is set when the last reference has been removed, while the
+	// content is being removed.
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+}
+
+// ID returns the blob qualified identifier
+func (b *Blob) ID() string { return b.DocID }
+
+// Rev returns the blob revision
+func (b *Blob) Rev() string { return b.DocRev }
+
+// DocType returns the blob document type
+func (b *Blob) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *Blob) Clone() couchdb.Doc {
+	cloned := *b
+	if b.ReleasedAt != nil {
+		releasedAt := *b.ReleasedAt
+		cloned.ReleasedAt = &releasedAt
+	}
+	return &cloned
+}
+
+// SetID changes the blob qualified identifier
+func (b *Blob) SetID(id string) { b.DocID = id }
+
+// SetRev changes the blob revision
+func (b *Blob) SetRev(rev string) { b.DocRev = rev }
+
+// NewBlobHash returns the hash used to compute the identifier of a blob from
+// its content.
+func NewBlobHash() hash.Hash {
+	return sha256.New()
+}
+
+// BlobIDFromSum returns the identifier of a blob from the sum of its blob
+// hash.
+func BlobIDFromSum(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+var _ couchdb.Doc = &Blob{}
@@ -0,0 +1,138 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+)
+
+// CopyFile duplicates a file in the given directory. If the name is empty,
+// the name of the original file is used. If a file with the same name already
+// exists in the directory, a suffix is added to the name of the copy.
+func CopyFile(fs VFS, olddoc *FileDoc, parent *DirDoc, name string) (*FileDoc, error) {
+	if name == "" {
+		name = olddoc.DocName
+	}
+
+	var newdoc *FileDoc
+	var err error
+	tryOrUseSuffix(name, conflictFormat, func(name string) error {
+		newdoc, err = newCopyFileDoc(olddoc, parent, name)
+		if err != nil {
+			return err
+		}
+		err = fs.CopyFile(olddoc, newdoc)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// CopyDir duplicates a directory and its content in the given directory. If
+// the name is empty, the name of the original directory is used. If a
+// directory with the same name already exists in the parent, a suffix is
+// added to the name of the copy.
+func CopyDir(fs VFS, olddoc *DirDoc, parent *DirDoc, name string) (*DirDoc, error) {
+	if name == "" {
+		name = olddoc.DocName
+	}
+	if parent.Fullpath == olddoc.Fullpath ||
+		strings.HasPrefix(parent.Fullpath, olddoc.Fullpath+"/") {
+		return nil, ErrForbiddenDocCopy
+	}
+
+	// The quota is checked before copying anything, to avoid leaving a
+	// partial copy of the directory.
+	if quota := fs.DiskQuota(); quota > 0 {
+		size, err := dirSize(fs, olddoc)
+		if err != nil {
+			return nil, err
+		}
+		used, err := fs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if used+size > quota {
+			return nil, ErrFileTooBig
+		}
+	}
+
+	var newdoc *DirDoc
+	var err error
+	tryOrUseSuffix(name, conflictFormat, func(name string) error {
+		newdoc, err = NewDirDocWithParent(name, parent, olddoc.Tags)
+		if err != nil {
+			return err
+		}
+		err = fs.CreateDir(newdoc)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = copyDirContent(fs, olddoc, newdoc); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+func copyDirContent(fs VFS, olddoc, newdoc *DirDoc) error {
+	iter := fs.DirIterator(olddoc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			var dir *DirDoc
+			dir, err = NewDirDocWithParent(d.DocName, newdoc, d.Tags)
+			if err != nil {
+				return err
+			}
+			if err = fs.CreateDir(dir); err != nil {
+				return err
+			}
+			err = copyDirContent(fs, d, dir)
+		} else {
+			var file *FileDoc
+			file, err = newCopyFileDoc(f, newdoc, f.DocName)
+			if err != nil {
+				return err
+			}
+			err = fs.CopyFile(f, file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func newCopyFileDoc(olddoc *FileDoc, parent *DirDoc, name string) (*FileDoc, error) {
+	newdoc, err := NewFileDoc(name, parent.ID(), olddoc.ByteSize, olddoc.MD5Sum,
+		olddoc.Mime, olddoc.Class, time.Now(), olddoc.Executable, false, olddoc.Tags)
+	if err != nil {
+		return nil, err
+	}
+	newdoc.SHA256Sum = olddoc.SHA256Sum
+	newdoc.Metadata = olddoc.Metadata
+	return newdoc, nil
+}
+
+// dirSize returns the total size of the files inside a directory.
+func dirSize(fs VFS, doc *DirDoc) (int64, error) {
+	var size int64
+	err := Walk(fs, doc.Fullpath, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			size += file.ByteSize
+		}
+		return nil
+	})
+	return size, err
+}
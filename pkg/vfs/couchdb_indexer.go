@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -50,8 +51,25 @@ func (c *couchdbIndexer) InitIndex() error {
 }
 
 func (c *couchdbIndexer) DiskUsage() (int64, error) {
+	used, err := c.sumView(consts.DiskUsageView)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := c.sumView(consts.VersionsDiskUsageView)
+	// the database of the versions is only created when the first version is
+	// kept.
+	if couchdb.IsNoDatabaseError(err) || couchdb.IsNotFoundError(err) {
+		return used, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return used + versions, nil
+}
+
+func (c *couchdbIndexer) sumView(view *couchdb.View) (int64, error) {
 	var doc couchdb.ViewResponse
-	err := couchdb.ExecView(c.db, consts.DiskUsageView, &couchdb.ViewRequest{
+	err := couchdb.ExecView(c.db, view, &couchdb.ViewRequest{
 		Reduce: true,
 	}, &doc)
 	if err != nil {
@@ -60,7 +78,7 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	if len(doc.Rows) == 0 {
 		return 0, nil
 	}
-	// Reduce of _count should give us a number value
+	// Reduce of _sum should give us a number value
 	f64, ok := doc.Rows[0].Value.(float64)
 	if !ok {
 		return 0, ErrWrongCouchdbState
@@ -79,10 +97,29 @@ func (c *couchdbIndexer) CreateNamedFileDoc(doc *FileDoc) error {
 func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
+	if newdoc.DirID != olddoc.DirID {
+		newdoc.MovedFrom = &MovedFrom{DirID: olddoc.DirID}
+		if oldpath, err := c.filePath(olddoc); err == nil {
+			newdoc.MovedFrom.Path = oldpath
+		}
+	}
 	return couchdb.UpdateDoc(c.db, newdoc)
 }
 
-func (c *couchdbIndexer) UpdateFileDocs(docs []*FileDoc) error {
+// filePath returns the path of a file, from the path of its parent directory
+// if it is not already known.
+func (c *couchdbIndexer) filePath(doc *FileDoc) (string, error) {
+	if doc.fullpath != "" {
+		return doc.fullpath, nil
+	}
+	parent, err := c.DirByID(doc.DirID)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(parent.Fullpath, doc.DocName), nil
+}
+
+func (c *couchdbIndexer) UpdateFileDocs(docs, olddocs []*FileDoc) error {
 	if len(docs) == 0 {
 		return nil
 	}
@@ -90,7 +127,14 @@ func (c *couchdbIndexer) UpdateFileDocs(docs []*FileDoc) error {
 	for i, doc := range docs {
 		couchdocs[i] = doc
 	}
-	return couchdb.BulkUpdateDoc(c.db, couchdocs)
+	var oldcouchdocs []couchdb.Doc
+	if olddocs != nil {
+		oldcouchdocs = make([]couchdb.Doc, len(olddocs))
+		for i, doc := range olddocs {
+			oldcouchdocs[i] = doc
+		}
+	}
+	return couchdb.BulkUpdateDoc(c.db, couchdocs, oldcouchdocs)
 }
 
 func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
@@ -108,6 +152,9 @@ func (c *couchdbIndexer) CreateNamedDirDoc(doc *DirDoc) error {
 func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
+	if newdoc.DirID != olddoc.DirID {
+		newdoc.MovedFrom = &MovedFrom{DirID: olddoc.DirID, Path: olddoc.Fullpath}
+	}
 	if newdoc.Fullpath != olddoc.Fullpath {
 		if err := c.moveDir(olddoc.Fullpath, newdoc.Fullpath); err != nil {
 			return err
@@ -140,6 +187,7 @@ func (c *couchdbIndexer) moveDir(oldpath, newpath string) error {
 			if !strings.HasPrefix(child.Fullpath, oldpath+"/") {
 				errc <- fmt.Errorf("Child has wrong base directory")
 			} else {
+				child.MovedFrom = &MovedFrom{DirID: child.DirID, Path: child.Fullpath}
 				child.Fullpath = path.Join(newpath, child.Fullpath[len(oldpath)+1:])
 				errc <- couchdb.UpdateDoc(c.db, child)
 			}
@@ -343,3 +391,389 @@ func (c *couchdbIndexer) DirLength(doc *DirDoc) (int, error) {
 	}
 	return int(f64), nil
 }
+
+// dirStatsBatchSize is the number of directories fetched or given as keys of
+// the view by request when computing the statistics of a directory.
+const dirStatsBatchSize = 1000
+
+func (c *couchdbIndexer) DirStats(doc *DirDoc) (*DirStats, error) {
+	ids, err := c.subDirIDs(doc)
+	if err != nil {
+		return nil, err
+	}
+	stats := &DirStats{DirsCount: int64(len(ids))}
+	ids = append(ids, doc.ID())
+
+	var updatedAt string
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > dirStatsBatchSize {
+			n = dirStatsBatchSize
+		}
+		keys := make([]interface{}, n)
+		for i, id := range ids[:n] {
+			keys[i] = id
+		}
+		ids = ids[n:]
+
+		var res couchdb.ViewResponse
+		err = couchdb.ExecView(c.db, consts.DirStatsView, &couchdb.ViewRequest{
+			Keys:   keys,
+			Reduce: true,
+			Group:  true,
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range res.Rows {
+			// The reduce function gives [size, count, updated_at]
+			values, ok := row.Value.([]interface{})
+			if !ok || len(values) != 3 {
+				return nil, ErrWrongCouchdbState
+			}
+			size, _ := values[0].(float64)
+			count, _ := values[1].(float64)
+			stats.Size += int64(size)
+			stats.FilesCount += int64(count)
+			if updated, _ := values[2].(string); updated > updatedAt {
+				updatedAt = updated
+			}
+		}
+	}
+
+	if updatedAt != "" {
+		stats.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+	}
+	if stats.UpdatedAt.IsZero() {
+		stats.UpdatedAt = doc.UpdatedAt
+	}
+	return stats, nil
+}
+
+// subDirIDs returns the identifiers of all the sub-directories of the given
+// directory, by batches on the dir-by-path index.
+func (c *couchdbIndexer) subDirIDs(doc *DirDoc) ([]string, error) {
+	prefix := doc.Fullpath + "/"
+	if doc.ID() == consts.RootDirID {
+		prefix = "/"
+	}
+	var ids []string
+	var sel mango.Filter = mango.StartWith("path", prefix)
+	for {
+		var children []*DirDoc
+		req := &couchdb.FindRequest{
+			UseIndex: "dir-by-path",
+			Selector: sel,
+			Fields:   []string{"_id", "path"},
+			Limit:    dirStatsBatchSize,
+		}
+		if err := couchdb.FindDocs(c.db, consts.Files, req, &children); err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if child.DocID != doc.ID() {
+				ids = append(ids, child.DocID)
+			}
+		}
+		if len(children) < dirStatsBatchSize {
+			return ids, nil
+		}
+		// The documents are sorted by path on the index
+		last := children[len(children)-1].Fullpath
+		sel = mango.And(
+			mango.Gt("path", last),
+			mango.Lt("path", prefix+mango.MaxString),
+		)
+	}
+}
+
+// allDocsPageSize is the number of documents fetched by each request when
+// all the directories and files are listed.
+const allDocsPageSize = 1000
+
+func (c *couchdbIndexer) AllDirsAndFiles() ([]*DirDoc, []*FileDoc, error) {
+	var dirs []*DirDoc
+	var files []*FileDoc
+	req := &couchdb.AllDocsRequest{Limit: allDocsPageSize}
+	for {
+		var docs []*DirOrFileDoc
+		if err := couchdb.GetAllDocs(c.db, consts.Files, req, &docs); err != nil {
+			return nil, nil, err
+		}
+		if len(docs) == 0 {
+			return dirs, files, nil
+		}
+		for _, doc := range docs {
+			dir, file := doc.Refine()
+			if dir != nil {
+				dirs = append(dirs, dir)
+			} else if file != nil {
+				files = append(files, file)
+			}
+		}
+		// The next page starts after the last document of this one. The key
+		// is sent as JSON in the query string.
+		startKey, err := json.Marshal(docs[len(docs)-1].ID())
+		if err != nil {
+			return nil, nil, err
+		}
+		req.StartKey = string(startKey)
+		req.Skip = 1
+	}
+}
+
+func (c *couchdbIndexer) CreateVersion(v *Version) error {
+	return couchdb.CreateNamedDocWithDB(c.db, v)
+}
+
+func (c *couchdbIndexer) DeleteVersion(v *Version) error {
+	return couchdb.DeleteDoc(c.db, v)
+}
+
+func (c *couchdbIndexer) VersionByID(id string) (*Version, error) {
+	doc := &Version{}
+	err := couchdb.GetDoc(c.db, consts.FilesVersions, id, doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *couchdbIndexer) VersionsFor(fileID string) ([]*Version, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.VersionsByFileView, &couchdb.ViewRequest{
+		Key:         fileID,
+		IncludeDocs: true,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Version, len(res.Rows))
+	for i, row := range res.Rows {
+		var v Version
+		if err = json.Unmarshal(*row.Doc, &v); err != nil {
+			return nil, err
+		}
+		versions[i] = &v
+	}
+	SortVersions(versions)
+	return versions, nil
+}
+
+func (c *couchdbIndexer) VersionsCreatedBefore(before time.Time) ([]*Version, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.VersionsByCreatedAtView, &couchdb.ViewRequest{
+		EndKey:      before.UTC().Format(time.RFC3339Nano),
+		IncludeDocs: true,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []*Version
+	for _, row := range res.Rows {
+		var v Version
+		if err = json.Unmarshal(*row.Doc, &v); err != nil {
+			return nil, err
+		}
+		// The keys are compared as strings by couchdb, so the date is checked
+		// again to be safe with the variable length of the nanoseconds.
+		if v.CreatedAt.Before(before) {
+			versions = append(versions, &v)
+		}
+	}
+	return versions, nil
+}
+
+func (c *couchdbIndexer) CreateUploadSession(s *UploadSession) error {
+	return couchdb.CreateDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) UpdateUploadSession(s *UploadSession) error {
+	return couchdb.UpdateDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) DeleteUploadSession(s *UploadSession) error {
+	return couchdb.DeleteDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) UploadSessionByID(id string) (*UploadSession, error) {
+	doc := &UploadSession{}
+	err := couchdb.GetDoc(c.db, consts.FilesUploads, id, doc)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *couchdbIndexer) ExpiredUploadSessions(now time.Time) ([]*UploadSession, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.UploadsByExpirationView, &couchdb.ViewRequest{
+		EndKey:      now.UTC().Format(time.RFC3339Nano),
+		IncludeDocs: true,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*UploadSession
+	for _, row := range res.Rows {
+		var s UploadSession
+		if err = json.Unmarshal(*row.Doc, &s); err != nil {
+			return nil, err
+		}
+		// The keys are compared as strings by couchdb, so the date is checked
+		// again to be safe with the variable length of the nanoseconds.
+		if s.Expired(now) {
+			sessions = append(sessions, &s)
+		}
+	}
+	return sessions, nil
+}
+
+func (c *couchdbIndexer) PendingUploadSessions(now time.Time) ([]*UploadSession, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.UploadsByExpirationView, &couchdb.ViewRequest{
+		StartKey:    now.UTC().Format(time.RFC3339Nano),
+		IncludeDocs: true,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*UploadSession
+	for _, row := range res.Rows {
+		var s UploadSession
+		if err = json.Unmarshal(*row.Doc, &s); err != nil {
+			return nil, err
+		}
+		if !s.Expired(now) {
+			sessions = append(sessions, &s)
+		}
+	}
+	return sessions, nil
+}
+
+// blobMaxAttempts is the number of times the document of a blob is fetched
+// and updated again when it has been modified concurrently, before giving up.
+const blobMaxAttempts = 5
+
+// blobReleaseTimeout is the delay after which a blob whose content was being
+// removed can be referenced again, as the removal has been interrupted.
+const blobReleaseTimeout = time.Minute
+
+// blobBackoff waits before the next attempt to update a blob document.
+func blobBackoff(attempt int) {
+	time.Sleep(time.Duration(attempt+1) * 50 * time.Millisecond)
+}
+
+func (c *couchdbIndexer) RefBlob(id string, size int64) (bool, error) {
+	// The document is updated with an optimistic lock: it is fetched again
+	// when it has been modified concurrently.
+	var err error
+	for attempt := 0; attempt < blobMaxAttempts; attempt++ {
+		if attempt > 0 {
+			blobBackoff(attempt)
+		}
+		blob := &Blob{}
+		err = couchdb.GetDoc(c.db, consts.FilesBlobs, id, blob)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			blob = &Blob{DocID: id, ByteSize: size, Refs: 1}
+			err = couchdb.CreateNamedDocWithDB(c.db, blob)
+			if couchdb.IsConflictError(err) {
+				continue
+			}
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+		// The content of a blob without reference is being removed: the new
+		// content can only be stored once the document has been deleted, or
+		// if the removal has been interrupted.
+		created := blob.Refs <= 0
+		if created && blob.ReleasedAt != nil &&
+			time.Since(*blob.ReleasedAt) < blobReleaseTimeout {
+			err = ErrConflict
+			continue
+		}
+		if created {
+			blob.Refs = 0
+			blob.ByteSize = size
+			blob.ReleasedAt = nil
+		}
+		blob.Refs++
+		err = couchdb.UpdateDoc(c.db, blob)
+		if !couchdb.IsConflictError(err) {
+			return created && err == nil, err
+		}
+	}
+	return false, err
+}
+
+func (c *couchdbIndexer) UnrefBlob(id string) (bool, error) {
+	var err error
+	for attempt := 0; attempt < blobMaxAttempts; attempt++ {
+		if attempt > 0 {
+			blobBackoff(attempt)
+		}
+		blob := &Blob{}
+		err = couchdb.GetDoc(c.db, consts.FilesBlobs, id, blob)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if blob.Refs <= 0 {
+			return false, nil
+		}
+		// The document of the last reference is kept until the content has
+		// been removed, so that the blob is not stored again in the meantime.
+		blob.Refs--
+		last := blob.Refs == 0
+		if last {
+			now := time.Now()
+			blob.ReleasedAt = &now
+		}
+		err = couchdb.UpdateDoc(c.db, blob)
+		if !couchdb.IsConflictError(err) {
+			return last && err == nil, err
+		}
+	}
+	return false, err
+}
+
+func (c *couchdbIndexer) DeleteBlob(id string) error {
+	blob := &Blob{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, id, blob)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if blob.Refs > 0 {
+		return nil
+	}
+	err = couchdb.DeleteDoc(c.db, blob)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	return err
+}
@@ -10,6 +10,16 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 )
 
+// DirStats is the recursive statistics of a directory: the total size and
+// number of the files in its tree, the number of its sub-directories, and the
+// date of the last modification of one of its files.
+type DirStats struct {
+	Size       int64     `json:"size,string"`
+	FilesCount int64     `json:"files_count"`
+	DirsCount  int64     `json:"dirs_count"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
 // DirDoc is a struct containing all the informations about a
 // directory. It implements the couchdb.Doc and jsonapi.Object
 // interfaces.
@@ -26,6 +36,8 @@ type DirDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// Date of the move of the directory to the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -35,6 +47,9 @@ type DirDoc struct {
 	Fullpath string `json:"path"`
 
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
+
+	// Previous location of the directory, if it has been moved
+	MovedFrom *MovedFrom `json:"moved_from,omitempty"`
 }
 
 // ID returns the directory qualified identifier
@@ -53,6 +68,10 @@ func (d *DirDoc) Clone() couchdb.Doc {
 	copy(cloned.Tags, d.Tags)
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(d.ReferencedBy))
 	copy(cloned.ReferencedBy, d.ReferencedBy)
+	if d.MovedFrom != nil {
+		moved := *d.MovedFrom
+		cloned.MovedFrom = &moved
+	}
 	return &cloned
 }
 
@@ -151,6 +170,9 @@ func NewDirDocWithParent(name string, parent *DirDoc, tags []string) (*DirDoc, e
 	if err := checkFileName(name); err != nil {
 		return nil, err
 	}
+	if err := checkReservedName(name, parent.DocID == consts.RootDirID); err != nil {
+		return nil, err
+	}
 
 	createDate := time.Now()
 	return &DirDoc{
@@ -171,6 +193,9 @@ func NewDirDocWithPath(name, dirID, dirPath string, tags []string) (*DirDoc, err
 	if err := checkFileName(name); err != nil {
 		return nil, err
 	}
+	if err := checkReservedName(name, dirPath == "/"); err != nil {
+		return nil, err
+	}
 
 	createDate := time.Now()
 	return &DirDoc{
@@ -201,6 +226,7 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 		RestorePath: &olddoc.RestorePath,
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
+		TrashedAt:   olddoc.TrashedAt,
 	}, patch, cdate)
 
 	if err != nil {
@@ -218,6 +244,9 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	if newdoc.RestorePath != "" {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.ReferencedBy = olddoc.ReferencedBy
@@ -240,7 +269,7 @@ func setTrashedForFilesInsideDir(fs VFS, doc *DirDoc, trashed bool) error {
 	if err != nil {
 		return err
 	}
-	return fs.UpdateFileDocs(files)
+	return fs.UpdateFileDocs(files, nil)
 }
 
 // TrashDir is used to delete a directory given its document
@@ -255,6 +284,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now().UTC()
 
 	if err = setTrashedForFilesInsideDir(fs, olddoc, true); err != nil {
 		return nil, err
@@ -266,6 +296,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
 			Name:        &name,
+			TrashedAt:   &trashedAt,
 		})
 		return err
 	})
@@ -3,6 +3,7 @@ package vfs
 import (
 	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,6 +18,11 @@ type DownloadStore interface {
 	AddArchive(domain string, archive *Archive) (string, error)
 	GetFile(domain, key string) (string, error)
 	GetArchive(domain, key string) (*Archive, error)
+	// AddChecksum and GetChecksum keep the CRC-32 checksums of the contents
+	// put in the zip archives, identified by their md5sum and size, so that
+	// the files are not read again when a download is resumed.
+	AddChecksum(md5sum []byte, size int64, crc uint32) error
+	GetChecksum(md5sum []byte, size int64) (uint32, bool, error)
 }
 
 // downloadStoreTTL is the time an Archive stay alive
@@ -26,6 +32,11 @@ var downloadStoreTTL = 1 * time.Hour
 // cleanup.
 var downloadStoreCleanInterval = 1 * time.Hour
 
+// checksumStoreTTL is the time the checksum of a content stay alive. It is
+// longer than the life of an archive, as the same files are often put in
+// several archives.
+var checksumStoreTTL = 24 * time.Hour
+
 var globalStoreMu sync.Mutex
 var globalStore DownloadStore
 
@@ -132,6 +143,32 @@ func (s *memStore) GetArchive(domain, key string) (*Archive, error) {
 	return a, nil
 }
 
+func (s *memStore) AddChecksum(md5sum []byte, size int64, crc uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vals[checksumKey(md5sum, size)] = &memRef{
+		val: crc,
+		exp: time.Now().Add(checksumStoreTTL),
+	}
+	return nil
+}
+
+func (s *memStore) GetChecksum(md5sum []byte, size int64) (uint32, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := checksumKey(md5sum, size)
+	ref, ok := s.vals[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.vals, key)
+		return 0, false, nil
+	}
+	crc, ok := ref.val.(uint32)
+	return crc, ok, nil
+}
+
 type redisStore struct {
 	c *redis.Client
 }
@@ -182,6 +219,27 @@ func (s *redisStore) GetArchive(domain, key string) (*Archive, error) {
 	return arch, nil
 }
 
+func (s *redisStore) AddChecksum(md5sum []byte, size int64, crc uint32) error {
+	return s.c.Set(checksumKey(md5sum, size), int64(crc), checksumStoreTTL).Err()
+}
+
+func (s *redisStore) GetChecksum(md5sum []byte, size int64) (uint32, bool, error) {
+	crc, err := s.c.Get(checksumKey(md5sum, size)).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint32(crc), true, nil
+}
+
+// checksumKey returns the key of the checksum of a content. The checksum
+// depends only on the content, so it is shared by the instances.
+func checksumKey(md5sum []byte, size int64) string {
+	return "crc32:" + hex.EncodeToString(md5sum) + ":" + strconv.FormatInt(size, 10)
+}
+
 func makeSecret() string {
 	return hex.EncodeToString(crypto.GenerateRandomBytes(8))
 }
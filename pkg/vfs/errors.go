@@ -9,14 +9,23 @@ var (
 	// ErrForbiddenDocMove is used when trying to move a document in an
 	// illicit destination
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
+	// ErrForbiddenDocCopy is used when trying to copy a directory inside
+	// itself
+	ErrForbiddenDocCopy = errors.New("Forbidden document copy")
 	// ErrIllegalFilename is used when the given filename is not allowed
 	ErrIllegalFilename = errors.New("Invalid filename: empty or contains an illegal character")
+	// ErrReservedFilename is used when the given filename is reserved for
+	// the internal directories of the stack
+	ErrReservedFilename = errors.New("Invalid filename: reserved for the stack")
 	// ErrIllegalTime is used when a time given (creation or
 	// modification) is not allowed
 	ErrIllegalTime = errors.New("Invalid time given")
 	// ErrInvalidHash is used when the given hash does not match the
 	// calculated one
 	ErrInvalidHash = errors.New("Invalid hash")
+	// ErrInvalidDigest is used when the given sha256 digest does not match
+	// the calculated one
+	ErrInvalidDigest = errors.New("Invalid digest")
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
@@ -40,4 +49,7 @@ var (
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrEncryptionDisabled is used when trying to encrypt the contents of a
+	// filesystem without an encryption key
+	ErrEncryptionDisabled = errors.New("The encryption of the files is not enabled")
 )
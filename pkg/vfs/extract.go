@@ -0,0 +1,369 @@
+package vfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedArchive is used when trying to extract a file that is not a
+// zip or tar archive
+var ErrUnsupportedArchive = errors.New("The file is not a zip or tar archive")
+
+// ExtractProgress is called during the extraction of an archive, with the
+// number of bytes written and the total size of the files in the archive. If
+// it returns an error, the extraction is stopped.
+type ExtractProgress func(done, total int64) error
+
+// archiveFormat is the format of an archive that can be extracted
+type archiveFormat int
+
+const (
+	zipFormat archiveFormat = iota
+	tarFormat
+	tarGzFormat
+)
+
+// extractEntry is a directory or a file listed in an archive.
+type extractEntry struct {
+	name       string
+	dir        bool
+	size       int64
+	modTime    time.Time
+	executable bool
+}
+
+// ExtractArchive unpacks a zip, tar or tar.gz archive in the given directory.
+// The directories and files are created with the modification times from the
+// archive, and a suffix is added to their names when they are in conflict
+// with an existing document. The quota is checked before writing anything.
+func ExtractArchive(fs VFS, doc *FileDoc, dir *DirDoc, progress ExtractProgress) error {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, err := sniffArchive(f)
+	if err != nil {
+		return err
+	}
+
+	var entries []*extractEntry
+	var zr *zip.Reader
+	if format == zipFormat {
+		zr, err = zip.NewReader(&readerAt{f: f}, doc.ByteSize)
+		if err != nil {
+			return ErrUnsupportedArchive
+		}
+		entries, err = zipEntries(zr)
+	} else {
+		entries, err = tarEntries(f, format)
+	}
+	if err != nil {
+		return err
+	}
+
+	e := &extractor{
+		fs:       fs,
+		root:     dir,
+		dirs:     make(map[string]*DirDoc),
+		modTimes: make(map[string]time.Time),
+		progress: progress,
+	}
+	for _, entry := range entries {
+		if entry.dir {
+			e.modTimes[entry.name] = entry.modTime
+		} else {
+			e.total += entry.size
+		}
+	}
+	if quota := fs.DiskQuota(); quota > 0 {
+		used, err := fs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if used+e.total > quota {
+			return ErrFileTooBig
+		}
+	}
+	if e.progress != nil {
+		if err = e.progress(0, e.total); err != nil {
+			return err
+		}
+	}
+
+	if format == zipFormat {
+		return e.extractZip(zr)
+	}
+	return e.extractTar(f, format)
+}
+
+// sniffArchive returns the format of the archive from its first bytes, and
+// rewinds the file.
+func sniffArchive(f File) (archiveFormat, error) {
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")),
+		bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return zipFormat, nil
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return tarGzFormat, nil
+	}
+	return tarFormat, nil
+}
+
+func zipEntries(zr *zip.Reader) ([]*extractEntry, error) {
+	var entries []*extractEntry
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		if !mode.IsDir() && !mode.IsRegular() {
+			continue
+		}
+		if zf.UncompressedSize64 > math.MaxInt64 {
+			return nil, ErrFileTooBig
+		}
+		entries = append(entries, &extractEntry{
+			name:       cleanArchiveName(zf.Name),
+			dir:        mode.IsDir(),
+			size:       int64(zf.UncompressedSize64),
+			modTime:    zf.ModTime(),
+			executable: mode&0100 != 0,
+		})
+	}
+	return entries, nil
+}
+
+// tarEntries lists the entries of a tar archive, without their content. The
+// file is rewound for the extraction.
+func tarEntries(f File, format archiveFormat) ([]*extractEntry, error) {
+	var entries []*extractEntry
+	err := walkTar(f, format, func(entry *extractEntry, r io.Reader) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// walkTar calls fn for each directory and regular file of a tar archive,
+// with a reader of its content.
+func walkTar(f File, format archiveFormat, fn func(entry *extractEntry, r io.Reader) error) error {
+	var r io.Reader = f
+	if format == tarGzFormat {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return ErrUnsupportedArchive
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if first {
+				return ErrUnsupportedArchive
+			}
+			return err
+		}
+		var dir bool
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dir = true
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			continue
+		}
+		entry := &extractEntry{
+			name:       cleanArchiveName(hdr.Name),
+			dir:        dir,
+			size:       hdr.Size,
+			modTime:    hdr.ModTime,
+			executable: hdr.Mode&0100 != 0,
+		}
+		if err = fn(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanArchiveName returns the path of an entry relative to the directory of
+// extraction. The paths going outside of it, like ../foo or /foo, are kept
+// inside.
+func cleanArchiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+type extractor struct {
+	fs       VFS
+	root     *DirDoc
+	dirs     map[string]*DirDoc
+	modTimes map[string]time.Time
+	done     int64
+	total    int64
+	progress ExtractProgress
+}
+
+func (e *extractor) extractZip(zr *zip.Reader) error {
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		name := cleanArchiveName(zf.Name)
+		if mode.IsDir() {
+			if _, err := e.mkdir(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = e.createFile(&extractEntry{
+			name:       name,
+			size:       int64(zf.UncompressedSize64),
+			modTime:    zf.ModTime(),
+			executable: mode&0100 != 0,
+		}, r)
+		if errc := r.Close(); errc != nil && err == nil {
+			err = errc
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractTar(f File, format archiveFormat) error {
+	return walkTar(f, format, func(entry *extractEntry, r io.Reader) error {
+		if entry.dir {
+			_, err := e.mkdir(entry.name)
+			return err
+		}
+		return e.createFile(entry, r)
+	})
+}
+
+// mkdir returns the directory for the given path of the archive, and creates
+// it and its parents if they have not been created yet.
+func (e *extractor) mkdir(name string) (*DirDoc, error) {
+	if name == "" || name == "." {
+		return e.root, nil
+	}
+	if dir, ok := e.dirs[name]; ok {
+		return dir, nil
+	}
+	parent, err := e.mkdir(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var dir *DirDoc
+	tryOrUseSuffix(path.Base(name), conflictFormat, func(base string) error {
+		dir, err = NewDirDocWithParent(base, parent, nil)
+		if err != nil {
+			return err
+		}
+		if modTime, ok := e.modTimes[name]; ok && !modTime.IsZero() {
+			dir.CreatedAt = modTime
+			dir.UpdatedAt = modTime
+		}
+		err = e.fs.CreateDir(dir)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.dirs[name] = dir
+	return dir, nil
+}
+
+func (e *extractor) createFile(entry *extractEntry, r io.Reader) error {
+	if entry.name == "" {
+		return nil
+	}
+	parent, err := e.mkdir(path.Dir(entry.name))
+	if err != nil {
+		return err
+	}
+	modTime := entry.modTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	var file File
+	tryOrUseSuffix(path.Base(entry.name), conflictFormat, func(base string) error {
+		mime, class := ExtractMimeAndClassFromFilename(base)
+		var doc *FileDoc
+		doc, err = NewFileDoc(base, parent.ID(), entry.size, nil, mime, class,
+			modTime, entry.executable, false, nil)
+		if err != nil {
+			return err
+		}
+		file, err = e.fs.CreateFile(doc, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if errc := file.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	e.done += entry.size
+	if e.progress != nil {
+		return e.progress(e.done, e.total)
+	}
+	return nil
+}
+
+// readerAt turns a File into an io.ReaderAt, for reading the zip archives.
+// The position is kept to seek only when needed, as seeking can be costly on
+// the remote storages.
+type readerAt struct {
+	f   File
+	pos int64
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if off != r.pos {
+		if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.pos = off
+	}
+	n, err := io.ReadFull(r.f, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
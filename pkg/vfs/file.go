@@ -29,22 +29,36 @@ type FileDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id,omitempty"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// Date of the move of the file to the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
 	ByteSize   int64    `json:"size,string"` // Serialized in JSON as a string, because JS has some issues with big numbers
 	MD5Sum     []byte   `json:"md5sum"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 	Mime       string   `json:"mime"`
 	Class      string   `json:"class"`
 	Executable bool     `json:"executable"`
 	Trashed    bool     `json:"trashed"`
 	Tags       []string `json:"tags"`
 
+	// Corrupted is set by the scrub worker when the stored content no longer
+	// matches the checksums of the file
+	Corrupted bool `json:"corrupted,omitempty"`
+
 	Metadata Metadata `json:"metadata,omitempty"`
 
+	// Identifier of the blob holding the content, when it is shared with
+	// other files
+	BlobID string `json:"blob_id,omitempty"`
+
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
 
+	// Previous location of the file, if it has been moved
+	MovedFrom *MovedFrom `json:"moved_from,omitempty"`
+
 	// Cache of the fullpath of the file. Should not have to be invalidated
 	// since we use FileDoc as immutable data-structures.
 	fullpath string
@@ -67,10 +81,18 @@ func (f *FileDoc) Clone() couchdb.Doc {
 	cloned := *f
 	cloned.MD5Sum = make([]byte, len(f.MD5Sum))
 	copy(cloned.MD5Sum, f.MD5Sum)
+	if f.SHA256Sum != nil {
+		cloned.SHA256Sum = make([]byte, len(f.SHA256Sum))
+		copy(cloned.SHA256Sum, f.SHA256Sum)
+	}
 	cloned.Tags = make([]string, len(f.Tags))
 	copy(cloned.Tags, f.Tags)
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(f.ReferencedBy))
 	copy(cloned.ReferencedBy, f.ReferencedBy)
+	if f.MovedFrom != nil {
+		moved := *f.MovedFrom
+		cloned.MovedFrom = &moved
+	}
 	return &cloned
 }
 
@@ -152,6 +174,9 @@ func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class strin
 	if dirID == "" {
 		dirID = consts.RootDirID
 	}
+	if err := checkReservedName(name, dirID == consts.RootDirID); err != nil {
+		return nil, err
+	}
 
 	tags = uniqueTags(tags)
 
@@ -208,6 +233,44 @@ func ServeFileContent(fs VFS, doc *FileDoc, disposition string, req *http.Reques
 // ModifyFileMetadata modify the metadata associated to a file. It can
 // be used to rename or move the file in the VFS.
 func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, error) {
+	newdoc, err := patchFileDoc(olddoc, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// ModifyFilesMetadata modify the metadata associated to several files, with a
+// single bulk update of their documents. The patches can only change the
+// tags and the modification date of the files, the other fields are ignored:
+// ModifyFileMetadata must be used to move or rename a file.
+//
+// The returned documents are the new documents, in the same order as the old
+// ones. If the update of some documents fails, an error is returned, and the
+// new documents that have been saved are the ones with a new revision.
+func ModifyFilesMetadata(fs VFS, olddocs []*FileDoc, patches []*DocPatch) ([]*FileDoc, error) {
+	newdocs := make([]*FileDoc, len(olddocs))
+	for i, olddoc := range olddocs {
+		patch := &DocPatch{
+			Tags:      patches[i].Tags,
+			UpdatedAt: patches[i].UpdatedAt,
+		}
+		newdoc, err := patchFileDoc(olddoc, patch)
+		if err != nil {
+			return nil, err
+		}
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdocs[i] = newdoc
+	}
+	return newdocs, fs.UpdateFileDocs(newdocs, olddocs)
+}
+
+// patchFileDoc returns a new document for the file, with the patch applied.
+func patchFileDoc(olddoc *FileDoc, patch *DocPatch) (*FileDoc, error) {
 	var err error
 	rename := patch.Name != nil
 	cdate := olddoc.CreatedAt
@@ -223,6 +286,7 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
 		Executable:  &olddoc.Executable,
+		TrashedAt:   olddoc.TrashedAt,
 	}, patch, cdate)
 	if err != nil {
 		return nil, err
@@ -257,13 +321,15 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	if newdoc.RestorePath != "" {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
 	newdoc.UpdatedAt = *patch.UpdatedAt
+	newdoc.SHA256Sum = olddoc.SHA256Sum
+	newdoc.Corrupted = olddoc.Corrupted
 	newdoc.Metadata = olddoc.Metadata
+	newdoc.BlobID = olddoc.BlobID
 	newdoc.ReferencedBy = olddoc.ReferencedBy
-
-	if err = fs.UpdateFileDoc(olddoc, newdoc); err != nil {
-		return nil, err
-	}
 	return newdoc, nil
 }
 
@@ -279,6 +345,7 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now().UTC()
 
 	var newdoc *FileDoc
 	tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
@@ -286,6 +353,7 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
 			Name:        &name,
+			TrashedAt:   &trashedAt,
 		})
 		return err
 	})
@@ -0,0 +1,230 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+)
+
+// FsckLogType is the type of an inconsistency found by the filesystem checker
+type FsckLogType string
+
+const (
+	// IndexMissing is used when a content is stored without a document in the
+	// index
+	IndexMissing FsckLogType = "index_missing"
+	// ContentMissing is used when a document of the index has no content in
+	// the storage
+	ContentMissing FsckLogType = "content_missing"
+	// ParentMissing is used when the parent of a document does not exist
+	ParentMissing FsckLogType = "parent_missing"
+	// PathMismatch is used when the path of a directory does not match the
+	// path of its parent
+	PathMismatch FsckLogType = "path_mismatch"
+	// FileMismatch is used when the size or the md5sum of a file does not
+	// match its content
+	FileMismatch FsckLogType = "file_mismatch"
+)
+
+// FsckLog is an inconsistency between the index and the storage of the
+// files, found by the filesystem checker.
+type FsckLog struct {
+	Type    FsckLogType `json:"type"`
+	DirDoc  *DirDoc     `json:"dir_doc,omitempty"`
+	FileDoc *FileDoc    `json:"file_doc,omitempty"`
+
+	// The path of the content in the storage, for IndexMissing
+	ContentPath string `json:"content_path,omitempty"`
+	// The expected path of a directory, for PathMismatch
+	ExpectedPath string `json:"expected_path,omitempty"`
+	// The size and md5sum of the content, for FileMismatch
+	ContentSize   int64  `json:"content_size,omitempty,string"`
+	ContentMD5Sum []byte `json:"content_md5sum,omitempty"`
+
+	// Repaired is true if the inconsistency has been fixed
+	Repaired bool `json:"repaired"`
+}
+
+// FsckTree is the content of the index, as seen by the filesystem checker.
+// The directories are indexed by their identifiers, and their paths are the
+// paths computed from their parents, even if the index is not repaired.
+type FsckTree struct {
+	Dirs  map[string]*DirDoc
+	Files []*FileDoc
+}
+
+// FilePath returns the path of a file of the tree.
+func (t *FsckTree) FilePath(doc *FileDoc) string {
+	return path.Join(t.Dirs[doc.DirID].Fullpath, doc.DocName)
+}
+
+// FsckRepair runs the repair of an inconsistency while holding the lock of
+// the VFS. The checks are made without the lock, and it is only held for one
+// repair at a time, so that the other operations on the files are not blocked
+// for the whole run. As a document may have been modified concurrently since
+// it was checked, a conflict or a missing document means that the
+// inconsistency has been changed by another operation, and it is skipped.
+//
+// The repair function returns false if it has found that there is nothing to
+// repair anymore.
+func FsckRepair(mu lock.ErrorRWLocker, log *FsckLog, repair func() (bool, error)) error {
+	if lockerr := mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer mu.Unlock()
+	repaired, err := repair()
+	if couchdb.IsConflictError(err) || couchdb.IsNotFoundError(err) || os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Repaired = repaired
+	return nil
+}
+
+// FsckIsIndexed returns true if a directory or a file of the index has the
+// given path. It is used to check that an orphan content has not been indexed
+// since it was found, and must be called with the lock of the VFS held.
+func FsckIsIndexed(index Indexer, name string) (bool, error) {
+	_, err := index.DirByPath(name)
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	_, err = index.FileByPath(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FsckIndex checks the consistency of the tree of directories and files in
+// the index: each document must have a parent, and the path of a directory
+// must match the path of its parent. If repair is true, the wrong paths are
+// fixed, with the given lock held for each of them. The returned tree
+// contains the documents that have a parent, and can be used by the storage
+// backends to check their content.
+func FsckIndex(index Indexer, mu lock.ErrorRWLocker, repair bool) (*FsckTree, []*FsckLog, error) {
+	dirs, files, err := index.AllDirsAndFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byID := make(map[string]*DirDoc, len(dirs))
+	for _, dir := range dirs {
+		byID[dir.ID()] = dir
+	}
+
+	var logs []*FsckLog
+	tree := &FsckTree{Dirs: make(map[string]*DirDoc, len(dirs))}
+	expected := make(map[string]string, len(dirs))
+	var expectedPath func(dir *DirDoc, depth int) (string, bool)
+	expectedPath = func(dir *DirDoc, depth int) (string, bool) {
+		if dir.ID() == consts.RootDirID {
+			return "/", true
+		}
+		if p, ok := expected[dir.ID()]; ok {
+			return p, p != ""
+		}
+		parent, ok := byID[dir.DirID]
+		if !ok || depth > len(byID) {
+			expected[dir.ID()] = ""
+			return "", false
+		}
+		parentPath, ok := expectedPath(parent, depth+1)
+		if !ok {
+			expected[dir.ID()] = ""
+			return "", false
+		}
+		p := path.Join(parentPath, dir.DocName)
+		expected[dir.ID()] = p
+		return p, true
+	}
+
+	var mismatches []*DirDoc
+	for _, dir := range dirs {
+		p, ok := expectedPath(dir, 0)
+		if !ok {
+			logs = append(logs, &FsckLog{Type: ParentMissing, DirDoc: dir})
+			continue
+		}
+		if dir.Fullpath != p {
+			mismatches = append(mismatches, dir)
+		}
+		cloned := dir.Clone().(*DirDoc)
+		cloned.Fullpath = p
+		tree.Dirs[dir.ID()] = cloned
+	}
+
+	// The parents are repaired before their children, as repairing the path
+	// of a directory also changes the paths of the directories inside it.
+	sort.Sort(byDepth{mismatches, expected})
+	for _, dir := range mismatches {
+		log := &FsckLog{Type: PathMismatch, DirDoc: dir, ExpectedPath: expected[dir.ID()]}
+		if repair {
+			err = FsckRepair(mu, log, func() (bool, error) {
+				current, err := index.DirByID(dir.ID())
+				if err != nil {
+					return false, err
+				}
+				if current.DirID != dir.DirID || current.DocName != dir.DocName {
+					return false, nil
+				}
+				if current.Fullpath != log.ExpectedPath {
+					newdoc := current.Clone().(*DirDoc)
+					newdoc.Fullpath = log.ExpectedPath
+					if err = index.UpdateDirDoc(current, newdoc); err != nil {
+						return false, err
+					}
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	for _, file := range files {
+		if _, ok := tree.Dirs[file.DirID]; !ok {
+			logs = append(logs, &FsckLog{Type: ParentMissing, FileDoc: file})
+			continue
+		}
+		tree.Files = append(tree.Files, file)
+	}
+
+	return tree, logs, nil
+}
+
+// IsFsckIgnoredPath returns true if the given path in the storage is not
+// indexed as a file or directory (versions, uploads, thumbnails, etc.) and
+// should be skipped by the filesystem checker.
+func IsFsckIgnoredPath(name string) bool {
+	for _, dir := range []string{VersionsDirName, UploadsDirName, BlobsDirName, ThumbsDirName} {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type byDepth struct {
+	dirs     []*DirDoc
+	expected map[string]string
+}
+
+func (b byDepth) Len() int      { return len(b.dirs) }
+func (b byDepth) Swap(i, j int) { b.dirs[i], b.dirs[j] = b.dirs[j], b.dirs[i] }
+func (b byDepth) Less(i, j int) bool {
+	pi, pj := b.expected[b.dirs[i].ID()], b.expected[b.dirs[j].ID()]
+	return strings.Count(pi, "/") < strings.Count(pj, "/")
+}
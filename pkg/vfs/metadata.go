@@ -1,8 +1,12 @@
 package vfs
 
 import (
+	"bufio"
 	"image"
 	"io"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	// Packages image/... are not used explicitly in the code below,
@@ -20,7 +24,7 @@ import (
 // MetadataExtractorVersion is the version number of the metadata extractor.
 // It will be used later to know which files can be re-examined to get more
 // metadata when the extractor is improved.
-const MetadataExtractorVersion = 2
+const MetadataExtractorVersion = 3
 
 // Metadata is a list of metadata specific to each mimetype:
 // id3 for music, exif for jpegs, etc.
@@ -40,22 +44,96 @@ type MetaExtractor interface {
 	Result() Metadata
 }
 
+// metaExtractors are the constructors of the metadata extractors, by mime
+// type
+var metaExtractors = map[string]func() MetaExtractor{
+	"image/jpeg":       func() MetaExtractor { return NewExifExtractor() },
+	"image/png":        func() MetaExtractor { return NewImageExtractor() },
+	"image/gif":        func() MetaExtractor { return NewImageExtractor() },
+	"audio/mpeg":       func() MetaExtractor { return NewMP3Extractor() },
+	"audio/mp3":        func() MetaExtractor { return NewMP3Extractor() },
+	"audio/flac":       func() MetaExtractor { return NewFLACExtractor() },
+	"audio/x-flac":     func() MetaExtractor { return NewFLACExtractor() },
+	"audio/ogg":        func() MetaExtractor { return NewOggExtractor() },
+	"audio/opus":       func() MetaExtractor { return NewOggExtractor() },
+	"application/ogg":  func() MetaExtractor { return NewOggExtractor() },
+	"audio/mp4":        func() MetaExtractor { return NewMP4Extractor() },
+	"audio/m4a":        func() MetaExtractor { return NewMP4Extractor() },
+	"audio/x-m4a":      func() MetaExtractor { return NewMP4Extractor() },
+	"video/mp4":        func() MetaExtractor { return NewMP4Extractor() },
+	"video/quicktime":  func() MetaExtractor { return NewMP4Extractor() },
+	"audio/webm":       func() MetaExtractor { return NewWebMExtractor() },
+	"video/webm":       func() MetaExtractor { return NewWebMExtractor() },
+	"video/x-matroska": func() MetaExtractor { return NewWebMExtractor() },
+}
+
 // NewMetaExtractor returns an extractor for metadata if the mime type has one,
 // or null else
 func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
-	var e MetaExtractor
-	switch doc.Mime {
-	case "image/jpeg":
-		e = NewExifExtractor()
-	case "image/png", "image/gif":
-		e = NewImageExtractor()
-	}
-	if e != nil {
+	if fn, ok := metaExtractors[doc.Mime]; ok {
+		e := fn()
 		return &e
 	}
 	return nil
 }
 
+// NeedsMetadataUpdate returns true if the file has a metadata extractor with
+// a more recent version than the one used for its current metadata.
+func NeedsMetadataUpdate(doc *FileDoc) bool {
+	if _, ok := metaExtractors[doc.Mime]; !ok {
+		return false
+	}
+	var version int
+	switch v := doc.Metadata["extractor_version"].(type) {
+	case int:
+		version = v
+	case float64:
+		version = int(v)
+	}
+	return version < MetadataExtractorVersion
+}
+
+// UpdateMetadata extracts again the metadata from the content of a file, and
+// saves them in the file document. The metadata that are no longer found by
+// the extractor are kept, and so is the datetime as the date of the upload
+// can't be known anymore.
+func UpdateMetadata(fs VFS, doc *FileDoc) error {
+	extractor := NewMetaExtractor(doc)
+	if extractor == nil {
+		return nil
+	}
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		(*extractor).Abort(err)
+		return err
+	}
+	_, err = io.Copy(*extractor, f)
+	if errc := f.Close(); errc != nil && (err == nil || err == io.ErrClosedPipe) {
+		err = errc
+	}
+	if err != nil && err != io.ErrClosedPipe {
+		(*extractor).Abort(err)
+		return err
+	}
+	if err = (*extractor).Close(); err != nil {
+		return err
+	}
+	meta := (*extractor).Result()
+
+	newdoc := doc.Clone().(*FileDoc)
+	newdoc.Metadata = Metadata{}
+	for k, v := range doc.Metadata {
+		newdoc.Metadata[k] = v
+	}
+	for k, v := range meta {
+		if _, ok := doc.Metadata[k]; ok && k == "datetime" {
+			continue
+		}
+		newdoc.Metadata[k] = v
+	}
+	return fs.UpdateFileDoc(doc, newdoc)
+}
+
 // ImageExtractor is used to extract width/height from images
 type ImageExtractor struct {
 	w  *io.PipeWriter
@@ -181,3 +259,115 @@ func (e *ExifExtractor) Result() Metadata {
 	}
 	return m
 }
+
+// mediaParser reads the content of an audio or video file, and adds to the
+// metadata what it has found
+type mediaParser func(r *bufio.Reader, m Metadata) error
+
+// MediaExtractor is used to extract the tags and the technical metadata
+// (duration, codecs, etc.) from audio and video files
+type MediaExtractor struct {
+	w     *io.PipeWriter
+	r     *io.PipeReader
+	parse mediaParser
+	meta  Metadata
+	ch    chan error
+}
+
+func newMediaExtractor(parse mediaParser) *MediaExtractor {
+	e := &MediaExtractor{parse: parse}
+	e.r, e.w = io.Pipe()
+	e.ch = make(chan error)
+	go e.Start()
+	return e
+}
+
+// Start is used in a goroutine to start the metadata extraction
+func (e *MediaExtractor) Start() {
+	m := NewMetadata()
+	err := e.parse(bufio.NewReaderSize(e.r, 64*1024), m)
+	e.r.Close()
+	e.meta = m
+	e.ch <- err
+}
+
+// Write is called to push some bytes to the extractor
+func (e *MediaExtractor) Write(p []byte) (n int, err error) {
+	return e.w.Write(p)
+}
+
+// Close is called when all the bytes has been pushed, to finalize the extraction
+func (e *MediaExtractor) Close() error {
+	return e.w.Close()
+}
+
+// Abort is called when the extractor can be discarded
+func (e *MediaExtractor) Abort(err error) {
+	e.w.CloseWithError(err)
+	<-e.ch
+}
+
+// Result is called to get the extracted metadata. The metadata found before
+// an error in the content are kept.
+func (e *MediaExtractor) Result() Metadata {
+	<-e.ch
+	return e.meta
+}
+
+// setMediaTag adds a tag of an audio or video file to the metadata, with
+// the same names and types for all the formats.
+func setMediaTag(m Metadata, key, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+	switch strings.ToLower(key) {
+	case "title":
+		m["title"] = value
+	case "artist":
+		m["artist"] = value
+	case "album":
+		m["album"] = value
+	case "albumartist", "album_artist":
+		m["album_artist"] = value
+	case "genre":
+		m["genre"] = value
+	case "tracknumber", "track":
+		if n, ok := leadingNumber(value); ok {
+			m["track"] = n
+		}
+	case "discnumber", "disc":
+		if n, ok := leadingNumber(value); ok {
+			m["disc"] = n
+		}
+	case "date", "year":
+		if n, ok := leadingNumber(value); ok && len(value) >= 4 {
+			if n > 9999 {
+				n, _ = strconv.Atoi(value[:4])
+			}
+			m["year"] = n
+		}
+	}
+}
+
+// leadingNumber parses the number at the beginning of a string, like 3 for
+// the track "3/12".
+func leadingNumber(s string) (int, bool) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s[:i])
+	return n, err == nil
+}
+
+// setDuration adds the duration in seconds, rounded to the millisecond
+func setDuration(m Metadata, seconds float64) {
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return
+	}
+	m["duration"] = math.Floor(seconds*1000+0.5) / 1000
+}
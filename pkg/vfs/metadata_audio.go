@@ -0,0 +1,494 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxTagSize is the maximal size of a block of tags read in memory. The
+// bigger blocks are mostly pictures, and they are skipped.
+const maxTagSize = 8 << 20
+
+// maxSyncSearch is the maximal number of bytes read to find the first frame
+// of a MP3 file
+const maxSyncSearch = 64 * 1024
+
+var errInvalidMedia = errors.New("vfs: invalid media content")
+
+// NewMP3Extractor returns an extractor for the ID3 tags, the duration and
+// the format of MP3 files
+func NewMP3Extractor() *MediaExtractor {
+	return newMediaExtractor(parseMP3)
+}
+
+// NewFLACExtractor returns an extractor for the Vorbis comments, the
+// duration and the format of FLAC files
+func NewFLACExtractor() *MediaExtractor {
+	return newMediaExtractor(parseFLAC)
+}
+
+// NewOggExtractor returns an extractor for the Vorbis comments, the duration
+// and the format of Ogg Vorbis and Opus files
+func NewOggExtractor() *MediaExtractor {
+	return newMediaExtractor(parseOgg)
+}
+
+func discard(r io.Reader, n int64) error {
+	copied, err := io.CopyN(ioutil.Discard, r, n)
+	if err == io.EOF || (err == nil && copied < n) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readBlock(r io.Reader, n int64) ([]byte, error) {
+	if n > maxTagSize {
+		return nil, discard(r, n)
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "album_artist", "TP2": "album_artist",
+	"TALB": "album", "TAL": "album",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TYER": "year", "TYE": "year",
+	"TDRC": "year",
+}
+
+// skipID3 reads the ID3v2 tag at the beginning of the content if there is
+// one, and adds its frames to the metadata
+func skipID3(r *bufio.Reader, m Metadata) error {
+	header, err := r.Peek(10)
+	if err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+	if _, err = r.Discard(10); err != nil {
+		return err
+	}
+	version, flags := header[3], header[5]
+	size := syncsafe(header[6:10])
+	if flags&0x10 != 0 { // footer
+		size += 10
+	}
+	tag, err := readBlock(r, int64(size))
+	if err != nil || tag == nil {
+		return err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.Replace(tag, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+	if flags&0x40 != 0 && version >= 3 && len(tag) >= 4 {
+		extended := int(binary.BigEndian.Uint32(tag))
+		if version == 3 {
+			extended += 4
+		} else {
+			extended = syncsafe(tag[:4])
+		}
+		if extended > len(tag) {
+			return nil
+		}
+		tag = tag[extended:]
+	}
+	parseID3Frames(tag, version, m)
+	return nil
+}
+
+func parseID3Frames(tag []byte, version byte, m Metadata) {
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = syncsafe(tag[4:8])
+		}
+		if size < 0 || headerLen+size > len(tag) {
+			return
+		}
+		if key, ok := id3Frames[id]; ok {
+			setMediaTag(m, key, decodeID3Text(tag[headerLen:headerLen+size]))
+		}
+		tag = tag[headerLen+size:]
+	}
+}
+
+// decodeID3Text returns the first value of a text frame, in UTF-8
+func decodeID3Text(frame []byte) string {
+	if len(frame) < 1 {
+		return ""
+	}
+	encoding, data := frame[0], frame[1:]
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, 0, len(data))
+		for _, b := range data {
+			if b == 0 {
+				break
+			}
+			runes = append(runes, rune(b))
+		}
+		return string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == 1 && len(data) >= 2 {
+			if data[0] == 0xFF && data[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			if (data[0] == 0xFF && data[1] == 0xFE) || (data[0] == 0xFE && data[1] == 0xFF) {
+				data = data[2:]
+			}
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			u := order.Uint16(data[i:])
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	default: // UTF-8
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		return string(data)
+	}
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+var mp3Bitrates = [2][3][15]int{
+	{ // MPEG-1, layers I, II, III
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{ // MPEG-2 and 2.5, layers I, II, III
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{0, 0, 0},             // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+var mp3Codecs = [4]string{"", "mp1", "mp2", "mp3"}
+
+// mp3Frame is the header of a MPEG audio frame
+type mp3Frame struct {
+	mpeg1      bool
+	layer      int
+	bitrate    int // in kbps
+	sampleRate int
+	channels   int
+}
+
+func parseMP3Frame(h []byte) (*mp3Frame, bool) {
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return nil, false
+	}
+	version := int(h[1]>>3) & 3
+	layer := 4 - int(h[1]>>1)&3
+	bitrateIndex := int(h[2] >> 4)
+	rateIndex := int(h[2]>>2) & 3
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil, false
+	}
+	f := &mp3Frame{mpeg1: version == 3, layer: layer, channels: 2}
+	table := 1
+	if f.mpeg1 {
+		table = 0
+	}
+	f.bitrate = mp3Bitrates[table][layer-1][bitrateIndex]
+	f.sampleRate = mp3SampleRates[version][rateIndex]
+	if h[3]>>6 == 3 {
+		f.channels = 1
+	}
+	return f, true
+}
+
+func (f *mp3Frame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && !f.mpeg1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// vbrFrames returns the number of frames announced by a Xing or VBRI header
+// in the first frame, or 0 if there is no such header
+func (f *mp3Frame) vbrFrames(frame []byte) int {
+	side := 32
+	switch {
+	case f.mpeg1 && f.channels == 1:
+		side = 17
+	case !f.mpeg1 && f.channels == 1:
+		side = 9
+	case !f.mpeg1:
+		side = 17
+	}
+	if len(frame) >= 4+side+12 {
+		x := frame[4+side:]
+		tag := string(x[:4])
+		if (tag == "Xing" || tag == "Info") && x[7]&1 != 0 {
+			return int(binary.BigEndian.Uint32(x[8:12]))
+		}
+	}
+	if len(frame) >= 36+18 {
+		x := frame[36:]
+		if string(x[:4]) == "VBRI" {
+			return int(binary.BigEndian.Uint32(x[14:18]))
+		}
+	}
+	return 0
+}
+
+// parseMP3 reads the ID3v2 tag, and the first frame to know the format. The
+// duration is computed from the number of frames of the Xing/VBRI header for
+// the variable bitrate files, and from the size of the audio data else.
+func parseMP3(r *bufio.Reader, m Metadata) error {
+	if err := skipID3(r, m); err != nil {
+		return err
+	}
+
+	var frame *mp3Frame
+	for i := 0; frame == nil; i++ {
+		if i > maxSyncSearch {
+			return errInvalidMedia
+		}
+		h, err := r.Peek(4)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if frame, ok = parseMP3Frame(h); !ok {
+			if _, err = r.Discard(1); err != nil {
+				return err
+			}
+		}
+	}
+	m["audio_codec"] = mp3Codecs[frame.layer]
+	m["sample_rate"] = frame.sampleRate
+	m["channels"] = frame.channels
+	m["bitrate"] = frame.bitrate
+
+	first, _ := r.Peek(64)
+	if n := frame.vbrFrames(first); n > 0 {
+		setDuration(m, float64(n*frame.samples())/float64(frame.sampleRate))
+		return nil
+	}
+	size, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	setDuration(m, float64(size)*8/float64(frame.bitrate*1000))
+	return nil
+}
+
+// parseVorbisComments parses the comments used by FLAC, Vorbis and Opus. All
+// the lengths are in little-endian.
+func parseVorbisComments(data []byte, m Metadata) {
+	if len(data) < 4 {
+		return
+	}
+	vendor := int(binary.LittleEndian.Uint32(data))
+	if vendor < 0 || 4+vendor+4 > len(data) {
+		return
+	}
+	data = data[4+vendor:]
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < count && len(data) >= 4; i++ {
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 0 || 4+size > len(data) {
+			return
+		}
+		comment := string(data[4 : 4+size])
+		data = data[4+size:]
+		if eq := strings.IndexByte(comment, '='); eq > 0 {
+			setMediaTag(m, comment[:eq], comment[eq+1:])
+		}
+	}
+}
+
+// parseFLAC reads the metadata blocks at the beginning of a FLAC file: the
+// STREAMINFO block for the format and duration, and the VORBIS_COMMENT block
+// for the tags.
+func parseFLAC(r *bufio.Reader, m Metadata) error {
+	if err := skipID3(r, m); err != nil {
+		return err
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != "fLaC" {
+		return errInvalidMedia
+	}
+	m["audio_codec"] = "flac"
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7F
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		switch kind {
+		case 0, 4: // STREAMINFO, VORBIS_COMMENT
+			block, err := readBlock(r, size)
+			if err != nil {
+				return err
+			}
+			if kind == 4 {
+				parseVorbisComments(block, m)
+			} else if len(block) >= 18 {
+				parseFLACStreamInfo(block, m)
+			}
+		default:
+			if err := discard(r, size); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func parseFLACStreamInfo(b []byte, m Metadata) {
+	rate := int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+	channels := int(b[12]>>1)&7 + 1
+	samples := int64(b[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(b[14:18]))
+	if rate == 0 {
+		return
+	}
+	m["sample_rate"] = rate
+	m["channels"] = channels
+	setDuration(m, float64(samples)/float64(rate))
+}
+
+// parseOgg reads the pages of the first logical stream of an Ogg file. The
+// first packet is the identification header, with the format, the second is
+// the comments, and the granule position of the last page gives the
+// duration.
+func parseOgg(r *bufio.Reader, m Metadata) error {
+	header := make([]byte, 27)
+	var serial uint32
+	var packet []byte
+	var packets int
+	var rate, preskip int
+	var opus bool
+	var granule int64 = -1
+	for pages := 0; ; pages++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF && pages > 0 {
+				break
+			}
+			return err
+		}
+		if string(header[:4]) != "OggS" {
+			return errInvalidMedia
+		}
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		if pages == 0 {
+			serial = pageSerial
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return err
+		}
+		if pageSerial != serial {
+			var size int64
+			for _, s := range segments {
+				size += int64(s)
+			}
+			if err := discard(r, size); err != nil {
+				return err
+			}
+			continue
+		}
+		if g := int64(binary.LittleEndian.Uint64(header[6:14])); g >= 0 {
+			granule = g
+		}
+		for _, s := range segments {
+			if packets >= 2 {
+				if err := discard(r, int64(s)); err != nil {
+					return err
+				}
+				continue
+			}
+			buf := make([]byte, s)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			if len(packet) < maxTagSize {
+				packet = append(packet, buf...)
+			}
+			if s == 255 {
+				continue
+			}
+			switch {
+			case packets == 0 && bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+				m["audio_codec"] = "vorbis"
+				m["channels"] = int(packet[11])
+				rate = int(binary.LittleEndian.Uint32(packet[12:16]))
+				m["sample_rate"] = rate
+			case packets == 0 && bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 16:
+				opus = true
+				m["audio_codec"] = "opus"
+				m["channels"] = int(packet[9])
+				preskip = int(binary.LittleEndian.Uint16(packet[10:12]))
+				rate = 48000
+				if input := int(binary.LittleEndian.Uint32(packet[12:16])); input > 0 {
+					m["sample_rate"] = input
+				}
+			case packets == 0:
+				return errInvalidMedia
+			case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+				parseVorbisComments(packet[7:], m)
+			case bytes.HasPrefix(packet, []byte("OpusTags")):
+				parseVorbisComments(packet[8:], m)
+			}
+			packets++
+			packet = nil
+		}
+	}
+	if rate > 0 && granule > 0 {
+		samples := granule
+		if opus {
+			samples -= int64(preskip)
+		}
+		setDuration(m, float64(samples)/float64(rate))
+	}
+	return nil
+}
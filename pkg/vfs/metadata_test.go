@@ -1,8 +1,12 @@
 package vfs
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io"
+	"math"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -58,3 +62,299 @@ func TestExifMetadataExtractor(t *testing.T) {
 	assert.True(t, ok, "height is present")
 	assert.Equal(t, 294, h)
 }
+
+func extractMetadata(t *testing.T, mime string, content []byte) Metadata {
+	doc := &FileDoc{Mime: mime}
+	extractor := NewMetaExtractor(doc)
+	if !assert.NotNil(t, extractor) {
+		t.FailNow()
+	}
+	_, err := io.Copy(*extractor, bytes.NewReader(content))
+	if err == io.ErrClosedPipe {
+		err = nil
+	}
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	assert.Equal(t, MetadataExtractorVersion, meta["extractor_version"])
+	return meta
+}
+
+func id3Frame(id string, encoding byte, text []byte) []byte {
+	frame := []byte(id)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(text)+1))
+	frame = append(frame, size...)
+	frame = append(frame, 0, 0, encoding)
+	return append(frame, text...)
+}
+
+func mp3Content(xingFrames uint32) []byte {
+	var frames []byte
+	frames = append(frames, id3Frame("TIT2", 0, []byte("Caf\xe9"))...)
+	// "Été" in UTF-16 little-endian, with a BOM
+	frames = append(frames, id3Frame("TPE1", 1, []byte{0xFF, 0xFE, 0xC9, 0x00, 't', 0x00, 0xE9, 0x00})...)
+	frames = append(frames, id3Frame("TALB", 3, []byte("Album"))...)
+	frames = append(frames, id3Frame("TRCK", 3, []byte("3/12"))...)
+	frames = append(frames, id3Frame("TYER", 3, []byte("2017"))...)
+	frames = append(frames, make([]byte, 32)...) // padding
+	size := len(frames)
+	content := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	content = append(content, frames...)
+
+	// 100 frames of MPEG-1 layer III, 128kbps, 44.1kHz, joint stereo
+	for i := 0; i < 100; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0x44})
+		if i == 0 && xingFrames > 0 {
+			copy(frame[36:], []byte("Xing\x00\x00\x00\x01"))
+			binary.BigEndian.PutUint32(frame[44:], xingFrames)
+		}
+		content = append(content, frame...)
+	}
+	return content
+}
+
+func TestMP3MetadataExtractor(t *testing.T) {
+	meta := extractMetadata(t, "audio/mpeg", mp3Content(0))
+	assert.Equal(t, "Café", meta["title"])
+	assert.Equal(t, "Été", meta["artist"])
+	assert.Equal(t, "Album", meta["album"])
+	assert.Equal(t, 3, meta["track"])
+	assert.Equal(t, 2017, meta["year"])
+	assert.Equal(t, "mp3", meta["audio_codec"])
+	assert.Equal(t, 44100, meta["sample_rate"])
+	assert.Equal(t, 2, meta["channels"])
+	assert.Equal(t, 128, meta["bitrate"])
+	assert.Equal(t, 2.606, meta["duration"])
+
+	meta = extractMetadata(t, "audio/mpeg", mp3Content(1000))
+	assert.Equal(t, 26.122, meta["duration"])
+}
+
+func vorbisComments(comments ...string) []byte {
+	vendor := "cozy"
+	buf := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(buf, uint32(len(vendor)))
+	buf = append(buf, vendor...)
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(comments)))
+	buf = append(buf, count...)
+	for _, c := range comments {
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(c)))
+		buf = append(buf, size...)
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func TestFLACMetadataExtractor(t *testing.T) {
+	rate, channels, bps, total := 44100, 2, 16, uint64(441000)
+	info := make([]byte, 34)
+	info[10] = byte(rate >> 12)
+	info[11] = byte(rate >> 4)
+	info[12] = byte(rate<<4) | byte((channels-1)<<1) | byte((bps-1)>>4)
+	info[13] = byte((bps-1)<<4) | byte(total>>32)
+	binary.BigEndian.PutUint32(info[14:], uint32(total))
+
+	content := []byte("fLaC")
+	content = append(content, 0x00, 0, 0, byte(len(info)))
+	content = append(content, info...)
+	content = append(content, 0x01, 0, 0, 8) // PADDING
+	content = append(content, make([]byte, 8)...)
+	comments := vorbisComments("TITLE=Song", "ARTIST=Band", "TRACKNUMBER=7", "DATE=2016-09-10", "GENRE=Rock")
+	content = append(content, 0x84, 0, 0, byte(len(comments)))
+	content = append(content, comments...)
+	content = append(content, make([]byte, 1000)...) // audio frames
+
+	meta := extractMetadata(t, "audio/flac", content)
+	assert.Equal(t, "Song", meta["title"])
+	assert.Equal(t, "Band", meta["artist"])
+	assert.Equal(t, 7, meta["track"])
+	assert.Equal(t, 2016, meta["year"])
+	assert.Equal(t, "Rock", meta["genre"])
+	assert.Equal(t, "flac", meta["audio_codec"])
+	assert.Equal(t, 44100, meta["sample_rate"])
+	assert.Equal(t, 2, meta["channels"])
+	assert.Equal(t, 10.0, meta["duration"])
+}
+
+func oggPage(granule int64, packets ...[]byte) []byte {
+	var segments, data []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(n))
+		data = append(data, p...)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint64(header[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(header[14:], 42)
+	header[26] = byte(len(segments))
+	page := append(header, segments...)
+	return append(page, data...)
+}
+
+func TestOggMetadataExtractor(t *testing.T) {
+	ident := []byte("\x01vorbis\x00\x00\x00\x00\x02")
+	rate := make([]byte, 4)
+	binary.LittleEndian.PutUint32(rate, 44100)
+	ident = append(ident, rate...)
+	ident = append(ident, make([]byte, 14)...)
+	// A comment bigger than a segment, with a picture
+	picture := "METADATA_BLOCK_PICTURE=" + strings.Repeat("A", 600)
+	comments := append([]byte("\x03vorbis"), vorbisComments("title=Vorbis", picture, "album=Ogg")...)
+	comments = append(comments, 1)
+
+	var content []byte
+	content = append(content, oggPage(0, ident)...)
+	content = append(content, oggPage(0, comments)...)
+	content = append(content, oggPage(44100*2, make([]byte, 300))...)
+	content = append(content, oggPage(44100*5, make([]byte, 300))...)
+
+	meta := extractMetadata(t, "audio/ogg", content)
+	assert.Equal(t, "Vorbis", meta["title"])
+	assert.Equal(t, "Ogg", meta["album"])
+	assert.Equal(t, "vorbis", meta["audio_codec"])
+	assert.Equal(t, 44100, meta["sample_rate"])
+	assert.Equal(t, 2, meta["channels"])
+	assert.Equal(t, 5.0, meta["duration"])
+
+	head := []byte("OpusHead\x01\x01\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	content = oggPage(0, head)
+	content = append(content, oggPage(0, append([]byte("OpusTags"), vorbisComments("ARTIST=Opus")...))...)
+	content = append(content, oggPage(48000*3+312, make([]byte, 100))...)
+	meta = extractMetadata(t, "audio/ogg", content)
+	assert.Equal(t, "Opus", meta["artist"])
+	assert.Equal(t, "opus", meta["audio_codec"])
+	assert.Equal(t, 48000, meta["sample_rate"])
+	assert.Equal(t, 1, meta["channels"])
+	assert.Equal(t, 3.0, meta["duration"])
+}
+
+func makeMP4Box(kind string, children ...[]byte) []byte {
+	box := make([]byte, 8)
+	copy(box[4:], kind)
+	for _, child := range children {
+		box = append(box, child...)
+	}
+	binary.BigEndian.PutUint32(box, uint32(len(box)))
+	return box
+}
+
+func makeMP4Track(handler string, entry []byte) []byte {
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+	stsd := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	return makeMP4Box("trak", makeMP4Box("mdia",
+		makeMP4Box("hdlr", hdlr),
+		makeMP4Box("minf", makeMP4Box("stbl", makeMP4Box("stsd", stsd, entry))),
+	))
+}
+
+func TestMP4MetadataExtractor(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[4:], 3556915200) // 2016-09-17T00:00:00Z
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 12500)
+
+	video := make([]byte, 70)
+	binary.BigEndian.PutUint16(video[24:], 1280)
+	binary.BigEndian.PutUint16(video[26:], 720)
+	audio := make([]byte, 28)
+	binary.BigEndian.PutUint16(audio[16:], 2)
+	binary.BigEndian.PutUint16(audio[24:], 48000)
+
+	ilst := makeMP4Box("ilst",
+		makeMP4Box("\xa9nam", makeMP4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("Holidays"))),
+		makeMP4Box("trkn", makeMP4Box("data", make([]byte, 8), []byte{0, 0, 0, 5, 0, 10, 0, 0})),
+	)
+	moov := makeMP4Box("moov",
+		makeMP4Box("mvhd", mvhd),
+		makeMP4Track("vide", makeMP4Box("avc1", video)),
+		makeMP4Track("soun", makeMP4Box("mp4a", audio)),
+		makeMP4Box("udta", makeMP4Box("meta", make([]byte, 4), makeMP4Box("hdlr", make([]byte, 24)), ilst)),
+	)
+
+	var content []byte
+	content = append(content, makeMP4Box("ftyp", []byte("isom\x00\x00\x02\x00"))...)
+	content = append(content, makeMP4Box("mdat", make([]byte, 5000))...)
+	content = append(content, moov...)
+
+	meta := extractMetadata(t, "video/mp4", content)
+	assert.Equal(t, "Holidays", meta["title"])
+	assert.Equal(t, 5, meta["track"])
+	assert.Equal(t, 12.5, meta["duration"])
+	assert.Equal(t, time.Date(2016, time.September, 17, 0, 0, 0, 0, time.UTC), meta["datetime"])
+	assert.Equal(t, "h264", meta["video_codec"])
+	assert.Equal(t, 1280, meta["width"])
+	assert.Equal(t, 720, meta["height"])
+	assert.Equal(t, "aac", meta["audio_codec"])
+	assert.Equal(t, 2, meta["channels"])
+	assert.Equal(t, 48000, meta["sample_rate"])
+}
+
+func ebml(id uint32, children ...[]byte) []byte {
+	var el []byte
+	for shift := uint(24); shift > 0; shift -= 8 {
+		if id>>shift != 0 {
+			el = append(el, byte(id>>shift))
+		}
+	}
+	el = append(el, byte(id))
+	var data []byte
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data)))
+	size[0] = 0x01
+	el = append(el, size...)
+	return append(el, data...)
+}
+
+func TestWebMMetadataExtractor(t *testing.T) {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(65000))
+	frequency := make([]byte, 4)
+	binary.BigEndian.PutUint32(frequency, math.Float32bits(48000))
+
+	var content []byte
+	content = append(content, ebml(0x1A45DFA3, ebml(0x4282, []byte("webm")))...)
+	// A segment with an unknown size, like for a live stream
+	content = append(content, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	content = append(content, ebml(0xEC, make([]byte, 20))...) // Void
+	content = append(content, ebml(0x1549A966,
+		ebml(0x2AD7B1, []byte{0x0F, 0x42, 0x40}),
+		ebml(0x4489, duration),
+		ebml(0x7BA9, []byte("Clip")),
+	)...)
+	content = append(content, ebml(0x1654AE6B,
+		ebml(0xAE,
+			ebml(0x83, []byte{1}),
+			ebml(0x86, []byte("V_VP9")),
+			ebml(0xE0, ebml(0xB0, []byte{0x02, 0x80}), ebml(0xBA, []byte{0x01, 0x68})),
+		),
+		ebml(0xAE,
+			ebml(0x83, []byte{2}),
+			ebml(0x86, []byte("A_OPUS")),
+			ebml(0xE1, ebml(0xB5, frequency), ebml(0x9F, []byte{2})),
+		),
+	)...)
+	content = append(content, ebml(0x1F43B675, make([]byte, 5000))...)
+
+	meta := extractMetadata(t, "video/webm", content)
+	assert.Equal(t, "Clip", meta["title"])
+	assert.Equal(t, 65.0, meta["duration"])
+	assert.Equal(t, "vp9", meta["video_codec"])
+	assert.Equal(t, 640, meta["width"])
+	assert.Equal(t, 360, meta["height"])
+	assert.Equal(t, "opus", meta["audio_codec"])
+	assert.Equal(t, 48000, meta["sample_rate"])
+	assert.Equal(t, 2, meta["channels"])
+}
@@ -0,0 +1,529 @@
+package vfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// maxMoovSize is the maximal size of the moov box of a MP4 file, or of the
+// Info and Tracks elements of a WebM file, read in memory
+const maxMoovSize = 64 << 20
+
+// NewMP4Extractor returns an extractor for the tags, the duration, the
+// dimensions and the codecs of the MP4, M4A and QuickTime files
+func NewMP4Extractor() *MediaExtractor {
+	return newMediaExtractor(parseMP4)
+}
+
+// NewWebMExtractor returns an extractor for the title, the duration, the
+// dimensions and the codecs of the WebM and Matroska files
+func NewWebMExtractor() *MediaExtractor {
+	return newMediaExtractor(parseWebM)
+}
+
+// mp4Epoch is the number of seconds between 1904-01-01, used by the MP4
+// dates, and the Unix epoch
+const mp4Epoch = 2082844800
+
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hev1": "hevc",
+	"hvc1": "hevc",
+	"mp4v": "mpeg4",
+	"vp08": "vp8",
+	"vp09": "vp9",
+	"av01": "av1",
+	"mp4a": "aac",
+	"alac": "alac",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	".mp3": "mp3",
+}
+
+var mp4Tags = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"aART":    "album_artist",
+	"\xa9alb": "album",
+	"\xa9gen": "genre",
+	"\xa9day": "year",
+}
+
+// mp4Box is a box of a MP4 file read in memory
+type mp4Box struct {
+	kind string
+	data []byte
+}
+
+// mp4Children splits the content of a box in its children boxes
+func mp4Children(data []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, mp4Box{kind, data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// parseMP4 reads the top-level boxes of a MP4 file until the moov box, where
+// all the metadata are.
+func parseMP4(r *bufio.Reader, m Metadata) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		switch size {
+		case 0: // The box extends to the end of the file
+			return nil
+		case 1:
+			if _, err := io.ReadFull(r, header); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header)) - 16
+		default:
+			size -= 8
+		}
+		if size < 0 {
+			return errInvalidMedia
+		}
+		if kind != "moov" {
+			if err := discard(r, size); err != nil {
+				return err
+			}
+			continue
+		}
+		if size > maxMoovSize {
+			return errInvalidMedia
+		}
+		moov := make([]byte, size)
+		if _, err := io.ReadFull(r, moov); err != nil {
+			return err
+		}
+		parseMP4Moov(moov, m)
+		return nil
+	}
+}
+
+func parseMP4Moov(moov []byte, m Metadata) {
+	for _, box := range mp4Children(moov) {
+		switch box.kind {
+		case "mvhd":
+			parseMP4Mvhd(box.data, m)
+		case "trak":
+			parseMP4Trak(box.data, m)
+		case "udta":
+			for _, meta := range mp4Children(box.data) {
+				if meta.kind != "meta" {
+					continue
+				}
+				data := meta.data
+				// The meta box is a full box in MP4, but not in QuickTime
+				if len(data) >= 8 && string(data[4:8]) != "hdlr" {
+					data = data[4:]
+				}
+				for _, ilst := range mp4Children(data) {
+					if ilst.kind == "ilst" {
+						parseMP4Ilst(ilst.data, m)
+					}
+				}
+			}
+		}
+	}
+}
+
+func parseMP4Mvhd(data []byte, m Metadata) {
+	var created, scale, duration uint64
+	switch {
+	case len(data) >= 32 && data[0] == 1:
+		created = binary.BigEndian.Uint64(data[4:])
+		scale = uint64(binary.BigEndian.Uint32(data[20:]))
+		duration = binary.BigEndian.Uint64(data[24:])
+	case len(data) >= 20:
+		created = uint64(binary.BigEndian.Uint32(data[4:]))
+		scale = uint64(binary.BigEndian.Uint32(data[12:]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:]))
+	default:
+		return
+	}
+	if scale > 0 {
+		setDuration(m, float64(duration)/float64(scale))
+	}
+	if created > mp4Epoch {
+		m["datetime"] = time.Unix(int64(created-mp4Epoch), 0).UTC()
+	}
+}
+
+func parseMP4Trak(trak []byte, m Metadata) {
+	var handler string
+	var entries []byte
+	for _, mdia := range mp4Children(trak) {
+		if mdia.kind != "mdia" {
+			continue
+		}
+		for _, box := range mp4Children(mdia.data) {
+			switch box.kind {
+			case "hdlr":
+				if len(box.data) >= 12 {
+					handler = string(box.data[8:12])
+				}
+			case "minf":
+				for _, stbl := range mp4Children(box.data) {
+					if stbl.kind != "stbl" {
+						continue
+					}
+					for _, stsd := range mp4Children(stbl.data) {
+						if stsd.kind == "stsd" && len(stsd.data) >= 8 {
+							entries = stsd.data[8:]
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(entries) < 8 {
+		return
+	}
+	// Only the first sample entry is used
+	format := string(entries[4:8])
+	codec, ok := mp4Codecs[format]
+	if !ok {
+		codec = strings.ToLower(strings.TrimSpace(format))
+	}
+	switch handler {
+	case "vide":
+		if _, ok := m["video_codec"]; ok {
+			return
+		}
+		m["video_codec"] = codec
+		if len(entries) >= 36 {
+			m["width"] = int(binary.BigEndian.Uint16(entries[32:]))
+			m["height"] = int(binary.BigEndian.Uint16(entries[34:]))
+		}
+	case "soun":
+		if _, ok := m["audio_codec"]; ok {
+			return
+		}
+		m["audio_codec"] = codec
+		if len(entries) >= 36 {
+			m["channels"] = int(binary.BigEndian.Uint16(entries[24:]))
+			m["sample_rate"] = int(binary.BigEndian.Uint16(entries[32:]))
+		}
+	}
+}
+
+func parseMP4Ilst(ilst []byte, m Metadata) {
+	for _, item := range mp4Children(ilst) {
+		var value []byte
+		for _, data := range mp4Children(item.data) {
+			if data.kind == "data" && len(data.data) >= 8 {
+				value = data.data[8:]
+				break
+			}
+		}
+		if value == nil {
+			continue
+		}
+		switch item.kind {
+		case "trkn", "disk":
+			if len(value) >= 4 {
+				key := "track"
+				if item.kind == "disk" {
+					key = "disc"
+				}
+				if n := int(binary.BigEndian.Uint16(value[2:])); n > 0 {
+					m[key] = n
+				}
+			}
+		default:
+			if key, ok := mp4Tags[item.kind]; ok {
+				setMediaTag(m, key, string(value))
+			}
+		}
+	}
+}
+
+// The identifiers of the EBML elements used in the WebM and Matroska files
+const (
+	ebmlSegment           = 0x18538067
+	ebmlInfo              = 0x1549A966
+	ebmlTimecodeScale     = 0x2AD7B1
+	ebmlDuration          = 0x4489
+	ebmlDateUTC           = 0x4461
+	ebmlTitle             = 0x7BA9
+	ebmlTracks            = 0x1654AE6B
+	ebmlTrackEntry        = 0xAE
+	ebmlTrackType         = 0x83
+	ebmlCodecID           = 0x86
+	ebmlVideo             = 0xE0
+	ebmlPixelWidth        = 0xB0
+	ebmlPixelHeight       = 0xBA
+	ebmlAudio             = 0xE1
+	ebmlSamplingFrequency = 0xB5
+	ebmlChannels          = 0x9F
+	ebmlCluster           = 0x1F43B675
+)
+
+// ebmlUnknownSize is the size of the elements whose size is not known, like
+// the segment of a live stream
+const ebmlUnknownSize = -1
+
+// matroskaEpoch is the date used as origin by the dates of the Matroska files
+var matroskaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var webmCodecs = map[string]string{
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+	"V_MPEG4/ISO/SP":   "mpeg4",
+	"V_MPEG4/ISO/ASP":  "mpeg4",
+	"A_MPEG/L3":        "mp3",
+	"A_AAC":            "aac",
+}
+
+// readEBMLVarint reads a variable-length integer. For the identifiers, the
+// length marker is kept.
+func readEBMLVarint(r io.ByteReader, keepMarker bool) (int64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		if mask == 1 {
+			return 0, errInvalidMedia
+		}
+		length++
+	}
+	value := int64(first)
+	if !keepMarker {
+		value &= int64(0xFF >> uint(length))
+	}
+	unknown := value == int64(0xFF>>uint(length))
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		unknown = unknown && b == 0xFF
+		value = value<<8 | int64(b)
+	}
+	if !keepMarker && unknown {
+		return ebmlUnknownSize, nil
+	}
+	return value, nil
+}
+
+// ebmlElement is an element of an EBML document read in memory
+type ebmlElement struct {
+	id   int64
+	data []byte
+}
+
+func ebmlChildren(data []byte) []ebmlElement {
+	var elements []ebmlElement
+	r := &byteReader{data: data}
+	for r.pos < len(data) {
+		id, err := readEBMLVarint(r, true)
+		if err != nil {
+			return elements
+		}
+		size, err := readEBMLVarint(r, false)
+		if err != nil || size < 0 || size > int64(len(data)-r.pos) {
+			return elements
+		}
+		end := r.pos + int(size)
+		elements = append(elements, ebmlElement{id, data[r.pos:end]})
+		r.pos = end
+	}
+	return elements
+}
+
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func ebmlUint(data []byte) uint64 {
+	var n uint64
+	for _, b := range data {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// parseWebM reads the elements of the segment until the Info and Tracks
+// elements have been found, or the first cluster of media data is reached.
+func parseWebM(r *bufio.Reader, m Metadata) error {
+	var hasInfo, hasTracks bool
+	for !hasInfo || !hasTracks {
+		id, err := readEBMLVarint(r, true)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size, err := readEBMLVarint(r, false)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case ebmlSegment:
+			// The children of the segment are read in this loop
+			continue
+		case ebmlCluster:
+			return nil
+		}
+		if size == ebmlUnknownSize {
+			return errInvalidMedia
+		}
+		if id != ebmlInfo && id != ebmlTracks {
+			if err = discard(r, size); err != nil {
+				return err
+			}
+			continue
+		}
+		if size > maxMoovSize {
+			return errInvalidMedia
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if id == ebmlInfo {
+			hasInfo = true
+			parseWebMInfo(data, m)
+		} else {
+			hasTracks = true
+			parseWebMTracks(data, m)
+		}
+	}
+	return nil
+}
+
+func parseWebMInfo(info []byte, m Metadata) {
+	scale := uint64(1000000)
+	var duration float64
+	for _, el := range ebmlChildren(info) {
+		switch el.id {
+		case ebmlTimecodeScale:
+			if s := ebmlUint(el.data); s > 0 {
+				scale = s
+			}
+		case ebmlDuration:
+			duration = ebmlFloat(el.data)
+		case ebmlDateUTC:
+			if len(el.data) == 8 {
+				ns := int64(binary.BigEndian.Uint64(el.data))
+				m["datetime"] = matroskaEpoch.Add(time.Duration(ns))
+			}
+		case ebmlTitle:
+			setMediaTag(m, "title", string(el.data))
+		}
+	}
+	setDuration(m, duration*float64(scale)/1e9)
+}
+
+func parseWebMTracks(tracks []byte, m Metadata) {
+	for _, entry := range ebmlChildren(tracks) {
+		if entry.id != ebmlTrackEntry {
+			continue
+		}
+		var kind uint64
+		var codec string
+		var video, audio []byte
+		for _, el := range ebmlChildren(entry.data) {
+			switch el.id {
+			case ebmlTrackType:
+				kind = ebmlUint(el.data)
+			case ebmlCodecID:
+				codec = strings.TrimRight(string(el.data), "\x00")
+			case ebmlVideo:
+				video = el.data
+			case ebmlAudio:
+				audio = el.data
+			}
+		}
+		if name, ok := webmCodecs[codec]; ok {
+			codec = name
+		} else if len(codec) > 2 {
+			codec = strings.ToLower(codec[2:])
+		}
+		switch kind {
+		case 1:
+			if _, ok := m["video_codec"]; ok {
+				continue
+			}
+			m["video_codec"] = codec
+			for _, el := range ebmlChildren(video) {
+				switch el.id {
+				case ebmlPixelWidth:
+					m["width"] = int(ebmlUint(el.data))
+				case ebmlPixelHeight:
+					m["height"] = int(ebmlUint(el.data))
+				}
+			}
+		case 2:
+			if _, ok := m["audio_codec"]; ok {
+				continue
+			}
+			m["audio_codec"] = codec
+			m["channels"] = 1
+			for _, el := range ebmlChildren(audio) {
+				switch el.id {
+				case ebmlSamplingFrequency:
+					m["sample_rate"] = int(ebmlFloat(el.data))
+				case ebmlChannels:
+					m["channels"] = int(ebmlUint(el.data))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+)
+
+// ScrubResult is the result of the verification of the contents of the files
+// of a VFS.
+type ScrubResult struct {
+	// Checked is the number of files whose content has been read
+	Checked int
+	// Corrupted is the list of the files whose stored content no longer
+	// matches their checksums
+	Corrupted []*FileDoc
+}
+
+// ScrubFiles reads the content of all the files, and checks them against the
+// size, the md5sum and the sha256sum of their documents. The files whose
+// content doesn't match are flagged as corrupted, and the flag is removed if
+// their content is valid again. The sha256sum of the files created before it
+// was computed is added when their content is valid.
+func ScrubFiles(fs VFS) (*ScrubResult, error) {
+	res := &ScrubResult{}
+	err := Walk(fs, "/", func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		valid, sha256sum, err := checkContent(fs, file)
+		if err != nil {
+			return err
+		}
+		res.Checked++
+		// The document is updated only if the flag or the sha256sum changes
+		backfill := valid && file.SHA256Sum == nil
+		if file.Corrupted != !valid || backfill {
+			newdoc := file.Clone().(*FileDoc)
+			newdoc.Corrupted = !valid
+			if backfill {
+				newdoc.SHA256Sum = sha256sum
+			}
+			err = fs.UpdateFileDoc(file, newdoc)
+			// The file has been modified or removed while its content was
+			// read: it is skipped, and its new content will be checked by
+			// the next scrub.
+			if couchdb.IsConflictError(err) || couchdb.IsNotFoundError(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !valid {
+			res.Corrupted = append(res.Corrupted, file)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// checkContent reads the content of a file, and returns true if it matches
+// the file document, with the sha256sum of the content. An error is returned
+// only if the content cannot be read for a reason unrelated to its
+// integrity, like a network error.
+func checkContent(fs VFS, doc *FileDoc) (bool, []byte, error) {
+	f, err := fs.OpenFile(doc)
+	if os.IsNotExist(err) || err == vfscrypt.ErrCorrupted || err == vfscrypt.ErrNotEncrypted {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	defer f.Close()
+
+	md5h := md5.New() // #nosec
+	sha256h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(md5h, sha256h), f)
+	if err == vfscrypt.ErrCorrupted {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	sha256sum := sha256h.Sum(nil)
+	valid := n == doc.ByteSize && bytes.Equal(md5h.Sum(nil), doc.MD5Sum)
+	if doc.SHA256Sum != nil && !bytes.Equal(sha256sum, doc.SHA256Sum) {
+		valid = false
+	}
+	return valid, sha256sum, nil
+}
@@ -0,0 +1,53 @@
+package vfs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// PurgeTrash destroys the files and directories that have been put in the
+// trash before the given date, and returns the number of destroyed items.
+// The items trashed before their trash date was recorded are kept.
+func PurgeTrash(fs VFS, before time.Time) (int, error) {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The expired items are listed before destroying them, to not modify the
+	// content of the trash while iterating on it.
+	var dirs []*DirDoc
+	var files []*FileDoc
+	iter := fs.DirIterator(trash, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if d != nil && d.TrashedAt != nil && d.TrashedAt.Before(before) {
+			dirs = append(dirs, d)
+		}
+		if f != nil && f.TrashedAt != nil && f.TrashedAt.Before(before) {
+			files = append(files, f)
+		}
+	}
+
+	n := 0
+	for _, d := range dirs {
+		if err = fs.DestroyDirAndContent(d); err != nil {
+			return n, err
+		}
+		n++
+	}
+	for _, f := range files {
+		if err = fs.DestroyFile(f); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,357 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// UploadsDirName is the path of the directory where the chunks of the upload
+// sessions are stored
+const UploadsDirName = "/.cozy_uploads"
+
+// UploadSessionTTL is the duration after which an upload session expires if
+// no chunk has been received.
+var UploadSessionTTL = 24 * time.Hour
+
+var (
+	// ErrUploadSessionExpired is used when an upload session has expired
+	ErrUploadSessionExpired = errors.New("The upload session has expired")
+	// ErrInvalidChunk is used when a chunk is out of the bounds of the file
+	ErrInvalidChunk = errors.New("The chunk is out of the bounds of the file")
+	// ErrChunkOverlap is used when a chunk overlaps a chunk already received
+	ErrChunkOverlap = errors.New("The chunk overlaps a chunk already received")
+	// ErrUploadIncomplete is used when an upload session is committed before
+	// all the chunks have been received
+	ErrUploadIncomplete = errors.New("Some chunks of the file are missing")
+)
+
+// UploadChunk is a part of the content of a file, received in an upload
+// session.
+type UploadChunk struct {
+	Offset int64 `json:"offset,string"`
+	Size   int64 `json:"size,string"`
+}
+
+// UploadSession is used to upload a large file in several chunks, possibly in
+// several requests, and to resume the upload when a request has failed. The
+// session is committed into a file when all the chunks have been received.
+type UploadSession struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// Informations about the file that will be created
+	Name       string   `json:"name"`
+	DirID      string   `json:"dir_id"`
+	ByteSize   int64    `json:"size,string"`
+	MD5Sum     []byte   `json:"md5sum,omitempty"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
+	Mime       string   `json:"mime"`
+	Class      string   `json:"class"`
+	Executable bool     `json:"executable"`
+	Tags       []string `json:"tags"`
+
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	Chunks    []UploadChunk `json:"chunks"`
+}
+
+// ID returns the upload session qualified identifier
+func (s *UploadSession) ID() string { return s.DocID }
+
+// Rev returns the upload session revision
+func (s *UploadSession) Rev() string { return s.DocRev }
+
+// DocType returns the upload session document type
+func (s *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (s *UploadSession) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.MD5Sum = make([]byte, len(s.MD5Sum))
+	copy(cloned.MD5Sum, s.MD5Sum)
+	if s.SHA256Sum != nil {
+		cloned.SHA256Sum = make([]byte, len(s.SHA256Sum))
+		copy(cloned.SHA256Sum, s.SHA256Sum)
+	}
+	cloned.Tags = make([]string, len(s.Tags))
+	copy(cloned.Tags, s.Tags)
+	cloned.Chunks = make([]UploadChunk, len(s.Chunks))
+	copy(cloned.Chunks, s.Chunks)
+	return &cloned
+}
+
+// SetID changes the upload session qualified identifier
+func (s *UploadSession) SetID(id string) { s.DocID = id }
+
+// SetRev changes the upload session revision
+func (s *UploadSession) SetRev(rev string) { s.DocRev = rev }
+
+// Expired returns true if the upload session has expired at the given date.
+func (s *UploadSession) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+// Received returns the number of bytes received in the session.
+func (s *UploadSession) Received() int64 {
+	var received int64
+	for _, c := range s.Chunks {
+		received += c.Size
+	}
+	return received
+}
+
+// Complete returns true if all the chunks have been received.
+func (s *UploadSession) Complete() bool {
+	var next int64
+	for _, c := range s.Chunks {
+		if c.Offset != next {
+			return false
+		}
+		next += c.Size
+	}
+	return next == s.ByteSize
+}
+
+// FileDoc returns the document of the file that will be created when the
+// session is committed.
+func (s *UploadSession) FileDoc() (*FileDoc, error) {
+	doc, err := NewFileDoc(s.Name, s.DirID, s.ByteSize, s.MD5Sum, s.Mime, s.Class,
+		time.Now(), s.Executable, false, s.Tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.SHA256Sum = s.SHA256Sum
+	return doc, nil
+}
+
+// addChunk adds the chunk to the list of the received chunks. A chunk sent
+// again with the same offset and size replaces the previous one.
+func (s *UploadSession) addChunk(chunk UploadChunk) error {
+	for _, c := range s.Chunks {
+		if c == chunk {
+			return nil
+		}
+		if chunk.Offset < c.Offset+c.Size && c.Offset < chunk.Offset+chunk.Size {
+			return ErrChunkOverlap
+		}
+	}
+	s.Chunks = append(s.Chunks, chunk)
+	sort.Sort(byOffset(s.Chunks))
+	return nil
+}
+
+type byOffset []UploadChunk
+
+func (c byOffset) Len() int           { return len(c) }
+func (c byOffset) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byOffset) Less(i, j int) bool { return c[i].Offset < c[j].Offset }
+
+// CreateUploadSession checks that the file can be created, and that there is
+// enough space left on the disk for it, before creating the upload session.
+func CreateUploadSession(fs VFS, session *UploadSession) error {
+	doc, err := session.FileDoc()
+	if err != nil {
+		return err
+	}
+	if doc.ByteSize < 0 {
+		return ErrContentLengthMismatch
+	}
+	parent, err := fs.DirByID(doc.DirID)
+	if os.IsNotExist(err) {
+		return ErrParentDoesNotExist
+	}
+	if err != nil {
+		return err
+	}
+	if parent.DocID == consts.TrashDirID || parent.RestorePath != "" {
+		return ErrParentInTrash
+	}
+
+	// The sessions are garbage collected by a periodic job, but it is cheap to
+	// clean the expired sessions of the instance here too.
+	now := time.Now().UTC()
+	if _, err = PurgeExpiredUploadSessions(fs, now); err != nil {
+		return err
+	}
+
+	// The space of the whole file is reserved for the session, so the other
+	// pending sessions can't use it.
+	if quota := fs.DiskQuota(); quota > 0 {
+		used, err := usedWithUploads(fs, now)
+		if err != nil {
+			return err
+		}
+		if used+doc.ByteSize > quota {
+			return ErrFileTooBig
+		}
+	}
+
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(UploadSessionTTL)
+	session.Chunks = []UploadChunk{}
+	return fs.CreateUploadSession(session)
+}
+
+// AddUploadChunk stores a chunk of the file, starting at the given offset,
+// and adds it to the received chunks of the session.
+func AddUploadChunk(fs VFS, session *UploadSession, offset, size int64, content io.Reader) (*UploadSession, error) {
+	if session.Expired(time.Now()) {
+		return nil, ErrUploadSessionExpired
+	}
+	chunk := UploadChunk{Offset: offset, Size: size}
+	if offset < 0 || size <= 0 || offset+size > session.ByteSize {
+		return nil, ErrInvalidChunk
+	}
+	if err := session.Clone().(*UploadSession).addChunk(chunk); err != nil {
+		return nil, err
+	}
+
+	// The space of the whole file has been reserved when the session was
+	// created, but the disk usage may have grown since. The reserved space
+	// includes the size of this session.
+	if quota := fs.DiskQuota(); quota > 0 {
+		used, err := usedWithUploads(fs, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if used > quota {
+			return nil, ErrFileTooBig
+		}
+	}
+
+	w, err := fs.CreateUploadChunk(session, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, content)
+	if cerr := w.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Several chunks can be received in parallel, so the session is reloaded
+	// in case of a conflict.
+	for i := 0; i < 5; i++ {
+		if err = session.addChunk(chunk); err != nil {
+			return nil, err
+		}
+		session.ExpiresAt = time.Now().UTC().Add(UploadSessionTTL)
+		err = fs.UpdateUploadSession(session)
+		if !couchdb.IsConflictError(err) {
+			break
+		}
+		if session, err = fs.UploadSessionByID(session.ID()); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// usedWithUploads returns the disk usage, plus the size of the files of the
+// pending upload sessions, as their chunks are not counted in the disk usage.
+func usedWithUploads(fs VFS, now time.Time) (int64, error) {
+	used, err := fs.DiskUsage()
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := fs.PendingUploadSessions(now)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		used += s.ByteSize
+	}
+	return used, nil
+}
+
+// CommitUploadSession creates the file from the chunks received in the upload
+// session. The md5sum and sha256sum, if given, are checked against the content
+// of the file.
+func CommitUploadSession(fs VFS, session *UploadSession, md5sum, sha256sum []byte) (*FileDoc, error) {
+	if session.Expired(time.Now()) {
+		return nil, ErrUploadSessionExpired
+	}
+	if !session.Complete() {
+		return nil, ErrUploadIncomplete
+	}
+
+	newdoc, err := session.FileDoc()
+	if err != nil {
+		return nil, err
+	}
+	if len(md5sum) > 0 {
+		if len(newdoc.MD5Sum) > 0 && string(md5sum) != string(newdoc.MD5Sum) {
+			return nil, ErrInvalidHash
+		}
+		newdoc.MD5Sum = md5sum
+	}
+	if len(sha256sum) > 0 {
+		if len(newdoc.SHA256Sum) > 0 && string(sha256sum) != string(newdoc.SHA256Sum) {
+			return nil, ErrInvalidDigest
+		}
+		newdoc.SHA256Sum = sha256sum
+	}
+	if err = fs.CommitUploadChunks(session, newdoc); err != nil {
+		return nil, err
+	}
+
+	// The file has been created, an error while cleaning the session will be
+	// fixed by the garbage collection of the expired sessions.
+	DestroyUploadSession(fs, session) // #nosec
+	return newdoc, nil
+}
+
+// CopyUploadChunks creates the file from the chunks of an upload session by
+// streaming their content through the stack. It can be used by the VFS
+// implementations for CommitUploadChunks.
+func CopyUploadChunks(fs VFS, session *UploadSession, newdoc *FileDoc) error {
+	content, err := fs.OpenUploadChunks(session)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file, err := fs.CreateFile(newdoc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DestroyUploadSession removes an upload session and its chunks.
+func DestroyUploadSession(fs VFS, session *UploadSession) error {
+	if err := fs.DestroyUploadChunks(session); err != nil {
+		return err
+	}
+	return fs.DeleteUploadSession(session)
+}
+
+// PurgeExpiredUploadSessions removes the upload sessions that have expired
+// at the given date, and returns the number of removed sessions.
+func PurgeExpiredUploadSessions(fs VFS, now time.Time) (int, error) {
+	sessions, err := fs.ExpiredUploadSessions(now)
+	if err != nil {
+		return 0, err
+	}
+	for i, s := range sessions {
+		if err = DestroyUploadSession(fs, s); err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
@@ -0,0 +1,244 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// VersionsDirName is the path of the directory where the old versions of the
+// files are stored
+const VersionsDirName = "/.cozy_versions"
+
+// DefaultVersionsMaxAge is the duration after which the old versions are
+// removed when the versioning is enabled without a max age.
+const DefaultVersionsMaxAge = 30 * 24 * time.Hour
+
+// DefaultVersionsMaxCount is the maximal number of old versions kept for a
+// file when no retention policy has been configured for the instance.
+const DefaultVersionsMaxCount = 20
+
+// DefaultVersionsRetention is the retention policy used when none has been
+// configured for the instance.
+var DefaultVersionsRetention = VersionsRetention{
+	MaxCount: DefaultVersionsMaxCount,
+	MaxAge:   DefaultVersionsMaxAge,
+}
+
+// Version is a struct containing the informations about an old version of a
+// file. When the content of a file is replaced, the previous binary is kept
+// and a version document is created to reference it.
+//
+// It implements the couchdb.Doc and jsonapi.Object interfaces.
+type Version struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// Identifier of the file of this version
+	FileID string `json:"file_id"`
+
+	// Last modification date of the content of this version
+	UpdatedAt time.Time `json:"updated_at"`
+	// Date at which this content has been replaced
+	CreatedAt time.Time `json:"created_at"`
+
+	ByteSize  int64    `json:"size,string"`
+	MD5Sum    []byte   `json:"md5sum"`
+	SHA256Sum []byte   `json:"sha256sum,omitempty"`
+	Mime      string   `json:"mime"`
+	Tags      []string `json:"tags"`
+
+	// Identifier of the blob holding the content, when it is shared with
+	// other files
+	BlobID string `json:"blob_id,omitempty"`
+}
+
+// ID returns the version qualified identifier
+func (v *Version) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *Version) DocType() string { return consts.FilesVersions }
+
+// Clone implements couchdb.Doc
+func (v *Version) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.MD5Sum = make([]byte, len(v.MD5Sum))
+	copy(cloned.MD5Sum, v.MD5Sum)
+	if v.SHA256Sum != nil {
+		cloned.SHA256Sum = make([]byte, len(v.SHA256Sum))
+		copy(cloned.SHA256Sum, v.SHA256Sum)
+	}
+	cloned.Tags = make([]string, len(v.Tags))
+	copy(cloned.Tags, v.Tags)
+	return &cloned
+}
+
+// SetID changes the version qualified identifier
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// NewVersion returns a version document for the current content of the given
+// file, before it gets replaced.
+func NewVersion(file *FileDoc) *Version {
+	return &Version{
+		DocID:     utils.RandomString(16),
+		FileID:    file.ID(),
+		UpdatedAt: file.UpdatedAt,
+		CreatedAt: time.Now(),
+		ByteSize:  file.ByteSize,
+		MD5Sum:    file.MD5Sum,
+		SHA256Sum: file.SHA256Sum,
+		Mime:      file.Mime,
+		Tags:      file.Tags,
+		BlobID:    file.BlobID,
+	}
+}
+
+// VersionsRetention is the policy used to decide which old versions of a file
+// are kept.
+type VersionsRetention struct {
+	// MaxCount is the maximal number of versions kept for a file. If minus or
+	// equal to zero, no version is kept.
+	MaxCount int
+	// MaxAge is the duration after which a version is removed. If minus or
+	// equal to zero, the versions are kept regardless of their age.
+	MaxAge time.Duration
+}
+
+// Enabled returns true if the policy allows to keep old versions.
+func (r VersionsRetention) Enabled() bool {
+	return r.MaxCount > 0
+}
+
+// Expired returns the list of versions that should be removed to enforce the
+// retention policy. The given versions should be the versions of one file.
+func (r VersionsRetention) Expired(versions []*Version, now time.Time) []*Version {
+	sorted := make([]*Version, len(versions))
+	copy(sorted, versions)
+	SortVersions(sorted)
+	var expired []*Version
+	for i, v := range sorted {
+		if i >= r.MaxCount || (r.MaxAge > 0 && now.Sub(v.CreatedAt) > r.MaxAge) {
+			expired = append(expired, v)
+		}
+	}
+	return expired
+}
+
+type byCreatedAt []*Version
+
+func (v byCreatedAt) Len() int           { return len(v) }
+func (v byCreatedAt) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byCreatedAt) Less(i, j int) bool { return v[i].CreatedAt.After(v[j].CreatedAt) }
+
+// SortVersions sorts the versions from the most recent to the oldest.
+func SortVersions(versions []*Version) {
+	sort.Stable(byCreatedAt(versions))
+}
+
+// ServeVersionContent replies to a http request using the content of an old
+// version of a file.
+func ServeVersionContent(fs VFS, doc *FileDoc, version *Version, disposition string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	header.Set("Content-Type", version.Mime)
+	if disposition != "" {
+		header.Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
+	}
+
+	if header.Get("Range") == "" {
+		eTag := base64.StdEncoding.EncodeToString(version.MD5Sum)
+		header.Set("Etag", eTag)
+	}
+
+	content, err := fs.OpenFileVersion(doc, version)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(w, req, doc.DocName, version.UpdatedAt, content)
+	return nil
+}
+
+// RevertFileVersion replaces the content of a file by the content of one of
+// its old versions. The current content of the file is itself kept as a new
+// version, and the restored version is removed.
+func RevertFileVersion(fs VFS, olddoc *FileDoc, version *Version) (*FileDoc, error) {
+	if version.FileID != olddoc.ID() {
+		return nil, os.ErrNotExist
+	}
+
+	content, err := fs.OpenFileVersion(olddoc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.ByteSize = version.ByteSize
+	newdoc.MD5Sum = version.MD5Sum
+	newdoc.SHA256Sum = version.SHA256Sum
+	newdoc.Metadata = nil
+	newdoc.UpdatedAt = time.Now()
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The version may already have been removed by the retention policy when
+	// the current content has been saved.
+	version, err = fs.VersionByID(version.ID())
+	if os.IsNotExist(err) {
+		return newdoc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, fs.DestroyVersion(version)
+}
+
+// PurgeVersions destroys the old versions that are older than the max age of
+// the retention policy. It returns the number of destroyed versions.
+func PurgeVersions(fs VFS, retention VersionsRetention, now time.Time) (int, error) {
+	if retention.MaxAge <= 0 {
+		return 0, nil
+	}
+	versions, err := fs.VersionsCreatedBefore(now.Add(-retention.MaxAge))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, v := range versions {
+		err = fs.DestroyVersion(v)
+		// The version may have been removed concurrently, when the file has
+		// been updated or destroyed.
+		if os.IsNotExist(err) || couchdb.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
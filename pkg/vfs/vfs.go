@@ -69,9 +69,42 @@ type Fs interface {
 	DestroyDirAndContent(doc *DirDoc) error
 	// DestroyFile  destroys a file from the trash.
 	DestroyFile(doc *FileDoc) error
+	// Fsck checks the consistency between the index and the content of the
+	// storage, and returns the list of the inconsistencies. If repair is true,
+	// the inconsistencies that can be fixed safely are repaired.
+	Fsck(repair bool) ([]*FsckLog, error)
+	// EncryptContents encrypts the contents that have been written before the
+	// encryption of the files was enabled, and returns how many of them have
+	// been encrypted. It returns ErrEncryptionDisabled if there is no key.
+	EncryptContents() (int, error)
+
+	// CopyFile creates a new file, described by newdoc, with the same content
+	// as the file of olddoc. The content is copied without being sent to the
+	// stack when the storage allows it.
+	CopyFile(olddoc, newdoc *FileDoc) error
 	// OpenFile return a file handler for reading associated with the given file
 	// document. The file handler implements io.ReadCloser and io.Seeker.
 	OpenFile(doc *FileDoc) (File, error)
+
+	// OpenFileVersion returns a file handler for reading the content of an
+	// old version of the given file.
+	OpenFileVersion(doc *FileDoc, version *Version) (File, error)
+	// DestroyVersion removes an old version of a file: its content and its
+	// document.
+	DestroyVersion(version *Version) error
+
+	// CreateUploadChunk returns a writer for storing a chunk of an upload
+	// session. The Close() method returns an error if the number of bytes
+	// written is not the expected size.
+	CreateUploadChunk(session *UploadSession, offset, size int64) (io.WriteCloser, error)
+	// OpenUploadChunks returns a reader over the content of all the chunks of
+	// an upload session, in the order of their offsets.
+	OpenUploadChunks(session *UploadSession) (io.ReadCloser, error)
+	// DestroyUploadChunks removes the chunks of an upload session.
+	DestroyUploadChunks(session *UploadSession) error
+	// CommitUploadChunks creates the file of the given document from the
+	// chunks of a complete upload session.
+	CommitUploadChunks(session *UploadSession, newdoc *FileDoc) error
 }
 
 // File is a reader, writer, seeker, closer iterface reprsenting an opened
@@ -91,7 +124,8 @@ type File interface {
 type Indexer interface {
 	InitIndex() error
 
-	// DiskUsage computes the total size of the files contained in the VFS.
+	// DiskUsage computes the total size of the files contained in the VFS,
+	// including their old versions.
 	DiskUsage() (int64, error)
 
 	// CreateFileDoc creates and add in the index a new file document.
@@ -103,8 +137,10 @@ type Indexer interface {
 	// new file document that you want to create and the old document,
 	// representing the current revision of the file.
 	UpdateFileDoc(olddoc, newdoc *FileDoc) error
-	// UpdateFileDocs is used to update several file docs in a bulk
-	UpdateFileDocs(docs []*FileDoc) error
+	// UpdateFileDocs is used to update several file docs in a bulk. The
+	// previous versions of the documents can be given in olddocs, in the
+	// same order, or olddocs can be nil.
+	UpdateFileDocs(docs, olddocs []*FileDoc) error
 	// DeleteFileDoc removes from the index the specified file document.
 	DeleteFileDoc(doc *FileDoc) error
 
@@ -146,9 +182,58 @@ type Indexer interface {
 	// directory.
 	DirIterator(doc *DirDoc, opts *IteratorOptions) DirIterator
 
+	// AllDirsAndFiles returns all the directories and files of the index.
+	AllDirsAndFiles() ([]*DirDoc, []*FileDoc, error)
+
 	// DirBatch returns a batch of documents
 	DirBatch(*DirDoc, couchdb.Cursor) ([]DirOrFileDoc, error)
 	DirLength(*DirDoc) (int, error)
+	// DirStats computes the recursive statistics of the files contained in
+	// the directory and its sub-directories.
+	DirStats(*DirDoc) (*DirStats, error)
+
+	// CreateVersion adds in the index a new version document.
+	CreateVersion(v *Version) error
+	// DeleteVersion removes from the index the specified version document.
+	DeleteVersion(v *Version) error
+	// VersionByID returns the version document associated with the specified
+	// identifier.
+	VersionByID(id string) (*Version, error)
+	// VersionsFor returns the list of the old versions of the specified file,
+	// from the most recent to the oldest.
+	VersionsFor(fileID string) ([]*Version, error)
+	// VersionsCreatedBefore returns the list of the old versions of the
+	// files that have been created before the given date.
+	VersionsCreatedBefore(before time.Time) ([]*Version, error)
+
+	// CreateUploadSession adds in the index a new upload session document.
+	CreateUploadSession(s *UploadSession) error
+	// UpdateUploadSession updates the document of an upload session.
+	UpdateUploadSession(s *UploadSession) error
+	// DeleteUploadSession removes from the index the specified upload session
+	// document.
+	DeleteUploadSession(s *UploadSession) error
+	// UploadSessionByID returns the upload session document associated with
+	// the specified identifier.
+	UploadSessionByID(id string) (*UploadSession, error)
+	// ExpiredUploadSessions returns the list of the upload sessions that have
+	// expired at the given date.
+	ExpiredUploadSessions(now time.Time) ([]*UploadSession, error)
+	// PendingUploadSessions returns the list of the upload sessions that
+	// have not expired at the given date.
+	PendingUploadSessions(now time.Time) ([]*UploadSession, error)
+
+	// RefBlob adds a reference to the blob with the given identifier, and
+	// returns true if the blob was not referenced before, in which case its
+	// content has to be stored.
+	RefBlob(id string, size int64) (bool, error)
+	// UnrefBlob removes a reference to the blob with the given identifier, and
+	// returns true if it was the last one, in which case its content has to be
+	// removed, and then DeleteBlob called.
+	UnrefBlob(id string) (bool, error)
+	// DeleteBlob removes the document of a blob without reference, once its
+	// content has been removed.
+	DeleteBlob(id string) error
 }
 
 // DiskThresholder it an interface that can be implemeted to known how many space
@@ -157,6 +242,9 @@ type DiskThresholder interface {
 	// DiskQuota returns the total number of bytes allowed to be stored in the
 	// VFS. If minus or equal to zero, it is considered without limit.
 	DiskQuota() int64
+	// VersionsRetention returns the policy used to decide which old versions
+	// of the files are kept.
+	VersionsRetention() VersionsRetention
 }
 
 // Thumbser defines an interface to define a thumbnail filesystem.
@@ -201,6 +289,17 @@ type DocPatch struct {
 	Tags        *[]string  `json:"tags,omitempty"`
 	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
 	Executable  *bool      `json:"executable,omitempty"`
+
+	// TrashedAt is only set by the vfs when a document is moved to the trash
+	TrashedAt *time.Time `json:"-"`
+}
+
+// MovedFrom is the previous location of a file or directory that has been
+// moved to another directory. It is kept on the document, so that the
+// clients limited to a directory can know that the document has left it.
+type MovedFrom struct {
+	DirID string `json:"dir_id"`
+	Path  string `json:"path,omitempty"`
 }
 
 // DirOrFileDoc is a union struct of FileDoc and DirDoc. It is useful to
@@ -211,11 +310,14 @@ type DirOrFileDoc struct {
 	// fields from FileDoc not contained in DirDoc
 	ByteSize   int64    `json:"size,string"`
 	MD5Sum     []byte   `json:"md5sum"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 	Mime       string   `json:"mime"`
 	Class      string   `json:"class"`
 	Executable bool     `json:"executable"`
 	Trashed    bool     `json:"trashed"`
+	Corrupted  bool     `json:"corrupted,omitempty"`
 	Metadata   Metadata `json:"metadata,omitempty"`
+	BlobID     string   `json:"blob_id,omitempty"`
 }
 
 // Refine returns either a DirDoc or FileDoc pointer depending on the type of
@@ -232,17 +334,22 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			DocName:      fd.DocName,
 			DirID:        fd.DirID,
 			RestorePath:  fd.RestorePath,
+			TrashedAt:    fd.TrashedAt,
 			CreatedAt:    fd.CreatedAt,
 			UpdatedAt:    fd.UpdatedAt,
 			ByteSize:     fd.ByteSize,
 			MD5Sum:       fd.MD5Sum,
+			SHA256Sum:    fd.SHA256Sum,
 			Mime:         fd.Mime,
 			Class:        fd.Class,
 			Executable:   fd.Executable,
 			Trashed:      fd.Trashed,
 			Tags:         fd.Tags,
+			Corrupted:    fd.Corrupted,
 			Metadata:     fd.Metadata,
+			BlobID:       fd.BlobID,
 			ReferencedBy: fd.ReferencedBy,
+			MovedFrom:    fd.MovedFrom,
 		}
 	}
 	return nil, nil
@@ -633,6 +740,10 @@ func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error
 		patch.Executable = data.Executable
 	}
 
+	if patch.TrashedAt == nil {
+		patch.TrashedAt = data.TrashedAt
+	}
+
 	return patch, nil
 }
 
@@ -643,6 +754,21 @@ func checkFileName(str string) error {
 	return nil
 }
 
+// checkReservedName returns an error if the name of a file or directory at
+// the root is the name of an internal directory of the stack. These
+// directories are not indexed, and a user directory with the same name could
+// be used to trash or destroy their content.
+func checkReservedName(name string, atRoot bool) error {
+	if !atRoot {
+		return nil
+	}
+	switch "/" + name {
+	case VersionsDirName, UploadsDirName, BlobsDirName:
+		return ErrReservedFilename
+	}
+	return nil
+}
+
 func uniqueTags(tags []string) []string {
 	m := make(map[string]struct{})
 	clone := make([]string, 0)
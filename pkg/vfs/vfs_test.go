@@ -1,8 +1,12 @@
 package vfs_test
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -23,13 +27,17 @@ import (
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
 )
 
 var fs vfs.VFS
 var diskQuota int64
+var versionsRetention vfs.VersionsRetention
 
 type diskImpl struct{}
 
@@ -37,6 +45,10 @@ func (d *diskImpl) DiskQuota() int64 {
 	return diskQuota
 }
 
+func (d *diskImpl) VersionsRetention() vfs.VersionsRetention {
+	return versionsRetention
+}
+
 type H map[string]H
 
 func (h H) String() string {
@@ -377,6 +389,30 @@ func TestUpdateDir(t *testing.T) {
 	}, tree)
 }
 
+func TestReservedNames(t *testing.T) {
+	_, err := vfs.NewDirDoc(fs, ".cozy_versions", consts.RootDirID, nil)
+	assert.Equal(t, vfs.ErrReservedFilename, err)
+	_, err = vfs.Mkdir(fs, "/.cozy_blobs", nil)
+	assert.Equal(t, vfs.ErrReservedFilename, err)
+	_, err = vfs.NewFileDoc(".cozy_uploads", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	assert.Equal(t, vfs.ErrReservedFilename, err)
+
+	dir, err := vfs.Mkdir(fs, "/reserved", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sub, err := vfs.Mkdir(fs, "/reserved/.cozy_versions", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rootID := consts.RootDirID
+	_, err = vfs.ModifyDirMetadata(fs, sub, &vfs.DocPatch{DirID: &rootID})
+	assert.Equal(t, vfs.ErrReservedFilename, err)
+	name := ".cozy_uploads"
+	_, err = vfs.ModifyDirMetadata(fs, dir, &vfs.DocPatch{Name: &name})
+	assert.Equal(t, vfs.ErrReservedFilename, err)
+}
+
 func TestWalk(t *testing.T) {
 	walktree := H{
 		"walk/": H{
@@ -555,7 +591,7 @@ func TestArchive(t *testing.T) {
 		},
 	}
 	w := httptest.NewRecorder()
-	err = a.Serve(fs, w)
+	err = a.Serve(fs, w, httptest.NewRequest("GET", "/test.zip", nil))
 	assert.NoError(t, err)
 
 	res := w.Result()
@@ -571,6 +607,13 @@ func TestArchive(t *testing.T) {
 	zipfiles := H{}
 	for _, f := range z.File {
 		zipfiles[f.Name] = nil
+		assert.Equal(t, zip.Deflate, f.Method)
+		rc, err := f.Open()
+		if assert.NoError(t, err) {
+			_, err = io.Copy(ioutil.Discard, rc)
+			assert.NoError(t, err)
+			rc.Close()
+		}
 	}
 	assert.EqualValues(t, H{
 		"test/foo.jpg":         nil,
@@ -578,6 +621,75 @@ func TestArchive(t *testing.T) {
 		"test/bar/baz/two.png": nil,
 		"test/bar/z.gif":       nil,
 	}, zipfiles)
+
+	a.Resumable = true
+	w = httptest.NewRecorder()
+	err = a.Serve(fs, w, httptest.NewRequest("GET", "/test.zip", nil))
+	assert.NoError(t, err)
+	res = w.Result()
+	b, err = ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", len(b)), res.Header.Get("Content-Length"))
+	z, err = zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if assert.NoError(t, err) && assert.Equal(t, 4, len(z.File)) {
+		for _, f := range z.File {
+			assert.Equal(t, zip.Store, f.Method)
+			rc, err := f.Open()
+			if assert.NoError(t, err) {
+				_, err = io.Copy(ioutil.Discard, rc)
+				assert.NoError(t, err)
+				rc.Close()
+			}
+		}
+
+		// The checksums are kept for the next downloads
+		foo, err := fs.FileByPath("/archive/foo.jpg")
+		if assert.NoError(t, err) {
+			crc, ok, err := vfs.GetStore().GetChecksum(foo.MD5Sum, foo.ByteSize)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, z.File[0].CRC32, crc)
+		}
+	}
+
+	// The end of the archive can be downloaded again, to resume a download
+	req := httptest.NewRequest("GET", "/test.zip", nil)
+	req.Header.Set("Range", "bytes=10-")
+	req.Header.Set("If-Range", res.Header.Get("Etag"))
+	w = httptest.NewRecorder()
+	err = a.Serve(fs, w, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, b[10:], w.Body.Bytes())
+
+	a.Resumable = false
+	for _, format := range []string{vfs.TarArchive, vfs.TarGzArchive} {
+		a.Format = format
+		w = httptest.NewRecorder()
+		err = a.Serve(fs, w, httptest.NewRequest("GET", "/test."+format, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, `attachment; filename=test.`+format, w.Header().Get("Content-Disposition"))
+		var r io.Reader = w.Body
+		if format == vfs.TarGzArchive {
+			r, err = gzip.NewReader(r)
+			if !assert.NoError(t, err) {
+				continue
+			}
+		}
+		tarfiles := H{}
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err) {
+				break
+			}
+			tarfiles[h.Name] = nil
+		}
+		assert.EqualValues(t, zipfiles, tarfiles)
+	}
 }
 
 func TestCreateFileTooBig(t *testing.T) {
@@ -683,120 +795,1266 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
-func TestMain(m *testing.M) {
-	config.UseTestFile()
+func TestFileVersions(t *testing.T) {
+	versionsRetention = vfs.VersionsRetention{MaxCount: 2}
+	defer func() { versionsRetention = vfs.VersionsRetention{} }()
 
-	check, err := checkup.HTTPChecker{URL: config.CouchURL()}.Check()
-	if err != nil || check.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
-		os.Exit(1)
+	diskUsage1, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
 	}
 
-	var rollback func()
-	fs, rollback, err = makeAferoFS()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	doc, err := vfs.NewFileDoc("versioned", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(f, strings.NewReader("content 1"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
 	}
-	res1 := m.Run()
-	rollback()
 
-	fs, rollback, err = makeSwiftFS()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for _, content := range []string{"content 2", "content 3", "content 4"} {
+		olddoc, err := fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		newdoc := olddoc.Clone().(*vfs.FileDoc)
+		newdoc.ByteSize = -1
+		newdoc.MD5Sum = nil
+		f, err = fs.CreateFile(newdoc, olddoc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.Copy(f, strings.NewReader(content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
 	}
-	res2 := m.Run()
-	rollback()
 
-	os.Exit(res1 + res2)
-}
+	versions, err := fs.VersionsFor(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, versions, 2) {
+		return
+	}
 
-func makeAferoFS() (vfs.VFS, func(), error) {
-	tempdir, err := ioutil.TempDir("", "cozy-stack")
-	if err != nil {
-		return nil, nil, errors.New("could not create temporary directory")
+	current, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
 	}
+	f, err = fs.OpenFileVersion(current, versions[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "content 3", string(buf))
 
-	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
-	index := vfs.NewCouchdbIndexer(db)
-	aferoFs, err := vfsafero.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
-		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
-	if err != nil {
-		return nil, nil, err
+	diskUsage2, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, diskUsage1+3*int64(len("content 1")), diskUsage2)
+
+	restored, err := vfs.RevertFileVersion(fs, current, versions[1])
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.OpenFile(restored)
+	if !assert.NoError(t, err) {
+		return
 	}
+	buf, err = ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "content 2", string(buf))
 
-	err = couchdb.ResetDB(db, consts.Files)
-	if err != nil {
-		return nil, nil, err
+	versions, err = fs.VersionsFor(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	restored, err = fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.NoError(t, fs.DestroyFile(restored))
+	versions, err = fs.VersionsFor(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
 
-	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
-	if err != nil {
-		return nil, nil, err
+	diskUsage3, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, diskUsage1, diskUsage3)
+}
+
+func TestVersionsRetention(t *testing.T) {
+	now := time.Now()
+	versions := []*vfs.Version{
+		{DocID: "a", CreatedAt: now.Add(-3 * time.Hour)},
+		{DocID: "b", CreatedAt: now.Add(-1 * time.Hour)},
+		{DocID: "c", CreatedAt: now.Add(-2 * time.Hour)},
+		{DocID: "d", CreatedAt: now.Add(-48 * time.Hour)},
 	}
 
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	retention := vfs.VersionsRetention{MaxCount: 2}
+	expired := retention.Expired(versions, now)
+	if assert.Len(t, expired, 2) {
+		assert.Equal(t, "a", expired[0].DocID)
+		assert.Equal(t, "d", expired[1].DocID)
 	}
 
-	err = aferoFs.InitFs()
-	if err != nil {
-		return nil, nil, err
+	retention = vfs.VersionsRetention{MaxCount: 10, MaxAge: 24 * time.Hour}
+	expired = retention.Expired(versions, now)
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, "d", expired[0].DocID)
 	}
 
-	return aferoFs, func() {
-		os.RemoveAll(tempdir)
-		couchdb.DeleteDB(db, consts.Files)
-	}, nil
+	assert.False(t, vfs.VersionsRetention{}.Enabled())
+	assert.True(t, vfs.DefaultVersionsRetention.Enabled())
 }
 
-func makeSwiftFS() (vfs.VFS, func(), error) {
-	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
-	index := vfs.NewCouchdbIndexer(db)
-	swiftSrv, err := swifttest.NewSwiftServer("localhost")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create swift server %s", err)
+func TestPurgeVersions(t *testing.T) {
+	retention := vfs.VersionsRetention{MaxCount: 5, MaxAge: time.Hour}
+	versionsRetention = retention
+	defer func() { versionsRetention = vfs.VersionsRetention{} }()
+
+	doc, err := vfs.NewFileDoc("purged-versions", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(f, strings.NewReader("content 1"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	for _, content := range []string{"content 2", "content 3"} {
+		olddoc, err := fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		newdoc := olddoc.Clone().(*vfs.FileDoc)
+		newdoc.ByteSize = -1
+		newdoc.MD5Sum = nil
+		f, err = fs.CreateFile(newdoc, olddoc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.Copy(f, strings.NewReader(content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
 	}
 
-	err = config.InitSwiftConnection(&url.URL{
-		Scheme:   "swift",
-		Host:     "localhost",
-		RawQuery: "UserName=swifttest&Password=swifttest&AuthURL=" + url.QueryEscape(swiftSrv.AuthURL),
-	})
-	if err != nil {
-		return nil, nil, err
+	n, err := vfs.PurgeVersions(fs, retention, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	versions, err := fs.VersionsFor(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	n, err = vfs.PurgeVersions(fs, retention, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	versions, err = fs.VersionsFor(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+
+	current, err := fs.FileByID(doc.ID())
+	if assert.NoError(t, err) {
+		assert.NoError(t, fs.DestroyFile(current))
 	}
+}
 
-	swiftFs, err := vfsswift.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
-		"io.cozy.vfs.test")
-	if err != nil {
-		return nil, nil, err
+func TestCopy(t *testing.T) {
+	tree := H{
+		"copy-src/": H{
+			"foo/": H{
+				"bar": nil,
+			},
+			"baz": nil,
+		},
+	}
+	src, err := createTree(tree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
 	}
 
-	err = couchdb.ResetDB(db, consts.Files)
-	if err != nil {
-		return nil, nil, err
+	copied, err := vfs.CopyDir(fs, src, root, "copy-dst")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/copy-dst", copied.Fullpath)
+	h, err := fetchTree("/copy-dst")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, H{"copy-dst/": tree["copy-src/"]}, h)
 	}
 
-	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
-	if err != nil {
-		return nil, nil, err
+	_, err = vfs.CopyDir(fs, src, copied, "")
+	assert.NoError(t, err)
+	foo, err := fs.DirByPath("/copy-src/foo")
+	if !assert.NoError(t, err) {
+		return
 	}
+	_, err = vfs.CopyDir(fs, src, foo, "")
+	assert.Equal(t, vfs.ErrForbiddenDocCopy, err)
 
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	doc, err := vfs.NewFileDoc("content", src.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, []string{"tag"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(f, strings.NewReader("copied content"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
 	}
 
-	err = swiftFs.InitFs()
-	if err != nil {
-		return nil, nil, err
+	copy1, err := vfs.CopyFile(fs, doc, src, "")
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.NotEqual(t, doc.ID(), copy1.ID())
+	assert.True(t, strings.HasPrefix(copy1.DocName, "content (__cozy__: "))
+	assert.Equal(t, doc.MD5Sum, copy1.MD5Sum)
+	assert.Equal(t, []string{"tag"}, copy1.Tags)
 
-	return swiftFs, func() {
-		couchdb.DeleteDB(db, consts.Files)
-		if swiftSrv != nil {
-			swiftSrv.Close()
-		}
+	copy2, err := vfs.CopyFile(fs, doc, root, "renamed")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "renamed", copy2.DocName)
+	f, err = fs.OpenFile(copy2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "copied content", string(buf))
+
+	diskQuota = 1
+	defer func() { diskQuota = 0 }()
+	_, err = vfs.CopyFile(fs, doc, root, "too-big")
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	_, err = vfs.CopyDir(fs, src, root, "too-big")
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+}
+
+func TestUploadSession(t *testing.T) {
+	content := "Hello, this file is uploaded in several chunks!"
+	session := &vfs.UploadSession{
+		Name:     "chunked.txt",
+		DirID:    consts.RootDirID,
+		ByteSize: int64(len(content)),
+		Mime:     "text/plain",
+		Class:    "text",
+	}
+	if !assert.NoError(t, vfs.CreateUploadSession(fs, session)) {
+		return
+	}
+	assert.NotEmpty(t, session.ID())
+
+	_, err := vfs.AddUploadChunk(fs, session, 40, 20, strings.NewReader(content[40:]))
+	assert.Equal(t, vfs.ErrInvalidChunk, err)
+
+	// The chunks are sent out of order
+	session, err = vfs.AddUploadChunk(fs, session, 20, 20, strings.NewReader(content[20:40]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.AddUploadChunk(fs, session, 30, 17, strings.NewReader(content[30:]))
+	assert.Equal(t, vfs.ErrChunkOverlap, err)
+	_, err = vfs.CommitUploadSession(fs, session, nil, nil)
+	assert.Equal(t, vfs.ErrUploadIncomplete, err)
+
+	session, err = vfs.AddUploadChunk(fs, session, 0, 20, strings.NewReader(content[:19]))
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	session, err = fs.UploadSessionByID(session.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	session, err = vfs.AddUploadChunk(fs, session, 0, 20, strings.NewReader(content[:20]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	session, err = vfs.AddUploadChunk(fs, session, 40, 7, strings.NewReader(content[40:]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, session.Chunks, 3)
+	assert.True(t, session.Complete())
+
+	badSum := md5.Sum([]byte("foo"))
+	_, err = vfs.CommitUploadSession(fs, session, badSum[:], nil)
+	assert.Equal(t, vfs.ErrInvalidHash, err)
+
+	goodSum := md5.Sum([]byte(content))
+	doc, err := vfs.CommitUploadSession(fs, session, goodSum[:], nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(len(content)), doc.ByteSize)
+	f, err := fs.OpenFile(doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, content, string(buf))
+
+	_, err = fs.UploadSessionByID(session.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadSessionQuota(t *testing.T) {
+	diskQuota = 1 << 20
+	defer func() { diskQuota = 0 }()
+
+	session := &vfs.UploadSession{
+		Name:     "too-big",
+		DirID:    consts.RootDirID,
+		ByteSize: diskQuota + 1,
+	}
+	assert.Equal(t, vfs.ErrFileTooBig, vfs.CreateUploadSession(fs, session))
+
+	// The quota is checked again for each chunk
+	used, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+	diskQuota = used + 30
+	session = &vfs.UploadSession{
+		Name:     "quota-shrinked",
+		DirID:    consts.RootDirID,
+		ByteSize: 20,
+	}
+	if !assert.NoError(t, vfs.CreateUploadSession(fs, session)) {
+		return
+	}
+	defer vfs.DestroyUploadSession(fs, session) // #nosec
+
+	// The space of the pending sessions is reserved
+	other := &vfs.UploadSession{
+		Name:     "quota-reserved",
+		DirID:    consts.RootDirID,
+		ByteSize: 20,
+	}
+	assert.Equal(t, vfs.ErrFileTooBig, vfs.CreateUploadSession(fs, other))
+
+	diskQuota = used + 10
+	_, err = vfs.AddUploadChunk(fs, session, 0, 20, strings.NewReader("01234567890123456789"))
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+}
+
+func TestUploadSessionExpiration(t *testing.T) {
+	session := &vfs.UploadSession{
+		Name:     "expired.txt",
+		DirID:    consts.RootDirID,
+		ByteSize: 3,
+	}
+	if !assert.NoError(t, vfs.CreateUploadSession(fs, session)) {
+		return
+	}
+	session, err := vfs.AddUploadChunk(fs, session, 0, 1, strings.NewReader("f"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := vfs.PurgeExpiredUploadSessions(fs, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = vfs.PurgeExpiredUploadSessions(fs, time.Now().Add(vfs.UploadSessionTTL+time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = fs.UploadSessionByID(session.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFsck(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+
+	doc, err := vfs.NewFileDoc("fsck-content", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(f, strings.NewReader("fsck content"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	doc, err = fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	goodMD5Sum := doc.MD5Sum
+	badMD5Sum := md5.Sum([]byte("other content"))
+	doc.MD5Sum = badMD5Sum[:]
+	if !assert.NoError(t, couchdb.UpdateDoc(db, doc)) {
+		return
+	}
+
+	ghost, err := vfs.NewFileDoc("fsck-ghost", consts.RootDirID, 12, goodMD5Sum, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(db, ghost)) {
+		return
+	}
+
+	findLogs := func(logs []*vfs.FsckLog) (mismatch, missing *vfs.FsckLog) {
+		for _, log := range logs {
+			if log.FileDoc == nil {
+				continue
+			}
+			switch log.FileDoc.ID() {
+			case doc.ID():
+				mismatch = log
+			case ghost.ID():
+				missing = log
+			}
+		}
+		return
+	}
+
+	logs, err := fs.Fsck(false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mismatch, missing := findLogs(logs)
+	if assert.NotNil(t, mismatch) {
+		assert.Equal(t, vfs.FileMismatch, mismatch.Type)
+		assert.Equal(t, goodMD5Sum, mismatch.ContentMD5Sum)
+		assert.False(t, mismatch.Repaired)
+	}
+	if assert.NotNil(t, missing) {
+		assert.Equal(t, vfs.ContentMissing, missing.Type)
+		assert.False(t, missing.Repaired)
+	}
+
+	logs, err = fs.Fsck(true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mismatch, missing = findLogs(logs)
+	if assert.NotNil(t, mismatch) {
+		assert.True(t, mismatch.Repaired)
+	}
+	if assert.NotNil(t, missing) {
+		assert.True(t, missing.Repaired)
+	}
+
+	logs, err = fs.Fsck(false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mismatch, missing = findLogs(logs)
+	assert.Nil(t, mismatch)
+	assert.Nil(t, missing)
+
+	doc, err = fs.FileByID(doc.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, goodMD5Sum, doc.MD5Sum)
+	}
+	_, err = fs.FileByID(ghost.ID())
+	assert.Error(t, err)
+}
+
+func TestScrubFiles(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+
+	doc, err := createFileWithContent("scrub-content", consts.RootDirID, []byte("scrub content"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sha256sum := sha256.Sum256([]byte("scrub content"))
+	assert.Equal(t, sha256sum[:], doc.SHA256Sum)
+	assert.False(t, doc.Corrupted)
+
+	isCorrupted := func(res *vfs.ScrubResult) bool {
+		for _, file := range res.Corrupted {
+			if file.ID() == doc.ID() {
+				return true
+			}
+		}
+		return false
+	}
+
+	res, err := vfs.ScrubFiles(fs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, isCorrupted(res))
+
+	badSHA256Sum := sha256.Sum256([]byte("other content"))
+	doc.SHA256Sum = badSHA256Sum[:]
+	if !assert.NoError(t, couchdb.UpdateDoc(db, doc)) {
+		return
+	}
+	res, err = vfs.ScrubFiles(fs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, isCorrupted(res))
+	doc, err = fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, doc.Corrupted)
+
+	doc.SHA256Sum = sha256sum[:]
+	if !assert.NoError(t, couchdb.UpdateDoc(db, doc)) {
+		return
+	}
+	res, err = vfs.ScrubFiles(fs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, isCorrupted(res))
+	doc, err = fs.FileByID(doc.ID())
+	if assert.NoError(t, err) {
+		assert.False(t, doc.Corrupted)
+	}
+
+	// The sha256sum of the files created without it is added
+	doc.SHA256Sum = nil
+	if !assert.NoError(t, couchdb.UpdateDoc(db, doc)) {
+		return
+	}
+	_, err = vfs.ScrubFiles(fs)
+	assert.NoError(t, err)
+	doc, err = fs.FileByID(doc.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, sha256sum[:], doc.SHA256Sum)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	tree := H{
+		"trash-purge/": H{
+			"dir/": H{
+				"foo": nil,
+			},
+			"bar": nil,
+			"baz": nil,
+		},
+	}
+	_, err := createTree(tree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dir, err := fs.DirByPath("/trash-purge/dir")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := fs.FileByPath("/trash-purge/bar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	recent, err := fs.FileByPath("/trash-purge/baz")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	trashedDir, err := vfs.TrashDir(fs, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotNil(t, trashedDir.TrashedAt)
+	trashedFile, err := vfs.TrashFile(fs, file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotNil(t, trashedFile.TrashedAt)
+
+	restored, err := vfs.RestoreFile(fs, trashedFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, restored.TrashedAt)
+	trashedFile, err = vfs.TrashFile(fs, restored)
+	if !assert.NoError(t, err) {
+		return
+	}
+	trashedRecent, err := vfs.TrashFile(fs, recent)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The directory and the first file are put in the trash two hours ago
+	longAgo := time.Now().Add(-2 * time.Hour)
+	olddir := trashedDir.Clone().(*vfs.DirDoc)
+	trashedDir.TrashedAt = &longAgo
+	if !assert.NoError(t, fs.UpdateDirDoc(olddir, trashedDir)) {
+		return
+	}
+	oldfile := trashedFile.Clone().(*vfs.FileDoc)
+	trashedFile.TrashedAt = &longAgo
+	if !assert.NoError(t, fs.UpdateFileDoc(oldfile, trashedFile)) {
+		return
+	}
+
+	n, err := vfs.PurgeTrash(fs, time.Now().Add(-3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = vfs.PurgeTrash(fs, time.Now().Add(-1*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	_, err = fs.DirByID(trashedDir.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByID(trashedFile.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByPath(vfs.TrashDirName + "/dir/foo")
+	assert.True(t, os.IsNotExist(err))
+	kept, err := fs.FileByID(trashedRecent.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, consts.TrashDirID, kept.DirID)
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	content, err := ioutil.ReadFile("../../assets/images/happycloud.png")
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err := vfs.NewFileDoc("update-metadata.png", consts.RootDirID, -1, nil, "image/png", "image", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	// Simulate a file uploaded with an old version of the extractor
+	olddoc, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, vfs.NeedsMetadataUpdate(olddoc))
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	newdoc.Metadata = vfs.Metadata{
+		"extractor_version": 1,
+		"datetime":          "2016-09-10T12:00:00Z",
+		"custom":            "kept",
+	}
+	if !assert.NoError(t, fs.UpdateFileDoc(olddoc, newdoc)) {
+		return
+	}
+
+	olddoc, err = fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, vfs.NeedsMetadataUpdate(olddoc))
+	if !assert.NoError(t, vfs.UpdateMetadata(fs, olddoc)) {
+		return
+	}
+
+	updated, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, vfs.NeedsMetadataUpdate(updated))
+	assert.EqualValues(t, vfs.MetadataExtractorVersion, updated.Metadata["extractor_version"])
+	assert.EqualValues(t, 140, updated.Metadata["width"])
+	assert.EqualValues(t, 140, updated.Metadata["height"])
+	assert.Equal(t, "2016-09-10T12:00:00Z", updated.Metadata["datetime"])
+	assert.Equal(t, "kept", updated.Metadata["custom"])
+}
+
+func TestExtractArchive(t *testing.T) {
+	mtime := time.Date(2016, 9, 10, 12, 0, 0, 0, time.UTC)
+	src, err := createTree(H{"extract-src/": H{"readme.txt": nil}}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	zipbuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipbuf)
+	for _, name := range []string{"photos/", "photos/a.txt", "readme.txt", "../evil.txt"} {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetModTime(mtime)
+		w, errc := zw.CreateHeader(hdr)
+		if !assert.NoError(t, errc) {
+			return
+		}
+		if !strings.HasSuffix(name, "/") {
+			_, errc = io.WriteString(w, "content of "+name)
+			assert.NoError(t, errc)
+		}
+	}
+	if !assert.NoError(t, zw.Close()) {
+		return
+	}
+	archive, err := createFileWithContent("archive.zip", src.ID(), zipbuf.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var done, total int64
+	err = vfs.ExtractArchive(fs, archive, src, func(d, tot int64) error {
+		done, total = d, tot
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, total, done)
+	assert.EqualValues(t, 66, total)
+
+	photos, err := fs.DirByPath("/extract-src/photos")
+	if assert.NoError(t, err) {
+		assert.True(t, mtime.Equal(photos.UpdatedAt))
+	}
+	a, err := fs.FileByPath("/extract-src/photos/a.txt")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, len("content of photos/a.txt"), a.ByteSize)
+		assert.True(t, mtime.Equal(a.UpdatedAt))
+		assert.Equal(t, "text/plain", a.Mime)
+	}
+	_, err = fs.FileByPath("/extract-src/evil.txt")
+	assert.NoError(t, err)
+	_, err = fs.FileByPath("/evil.txt")
+	assert.Error(t, err)
+
+	// The readme.txt file was already in the directory
+	iter := fs.DirIterator(src, nil)
+	names := map[string]bool{}
+	for {
+		d, f, errn := iter.Next()
+		if errn == vfs.ErrIteratorDone {
+			break
+		}
+		if !assert.NoError(t, errn) {
+			return
+		}
+		if d != nil {
+			names[d.DocName] = true
+		} else {
+			names[f.DocName] = true
+		}
+	}
+	assert.Len(t, names, 5)
+	assert.True(t, names["readme.txt"])
+	renamed := false
+	for name := range names {
+		if strings.HasPrefix(name, "readme.txt (__cozy__: ") {
+			renamed = true
+		}
+	}
+	assert.True(t, renamed)
+
+	tarbuf := &bytes.Buffer{}
+	gw := gzip.NewWriter(tarbuf)
+	tw := tar.NewWriter(gw)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     "docs/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  mtime,
+	}))
+	assert.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     "docs/script.sh",
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		Size:     9,
+		ModTime:  mtime,
+	}))
+	_, err = io.WriteString(tw, "echo test")
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	tgz, err := createFileWithContent("archive.tar.gz", src.ID(), tarbuf.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.ExtractArchive(fs, tgz, src, nil)) {
+		return
+	}
+	script, err := fs.FileByPath("/extract-src/docs/script.sh")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 9, script.ByteSize)
+		assert.True(t, script.Executable)
+		assert.True(t, mtime.Equal(script.UpdatedAt))
+	}
+
+	notArchive, err := fs.FileByPath("/extract-src/photos/a.txt")
+	if assert.NoError(t, err) {
+		err = vfs.ExtractArchive(fs, notArchive, src, nil)
+		assert.Equal(t, vfs.ErrUnsupportedArchive, err)
+	}
+
+	diskQuota = 1
+	defer func() { diskQuota = 0 }()
+	err = vfs.ExtractArchive(fs, archive, src, nil)
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+}
+
+func createFileWithContent(name, dirID string, content []byte) (*vfs.FileDoc, error) {
+	mime, class := vfs.ExtractMimeAndClassFromFilename(name)
+	doc, err := vfs.NewFileDoc(name, dirID, int64(len(content)), nil, mime, class, time.Now(), false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return fs.FileByID(doc.ID())
+}
+
+func TestDirStats(t *testing.T) {
+	dir, err := createTree(H{
+		"stats/": H{
+			"sub1/": H{
+				"subsub/": H{},
+			},
+			"sub2/": H{},
+		},
+	}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stats, err := fs.DirStats(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Size)
+	assert.Equal(t, int64(0), stats.FilesCount)
+	assert.Equal(t, int64(3), stats.DirsCount)
+
+	sub1, err := fs.DirByPath("/stats/sub1")
+	assert.NoError(t, err)
+	subsub, err := fs.DirByPath("/stats/sub1/subsub")
+	assert.NoError(t, err)
+	_, err = createFileWithContent("a.txt", dir.ID(), []byte("foo"))
+	assert.NoError(t, err)
+	_, err = createFileWithContent("b.txt", sub1.ID(), []byte("hello"))
+	assert.NoError(t, err)
+	last, err := createFileWithContent("c.txt", subsub.ID(), []byte("world!"))
+	assert.NoError(t, err)
+
+	stats, err = fs.DirStats(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), stats.Size)
+	assert.Equal(t, int64(3), stats.FilesCount)
+	assert.Equal(t, int64(3), stats.DirsCount)
+	assert.True(t, last.UpdatedAt.Equal(stats.UpdatedAt))
+
+	stats, err = fs.DirStats(sub1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), stats.Size)
+	assert.Equal(t, int64(2), stats.FilesCount)
+	assert.Equal(t, int64(1), stats.DirsCount)
+}
+
+func TestDedup(t *testing.T) {
+	if !config.GetConfig().Fs.Dedup {
+		t.Skip("the deduplication is not enabled")
+	}
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+
+	dir, err := vfs.Mkdir(fs, "/dedup", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	usage, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	create := func(name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = io.Copy(f, strings.NewReader("deduplicated content"))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return nil
+		}
+		return doc
+	}
+	refs := func(id string) int {
+		blob := &vfs.Blob{}
+		err := couchdb.GetDoc(db, consts.FilesBlobs, id, blob)
+		if couchdb.IsNotFoundError(err) {
+			return 0
+		}
+		assert.NoError(t, err)
+		return blob.Refs
+	}
+
+	doc1 := create("dedup1")
+	doc2 := create("dedup2")
+	if doc1 == nil || doc2 == nil {
+		return
+	}
+	assert.NotEmpty(t, doc1.BlobID)
+	assert.Equal(t, doc1.BlobID, doc2.BlobID)
+	assert.Equal(t, 2, refs(doc1.BlobID))
+
+	doc3, err := vfs.CopyFile(fs, doc1, dir, "dedup3")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, doc1.BlobID, doc3.BlobID)
+	assert.Equal(t, 3, refs(doc1.BlobID))
+
+	// The quota is still computed on the size of each file
+	newUsage, err := fs.DiskUsage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, usage+3*int64(len("deduplicated content")), newUsage)
+	}
+
+	assert.NoError(t, fs.DestroyFile(doc1))
+	assert.Equal(t, 2, refs(doc1.BlobID))
+	f, err := fs.OpenFile(doc2)
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		assert.Equal(t, "deduplicated content", string(buf))
+	}
+
+	assert.NoError(t, fs.DestroyDirAndContent(dir))
+	assert.Equal(t, 0, refs(doc1.BlobID))
+}
+
+func TestBlobRelease(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	id := "release-blob"
+
+	created, err := index.RefBlob(id, 42)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	released, err := index.UnrefBlob(id)
+	assert.NoError(t, err)
+	assert.True(t, released)
+
+	// The blob can't be referenced again while its content is being removed
+	_, err = index.RefBlob(id, 42)
+	assert.Equal(t, vfs.ErrConflict, err)
+
+	assert.NoError(t, index.DeleteBlob(id))
+	created, err = index.RefBlob(id, 42)
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	// A blob still referenced is not deleted
+	assert.NoError(t, index.DeleteBlob(id))
+	created, err = index.RefBlob(id, 42)
+	assert.NoError(t, err)
+	assert.False(t, created)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+
+	check, err := checkup.HTTPChecker{URL: config.CouchURL()}.Check()
+	if err != nil || check.Status() != checkup.Healthy {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+
+	var rollback func()
+	fs, rollback, err = makeAferoFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res1 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeSwiftFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res2 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeS3FS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res3 := m.Run()
+	rollback()
+
+	// The afero and swift backends are tested again with the deduplication of
+	// the contents.
+	config.GetConfig().Fs.Dedup = true
+
+	fs, rollback, err = makeAferoFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res4 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeSwiftFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res5 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4 + res5)
+}
+
+func makeAferoFS() (vfs.VFS, func(), error) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		return nil, nil, errors.New("could not create temporary directory")
+	}
+
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	aferoFs, err := vfsafero.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
+		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesUploads)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesUploads)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = aferoFs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aferoFs, func() {
+		os.RemoveAll(tempdir)
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
+	}, nil
+}
+
+func makeSwiftFS() (vfs.VFS, func(), error) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	swiftSrv, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create swift server %s", err)
+	}
+
+	err = config.InitSwiftConnection(&url.URL{
+		Scheme:   "swift",
+		Host:     "localhost",
+		RawQuery: "UserName=swifttest&Password=swifttest&AuthURL=" + url.QueryEscape(swiftSrv.AuthURL),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	swiftFs, err := vfsswift.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
+		"io.cozy.vfs.test", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesUploads)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesUploads)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = swiftFs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return swiftFs, func() {
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
+		if swiftSrv != nil {
+			swiftSrv.Close()
+		}
+	}, nil
+}
+
+func makeS3FS() (vfs.VFS, func(), error) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	// A fake S3 server, implementing the parts of the API used by MinIO
+	// clients, is used in place of a real MinIO server.
+	s3Srv := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	s3URL, err := url.Parse(s3Srv.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = config.InitS3Connection(&url.URL{
+		Scheme:   "s3",
+		Host:     s3URL.Host,
+		Path:     "/cozy-test",
+		RawQuery: "AccessKeyID=s3test&SecretAccessKey=s3test&Secure=false",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s3Fs, err := vfss3.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
+		"io.cozy.vfs.test", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesUploads)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesUploads)); err != nil {
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		s3Srv.Close()
 	}, nil
 }
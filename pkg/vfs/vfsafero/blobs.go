@@ -0,0 +1,109 @@
+package vfsafero
+
+import (
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/spf13/afero"
+)
+
+// When the deduplication is enabled, the content of a file is written in the
+// blobs directory, under the sha256 of the content, and an empty file is kept
+// at the path of the file to reserve its name. The blobs are reference
+// counted by the indexer, and the content is removed with the last reference.
+
+func blobPath(id string) string {
+	return path.Join(vfs.BlobsDirName, id[:2], id)
+}
+
+func blobTmpPath() string {
+	return path.Join(vfs.BlobsDirName, "tmp", utils.RandomString(16))
+}
+
+// contentPath returns the path where the content of the file is stored.
+func (afs *aferoVFS) contentPath(doc *vfs.FileDoc) (string, error) {
+	if doc.BlobID != "" {
+		return blobPath(doc.BlobID), nil
+	}
+	return afs.Indexer.FilePath(doc)
+}
+
+// createBlobTmp creates the temporary file where the content of a new blob
+// is written before its identifier is known.
+func (afs *aferoVFS) createBlobTmp() (afero.File, string, error) {
+	tmppath := blobTmpPath()
+	if err := afs.fs.MkdirAll(path.Dir(tmppath), 0755); err != nil {
+		return nil, "", err
+	}
+	f, err := safeCreateFile(tmppath, 0644, afs.fs)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, tmppath, nil
+}
+
+// storeBlob adds a reference for the given document to the blob of its
+// content, written in tmppath. The content is moved to the blob path if the
+// blob is new, and removed otherwise.
+func (afs *aferoVFS) storeBlob(tmppath string, doc *vfs.FileDoc, sum []byte) error {
+	id := vfs.BlobIDFromSum(sum)
+	created, err := afs.Indexer.RefBlob(id, doc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if !created {
+		afs.fs.Remove(tmppath) // #nosec
+		doc.BlobID = id
+		return nil
+	}
+	name := blobPath(id)
+	err = afs.fs.MkdirAll(path.Dir(name), 0755)
+	if err == nil {
+		err = afs.fs.Rename(tmppath, name)
+	}
+	if err != nil {
+		afs.releaseBlob(id) // #nosec
+		return err
+	}
+	doc.BlobID = id
+	return nil
+}
+
+// releaseBlob removes a reference to a blob, and its content if it was the
+// last reference.
+func (afs *aferoVFS) releaseBlob(id string) error {
+	released, err := afs.Indexer.UnrefBlob(id)
+	if err != nil || !released {
+		return err
+	}
+	err = afs.fs.Remove(blobPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return afs.Indexer.DeleteBlob(id)
+}
+
+// copyBlob creates the file of newdoc with the same blob as olddoc.
+func (afs *aferoVFS) copyBlob(olddoc, newdoc *vfs.FileDoc, newpath string) error {
+	f, err := safeCreateFile(newpath, newdoc.Mode(), afs.fs)
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		afs.fs.Remove(newpath) // #nosec
+		return err
+	}
+	if _, err = afs.Indexer.RefBlob(olddoc.BlobID, olddoc.ByteSize); err != nil {
+		afs.fs.Remove(newpath) // #nosec
+		return err
+	}
+	newdoc.BlobID = olddoc.BlobID
+	if err = afs.Indexer.CreateFileDoc(newdoc); err != nil {
+		afs.releaseBlob(newdoc.BlobID) // #nosec
+		afs.fs.Remove(newpath)         // #nosec
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package vfsafero
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/spf13/afero"
+)
+
+func (afs *aferoVFS) EncryptContents() (int, error) {
+	if afs.key == nil {
+		return 0, vfs.ErrEncryptionDisabled
+	}
+
+	// The names are collected first, as the walk must not see the new
+	// encrypted files.
+	var names []string
+	err := afero.Walk(afs.raw, "/", func(name string, info os.FileInfo, err error) error {
+		// The content may have been removed since it was listed
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		encrypted, err := afs.encryptContent(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if encrypted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// encryptContent rewrites the file at the given path in encrypted form, if
+// it is not already encrypted. The encrypted content is written next to the
+// file without holding the lock of the VFS. Then, with the lock, it replaces
+// the file only if the file has not been modified in the meantime: a new
+// content has already been written encrypted.
+func (afs *aferoVFS) encryptContent(name string) (bool, error) {
+	src, err := afs.raw.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := vfscrypt.IsEncryptedWith(src, afs.key, info.Size())
+	if err != nil || encrypted {
+		return false, err
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	tmppath := path.Join(path.Dir(name), ".encrypt-"+utils.RandomString(16))
+	dst, err := safeCreateFile(tmppath, info.Mode(), afs.fs)
+	if err != nil {
+		return false, err
+	}
+	h := md5.New() // #nosec
+	_, err = io.Copy(dst, io.TeeReader(src, h))
+	if errc := dst.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = afs.raw.Chtimes(tmppath, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		afs.raw.Remove(tmppath) // #nosec
+		return false, err
+	}
+
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		afs.raw.Remove(tmppath) // #nosec
+		return false, lockerr
+	}
+	defer afs.mu.Unlock()
+	md5sum, err := afs.rawMD5Sum(name)
+	if err == nil && !bytes.Equal(md5sum, h.Sum(nil)) {
+		afs.raw.Remove(tmppath) // #nosec
+		return false, nil
+	}
+	if err == nil {
+		err = afs.raw.Rename(tmppath, name)
+	}
+	if err != nil {
+		afs.raw.Remove(tmppath) // #nosec
+		return false, err
+	}
+	return true, nil
+}
+
+// rawMD5Sum returns the md5sum of the content of a file, as it is stored.
+func (afs *aferoVFS) rawMD5Sum(name string) ([]byte, error) {
+	f, err := afs.raw.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New() // #nosec
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
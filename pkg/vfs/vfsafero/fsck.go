@@ -0,0 +1,254 @@
+package vfsafero
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/spf13/afero"
+)
+
+func (afs *aferoVFS) Fsck(repair bool) ([]*vfs.FsckLog, error) {
+	tree, logs, err := vfs.FsckIndex(afs.Indexer, afs.mu, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	// The paths of the directories and files known by the index
+	dirsByPath := make(map[string]*vfs.DirDoc, len(tree.Dirs))
+	for _, dir := range tree.Dirs {
+		dirsByPath[dir.Fullpath] = dir
+		if dir.ID() == consts.RootDirID {
+			continue
+		}
+		info, err := afs.fs.Stat(dir.Fullpath)
+		if err == nil && info.IsDir() {
+			continue
+		}
+		log := &vfs.FsckLog{Type: vfs.ContentMissing, DirDoc: dir}
+		if repair && os.IsNotExist(err) {
+			err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+				current, err := afs.Indexer.DirByID(dir.ID())
+				if err != nil || current.Fullpath != dir.Fullpath {
+					return false, err
+				}
+				return true, afs.fs.MkdirAll(dir.Fullpath, 0755)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	filesByPath := make(map[string]*vfs.FileDoc, len(tree.Files))
+	for _, file := range tree.Files {
+		name := tree.FilePath(file)
+		filesByPath[name] = file
+		contentName := name
+		if file.BlobID != "" {
+			contentName = blobPath(file.BlobID)
+		}
+		info, err := afs.fs.Stat(contentName)
+		if err != nil || info.IsDir() {
+			log := &vfs.FsckLog{Type: vfs.ContentMissing, FileDoc: file}
+			if repair && os.IsNotExist(err) {
+				err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+					if changed, err := afs.fileChanged(file, contentName); changed || err != nil {
+						return false, err
+					}
+					if err := afs.Indexer.DeleteFileDoc(file); err != nil {
+						return false, err
+					}
+					if file.BlobID != "" {
+						afs.fs.Remove(name) // #nosec
+						if err := afs.releaseBlob(file.BlobID); err != nil {
+							return false, err
+						}
+					}
+					return true, nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			logs = append(logs, log)
+			continue
+		}
+		// The empty file reserving the name of a file whose content is a blob
+		// can be recreated.
+		if file.BlobID != "" {
+			if _, err = afs.fs.Stat(name); os.IsNotExist(err) {
+				log := &vfs.FsckLog{Type: vfs.ContentMissing, FileDoc: file}
+				if repair {
+					err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+						current, err := afs.Indexer.FileByID(file.ID())
+						if err != nil || current.Rev() != file.Rev() {
+							return false, err
+						}
+						f, err := safeCreateFile(name, file.Mode(), afs.fs)
+						if os.IsExist(err) {
+							return false, nil
+						}
+						if err != nil {
+							return false, err
+						}
+						return true, f.Close()
+					})
+					if err != nil {
+						return nil, err
+					}
+				}
+				logs = append(logs, log)
+			}
+		}
+		// The content may have been replaced or removed since it was listed
+		md5sum, err := afs.contentMD5Sum(contentName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() == file.ByteSize && bytes.Equal(md5sum, file.MD5Sum) {
+			continue
+		}
+		log := &vfs.FsckLog{
+			Type:          vfs.FileMismatch,
+			FileDoc:       file,
+			ContentSize:   info.Size(),
+			ContentMD5Sum: md5sum,
+		}
+		if repair {
+			// The update is rejected with a conflict if the file has been
+			// modified since it was checked.
+			err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+				newdoc := file.Clone().(*vfs.FileDoc)
+				newdoc.ByteSize = info.Size()
+				newdoc.MD5Sum = md5sum
+				return true, afs.Indexer.UpdateFileDoc(file, newdoc)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	// The storage is walked from the root, so a directory is indexed before
+	// its content when the orphans are repaired.
+	err = afero.Walk(afs.fs, "/", func(name string, info os.FileInfo, err error) error {
+		// The content may have been removed since it was listed
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if vfs.IsFsckIgnoredPath(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if _, ok := dirsByPath[name]; ok {
+				return nil
+			}
+		} else if _, ok := filesByPath[name]; ok {
+			return nil
+		}
+
+		log := &vfs.FsckLog{Type: vfs.IndexMissing, ContentPath: name}
+		logs = append(logs, log)
+		parent, ok := dirsByPath[path.Dir(name)]
+		if !repair || !ok {
+			return nil
+		}
+		if info.IsDir() {
+			dir, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+			if err != nil {
+				return nil
+			}
+			err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+				if indexed, err := vfs.FsckIsIndexed(afs.Indexer, name); indexed || err != nil {
+					return false, err
+				}
+				return true, afs.Indexer.CreateDirDoc(dir)
+			})
+			if err != nil {
+				return err
+			}
+			if log.Repaired {
+				dirsByPath[name] = dir
+				log.DirDoc = dir
+			}
+			return nil
+		}
+		md5sum, err := afs.contentMD5Sum(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mime, class := vfs.ExtractMimeAndClassFromFilename(name)
+		file, err := vfs.NewFileDoc(path.Base(name), parent.ID(), info.Size(), md5sum,
+			mime, class, info.ModTime(), info.Mode()&0100 != 0, false, nil)
+		if err != nil {
+			return nil
+		}
+		err = vfs.FsckRepair(afs.mu, log, func() (bool, error) {
+			if indexed, err := vfs.FsckIsIndexed(afs.Indexer, name); indexed || err != nil {
+				return false, err
+			}
+			return true, afs.Indexer.CreateFileDoc(file)
+		})
+		if err != nil {
+			return err
+		}
+		if log.Repaired {
+			log.FileDoc = file
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// fileChanged returns true if the file has been modified or its content has
+// been written since it was checked. It must be called with the lock held.
+func (afs *aferoVFS) fileChanged(file *vfs.FileDoc, contentName string) (bool, error) {
+	current, err := afs.Indexer.FileByID(file.ID())
+	if err != nil {
+		return false, err
+	}
+	if current.Rev() != file.Rev() {
+		return true, nil
+	}
+	_, err = afs.fs.Stat(contentName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (afs *aferoVFS) contentMD5Sum(name string) ([]byte, error) {
+	f, err := afs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New() // #nosec
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -4,6 +4,7 @@ package vfsafero
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -11,9 +12,12 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
 	"github.com/spf13/afero"
 )
 
@@ -28,17 +32,28 @@ type aferoVFS struct {
 	mu  lock.ErrorRWLocker
 	pth string
 
+	// whether or not the contents are deduplicated in the blobs directory
+	dedup bool
+
 	// whether or not the localfilesystem requires an initialisation of its root
 	// directory
 	osFS bool
+
+	// the key used to encrypt the contents of the files, and the filesystem
+	// without the encryption, or nil if the contents are not encrypted
+	key []byte
+	raw afero.Fs
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and
 // storage url.
 //
 // The supported scheme of the storage url are file://, for an OS-FS store, and
-// mem:// for an in-memory store. The backend used is the afero package.
-func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, domain string) (vfs.VFS, error) {
+// mem:// for an in-memory store. The backend used is the afero package. If key
+// is not nil, the contents of the files are encrypted with it, and plain tells
+// if the contents written before can still be read, until their migration is
+// finished.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, domain string, key []byte, plain bool) (vfs.VFS, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
 		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
@@ -56,6 +71,10 @@ func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsU
 	default:
 		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
 	}
+	raw := fs
+	if key != nil {
+		fs = vfscrypt.NewFs(raw, key, plain)
+	}
 	return &aferoVFS{
 		Indexer:         index,
 		DiskThresholder: disk,
@@ -65,7 +84,10 @@ func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsU
 		pth: pth,
 		// for now, only the file:// scheme needs a specific initialisation of its
 		// root directory.
-		osFS: fsURL.Scheme == "file",
+		osFS:  fsURL.Scheme == "file",
+		dedup: config.GetConfig().Fs.Dedup,
+		key:   key,
+		raw:   raw,
 	}, nil
 }
 
@@ -131,6 +153,11 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 
 	diskQuota := afs.DiskQuota()
 
+	var version *vfs.Version
+	if olddoc != nil && afs.VersionsRetention().Enabled() {
+		version = vfs.NewVersion(olddoc)
+	}
+
 	var maxsize, newsize int64
 	newsize = newdoc.ByteSize
 	if diskQuota > 0 {
@@ -147,6 +174,11 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
 			return nil, vfs.ErrFileTooBig
 		}
+		// the old content is not kept as a version if there is not enough space
+		// left for it.
+		if newsize < 0 || newsize > maxsize {
+			version = nil
+		}
 	} else {
 		maxsize = -1 // no limit
 	}
@@ -179,12 +211,33 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
+	// The new content is not shared until its blob is stored
+	newdoc.BlobID = ""
 
 	f, err := safeCreateFile(newpath, newdoc.Mode(), afs.fs)
 	if err != nil {
 		return nil, err
 	}
 
+	// With the deduplication, the file at newpath only reserves the name of
+	// the file, and the content is written in the blobs directory.
+	var tmppath string
+	var blobHash hash.Hash
+	if afs.dedup {
+		if err = f.Close(); err == nil {
+			f, tmppath, err = afs.createBlobTmp()
+		}
+		if err != nil {
+			if olddoc != nil {
+				afs.fs.Rename(bakpath, newpath) // #nosec
+			} else {
+				afs.fs.Remove(newpath) // #nosec
+			}
+			return nil, err
+		}
+		blobHash = vfs.NewBlobHash()
+	}
+
 	hash := md5.New() // #nosec
 	extractor := vfs.NewMetaExtractor(newdoc)
 
@@ -195,12 +248,16 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		afs:     afs,
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		version: version,
 		bakpath: bakpath,
 		newpath: newpath,
+		tmppath: tmppath,
 		maxsize: maxsize,
 
-		hash: hash,
-		meta: extractor,
+		hash:     hash,
+		sha256:   sha256.New(),
+		blobHash: blobHash,
+		meta:     extractor,
 	}, nil
 }
 
@@ -228,6 +285,61 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 	return afs.destroyFile(doc)
 }
 
+func (afs *aferoVFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	if diskQuota := afs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := afs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+olddoc.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	oldpath, err := afs.contentPath(olddoc)
+	if err != nil {
+		return err
+	}
+	newpath, err := afs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	// A shared content is not copied, a reference to its blob is added
+	if olddoc.BlobID != "" {
+		return afs.copyBlob(olddoc, newdoc, newpath)
+	}
+
+	src, err := afs.fs.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := safeCreateFile(newpath, newdoc.Mode(), afs.fs)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if errc := dst.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = afs.Indexer.CreateFileDoc(newdoc)
+	}
+	if err != nil {
+		afs.fs.Remove(newpath) // #nosec
+	}
+	return err
+}
+
 func (afs *aferoVFS) destroyDirContent(doc *vfs.DirDoc) error {
 	iter := afs.Indexer.DirIterator(doc, nil)
 	for {
@@ -268,7 +380,86 @@ func (afs *aferoVFS) destroyFile(doc *vfs.FileDoc) error {
 	if err != nil {
 		return err
 	}
-	return afs.Indexer.DeleteFileDoc(doc)
+	versions, err := afs.Indexer.VersionsFor(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = afs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	afs.fs.RemoveAll(versionsDir(doc.ID())) // #nosec
+	if err = afs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	if doc.BlobID != "" {
+		return afs.releaseBlob(doc.BlobID)
+	}
+	return nil
+}
+
+func (afs *aferoVFS) DestroyVersion(version *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	return afs.destroyVersion(version)
+}
+
+func (afs *aferoVFS) destroyVersion(version *vfs.Version) error {
+	if version.BlobID != "" {
+		if err := afs.Indexer.DeleteVersion(version); err != nil {
+			return err
+		}
+		return afs.releaseBlob(version.BlobID)
+	}
+	err := afs.fs.Remove(versionPath(version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return afs.Indexer.DeleteVersion(version)
+}
+
+// keepVersion moves the backup of the old content of a file to the
+// versions directory, and removes the versions that have expired. When the
+// old content is a blob, the version takes the reference of the file to it.
+func (afs *aferoVFS) keepVersion(version *vfs.Version, bakpath string) error {
+	if version.BlobID != "" {
+		if err := afs.Indexer.CreateVersion(version); err != nil {
+			afs.releaseBlob(version.BlobID) // #nosec
+			return err
+		}
+	} else {
+		if err := afs.fs.MkdirAll(versionsDir(version.FileID), 0755); err != nil {
+			return err
+		}
+		if err := afs.fs.Rename(bakpath, versionPath(version)); err != nil {
+			return err
+		}
+		if err := afs.Indexer.CreateVersion(version); err != nil {
+			afs.fs.Rename(versionPath(version), bakpath) // #nosec
+			return err
+		}
+	}
+	versions, err := afs.Indexer.VersionsFor(version.FileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range afs.VersionsRetention().Expired(versions, time.Now()) {
+		if err = afs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionsDir(fileID string) string {
+	return path.Join(vfs.VersionsDirName, fileID)
+}
+
+func versionPath(version *vfs.Version) string {
+	return path.Join(vfs.VersionsDirName, version.FileID, version.ID())
 }
 
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
@@ -276,10 +467,29 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer afs.mu.RUnlock()
-	name, err := afs.Indexer.FilePath(doc)
+	name, err := afs.contentPath(doc)
+	if err != nil {
+		return nil, err
+	}
+	f, err := afs.fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	return &aferoFileOpen{f}, nil
+}
+
+func (afs *aferoVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	if version.FileID != doc.ID() {
+		return nil, os.ErrNotExist
+	}
+	name := versionPath(version)
+	if version.BlobID != "" {
+		name = blobPath(version.BlobID)
+	}
 	f, err := afs.fs.Open(name)
 	if err != nil {
 		return nil, err
@@ -424,17 +634,21 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	f       afero.File         // file handle
-	w       int64              // total size written
-	afs     *aferoVFS          // parent vfs
-	newdoc  *vfs.FileDoc       // new document
-	olddoc  *vfs.FileDoc       // old document
-	newpath string             // file new path
-	bakpath string             // backup file path in case of modifying an existing file
-	maxsize int64              // maximum size allowed for the file
-	hash    hash.Hash          // hash we build up along the file
-	meta    *vfs.MetaExtractor // extracts metadata from the content
-	err     error              // write error
+	f        afero.File         // file handle
+	w        int64              // total size written
+	afs      *aferoVFS          // parent vfs
+	newdoc   *vfs.FileDoc       // new document
+	olddoc   *vfs.FileDoc       // old document
+	version  *vfs.Version       // version document for the old content
+	newpath  string             // file new path
+	bakpath  string             // backup file path in case of modifying an existing file
+	tmppath  string             // temporary path of the content of a new blob
+	maxsize  int64              // maximum size allowed for the file
+	hash     hash.Hash          // hash we build up along the file
+	sha256   hash.Hash          // sha256 hash we build up along the file
+	blobHash hash.Hash          // hash identifying the blob of the content
+	meta     *vfs.MetaExtractor // extracts metadata from the content
+	err      error              // write error
 }
 
 func (f *aferoFileCreation) Read(p []byte) (int, error) {
@@ -471,6 +685,11 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
+	if f.blobHash != nil {
+		f.blobHash.Write(p) // #nosec
+	}
+
+	f.sha256.Write(p) // #nosec
 	_, err = f.hash.Write(p)
 	return n, err
 }
@@ -487,6 +706,9 @@ func (f *aferoFileCreation) Close() (err error) {
 			// remove the new file if an error occured
 			f.afs.fs.Remove(f.newpath) // #nosec
 		}
+		if err != nil && f.tmppath != "" {
+			f.afs.fs.Remove(f.tmppath) // #nosec
+		}
 	}()
 
 	if err = f.f.Close(); err != nil {
@@ -519,6 +741,13 @@ func (f *aferoFileCreation) Close() (err error) {
 		return vfs.ErrInvalidHash
 	}
 
+	sha256sum := f.sha256.Sum(nil)
+	if newdoc.SHA256Sum != nil && !bytes.Equal(newdoc.SHA256Sum, sha256sum) {
+		return vfs.ErrInvalidDigest
+	}
+	newdoc.SHA256Sum = sha256sum
+	newdoc.Corrupted = false
+
 	if newdoc.ByteSize < 0 {
 		newdoc.ByteSize = written
 	}
@@ -532,6 +761,18 @@ func (f *aferoFileCreation) Close() (err error) {
 		return lockerr
 	}
 	defer f.afs.mu.Unlock()
+
+	if f.blobHash != nil {
+		if err = f.afs.storeBlob(f.tmppath, newdoc, f.blobHash.Sum(nil)); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				f.afs.releaseBlob(newdoc.BlobID) // #nosec
+			}
+		}()
+	}
+
 	if olddoc == nil {
 		if newdoc.ID() == "" {
 			return f.afs.Indexer.CreateFileDoc(newdoc)
@@ -539,7 +780,18 @@ func (f *aferoFileCreation) Close() (err error) {
 
 		return f.afs.Indexer.CreateNamedFileDoc(newdoc)
 	}
-	return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	if err = f.afs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	if f.version != nil {
+		// The new content is already saved: failing to keep the old one should
+		// not be reported as an error of the upload, in which case the backup
+		// is simply removed.
+		f.afs.keepVersion(f.version, f.bakpath) // #nosec
+	} else if olddoc.BlobID != "" {
+		f.afs.releaseBlob(olddoc.BlobID) // #nosec
+	}
+	return nil
 }
 
 func safeCreateFile(name string, mode os.FileMode, fs afero.Fs) (afero.File, error) {
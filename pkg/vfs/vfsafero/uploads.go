@@ -0,0 +1,131 @@
+package vfsafero
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/spf13/afero"
+)
+
+func uploadDir(session *vfs.UploadSession) string {
+	return path.Join(vfs.UploadsDirName, session.ID())
+}
+
+func chunkPath(session *vfs.UploadSession, offset int64) string {
+	return path.Join(uploadDir(session), fmt.Sprintf("%020d", offset))
+}
+
+func (afs *aferoVFS) CreateUploadChunk(session *vfs.UploadSession, offset, size int64) (io.WriteCloser, error) {
+	if err := afs.fs.MkdirAll(uploadDir(session), 0755); err != nil {
+		return nil, err
+	}
+	// The chunk is written in a temporary file and renamed when it is
+	// complete, so that a chunk sent again doesn't corrupt the previous one.
+	name := chunkPath(session, offset)
+	tmppath := name + "." + utils.RandomString(8)
+	f, err := safeCreateFile(tmppath, 0666, afs.fs)
+	if err != nil {
+		return nil, err
+	}
+	return &aferoChunkCreation{
+		f:       f,
+		fs:      afs.fs,
+		size:    size,
+		tmppath: tmppath,
+		newpath: name,
+	}, nil
+}
+
+func (afs *aferoVFS) OpenUploadChunks(session *vfs.UploadSession) (io.ReadCloser, error) {
+	names := make([]string, len(session.Chunks))
+	for i, c := range session.Chunks {
+		names[i] = chunkPath(session, c.Offset)
+	}
+	return &aferoChunksReader{fs: afs.fs, names: names}, nil
+}
+
+func (afs *aferoVFS) DestroyUploadChunks(session *vfs.UploadSession) error {
+	return afs.fs.RemoveAll(uploadDir(session))
+}
+
+func (afs *aferoVFS) CommitUploadChunks(session *vfs.UploadSession, newdoc *vfs.FileDoc) error {
+	return vfs.CopyUploadChunks(afs, session, newdoc)
+}
+
+// aferoChunkCreation is used to write a chunk of an upload session.
+type aferoChunkCreation struct {
+	f       afero.File
+	fs      afero.Fs
+	w       int64
+	size    int64
+	tmppath string
+	newpath string
+}
+
+func (c *aferoChunkCreation) Write(p []byte) (int, error) {
+	if c.w+int64(len(p)) > c.size {
+		return 0, vfs.ErrContentLengthMismatch
+	}
+	n, err := c.f.Write(p)
+	c.w += int64(n)
+	return n, err
+}
+
+func (c *aferoChunkCreation) Close() error {
+	err := c.f.Close()
+	if err == nil && c.w != c.size {
+		err = vfs.ErrContentLengthMismatch
+	}
+	if err == nil {
+		err = c.fs.Rename(c.tmppath, c.newpath)
+	}
+	if err != nil {
+		c.fs.Remove(c.tmppath) // #nosec
+	}
+	return err
+}
+
+// aferoChunksReader reads the chunks of an upload session, one after the
+// other.
+type aferoChunksReader struct {
+	fs    afero.Fs
+	names []string
+	cur   afero.File
+}
+
+func (r *aferoChunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.fs.Open(r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.names = f, r.names[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			err = r.cur.Close()
+			r.cur = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *aferoChunksReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
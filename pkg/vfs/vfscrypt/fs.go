@@ -0,0 +1,223 @@
+package vfscrypt
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// OpenReader returns a reader for the plain content of r, which has the given
+// size. The content is read as is if the key is nil. If plain is true, the
+// contents written before the encryption was enabled are read as is too:
+// otherwise, they are refused with ErrNotEncrypted.
+func OpenReader(r io.ReadSeeker, key []byte, cipherSize int64, plain bool) (io.ReadSeeker, error) {
+	if key == nil {
+		return r, nil
+	}
+	dec, err := NewReader(r, key, cipherSize)
+	if err == ErrNotEncrypted && plain {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dec, nil
+}
+
+type writeCloser struct {
+	io.WriteCloser
+	c io.Closer
+}
+
+func (w *writeCloser) Close() error {
+	err := w.WriteCloser.Close()
+	if errc := w.c.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// WrapWriteCloser returns a writer that encrypts its content before writing
+// it to w, and closes w when it is closed. If the key is nil, w is returned.
+func WrapWriteCloser(w io.WriteCloser, key []byte) (io.WriteCloser, error) {
+	if key == nil {
+		return w, nil
+	}
+	enc, err := NewWriter(w, key)
+	if err != nil {
+		return nil, err
+	}
+	return &writeCloser{enc, w}, nil
+}
+
+// NewFs returns an afero.Fs where the contents of the files are encrypted
+// with the given key. The files are opened either for reading or for writing
+// a new content, as an encrypted content cannot be modified in place. If
+// plain is true, the files written before the encryption was enabled are read
+// as is, until they have been migrated.
+func NewFs(fs afero.Fs, key []byte, plain bool) afero.Fs {
+	return &cryptFs{fs, key, plain}
+}
+
+type cryptFs struct {
+	afero.Fs
+	key   []byte
+	plain bool
+}
+
+func (c *cryptFs) Name() string { return "cryptFs" }
+
+func (c *cryptFs) Create(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (c *cryptFs) Open(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c *cryptFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	if flag&os.O_WRONLY != 0 {
+		f, err := c.Fs.OpenFile(name, flag|os.O_TRUNC, perm)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := NewWriter(f, c.key)
+		if err != nil {
+			f.Close() // #nosec
+			return nil, err
+		}
+		return &cryptFile{File: f, w: enc}, nil
+	}
+
+	f, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close() // #nosec
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return f, nil
+	}
+	dec, err := NewReader(f, c.key, info.Size())
+	if err == ErrNotEncrypted && c.plain {
+		return f, nil
+	}
+	if err != nil {
+		f.Close() // #nosec
+		return nil, err
+	}
+	return &cryptFile{File: f, r: dec}, nil
+}
+
+func (c *cryptFs) Stat(name string) (os.FileInfo, error) {
+	info, err := c.Fs.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	f, err := c.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return plainInfo(f, c.key, info, c.plain)
+}
+
+// plainInfo returns the informations about a file with the size of its plain
+// content.
+func plainInfo(f io.ReadSeeker, key []byte, info os.FileInfo, plain bool) (os.FileInfo, error) {
+	dec, err := NewReader(f, key, info.Size())
+	if err == ErrNotEncrypted && plain {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{info, dec.Size()}, nil
+}
+
+type fileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *fileInfo) Size() int64 { return i.size }
+
+// cryptFile is a file opened either for reading with r, or for writing with
+// w.
+type cryptFile struct {
+	afero.File
+	r *Reader
+	w io.WriteCloser
+}
+
+func (f *cryptFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.r.Read(p)
+}
+
+func (f *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	if _, err := f.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(f.r, p)
+}
+
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *cryptFile) Write(p []byte) (int, error) {
+	if f.w == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.w.Write(p)
+}
+
+func (f *cryptFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *cryptFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *cryptFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
+
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if f.r != nil {
+		return &fileInfo{info, f.r.Size()}, nil
+	}
+	return info, nil
+}
+
+func (f *cryptFile) Close() error {
+	var err error
+	if f.w != nil {
+		err = f.w.Close()
+	}
+	if errc := f.File.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package vfscrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// ErrInvalidWrappedKey is returned when a data key cannot be unwrapped with
+// the master key
+var ErrInvalidWrappedKey = errors.New("vfscrypt: invalid wrapped key")
+
+// GenerateKey returns a new random data key, for the contents of an instance
+func GenerateKey() []byte {
+	return crypto.GenerateRandomBytes(KeySize)
+}
+
+// WrapKey encrypts a data key with the master key, so that it can be stored
+// with the instance.
+func WrapKey(master, key []byte) ([]byte, error) {
+	aead, err := newKeyAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := crypto.GenerateRandomBytes(aead.NonceSize())
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func UnwrapKey(master, wrapped []byte) ([]byte, error) {
+	aead, err := newKeyAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	n := aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrInvalidWrappedKey
+	}
+	key, err := aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidWrappedKey
+	}
+	return key, nil
+}
+
+func newKeyAEAD(master []byte) (cipher.AEAD, error) {
+	if len(master) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,306 @@
+// Package vfscrypt is used to encrypt the contents of the files at rest. The
+// contents are encrypted in chunks with AES-GCM, so that a file can be read
+// from any offset without decrypting what is before, and a chunk that has
+// been modified, removed or reordered is detected.
+//
+// An encrypted content starts with a header made of a magic string and a
+// random prefix for the nonces of its chunks. Then, the plain content is
+// split in chunks of ChunkSize bytes, and the last chunk, which is the only
+// one to be shorter, is flagged as final in the additional data of AES-GCM.
+// The nonce of a chunk is the random prefix followed by its index.
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+const (
+	// KeySize is the size of the keys, in bytes
+	KeySize = 32
+	// ChunkSize is the size of the plain content of a chunk
+	ChunkSize = 64 * 1024
+
+	magic      = "COZYENC1"
+	prefixSize = 8
+	headerSize = len(magic) + prefixSize
+	tagSize    = 16
+	sealedSize = ChunkSize + tagSize
+)
+
+var (
+	// ErrNotEncrypted is returned when reading a content that does not start
+	// with the header of the encrypted contents
+	ErrNotEncrypted = errors.New("vfscrypt: the content is not encrypted")
+	// ErrCorrupted is returned when an encrypted content cannot be
+	// authenticated
+	ErrCorrupted = errors.New("vfscrypt: the encrypted content is corrupted")
+	// ErrInvalidKey is returned when a key does not have the expected size
+	ErrInvalidKey = errors.New("vfscrypt: invalid key")
+)
+
+// CipherSize returns the size of the encrypted content for a plain content of
+// the given size, or -1 if the size is unknown.
+func CipherSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	return int64(headerSize) + (size/ChunkSize)*sealedSize + size%ChunkSize + tagSize
+}
+
+// PlainSize returns the size of the plain content for an encrypted content of
+// the given size.
+func PlainSize(size int64) (int64, error) {
+	n := size - int64(headerSize)
+	if n < tagSize {
+		return 0, ErrCorrupted
+	}
+	rest := n % sealedSize
+	if rest < tagSize {
+		return 0, ErrCorrupted
+	}
+	return (n/sealedSize)*ChunkSize + rest - tagSize, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, prefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], uint32(index))
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  int64
+	header bool
+	err    error
+}
+
+// NewWriter returns a writer that encrypts the content written to it, with
+// the given key, and writes it to w. The Close method must be called to write
+// the last chunk: it does not close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		prefix: crypto.GenerateRandomBytes(prefixSize),
+		buf:    make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		// A full chunk is never the last one, as the last chunk is shorter
+		if len(w.buf) == ChunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return written, w.err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("vfscrypt: write on closed writer")
+	return nil
+}
+
+func (w *writer) flush(final bool) error {
+	if !w.header {
+		if _, err := w.w.Write(append([]byte(magic), w.prefix...)); err != nil {
+			return err
+		}
+		w.header = true
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.index), w.buf, chunkAD(final))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts an encrypted content. It implements io.ReadSeeker.
+type Reader struct {
+	r      io.ReadSeeker
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	offset int64
+
+	// the last decrypted chunk
+	index int64
+	chunk []byte
+}
+
+// NewReader returns a reader for the plain content of r, which has the given
+// size. If r does not start with the header of an encrypted content,
+// ErrNotEncrypted is returned and r is positioned at its start, which allows
+// the caller to read it as is.
+func NewReader(r io.ReadSeeker, key []byte, cipherSize int64) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n < headerSize || !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotEncrypted
+	}
+	size, err := PlainSize(cipherSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      r,
+		aead:   aead,
+		prefix: header[len(magic):],
+		size:   size,
+		index:  -1,
+	}, nil
+}
+
+// IsEncryptedWith returns true if r, which has the given size, is a content
+// encrypted with the given key. All its chunks are authenticated, so that a
+// plain content that starts with the magic string is not mistaken for an
+// encrypted one.
+func IsEncryptedWith(r io.ReadSeeker, key []byte, cipherSize int64) (bool, error) {
+	dec, err := NewReader(r, key, cipherSize)
+	if err == nil {
+		err = dec.Verify()
+	}
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotEncrypted, ErrCorrupted:
+		return false, nil
+	}
+	return false, err
+}
+
+// Size returns the size of the plain content
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / ChunkSize
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.offset%ChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *Reader) load(index int64) error {
+	if _, err := r.r.Seek(int64(headerSize)+index*sealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	last := r.size / ChunkSize
+	size := sealedSize
+	if index == last {
+		size = int(r.size%ChunkSize) + tagSize
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorrupted
+		}
+		return err
+	}
+	chunk, err := r.aead.Open(sealed[:0], chunkNonce(r.prefix, index), sealed, chunkAD(index == last))
+	if err != nil {
+		r.index = -1
+		return ErrCorrupted
+	}
+	r.index = index
+	r.chunk = chunk
+	return nil
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("vfscrypt: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("vfscrypt: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Verify reads all the chunks of the content, including the last one, to
+// check that they have not been altered.
+func (r *Reader) Verify() error {
+	for index := int64(0); index <= r.size/ChunkSize; index++ {
+		if err := r.load(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
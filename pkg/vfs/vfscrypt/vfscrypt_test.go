@@ -0,0 +1,189 @@
+package vfscrypt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	assert.NoError(t, err)
+	_, err = w.Write(plain)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := GenerateKey()
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 42} {
+		plain := crypto.GenerateRandomBytes(size)
+		sealed := encrypt(t, key, plain)
+		assert.Equal(t, CipherSize(int64(size)), int64(len(sealed)))
+		plainSize, err := PlainSize(int64(len(sealed)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), plainSize)
+
+		r, err := NewReader(bytes.NewReader(sealed), key, int64(len(sealed)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), r.Size())
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plain, content))
+		assert.NoError(t, r.Verify())
+	}
+}
+
+func TestSeek(t *testing.T) {
+	key := GenerateKey()
+	plain := crypto.GenerateRandomBytes(2*ChunkSize + 100)
+	sealed := encrypt(t, key, plain)
+	r, err := NewReader(bytes.NewReader(sealed), key, int64(len(sealed)))
+	assert.NoError(t, err)
+
+	for _, offset := range []int64{ChunkSize + 10, 5, 2 * ChunkSize, ChunkSize - 3} {
+		pos, err := r.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		buf := make([]byte, 50)
+		_, err = io.ReadFull(r, buf)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plain[offset:offset+50], buf))
+	}
+
+	pos, err := r.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plain)-10), pos)
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(plain[len(plain)-10:], rest))
+}
+
+func TestCorruption(t *testing.T) {
+	key := GenerateKey()
+	plain := crypto.GenerateRandomBytes(2*ChunkSize + 100)
+	sealed := encrypt(t, key, plain)
+
+	altered := append([]byte{}, sealed...)
+	altered[headerSize+ChunkSize+5] ^= 1
+	r, err := NewReader(bytes.NewReader(altered), key, int64(len(altered)))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// A truncated content must not be accepted, even if its size looks like
+	// the one of a valid content
+	truncated := sealed[:headerSize+sealedSize]
+	_, err = NewReader(bytes.NewReader(truncated), key, int64(len(truncated)))
+	assert.Equal(t, ErrCorrupted, err)
+	truncated = sealed[:headerSize+sealedSize+tagSize+5]
+	r, err = NewReader(bytes.NewReader(truncated), key, int64(len(truncated)))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrCorrupted, r.Verify())
+
+	r, err = NewReader(bytes.NewReader(sealed), GenerateKey(), int64(len(sealed)))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	plain := bytes.NewReader([]byte("foo bar baz"))
+	_, err := NewReader(plain, GenerateKey(), plain.Size())
+	assert.Equal(t, ErrNotEncrypted, err)
+	content, err := ioutil.ReadAll(plain)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo bar baz", string(content))
+
+	key := GenerateKey()
+	encrypted, err := IsEncryptedWith(bytes.NewReader([]byte("foo")), key, 3)
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+	sealed := encrypt(t, key, nil)
+	encrypted, err = IsEncryptedWith(bytes.NewReader(sealed), key, int64(len(sealed)))
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+	// A plain content that starts with the magic string is not encrypted
+	fake := append([]byte(magic), make([]byte, 100)...)
+	encrypted, err = IsEncryptedWith(bytes.NewReader(fake), key, int64(len(fake)))
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+	encrypted, err = IsEncryptedWith(bytes.NewReader(sealed), GenerateKey(), int64(len(sealed)))
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+}
+
+func TestWrapKey(t *testing.T) {
+	master := GenerateKey()
+	key := GenerateKey()
+	wrapped, err := WrapKey(master, key)
+	assert.NoError(t, err)
+	unwrapped, err := UnwrapKey(master, wrapped)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(key, unwrapped))
+
+	_, err = UnwrapKey(GenerateKey(), wrapped)
+	assert.Equal(t, ErrInvalidWrappedKey, err)
+	_, err = WrapKey([]byte("too short"), key)
+	assert.Equal(t, ErrInvalidKey, err)
+}
+
+func TestFs(t *testing.T) {
+	raw := afero.NewMemMapFs()
+	key := GenerateKey()
+	fs := NewFs(raw, key, true)
+	plain := crypto.GenerateRandomBytes(ChunkSize + 100)
+
+	assert.NoError(t, afero.WriteFile(raw, "/legacy", []byte("legacy content"), 0644))
+	f, err := fs.Create("/foo")
+	assert.NoError(t, err)
+	_, err = f.Write(plain)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	sealed, err := afero.ReadFile(raw, "/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, CipherSize(int64(len(plain))), int64(len(sealed)))
+
+	info, err := fs.Stat("/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plain)), info.Size())
+	content, err := afero.ReadFile(fs, "/foo")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(plain, content))
+
+	f, err = fs.Open("/foo")
+	assert.NoError(t, err)
+	_, err = f.Seek(ChunkSize-5, io.SeekStart)
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(f, buf)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(plain[ChunkSize-5:ChunkSize+5], buf))
+	assert.NoError(t, f.Close())
+
+	content, err = afero.ReadFile(fs, "/legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy content", string(content))
+
+	// Once the contents have been migrated, a plain content is refused
+	strict := NewFs(raw, key, false)
+	_, err = strict.Open("/legacy")
+	assert.Equal(t, ErrNotEncrypted, err)
+	_, err = strict.Stat("/legacy")
+	assert.Equal(t, ErrNotEncrypted, err)
+	content, err = afero.ReadFile(strict, "/foo")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(plain, content))
+
+	_, err = fs.OpenFile("/foo", os.O_RDWR, 0644)
+	assert.Error(t, err)
+}
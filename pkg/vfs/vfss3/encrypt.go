@@ -0,0 +1,106 @@
+package vfss3
+
+import (
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	minio "github.com/minio/minio-go"
+)
+
+func (s3fs *s3VFS) EncryptContents() (int, error) {
+	if s3fs.key == nil {
+		return 0, vfs.ErrEncryptionDisabled
+	}
+
+	objects, err := listObjects(s3fs.c, s3fs.bucket, s3fs.prefix)
+	if err != nil {
+		return 0, err
+	}
+	// The chunks of the upload sessions are temporary: they are left as is.
+	uploads := s3fs.prefix + vfs.UploadsDirName[1:] + "/"
+	count := 0
+	for _, obj := range objects {
+		if obj.Size == 0 || strings.HasSuffix(obj.Key, "/") ||
+			strings.HasPrefix(obj.Key, uploads) {
+			continue
+		}
+		encrypted, err := s3fs.encryptObject(obj.Key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if encrypted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// encryptObject rewrites an object in encrypted form, if it is not already
+// encrypted. The encrypted content is written in a temporary object without
+// holding the lock of the VFS. Then, with the lock, it replaces the object
+// only if the object has not been modified in the meantime: a new content has
+// already been written encrypted.
+func (s3fs *s3VFS) encryptObject(objName string) (bool, error) {
+	o, err := s3fs.c.GetObject(s3fs.bucket, objName, minio.GetObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer o.Close()
+	info, err := o.Stat()
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := vfscrypt.IsEncryptedWith(o, s3fs.key, info.Size)
+	if err != nil || encrypted {
+		return false, err
+	}
+	if _, err = o.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	// S3 creates the temporary object only when all its content has been
+	// received. In case of error, the upload is aborted.
+	tmpName := s3fs.prefix + vfs.UploadsDirName[1:] + "/encrypt-" + utils.RandomString(16)
+	sw := newObjectWriter(s3fs.c, s3fs.bucket, tmpName, info.ContentType)
+	w, err := vfscrypt.WrapWriteCloser(sw, s3fs.key)
+	if err != nil {
+		sw.pw.CloseWithError(err) // #nosec
+		<-sw.errc
+		return false, err
+	}
+	if _, err = io.Copy(w, o); err != nil {
+		sw.pw.CloseWithError(err) // #nosec
+	}
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		s3fs.c.RemoveObject(s3fs.bucket, tmpName) // #nosec
+		return false, err
+	}
+
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		s3fs.c.RemoveObject(s3fs.bucket, tmpName) // #nosec
+		return false, lockerr
+	}
+	defer s3fs.mu.Unlock()
+	current, err := s3fs.c.StatObject(s3fs.bucket, objName, minio.StatObjectOptions{})
+	if err == nil && current.ETag != info.ETag {
+		s3fs.c.RemoveObject(s3fs.bucket, tmpName) // #nosec
+		return false, nil
+	}
+	if err == nil {
+		err = moveObject(s3fs.c, s3fs.bucket, tmpName, objName)
+	}
+	if err != nil {
+		s3fs.c.RemoveObject(s3fs.bucket, tmpName) // #nosec
+		return false, err
+	}
+	return true, nil
+}
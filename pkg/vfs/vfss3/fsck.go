@@ -0,0 +1,197 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	minio "github.com/minio/minio-go"
+)
+
+func (s3fs *s3VFS) Fsck(repair bool) ([]*vfs.FsckLog, error) {
+	tree, logs, err := vfs.FsckIndex(s3fs.Indexer, s3fs.mu, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := listObjects(s3fs.c, s3fs.bucket, s3fs.prefix)
+	if err != nil {
+		return nil, err
+	}
+	objectsByName := make(map[string]minio.ObjectInfo, len(objects))
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, s3fs.prefix)
+		if vfs.IsFsckIgnoredPath("/" + name) {
+			continue
+		}
+		objectsByName[obj.Key] = obj
+	}
+
+	// The root and the trash are only directories in the index
+	for _, dir := range tree.Dirs {
+		if dir.ID() == consts.RootDirID || dir.ID() == consts.TrashDirID {
+			continue
+		}
+		objName := s3fs.dirObjName(dir)
+		if _, ok := objectsByName[objName]; ok {
+			delete(objectsByName, objName)
+			continue
+		}
+		log := &vfs.FsckLog{Type: vfs.ContentMissing, DirDoc: dir}
+		if repair {
+			err = vfs.FsckRepair(s3fs.mu, log, func() (bool, error) {
+				current, err := s3fs.Indexer.DirByID(dir.ID())
+				if err != nil || current.DirID != dir.DirID || current.DocName != dir.DocName {
+					return false, err
+				}
+				_, err = s3fs.c.PutObject(s3fs.bucket, objName, bytes.NewReader(nil), 0,
+					minio.PutObjectOptions{})
+				return true, err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	for _, file := range tree.Files {
+		objName := s3fs.fileObjName(file)
+		obj, ok := objectsByName[objName]
+		if !ok {
+			log := &vfs.FsckLog{Type: vfs.ContentMissing, FileDoc: file}
+			if repair {
+				err = vfs.FsckRepair(s3fs.mu, log, func() (bool, error) {
+					current, err := s3fs.Indexer.FileByID(file.ID())
+					if err != nil || current.Rev() != file.Rev() {
+						return false, err
+					}
+					if exists, err := objectExists(s3fs.c, s3fs.bucket, objName); exists || err != nil {
+						return false, err
+					}
+					return true, s3fs.Indexer.DeleteFileDoc(file)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			logs = append(logs, log)
+			continue
+		}
+		delete(objectsByName, objName)
+		md5sum := etagMD5Sum(obj.ETag)
+		if obj.Size == file.ByteSize && (md5sum == nil || bytes.Equal(md5sum, file.MD5Sum)) {
+			continue
+		}
+		size := obj.Size
+		if s3fs.key != nil {
+			// The ETag of an encrypted object is the one of the encrypted
+			// content: only its size can be checked.
+			if obj.Size == vfscrypt.CipherSize(file.ByteSize) {
+				continue
+			}
+			if plainSize, errp := vfscrypt.PlainSize(obj.Size); errp == nil {
+				size, md5sum = plainSize, nil
+			}
+		}
+		log := &vfs.FsckLog{
+			Type:          vfs.FileMismatch,
+			FileDoc:       file,
+			ContentSize:   size,
+			ContentMD5Sum: md5sum,
+		}
+		if repair {
+			// The update is rejected with a conflict if the file has been
+			// modified since it was checked.
+			err = vfs.FsckRepair(s3fs.mu, log, func() (bool, error) {
+				newdoc := file.Clone().(*vfs.FileDoc)
+				newdoc.ByteSize = size
+				if md5sum != nil {
+					newdoc.MD5Sum = md5sum
+				}
+				return true, s3fs.Indexer.UpdateFileDoc(file, newdoc)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	// The remaining objects have no document in the index. They can be
+	// indexed if their parent directory is known. The identifier of an orphan
+	// directory is lost, so its content can't be attached to it. The files
+	// uploaded in several parts have no known md5sum, and are only reported.
+	for _, obj := range objectsByName {
+		name := strings.TrimPrefix(obj.Key, s3fs.prefix)
+		log := &vfs.FsckLog{Type: vfs.IndexMissing, ContentPath: name}
+		logs = append(logs, log)
+		isDir := strings.HasSuffix(name, "/")
+		parts := strings.SplitN(strings.TrimSuffix(name, "/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		parent, ok := tree.Dirs[parts[0]]
+		if !repair || !ok {
+			continue
+		}
+		fullpath := path.Join(parent.Fullpath, parts[1])
+		if isDir {
+			dir, err := vfs.NewDirDocWithParent(parts[1], parent, nil)
+			if err != nil {
+				continue
+			}
+			err = vfs.FsckRepair(s3fs.mu, log, func() (bool, error) {
+				if indexed, err := vfs.FsckIsIndexed(s3fs.Indexer, fullpath); indexed || err != nil {
+					return false, err
+				}
+				return true, s3fs.Indexer.CreateDirDoc(dir)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if log.Repaired {
+				log.DirDoc = dir
+			}
+			continue
+		}
+		md5sum := etagMD5Sum(obj.ETag)
+		if md5sum == nil {
+			continue
+		}
+		mime, class := vfs.ExtractMimeAndClassFromFilename(parts[1])
+		file, err := vfs.NewFileDoc(parts[1], parent.ID(), obj.Size, md5sum,
+			mime, class, obj.LastModified, false, false, nil)
+		if err != nil {
+			continue
+		}
+		err = vfs.FsckRepair(s3fs.mu, log, func() (bool, error) {
+			if indexed, err := vfs.FsckIsIndexed(s3fs.Indexer, fullpath); indexed || err != nil {
+				return false, err
+			}
+			return true, s3fs.Indexer.CreateFileDoc(file)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if log.Repaired {
+			log.FileDoc = file
+		}
+	}
+
+	return logs, nil
+}
+
+// etagMD5Sum returns the md5sum of an object from its ETag, or nil if the
+// ETag is not a md5sum, like for the objects uploaded in several parts.
+func etagMD5Sum(etag string) []byte {
+	md5sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(md5sum) != 16 {
+		return nil
+	}
+	return md5sum
+}
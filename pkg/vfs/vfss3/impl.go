@@ -0,0 +1,716 @@
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	minio "github.com/minio/minio-go"
+)
+
+// partSize is the size of the parts of the multipart uploads. The content of
+// the files is streamed to S3 by parts of this size, so only one part is kept
+// in memory while uploading a file.
+const partSize = 16 * 1024 * 1024
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c      *minio.Client
+	bucket string
+	prefix string
+	mu     lock.ErrorRWLocker
+	log    *logrus.Entry
+
+	// the key used to encrypt the contents of the files, or nil if they are
+	// not encrypted, and whether the contents written before the encryption
+	// was enabled can still be read as is
+	key   []byte
+	plain bool
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 bucket of the configuration. All the objects of the instance are
+// stored in this bucket, under a prefix made of its domain.
+//
+// The objects are named like in swift, with the identifier of their parent
+// directory and their name. The name of the object of a directory ends with
+// a slash. If key is not nil, the contents of the files are encrypted with it,
+// and plain tells if the contents written before can still be read, until
+// their migration is finished.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, domain string, key []byte, plain bool) (vfs.VFS, error) {
+	if domain == "" {
+		return nil, fmt.Errorf("vfss3: specified domain is empty")
+	}
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:      config.GetS3Client(),
+		bucket: config.GetS3Bucket(),
+		prefix: domain + "/",
+		mu:     mu,
+		log:    logger.WithDomain(domain),
+		key:    key,
+		plain:  plain,
+	}, nil
+}
+
+func (s3fs *s3VFS) dirObjName(doc *vfs.DirDoc) string {
+	return s3fs.prefix + doc.DirID + "/" + doc.DocName + "/"
+}
+
+func (s3fs *s3VFS) fileObjName(doc *vfs.FileDoc) string {
+	return s3fs.prefix + doc.DirID + "/" + doc.DocName
+}
+
+func (s3fs *s3VFS) versionObjName(version *vfs.Version) string {
+	return s3fs.prefix + vfs.VersionsDirName[1:] + "/" + version.FileID + "/" + version.ID()
+}
+
+func (s3fs *s3VFS) InitFs() error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	if err := s3fs.Indexer.InitIndex(); err != nil {
+		return err
+	}
+	s3fs.log.Infof("[vfss3] Initialized storage in bucket %s", s3fs.bucket)
+	return nil
+}
+
+func (s3fs *s3VFS) Delete() error {
+	objects, err := listObjects(s3fs.c, s3fs.bucket, s3fs.prefix)
+	if err == nil {
+		err = removeObjects(s3fs.c, s3fs.bucket, objects)
+	}
+	if err != nil {
+		s3fs.log.Errorf("[vfss3] Could not delete the objects of %s: %s",
+			s3fs.prefix, err.Error())
+		return err
+	}
+	s3fs.log.Infof("[vfss3] Deleted the objects of %s", s3fs.prefix)
+	return nil
+}
+
+func (s3fs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	objName := s3fs.dirObjName(doc)
+	exists, err := objectExists(s3fs.c, s3fs.bucket, objName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	_, err = s3fs.c.PutObject(s3fs.bucket, objName, bytes.NewReader(nil), 0,
+		minio.PutObjectOptions{})
+	if err != nil {
+		return err
+	}
+	if doc.ID() == "" {
+		return s3fs.Indexer.CreateDirDoc(doc)
+	}
+	return s3fs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (s3fs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.Unlock()
+
+	diskQuota := s3fs.DiskQuota()
+
+	var version *vfs.Version
+	if olddoc != nil && s3fs.VersionsRetention().Enabled() {
+		version = vfs.NewVersion(olddoc)
+	}
+
+	var maxsize, newsize int64
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := s3fs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+
+		var oldsize int64
+		if olddoc != nil {
+			oldsize = olddoc.Size()
+		}
+		maxsize = diskQuota - diskUsage
+		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+			return nil, vfs.ErrFileTooBig
+		}
+		// the old content is not kept as a version if there is not enough space
+		// left for it.
+		if newsize < 0 || newsize > maxsize {
+			version = nil
+		}
+	} else {
+		maxsize = -1 // no limit
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := s3fs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	objName := s3fs.fileObjName(newdoc)
+	if olddoc == nil {
+		exists, err := objectExists(s3fs.c, s3fs.bucket, objName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	// The old content is copied before being overwritten. The version
+	// document is only created when the new content has been successfully
+	// uploaded.
+	if version != nil {
+		err = copyObject(s3fs.c, s3fs.bucket, s3fs.fileObjName(olddoc), s3fs.versionObjName(version))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The content is streamed to S3 with an unknown size, so that the object
+	// is only created when the writer is closed, after the checks of its
+	// size and md5sum. Until then, the old content is left untouched.
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s3fs.c.PutObject(s3fs.bucket, objName, pr, -1, minio.PutObjectOptions{
+			ContentType: newdoc.Mime,
+			PartSize:    partSize,
+		})
+		pr.CloseWithError(err) // #nosec
+		errc <- err
+	}()
+
+	var enc io.WriteCloser
+	if s3fs.key != nil {
+		if enc, err = vfscrypt.NewWriter(pw, s3fs.key); err != nil {
+			pw.CloseWithError(err) // #nosec
+			<-errc
+			if version != nil {
+				s3fs.c.RemoveObject(s3fs.bucket, s3fs.versionObjName(version)) // #nosec
+			}
+			return nil, err
+		}
+	}
+
+	return &s3FileCreation{
+		pw:      pw,
+		enc:     enc,
+		errc:    errc,
+		fs:      s3fs,
+		name:    objName,
+		hash:    md5.New(), // #nosec
+		sha256:  sha256.New(),
+		meta:    vfs.NewMetaExtractor(newdoc),
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		version: version,
+		maxsize: maxsize,
+	}, nil
+}
+
+func (s3fs *s3VFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	return s3fs.destroyDirContent(doc)
+}
+
+func (s3fs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	return s3fs.destroyDirAndContent(doc)
+}
+
+func (s3fs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	return s3fs.destroyFile(doc)
+}
+
+func (s3fs *s3VFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+
+	if diskQuota := s3fs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := s3fs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+olddoc.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	newpath, err := s3fs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	objName := s3fs.fileObjName(newdoc)
+	exists, err := objectExists(s3fs.c, s3fs.bucket, objName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+
+	// The content is copied by S3, without being downloaded by the stack
+	if err = copyObject(s3fs.c, s3fs.bucket, s3fs.fileObjName(olddoc), objName); err != nil {
+		return err
+	}
+	if err = s3fs.Indexer.CreateFileDoc(newdoc); err != nil {
+		s3fs.c.RemoveObject(s3fs.bucket, objName) // #nosec
+		return err
+	}
+	return nil
+}
+
+func (s3fs *s3VFS) destroyDirContent(doc *vfs.DirDoc) error {
+	iter := s3fs.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = s3fs.destroyDirAndContent(d)
+		} else {
+			err = s3fs.destroyFile(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s3fs *s3VFS) destroyDirAndContent(doc *vfs.DirDoc) error {
+	err := s3fs.destroyDirContent(doc)
+	if err != nil {
+		return err
+	}
+	if err = s3fs.c.RemoveObject(s3fs.bucket, s3fs.dirObjName(doc)); err != nil {
+		return err
+	}
+	return s3fs.Indexer.DeleteDirDoc(doc)
+}
+
+func (s3fs *s3VFS) destroyFile(doc *vfs.FileDoc) error {
+	err := s3fs.c.RemoveObject(s3fs.bucket, s3fs.fileObjName(doc))
+	if err != nil {
+		return err
+	}
+	if err = s3fs.destroyVersions(doc); err != nil {
+		return err
+	}
+	return s3fs.Indexer.DeleteFileDoc(doc)
+}
+
+func (s3fs *s3VFS) destroyVersions(doc *vfs.FileDoc) error {
+	versions, err := s3fs.Indexer.VersionsFor(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = s3fs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s3fs *s3VFS) DestroyVersion(version *vfs.Version) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	return s3fs.destroyVersion(version)
+}
+
+func (s3fs *s3VFS) destroyVersion(version *vfs.Version) error {
+	err := s3fs.c.RemoveObject(s3fs.bucket, s3fs.versionObjName(version))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return s3fs.Indexer.DeleteVersion(version)
+}
+
+// keepVersion creates the document of a version, whose content has already
+// been copied, and removes the versions that have expired.
+func (s3fs *s3VFS) keepVersion(version *vfs.Version) error {
+	if err := s3fs.Indexer.CreateVersion(version); err != nil {
+		s3fs.c.RemoveObject(s3fs.bucket, s3fs.versionObjName(version)) // #nosec
+		return err
+	}
+	versions, err := s3fs.Indexer.VersionsFor(version.FileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range s3fs.VersionsRetention().Expired(versions, time.Now()) {
+		if err = s3fs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s3fs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return openObject(s3fs.c, s3fs.bucket, s3fs.fileObjName(doc), s3fs.key, s3fs.plain)
+}
+
+func (s3fs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	if version.FileID != doc.ID() {
+		return nil, os.ErrNotExist
+	}
+	return openObject(s3fs.c, s3fs.bucket, s3fs.versionObjName(version), s3fs.key, s3fs.plain)
+}
+
+// UpdateFileDoc overrides the indexer's one since the S3 fs indexes files
+// using their DirID + Name value to preserve atomicity of the hierarchy.
+//
+// @override Indexer.UpdateFileDoc
+func (s3fs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		err := moveObject(s3fs.c, s3fs.bucket, s3fs.fileObjName(olddoc), s3fs.fileObjName(newdoc))
+		if err != nil {
+			return err
+		}
+	}
+	return s3fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UpdateDirDoc overrides the indexer's one since the S3 fs indexes files
+// using their DirID + Name value to preserve atomicity of the hierarchy.
+//
+// @override Indexer.UpdateDirDoc
+func (s3fs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := s3fs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s3fs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		err := moveObject(s3fs.c, s3fs.bucket, s3fs.dirObjName(olddoc), s3fs.dirObjName(newdoc))
+		if err != nil {
+			return err
+		}
+	}
+	return s3fs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (s3fs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.DirByID(fileID)
+}
+
+func (s3fs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.DirByPath(name)
+}
+
+func (s3fs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.FileByID(fileID)
+}
+
+func (s3fs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.FileByPath(name)
+}
+
+func (s3fs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.FilePath(doc)
+}
+
+func (s3fs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.DirOrFileByID(fileID)
+}
+
+func (s3fs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := s3fs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer s3fs.mu.RUnlock()
+	return s3fs.Indexer.DirOrFileByPath(name)
+}
+
+type s3FileCreation struct {
+	pw      *io.PipeWriter
+	enc     io.WriteCloser // encrypts the content before writing it to pw
+	errc    chan error
+	w       int64
+	fs      *s3VFS
+	name    string
+	err     error
+	hash    hash.Hash
+	sha256  hash.Hash
+	meta    *vfs.MetaExtractor
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	version *vfs.Version
+	maxsize int64
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	var n int
+	var err error
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = f.pw.Write(p)
+	}
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+
+	f.w += int64(n)
+	if f.maxsize >= 0 && f.w > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	size := f.newdoc.ByteSize
+	if size >= 0 && f.w > size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	f.sha256.Write(p) // #nosec
+	_, err = f.hash.Write(p)
+	return n, err
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err != nil && f.version != nil {
+			f.fs.c.RemoveObject(f.fs.bucket, f.fs.versionObjName(f.version)) // #nosec
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+
+	// The size and hashes are checked before closing the pipe: in case of
+	// error, the upload is aborted and the object is not modified.
+	md5sum := f.hash.Sum(nil)
+	if f.err == nil && newdoc.MD5Sum != nil && !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		f.err = vfs.ErrInvalidHash
+	}
+	sha256sum := f.sha256.Sum(nil)
+	if f.err == nil && newdoc.SHA256Sum != nil && !bytes.Equal(newdoc.SHA256Sum, sha256sum) {
+		f.err = vfs.ErrInvalidDigest
+	}
+	if f.err == nil && newdoc.ByteSize >= 0 && newdoc.ByteSize != written {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+	if f.err == nil && f.enc != nil {
+		f.err = f.enc.Close()
+	}
+	if f.err != nil {
+		f.pw.CloseWithError(f.err) // #nosec
+		<-f.errc
+		if f.meta != nil {
+			(*f.meta).Abort(f.err)
+		}
+		return f.err
+	}
+
+	f.pw.Close() // #nosec
+	if err = <-f.errc; err != nil {
+		if f.meta != nil {
+			(*f.meta).Abort(err)
+		}
+		return err
+	}
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			newdoc.Metadata = (*f.meta).Result()
+		}
+	}
+
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	}
+	newdoc.SHA256Sum = sha256sum
+	newdoc.Corrupted = false
+
+	if newdoc.ByteSize < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if olddoc == nil {
+		if newdoc.ID() == "" {
+			err = f.fs.Indexer.CreateFileDoc(newdoc)
+		} else {
+			err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
+		}
+		if err != nil {
+			f.fs.c.RemoveObject(f.fs.bucket, f.name) // #nosec
+		}
+		return err
+	}
+
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// If we reach a conflict error, the document has been modified while
+	// uploading the content of the file.
+	//
+	// TODO: remove dep on couchdb, with a generalized conflict error for
+	// UpdateFileDoc/UpdateDirDoc.
+	if couchdb.IsConflictError(err) {
+		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		if err != nil {
+			return err
+		}
+		resdoc.Metadata = newdoc.Metadata
+		resdoc.ByteSize = newdoc.ByteSize
+		resdoc.MD5Sum = newdoc.MD5Sum
+		resdoc.SHA256Sum = newdoc.SHA256Sum
+		resdoc.Corrupted = false
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if f.version != nil {
+		// The new content is already saved: failing to keep the old one should
+		// not be reported as an error of the upload.
+		if errv := f.fs.keepVersion(f.version); errv != nil {
+			f.fs.log.Errorf("[vfss3] Could not keep version of %s: %s",
+				olddoc.ID(), errv.Error())
+		}
+	}
+	return nil
+}
+
+type s3FileOpen struct {
+	o *minio.Object
+	r io.ReadSeeker
+}
+
+func (f *s3FileOpen) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *s3FileOpen) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileOpen) Close() error {
+	return f.o.Close()
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
@@ -0,0 +1,141 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	minio "github.com/minio/minio-go"
+)
+
+// isNotFound returns true if the error is returned by S3 for an object or a
+// bucket that does not exist.
+func isNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket", "NotFound":
+		return true
+	}
+	return false
+}
+
+func wrapS3Err(err error) error {
+	if isNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func objectExists(c *minio.Client, bucket, objName string) (bool, error) {
+	_, err := c.StatObject(bucket, objName, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// openObject opens an object for reading. The object is stat'ed first, as
+// the errors are only returned by minio on the first read otherwise. If key
+// is not nil, the content of the object is decrypted with it, or read as is
+// if it is not encrypted and plain is true.
+func openObject(c *minio.Client, bucket, objName string, key []byte, plain bool) (vfs.File, error) {
+	o, err := c.GetObject(bucket, objName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	info, err := o.Stat()
+	if err != nil {
+		o.Close() // #nosec
+		return nil, wrapS3Err(err)
+	}
+	r, err := vfscrypt.OpenReader(o, key, info.Size, plain)
+	if err != nil {
+		o.Close() // #nosec
+		return nil, err
+	}
+	return &s3FileOpen{o, r}, nil
+}
+
+// copyObject makes a server-side copy of an object.
+func copyObject(c *minio.Client, bucket, srcName, dstName string) error {
+	src := minio.NewSourceInfo(bucket, srcName, nil)
+	dst, err := minio.NewDestinationInfo(bucket, dstName, nil, nil)
+	if err != nil {
+		return err
+	}
+	return c.CopyObject(dst, src)
+}
+
+// moveObject renames an object. S3 has no rename operation, so the object is
+// copied and the original is removed.
+func moveObject(c *minio.Client, bucket, srcName, dstName string) error {
+	if err := copyObject(c, bucket, srcName, dstName); err != nil {
+		return err
+	}
+	return c.RemoveObject(bucket, srcName)
+}
+
+// listObjects returns all the objects whose name starts with the given
+// prefix.
+func listObjects(c *minio.Client, bucket, prefix string) ([]minio.ObjectInfo, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var objects []minio.ObjectInfo
+	for obj := range c.ListObjectsV2(bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// removeObjects removes the given objects with multi-objects delete
+// requests.
+func removeObjects(c *minio.Client, bucket string, objects []minio.ObjectInfo) error {
+	names := make(chan string, len(objects))
+	for _, obj := range objects {
+		names <- obj.Key
+	}
+	close(names)
+	var err error
+	for rerr := range c.RemoveObjects(bucket, names) {
+		if rerr.Err != nil && err == nil {
+			err = rerr.Err
+		}
+	}
+	return err
+}
+
+// s3Writer is an io.WriteCloser that streams its content to a new object.
+// The object is created when the writer is closed.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	errc chan error
+}
+
+func newObjectWriter(c *minio.Client, bucket, objName, contentType string) *s3Writer {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.PutObject(bucket, objName, pr, -1, minio.PutObjectOptions{
+			ContentType: contentType,
+			PartSize:    partSize,
+		})
+		pr.CloseWithError(err) // #nosec
+		errc <- err
+	}()
+	return &s3Writer{pw: pw, errc: errc}
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.pw.Close() // #nosec
+	return <-w.errc
+}
@@ -0,0 +1,65 @@
+package vfss3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	minio "github.com/minio/minio-go"
+)
+
+// NewThumbsFs creates a new thumb filesystem base on S3. If key is not nil,
+// the thumbnails are encrypted with it, and plain tells if the thumbnails
+// generated before can still be read.
+func NewThumbsFs(c *minio.Client, bucket, domain string, key []byte, plain bool) vfs.Thumbser {
+	return &thumbs{
+		c:      c,
+		bucket: bucket,
+		prefix: domain + vfs.ThumbsDirName + "/",
+		key:    key,
+		plain:  plain,
+	}
+}
+
+type thumbs struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+	key    []byte
+	plain  bool
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, error) {
+	w := newObjectWriter(t.c, t.bucket, t.makeName(img, format), "")
+	return vfscrypt.WrapWriteCloser(w, t.key)
+}
+
+func (t *thumbs) RemoveThumb(img *vfs.FileDoc, format string) error {
+	return t.c.RemoveObject(t.bucket, t.makeName(img, format))
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	name := t.makeName(img, format)
+	o, err := t.c.GetObject(t.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	defer o.Close()
+	info, err := o.Stat()
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	content, err := vfscrypt.OpenReader(o, t.key, info.Size, t.plain)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Etag", info.ETag)
+	http.ServeContent(w, req, name, info.LastModified, content)
+	return nil
+}
+
+func (t *thumbs) makeName(img *vfs.FileDoc, format string) string {
+	return t.prefix + fmt.Sprintf("%s-%s", img.ID(), format)
+}
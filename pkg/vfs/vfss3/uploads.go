@@ -0,0 +1,126 @@
+package vfss3
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+func (s3fs *s3VFS) uploadPrefix(session *vfs.UploadSession) string {
+	return s3fs.prefix + vfs.UploadsDirName[1:] + "/" + session.ID() + "/"
+}
+
+func (s3fs *s3VFS) chunkObjName(session *vfs.UploadSession, offset int64) string {
+	return s3fs.uploadPrefix(session) + fmt.Sprintf("%020d", offset)
+}
+
+func (s3fs *s3VFS) CreateUploadChunk(session *vfs.UploadSession, offset, size int64) (io.WriteCloser, error) {
+	// The object of a chunk is only created by S3 when all its content has
+	// been received, so a chunk sent again doesn't corrupt the previous one.
+	objName := s3fs.chunkObjName(session, offset)
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s3fs.c.PutObject(s3fs.bucket, objName, pr, size, minio.PutObjectOptions{
+			PartSize: partSize,
+		})
+		pr.CloseWithError(err) // #nosec
+		errc <- err
+	}()
+	return &s3ChunkCreation{
+		pw:   pw,
+		errc: errc,
+		size: size,
+	}, nil
+}
+
+func (s3fs *s3VFS) OpenUploadChunks(session *vfs.UploadSession) (io.ReadCloser, error) {
+	names := make([]string, len(session.Chunks))
+	for i, c := range session.Chunks {
+		names[i] = s3fs.chunkObjName(session, c.Offset)
+	}
+	return &s3ChunksReader{s3fs: s3fs, names: names}, nil
+}
+
+func (s3fs *s3VFS) DestroyUploadChunks(session *vfs.UploadSession) error {
+	objects, err := listObjects(s3fs.c, s3fs.bucket, s3fs.uploadPrefix(session))
+	if err != nil {
+		return err
+	}
+	return removeObjects(s3fs.c, s3fs.bucket, objects)
+}
+
+func (s3fs *s3VFS) CommitUploadChunks(session *vfs.UploadSession, newdoc *vfs.FileDoc) error {
+	return vfs.CopyUploadChunks(s3fs, session, newdoc)
+}
+
+// s3ChunkCreation is used to write a chunk of an upload session.
+type s3ChunkCreation struct {
+	pw   *io.PipeWriter
+	errc chan error
+	w    int64
+	size int64
+}
+
+func (c *s3ChunkCreation) Write(p []byte) (int, error) {
+	if c.w+int64(len(p)) > c.size {
+		return 0, vfs.ErrContentLengthMismatch
+	}
+	n, err := c.pw.Write(p)
+	c.w += int64(n)
+	return n, err
+}
+
+func (c *s3ChunkCreation) Close() error {
+	if c.w != c.size {
+		c.pw.CloseWithError(vfs.ErrContentLengthMismatch) // #nosec
+		<-c.errc
+		return vfs.ErrContentLengthMismatch
+	}
+	c.pw.Close() // #nosec
+	return <-c.errc
+}
+
+// s3ChunksReader reads the chunks of an upload session, one after the
+// other.
+type s3ChunksReader struct {
+	s3fs  *s3VFS
+	names []string
+	cur   vfs.File
+}
+
+func (r *s3ChunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := openObject(r.s3fs.c, r.s3fs.bucket, r.names[0], nil, false)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.names = f, r.names[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			err = r.cur.Close()
+			r.cur = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *s3ChunksReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,97 @@
+package vfsswift
+
+import (
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// When the deduplication is enabled, the content of a file is written in an
+// object of the blobs directory, named after the sha256 of the content, and
+// an empty object is kept at the name of the file to reserve it. The blobs
+// are reference counted by the indexer, and the object is removed with the
+// last reference.
+
+func blobObjName(id string) string {
+	return vfs.BlobsDirName[1:] + "/" + id
+}
+
+func blobTmpObjName() string {
+	return vfs.BlobsDirName[1:] + "/tmp/" + utils.RandomString(16)
+}
+
+// contentObjName returns the name of the object where the content of the
+// file is stored.
+func contentObjName(doc *vfs.FileDoc) string {
+	if doc.BlobID != "" {
+		return blobObjName(doc.BlobID)
+	}
+	return doc.DirID + "/" + doc.DocName
+}
+
+// storeBlob adds a reference for the given document to the blob of its
+// content, written in the tmpName object. The object is moved to the blob
+// name if the blob is new, and removed otherwise.
+func (sfs *swiftVFS) storeBlob(tmpName string, doc *vfs.FileDoc, sum []byte) error {
+	id := vfs.BlobIDFromSum(sum)
+	created, err := sfs.Indexer.RefBlob(id, doc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if !created {
+		sfs.c.ObjectDelete(sfs.container, tmpName) // #nosec
+		doc.BlobID = id
+		return nil
+	}
+	if err = sfs.c.ObjectMove(sfs.container, tmpName, sfs.container, blobObjName(id)); err != nil {
+		sfs.releaseBlob(id) // #nosec
+		return err
+	}
+	doc.BlobID = id
+	return nil
+}
+
+// releaseBlob removes a reference to a blob, and its object if it was the
+// last reference.
+func (sfs *swiftVFS) releaseBlob(id string) error {
+	released, err := sfs.Indexer.UnrefBlob(id)
+	if err != nil || !released {
+		return err
+	}
+	err = sfs.c.ObjectDelete(sfs.container, blobObjName(id))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return sfs.Indexer.DeleteBlob(id)
+}
+
+// copyBlob creates the file of newdoc, in the objName object, with the same
+// blob as olddoc.
+func (sfs *swiftVFS) copyBlob(olddoc, newdoc *vfs.FileDoc, objName string) error {
+	if err := sfs.c.ObjectPutBytes(sfs.container, objName, nil, newdoc.Mime); err != nil {
+		return err
+	}
+	if _, err := sfs.Indexer.RefBlob(olddoc.BlobID, olddoc.ByteSize); err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	newdoc.BlobID = olddoc.BlobID
+	if err := sfs.Indexer.CreateFileDoc(newdoc); err != nil {
+		sfs.releaseBlob(newdoc.BlobID)             // #nosec
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	return nil
+}
+
+// deleteFileDoc removes the document of a file from the index, and releases
+// the blob of its content.
+func (sfs *swiftVFS) deleteFileDoc(doc *vfs.FileDoc) error {
+	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	if doc.BlobID != "" {
+		return sfs.releaseBlob(doc.BlobID)
+	}
+	return nil
+}
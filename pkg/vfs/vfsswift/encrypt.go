@@ -0,0 +1,129 @@
+package vfsswift
+
+import (
+	"crypto/md5" // #nosec
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/cozy/swift"
+)
+
+func (sfs *swiftVFS) EncryptContents() (int, error) {
+	if sfs.key == nil {
+		return 0, vfs.ErrEncryptionDisabled
+	}
+
+	count := 0
+	for _, container := range []string{sfs.container, sfs.thumbs} {
+		objects, err := sfs.c.ObjectsAll(container, nil)
+		if err == swift.ContainerNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		// The chunks of the upload sessions are temporary, and they are read
+		// through a manifest: they are left as is.
+		uploads := vfs.UploadsDirName[1:] + "/"
+		for _, obj := range objects {
+			if obj.Bytes == 0 || obj.ContentType == dirContentType ||
+				strings.HasPrefix(obj.Name, uploads) {
+				continue
+			}
+			encrypted, err := sfs.encryptObject(container, obj)
+			if err == swift.ObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return count, err
+			}
+			if encrypted {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// encryptObject rewrites an object in encrypted form, if it is not already
+// encrypted. The encrypted content is written in a temporary object without
+// holding the lock of the VFS. Then, with the lock, it replaces the object
+// only if the object has not been modified in the meantime: a new content has
+// already been written encrypted.
+func (sfs *swiftVFS) encryptObject(container string, obj swift.Object) (bool, error) {
+	f, headers, err := sfs.c.ObjectOpen(container, obj.Name, false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	encrypted, err := vfscrypt.IsEncryptedWith(f, sfs.key, obj.Bytes)
+	if err != nil || encrypted {
+		return false, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	tmpName := vfs.UploadsDirName[1:] + "/encrypt-" + utils.RandomString(16)
+	h := swift.Headers{"Content-Length": fmt.Sprintf("%d", vfscrypt.CipherSize(obj.Bytes))}
+	w, err := sfs.c.ObjectCreate(container, tmpName, false, "", obj.ContentType, h)
+	if err != nil {
+		return false, err
+	}
+	enc, err := vfscrypt.WrapWriteCloser(w, sfs.key)
+	if err != nil {
+		w.Close()                              // #nosec
+		sfs.c.ObjectDelete(container, tmpName) // #nosec
+		return false, err
+	}
+	sum := md5.New() // #nosec
+	_, err = io.Copy(enc, io.TeeReader(f, sum))
+	if errc := enc.Close(); err == nil {
+		err = errc
+	}
+	if err == nil && hex.EncodeToString(sum.Sum(nil)) != headers["Etag"] {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(container, tmpName) // #nosec
+		return false, err
+	}
+
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		sfs.c.ObjectDelete(container, tmpName) // #nosec
+		return false, lockerr
+	}
+	defer sfs.mu.Unlock()
+	current, _, err := sfs.c.Object(container, obj.Name)
+	if err == nil && current.Hash != headers["Etag"] {
+		sfs.c.ObjectDelete(container, tmpName) // #nosec
+		return false, nil
+	}
+	if err == nil {
+		err = sfs.c.ObjectMove(container, tmpName, container, obj.Name)
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(container, tmpName) // #nosec
+		return false, err
+	}
+
+	// With the versioning of the container, the plain content has been kept
+	// in the versions container, and it must be removed.
+	archived, err := sfs.c.ObjectNamesAll(sfs.version, &swift.ObjectsOpts{
+		Prefix: fmt.Sprintf("%03x%s/", len(obj.Name), obj.Name),
+	})
+	if err != nil && err != swift.ContainerNotFound {
+		return true, err
+	}
+	if len(archived) > 0 {
+		if _, err = sfs.c.BulkDelete(sfs.version, archived); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,235 @@
+package vfsswift
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/cozy/swift"
+)
+
+const dirContentType = "directory"
+
+func (sfs *swiftVFS) Fsck(repair bool) ([]*vfs.FsckLog, error) {
+	tree, logs, err := vfs.FsckIndex(sfs.Indexer, sfs.mu, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := sfs.c.ObjectsAll(sfs.container, nil)
+	if err != nil {
+		return nil, err
+	}
+	objectsByName := make(map[string]swift.Object, len(objects))
+	blobsByName := make(map[string]swift.Object)
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, vfs.BlobsDirName[1:]+"/") {
+			blobsByName[obj.Name] = obj
+		}
+		if vfs.IsFsckIgnoredPath("/" + obj.Name) {
+			continue
+		}
+		objectsByName[obj.Name] = obj
+	}
+
+	// The root and the trash are only directories in the index
+	for _, dir := range tree.Dirs {
+		if dir.ID() == consts.RootDirID || dir.ID() == consts.TrashDirID {
+			continue
+		}
+		objName := dir.DirID + "/" + dir.DocName
+		if _, ok := objectsByName[objName]; ok {
+			delete(objectsByName, objName)
+			continue
+		}
+		log := &vfs.FsckLog{Type: vfs.ContentMissing, DirDoc: dir}
+		if repair {
+			err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+				current, err := sfs.Indexer.DirByID(dir.ID())
+				if err != nil || current.DirID != dir.DirID || current.DocName != dir.DocName {
+					return false, err
+				}
+				f, err := sfs.c.ObjectCreate(sfs.container, objName, false, "", dirContentType, nil)
+				if err != nil {
+					return false, err
+				}
+				return true, f.Close()
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	for _, file := range tree.Files {
+		objName := file.DirID + "/" + file.DocName
+		obj, ok := objectsByName[objName]
+		delete(objectsByName, objName)
+		// The content of a file can be in a blob, in which case the empty
+		// object reserving its name can be recreated.
+		if file.BlobID != "" {
+			blob, hasBlob := blobsByName[blobObjName(file.BlobID)]
+			if !ok && hasBlob {
+				log := &vfs.FsckLog{Type: vfs.ContentMissing, FileDoc: file}
+				if repair {
+					err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+						current, err := sfs.Indexer.FileByID(file.ID())
+						if err != nil || current.Rev() != file.Rev() {
+							return false, err
+						}
+						if exists, err := sfs.objectExists(objName); exists || err != nil {
+							return false, err
+						}
+						return true, sfs.c.ObjectPutBytes(sfs.container, objName, nil, file.Mime)
+					})
+					if err != nil {
+						return nil, err
+					}
+				}
+				logs = append(logs, log)
+			}
+			obj, ok = blob, hasBlob
+		}
+		if !ok {
+			log := &vfs.FsckLog{Type: vfs.ContentMissing, FileDoc: file}
+			if repair {
+				contentName := objName
+				if file.BlobID != "" {
+					contentName = blobObjName(file.BlobID)
+				}
+				err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+					current, err := sfs.Indexer.FileByID(file.ID())
+					if err != nil || current.Rev() != file.Rev() {
+						return false, err
+					}
+					if exists, err := sfs.objectExists(contentName); exists || err != nil {
+						return false, err
+					}
+					if file.BlobID != "" {
+						sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+					}
+					return true, sfs.deleteFileDoc(file)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			logs = append(logs, log)
+			continue
+		}
+		md5sum, err := hex.DecodeString(obj.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if obj.Bytes == file.ByteSize && bytes.Equal(md5sum, file.MD5Sum) {
+			continue
+		}
+		size := obj.Bytes
+		if sfs.key != nil {
+			// The hash of an encrypted object is the one of the encrypted
+			// content: only its size can be checked.
+			if obj.Bytes == vfscrypt.CipherSize(file.ByteSize) {
+				continue
+			}
+			if plainSize, errp := vfscrypt.PlainSize(obj.Bytes); errp == nil {
+				size, md5sum = plainSize, nil
+			}
+		}
+		log := &vfs.FsckLog{
+			Type:          vfs.FileMismatch,
+			FileDoc:       file,
+			ContentSize:   size,
+			ContentMD5Sum: md5sum,
+		}
+		if repair {
+			// The update is rejected with a conflict if the file has been
+			// modified since it was checked.
+			err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+				newdoc := file.Clone().(*vfs.FileDoc)
+				newdoc.ByteSize = size
+				if md5sum != nil {
+					newdoc.MD5Sum = md5sum
+				}
+				return true, sfs.Indexer.UpdateFileDoc(file, newdoc)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, log)
+	}
+
+	// The remaining objects have no document in the index. They can be
+	// indexed if their parent directory is known. The identifier of an orphan
+	// directory is lost, so its content can't be attached to it.
+	for _, obj := range objectsByName {
+		log := &vfs.FsckLog{Type: vfs.IndexMissing, ContentPath: obj.Name}
+		logs = append(logs, log)
+		parts := strings.SplitN(obj.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		parent, ok := tree.Dirs[parts[0]]
+		if !repair || !ok {
+			continue
+		}
+		fullpath := path.Join(parent.Fullpath, parts[1])
+		if obj.ContentType == dirContentType {
+			dir, err := vfs.NewDirDocWithParent(parts[1], parent, nil)
+			if err != nil {
+				continue
+			}
+			err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+				if indexed, err := vfs.FsckIsIndexed(sfs.Indexer, fullpath); indexed || err != nil {
+					return false, err
+				}
+				return true, sfs.Indexer.CreateDirDoc(dir)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if log.Repaired {
+				log.DirDoc = dir
+			}
+			continue
+		}
+		md5sum, err := hex.DecodeString(obj.Hash)
+		if err != nil {
+			continue
+		}
+		mime, class := vfs.ExtractMimeAndClass(obj.ContentType)
+		file, err := vfs.NewFileDoc(parts[1], parent.ID(), obj.Bytes, md5sum,
+			mime, class, obj.LastModified, false, false, nil)
+		if err != nil {
+			continue
+		}
+		err = vfs.FsckRepair(sfs.mu, log, func() (bool, error) {
+			if indexed, err := vfs.FsckIsIndexed(sfs.Indexer, fullpath); indexed || err != nil {
+				return false, err
+			}
+			return true, sfs.Indexer.CreateFileDoc(file)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if log.Repaired {
+			log.FileDoc = file
+		}
+	}
+
+	return logs, nil
+}
+
+// objectExists returns true if the container has an object with this name.
+func (sfs *swiftVFS) objectExists(objName string) (bool, error) {
+	_, _, err := sfs.c.Object(sfs.container, objName)
+	if err == swift.ObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
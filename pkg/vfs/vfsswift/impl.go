@@ -1,12 +1,17 @@
 package vfsswift
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -14,6 +19,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
 	"github.com/cozy/swift"
 )
 
@@ -25,13 +31,25 @@ type swiftVFS struct {
 	c         *swift.Connection
 	container string
 	version   string
+	dedup     bool
 	mu        lock.ErrorRWLocker
 	log       *logrus.Entry
+
+	// the container of the thumbnails
+	thumbs string
+
+	// the key used to encrypt the contents of the files, or nil if they are
+	// not encrypted, and whether the contents written before the encryption
+	// was enabled can still be read as is
+	key   []byte
+	plain bool
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and the
-// swift storage url.
-func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, domain string) (vfs.VFS, error) {
+// swift storage url. If key is not nil, the contents of the files are
+// encrypted with it, and plain tells if the contents written before can still
+// be read, until their migration is finished.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, domain string, key []byte, plain bool) (vfs.VFS, error) {
 	if domain == "" {
 		return nil, fmt.Errorf("vfsswift: specified domain is empty")
 	}
@@ -42,8 +60,12 @@ func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, dom
 		c:         config.GetSwiftConnection(),
 		container: "cozy-" + domain,
 		version:   "cozy-" + domain + versionSuffix,
+		dedup:     config.GetConfig().Fs.Dedup,
 		mu:        mu,
 		log:       logger.WithDomain(domain),
+		thumbs:    "data-" + domain,
+		key:       key,
+		plain:     plain,
 	}, nil
 }
 
@@ -149,6 +171,11 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 
 	diskQuota := sfs.DiskQuota()
 
+	var version *vfs.Version
+	if olddoc != nil && sfs.VersionsRetention().Enabled() {
+		version = vfs.NewVersion(olddoc)
+	}
+
 	var maxsize, newsize int64
 	newsize = newdoc.ByteSize
 	if diskQuota > 0 {
@@ -165,6 +192,11 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
 			return nil, vfs.ErrFileTooBig
 		}
+		// the old content is not kept as a version if there is not enough space
+		// left for it.
+		if newsize < 0 || newsize > maxsize {
+			version = nil
+		}
 	} else {
 		maxsize = -1 // no limit
 	}
@@ -174,6 +206,8 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
+	// The new content is not shared until its blob is stored
+	newdoc.BlobID = ""
 
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
@@ -194,30 +228,102 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		}
 	}
 
-	var h swift.Headers
-	if newsize >= 0 {
-		h = swift.Headers{"Content-Length": strconv.FormatInt(newsize, 10)}
+	// The old content is copied before being overwritten. The version
+	// document is only created when the new content has been successfully
+	// uploaded. A blob is not copied, the version takes the reference of the
+	// file to it.
+	if version != nil && version.BlobID == "" {
+		_, err = sfs.c.ObjectCopy(
+			sfs.container, olddoc.DirID+"/"+olddoc.DocName,
+			sfs.container, versionObjName(version),
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	// With the deduplication, the object at objName only reserves the name of
+	// the file, and the content is written in the blobs directory.
+	name := objName
+	var placeholder string
+	var blobHash hash.Hash
+	if sfs.dedup {
+		if olddoc == nil {
+			err = sfs.c.ObjectPutBytes(sfs.container, objName, nil, newdoc.Mime)
+			if err != nil {
+				if version != nil && version.BlobID == "" {
+					sfs.c.ObjectDelete(sfs.container, versionObjName(version)) // #nosec
+				}
+				return nil, err
+			}
+			placeholder = objName
+		}
+		name = blobTmpObjName()
+		blobHash = vfs.NewBlobHash()
+	}
+
+	// With the encryption, swift only sees the encrypted content: the md5sum
+	// of the plain content is computed and checked by the stack.
+	var md5Hash hash.Hash
+	cipherSize := newsize
 	hash := hex.EncodeToString(newdoc.MD5Sum)
+	if sfs.key != nil {
+		md5Hash = md5.New() // #nosec
+		cipherSize = vfscrypt.CipherSize(newsize)
+		hash = ""
+	}
+
+	var h swift.Headers
+	if cipherSize >= 0 {
+		h = swift.Headers{"Content-Length": strconv.FormatInt(cipherSize, 10)}
+	}
 	f, err := sfs.c.ObjectCreate(
 		sfs.container,
-		objName,
+		name,
 		hash != "",
 		hash,
 		newdoc.Mime,
 		h,
 	)
 	if err != nil {
+		if version != nil && version.BlobID == "" {
+			sfs.c.ObjectDelete(sfs.container, versionObjName(version)) // #nosec
+		}
+		if placeholder != "" {
+			sfs.c.ObjectDelete(sfs.container, placeholder) // #nosec
+		}
 		return nil, err
 	}
+	var w io.WriteCloser = f
+	if sfs.key != nil {
+		if w, err = vfscrypt.WrapWriteCloser(f, sfs.key); err != nil {
+			f.Close()                               // #nosec
+			sfs.c.ObjectDelete(sfs.container, name) // #nosec
+			if version != nil && version.BlobID == "" {
+				sfs.c.ObjectDelete(sfs.container, versionObjName(version)) // #nosec
+			}
+			if placeholder != "" {
+				sfs.c.ObjectDelete(sfs.container, placeholder) // #nosec
+			}
+			return nil, err
+		}
+	}
 	return &swiftFileCreation{
-		f:       f,
-		fs:      sfs,
-		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
-		newdoc:  newdoc,
-		olddoc:  olddoc,
-		maxsize: maxsize,
+		f:           f,
+		w:           w,
+		md5Hash:     md5Hash,
+		sha256Hash:  sha256.New(),
+		fs:          sfs,
+		name:        name,
+		objName:     objName,
+		placeholder: placeholder,
+		meta:        vfs.NewMetaExtractor(newdoc),
+		blobHash:    blobHash,
+		newdoc:      newdoc,
+		olddoc:      olddoc,
+		version:     version,
+		maxsize:     maxsize,
 	}, nil
 }
 
@@ -245,6 +351,60 @@ func (sfs *swiftVFS) DestroyFile(doc *vfs.FileDoc) error {
 	return sfs.destroyFile(doc)
 }
 
+func (sfs *swiftVFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if diskQuota := sfs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+olddoc.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	objName := newdoc.DirID + "/" + newdoc.DocName
+	_, _, err = sfs.c.Object(sfs.container, objName)
+	if err != swift.ObjectNotFound {
+		if err != nil {
+			return err
+		}
+		return os.ErrExist
+	}
+
+	// A shared content is not copied, a reference to its blob is added
+	if olddoc.BlobID != "" {
+		return sfs.copyBlob(olddoc, newdoc, objName)
+	}
+
+	// The content is copied by swift, without being downloaded by the stack
+	_, err = sfs.c.ObjectCopy(
+		sfs.container, olddoc.DirID+"/"+olddoc.DocName,
+		sfs.container, objName,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	if err = sfs.Indexer.CreateFileDoc(newdoc); err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	return nil
+}
+
 func (sfs *swiftVFS) destroyDirContent(doc *vfs.DirDoc) error {
 	iter := sfs.DirIterator(doc, nil)
 	for {
@@ -281,11 +441,14 @@ func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
 	if err != nil {
 		return err
 	}
+	if err = sfs.destroyVersions(doc); err != nil {
+		return err
+	}
 	versionObjNames, err := sfs.c.VersionObjectList(sfs.version, objName)
 	// could happened if the versionning could not be enabled, in which case we
 	// do not propagate the error.
 	if err == swift.ContainerNotFound {
-		return sfs.Indexer.DeleteFileDoc(doc)
+		return sfs.deleteFileDoc(doc)
 	}
 	if err != nil {
 		return err
@@ -297,7 +460,69 @@ func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
 				objName, err.Error())
 		}
 	}
-	return sfs.Indexer.DeleteFileDoc(doc)
+	return sfs.deleteFileDoc(doc)
+}
+
+func (sfs *swiftVFS) destroyVersions(doc *vfs.FileDoc) error {
+	versions, err := sfs.Indexer.VersionsFor(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sfs *swiftVFS) DestroyVersion(version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyVersion(version)
+}
+
+func (sfs *swiftVFS) destroyVersion(version *vfs.Version) error {
+	if version.BlobID != "" {
+		if err := sfs.Indexer.DeleteVersion(version); err != nil {
+			return err
+		}
+		return sfs.releaseBlob(version.BlobID)
+	}
+	err := sfs.c.ObjectDelete(sfs.container, versionObjName(version))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return sfs.Indexer.DeleteVersion(version)
+}
+
+// keepVersion creates the document of a version, whose content has already
+// been copied, and removes the versions that have expired.
+func (sfs *swiftVFS) keepVersion(version *vfs.Version) error {
+	if err := sfs.Indexer.CreateVersion(version); err != nil {
+		if version.BlobID != "" {
+			sfs.releaseBlob(version.BlobID) // #nosec
+		} else {
+			sfs.c.ObjectDelete(sfs.container, versionObjName(version)) // #nosec
+		}
+		return err
+	}
+	versions, err := sfs.Indexer.VersionsFor(version.FileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range sfs.VersionsRetention().Expired(versions, time.Now()) {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionObjName(version *vfs.Version) string {
+	return vfs.VersionsDirName[1:] + "/" + version.FileID + "/" + version.ID()
 }
 
 func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
@@ -305,14 +530,36 @@ func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer sfs.mu.RUnlock()
-	f, _, err := sfs.c.ObjectOpen(sfs.container, doc.DirID+"/"+doc.DocName, false, nil)
+	f, _, err := sfs.c.ObjectOpen(sfs.container, contentObjName(doc), false, nil)
 	if err == swift.ObjectNotFound {
 		return nil, os.ErrNotExist
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileOpen{f}, nil
+	return sfs.newFileOpen(f)
+}
+
+func (sfs *swiftVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	if version.FileID != doc.ID() {
+		return nil, os.ErrNotExist
+	}
+	name := versionObjName(version)
+	if version.BlobID != "" {
+		name = blobObjName(version.BlobID)
+	}
+	f, _, err := sfs.c.ObjectOpen(sfs.container, name, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sfs.newFileOpen(f)
 }
 
 // UpdateFileDoc overrides the indexer's one since the swift fs indexes files
@@ -414,15 +661,22 @@ func (sfs *swiftVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 }
 
 type swiftFileCreation struct {
-	f       *swift.ObjectCreateFile
-	w       int64
-	fs      *swiftVFS
-	name    string
-	err     error
-	meta    *vfs.MetaExtractor
-	newdoc  *vfs.FileDoc
-	olddoc  *vfs.FileDoc
-	maxsize int64
+	f           *swift.ObjectCreateFile
+	w           io.WriteCloser
+	written     int64
+	md5Hash     hash.Hash
+	sha256Hash  hash.Hash
+	fs          *swiftVFS
+	name        string
+	objName     string
+	placeholder string
+	err         error
+	meta        *vfs.MetaExtractor
+	blobHash    hash.Hash
+	newdoc      *vfs.FileDoc
+	olddoc      *vfs.FileDoc
+	version     *vfs.Version
+	maxsize     int64
 }
 
 func (f *swiftFileCreation) Read(p []byte) (int, error) {
@@ -441,20 +695,28 @@ func (f *swiftFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	if f.blobHash != nil {
+		f.blobHash.Write(p) // #nosec
+	}
+	if f.md5Hash != nil {
+		f.md5Hash.Write(p) // #nosec
+	}
+	f.sha256Hash.Write(p) // #nosec
+
+	n, err := f.w.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
 	}
 
-	f.w += int64(n)
-	if f.maxsize >= 0 && f.w > f.maxsize {
+	f.written += int64(n)
+	if f.maxsize >= 0 && f.written > f.maxsize {
 		f.err = vfs.ErrFileTooBig
 		return n, f.err
 	}
 
 	size := f.newdoc.ByteSize
-	if size >= 0 && f.w > size {
+	if size >= 0 && f.written > size {
 		f.err = vfs.ErrContentLengthMismatch
 		return n, f.err
 	}
@@ -468,10 +730,16 @@ func (f *swiftFileCreation) Close() (err error) {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
 			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			if f.version != nil && f.version.BlobID == "" {
+				f.fs.c.ObjectDelete(f.fs.container, versionObjName(f.version)) // #nosec
+			}
+			if f.placeholder != "" {
+				f.fs.c.ObjectDelete(f.fs.container, f.placeholder) // #nosec
+			}
 		}
 	}()
 
-	if err = f.f.Close(); err != nil {
+	if err = f.w.Close(); err != nil {
 		if f.meta != nil {
 			(*f.meta).Abort(err)
 		}
@@ -484,7 +752,7 @@ func (f *swiftFileCreation) Close() (err error) {
 		return f.err
 	}
 
-	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.written
 	if f.meta != nil {
 		if errc := (*f.meta).Close(); errc == nil {
 			newdoc.Metadata = (*f.meta).Result()
@@ -492,8 +760,14 @@ func (f *swiftFileCreation) Close() (err error) {
 	}
 
 	// The actual check of the optionally given md5 hash is handled by the swift
-	// library.
-	if newdoc.MD5Sum == nil {
+	// library, except for the encrypted contents.
+	if f.md5Hash != nil {
+		md5sum := f.md5Hash.Sum(nil)
+		if newdoc.MD5Sum != nil && !bytes.Equal(newdoc.MD5Sum, md5sum) {
+			return vfs.ErrInvalidHash
+		}
+		newdoc.MD5Sum = md5sum
+	} else if newdoc.MD5Sum == nil {
 		var headers swift.Headers
 		var md5sum []byte
 		headers, err = f.f.Headers()
@@ -513,18 +787,37 @@ func (f *swiftFileCreation) Close() (err error) {
 		return vfs.ErrContentLengthMismatch
 	}
 
-	if olddoc == nil {
-		if newdoc.ID() == "" {
-			return f.fs.Indexer.CreateFileDoc(newdoc)
-		}
-		return f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	sha256sum := f.sha256Hash.Sum(nil)
+	if newdoc.SHA256Sum != nil && !bytes.Equal(newdoc.SHA256Sum, sha256sum) {
+		return vfs.ErrInvalidDigest
 	}
+	newdoc.SHA256Sum = sha256sum
+	newdoc.Corrupted = false
 
 	lockerr := f.fs.mu.Lock()
 	if lockerr != nil {
 		return lockerr
 	}
 	defer f.fs.mu.Unlock()
+
+	if f.blobHash != nil {
+		if err = f.fs.storeBlob(f.name, newdoc, f.blobHash.Sum(nil)); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				f.fs.releaseBlob(newdoc.BlobID) // #nosec
+			}
+		}()
+	}
+
+	if olddoc == nil {
+		if newdoc.ID() == "" {
+			return f.fs.Indexer.CreateFileDoc(newdoc)
+		}
+		return f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+
 	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
 	// If we reach a conflict error, the document has been modified while
 	// uploading the content of the file.
@@ -538,21 +831,69 @@ func (f *swiftFileCreation) Close() (err error) {
 		}
 		resdoc.Metadata = newdoc.Metadata
 		resdoc.ByteSize = newdoc.ByteSize
-		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		resdoc.SHA256Sum = newdoc.SHA256Sum
+		resdoc.Corrupted = false
+		resdoc.BlobID = newdoc.BlobID
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	// The old content, stored at the name of the file before the
+	// deduplication, is replaced by an empty object.
+	if f.blobHash != nil && olddoc.BlobID == "" {
+		errp := f.fs.c.ObjectPutBytes(f.fs.container, f.objName, nil, newdoc.Mime)
+		if errp != nil {
+			f.fs.log.Errorf("[vfsswift] Could not empty the object of %s: %s",
+				olddoc.ID(), errp.Error())
+		}
+	}
+	if f.version != nil {
+		// The new content is already saved: failing to keep the old one should
+		// not be reported as an error of the upload.
+		if errv := f.fs.keepVersion(f.version); errv != nil {
+			f.fs.log.Errorf("[vfsswift] Could not keep version of %s: %s",
+				olddoc.ID(), errv.Error())
+		}
+	} else if olddoc.BlobID != "" {
+		if errb := f.fs.releaseBlob(olddoc.BlobID); errb != nil {
+			f.fs.log.Errorf("[vfsswift] Could not release the blob of %s: %s",
+				olddoc.ID(), errb.Error())
+		}
 	}
 	return nil
 }
 
+// newFileOpen returns the file for reading the content of an object,
+// decrypted if needed.
+func (sfs *swiftVFS) newFileOpen(f *swift.ObjectOpenFile) (vfs.File, error) {
+	if sfs.key == nil {
+		return &swiftFileOpen{f, f}, nil
+	}
+	size, err := f.Length()
+	if err == nil {
+		var r io.ReadSeeker
+		if r, err = vfscrypt.OpenReader(f, sfs.key, size, sfs.plain); err == nil {
+			return &swiftFileOpen{f, r}, nil
+		}
+	}
+	f.Close() // #nosec
+	return nil, err
+}
+
 type swiftFileOpen struct {
 	f *swift.ObjectOpenFile
+	r io.ReadSeeker
 }
 
 func (f *swiftFileOpen) Read(p []byte) (int, error) {
-	return f.f.Read(p)
+	return f.r.Read(p)
 }
 
 func (f *swiftFileOpen) Seek(offset int64, whence int) (int64, error) {
-	return f.f.Seek(offset, whence)
+	return f.r.Seek(offset, whence)
 }
 
 func (f *swiftFileOpen) Write(p []byte) (int, error) {
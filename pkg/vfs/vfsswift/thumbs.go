@@ -8,17 +8,22 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
 	"github.com/cozy/swift"
 )
 
-// NewThumbsFs creates a new thumb filesystem base on swift.
-func NewThumbsFs(c *swift.Connection, domain string) vfs.Thumbser {
-	return &thumbs{c: c, container: "data-" + domain}
+// NewThumbsFs creates a new thumb filesystem base on swift. If key is not
+// nil, the thumbnails are encrypted with it, and plain tells if the
+// thumbnails generated before can still be read.
+func NewThumbsFs(c *swift.Connection, domain string, key []byte, plain bool) vfs.Thumbser {
+	return &thumbs{c: c, container: "data-" + domain, key: key, plain: plain}
 }
 
 type thumbs struct {
 	c         *swift.Connection
 	container string
+	key       []byte
+	plain     bool
 }
 
 func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, error) {
@@ -27,7 +32,11 @@ func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, e
 	if err := t.c.ContainerCreate(t.container, nil); err != nil {
 		return nil, err
 	}
-	return t.c.ObjectCreate(t.container, t.makeName(img, format), false, "", "", nil)
+	f, err := t.c.ObjectCreate(t.container, t.makeName(img, format), false, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return vfscrypt.WrapWriteCloser(f, t.key)
 }
 
 func (t *thumbs) RemoveThumb(img *vfs.FileDoc, format string) error {
@@ -41,9 +50,17 @@ func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img
 		return wrapSwiftErr(err)
 	}
 	defer f.Close()
+	size, err := f.Length()
+	if err != nil {
+		return err
+	}
+	content, err := vfscrypt.OpenReader(f, t.key, size, t.plain)
+	if err != nil {
+		return err
+	}
 	lastModified, _ := time.Parse(http.TimeFormat, o["Last-Modified"]) // #nosec
 	w.Header().Set("Etag", o["Etag"])
-	http.ServeContent(w, req, name, lastModified, f)
+	http.ServeContent(w, req, name, lastModified, content)
 	return nil
 }
 
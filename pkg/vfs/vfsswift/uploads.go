@@ -0,0 +1,198 @@
+package vfsswift
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// The chunks of an upload session are stored as the segments of a dynamic
+// large object: the manifest object references them by their common prefix,
+// and reading it gives the concatenation of the chunks, sorted by name.
+
+func uploadPrefix(session *vfs.UploadSession) string {
+	return vfs.UploadsDirName[1:] + "/" + session.ID() + "/"
+}
+
+func chunkObjName(session *vfs.UploadSession, offset int64) string {
+	return uploadPrefix(session) + "chunks/" + fmt.Sprintf("%020d", offset)
+}
+
+// chunkTmpObjName returns the name of the object where a chunk is written
+// before being moved under the prefix of the manifest. It is outside of this
+// prefix, and each attempt has its own name, so that a failed attempt doesn't
+// corrupt a chunk that has already been received.
+func chunkTmpObjName(session *vfs.UploadSession, offset int64) string {
+	return uploadPrefix(session) + "tmp/" + fmt.Sprintf("%020d", offset) + "-" + utils.RandomString(8)
+}
+
+func manifestObjName(session *vfs.UploadSession) string {
+	return uploadPrefix(session) + "manifest"
+}
+
+func (sfs *swiftVFS) CreateUploadChunk(session *vfs.UploadSession, offset, size int64) (io.WriteCloser, error) {
+	tmpName := chunkTmpObjName(session, offset)
+	f, err := sfs.c.ObjectCreate(sfs.container, tmpName, false, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &swiftChunkCreation{
+		f:       f,
+		sfs:     sfs,
+		size:    size,
+		tmpName: tmpName,
+		objName: chunkObjName(session, offset),
+	}, nil
+}
+
+// putManifest creates the manifest object of the upload session.
+func (sfs *swiftVFS) putManifest(session *vfs.UploadSession) (string, error) {
+	objName := manifestObjName(session)
+	headers := swift.Headers{
+		"Content-Length":    "0",
+		"X-Object-Manifest": sfs.container + "/" + uploadPrefix(session) + "chunks/",
+	}
+	_, err := sfs.c.ObjectPut(sfs.container, objName, strings.NewReader(""), false, "", "", headers)
+	return objName, err
+}
+
+func (sfs *swiftVFS) OpenUploadChunks(session *vfs.UploadSession) (io.ReadCloser, error) {
+	objName, err := sfs.putManifest(session)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (sfs *swiftVFS) CommitUploadChunks(session *vfs.UploadSession, newdoc *vfs.FileDoc) error {
+	// The content must go through the stack when it is deduplicated or
+	// encrypted, when its metadata are extracted, and when its sha256 has to
+	// be checked.
+	if sfs.dedup || sfs.key != nil || vfs.NewMetaExtractor(newdoc) != nil ||
+		len(newdoc.SHA256Sum) > 0 {
+		return vfs.CopyUploadChunks(sfs, session, newdoc)
+	}
+
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if diskQuota := sfs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+newdoc.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	objName := newdoc.DirID + "/" + newdoc.DocName
+	_, _, err = sfs.c.Object(sfs.container, objName)
+	if err != swift.ObjectNotFound {
+		if err != nil {
+			return err
+		}
+		return os.ErrExist
+	}
+
+	// Copying the manifest of a dynamic large object creates an object with
+	// the concatenation of its segments: the chunks are assembled by swift,
+	// without being downloaded and uploaded again by the stack.
+	manifest, err := sfs.putManifest(session)
+	if err != nil {
+		return err
+	}
+	h := swift.Headers{"Content-Type": newdoc.Mime}
+	if _, err = sfs.c.ObjectCopy(sfs.container, manifest, sfs.container, objName, h); err != nil {
+		return err
+	}
+	obj, _, err := sfs.c.Object(sfs.container, objName)
+	if err == nil && obj.Bytes != newdoc.ByteSize {
+		err = vfs.ErrContentLengthMismatch
+	}
+	var md5sum []byte
+	if err == nil {
+		md5sum, err = hex.DecodeString(obj.Hash)
+	}
+	if err == nil && len(newdoc.MD5Sum) > 0 && !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	newdoc.MD5Sum = md5sum
+	if err = sfs.Indexer.CreateFileDoc(newdoc); err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	return nil
+}
+
+func (sfs *swiftVFS) DestroyUploadChunks(session *vfs.UploadSession) error {
+	objNames, err := sfs.c.ObjectNamesAll(sfs.container, &swift.ObjectsOpts{
+		Prefix: uploadPrefix(session),
+	})
+	if err != nil {
+		return err
+	}
+	if len(objNames) > 0 {
+		_, err = sfs.c.BulkDelete(sfs.container, objNames)
+	}
+	return err
+}
+
+// swiftChunkCreation is used to write a chunk of an upload session.
+type swiftChunkCreation struct {
+	f       *swift.ObjectCreateFile
+	sfs     *swiftVFS
+	w       int64
+	size    int64
+	tmpName string
+	objName string
+}
+
+func (c *swiftChunkCreation) Write(p []byte) (int, error) {
+	if c.w+int64(len(p)) > c.size {
+		return 0, vfs.ErrContentLengthMismatch
+	}
+	n, err := c.f.Write(p)
+	c.w += int64(n)
+	return n, err
+}
+
+func (c *swiftChunkCreation) Close() error {
+	err := c.f.Close()
+	if err == nil && c.w != c.size {
+		err = vfs.ErrContentLengthMismatch
+	}
+	if err == nil {
+		err = c.sfs.c.ObjectMove(c.sfs.container, c.tmpName, c.sfs.container, c.objName)
+	}
+	if err != nil {
+		// Only the object written by this attempt is removed
+		c.sfs.c.ObjectDelete(c.sfs.container, c.tmpName) // #nosec
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package encrypt
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+func init() {
+	jobs.AddWorker("encrypt-files", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  24 * time.Hour,
+		Timeout:      24 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that encrypts the contents of the files of an instance
+// that have been written before the encryption was enabled. The contents are
+// encrypted one by one, and the files can still be used in the meantime.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	n, err := i.EncryptFiles()
+	if n > 0 {
+		logger.WithDomain(domain).Infof("[jobs] encrypt-files: %d contents encrypted", n)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package extract
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// progressInterval is the minimal duration between two updates of the
+// progress of a job
+const progressInterval = 2 * time.Second
+
+// Message is the message of the jobs for extracting an archive.
+type Message struct {
+	FileID string `json:"file_id"`
+	DirID  string `json:"dir_id"`
+}
+
+func init() {
+	jobs.AddWorker("extract", &jobs.WorkerConfig{
+		Concurrency: 2,
+		// A new execution would extract the files again, next to the ones
+		// extracted by the failed execution
+		MaxExecCount: 1,
+		MaxExecTime:  1 * time.Hour,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that unpacks a zip or tar archive of the VFS in a
+// directory. The progress of the extraction is reported in the job.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	msg := &Message{}
+	if err := m.Unmarshal(msg); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	log := logger.WithDomain(domain)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	fs := i.VFS()
+	file, err := fs.FileByID(msg.FileID)
+	if err != nil {
+		return err
+	}
+	dir, err := fs.DirByID(msg.DirID)
+	if err != nil {
+		return err
+	}
+	if file.Trashed {
+		return vfs.ErrFileInTrash
+	}
+	if dir.Fullpath == vfs.TrashDirName ||
+		strings.HasPrefix(dir.Fullpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	var last time.Time
+	err = vfs.ExtractArchive(fs, file, dir, func(done, total int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if done < total && time.Since(last) < progressInterval {
+			return nil
+		}
+		last = time.Now()
+		return jobs.SetProgress(ctx, done, total)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("[jobs] extract: %s extracted in %s", file.ID(), dir.Fullpath)
+	return nil
+}
@@ -0,0 +1,372 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// MaxSize is the maximal size of a file downloaded in the VFS, in bytes.
+var MaxSize int64 = 1 << 30
+
+// progressInterval is the minimal duration between two updates of the
+// progress of a job
+const progressInterval = 2 * time.Second
+
+// maxRedirects is the maximal number of redirections followed for a download
+const maxRedirects = 10
+
+var (
+	// ErrInvalidURL is used when the URL to download is not an absolute
+	// HTTP(S) URL
+	ErrInvalidURL = errors.New("The URL must be an absolute http or https URL")
+	// ErrForbiddenAddress is used when the URL to download resolves to a
+	// private, loopback or link-local address
+	ErrForbiddenAddress = errors.New("The URL resolves to a forbidden address")
+	// ErrTooBig is used when the resource to download is bigger than MaxSize
+	ErrTooBig = errors.New("The resource is too big to be downloaded")
+)
+
+// isForbiddenAddress returns true if the error of a request comes from the
+// check of the addresses. The error of the dialer can be wrapped in a
+// *net.OpError by the transport, and in a *url.Error by the client.
+func isForbiddenAddress(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return err == ErrForbiddenAddress
+		}
+	}
+}
+
+// forbiddenNets are the networks that can't be reached by a download, to not
+// let a user use the stack to access the services of its private network.
+var forbiddenNets []*net.IPNet
+
+// allowPrivateAddresses disables the check of the addresses, for the tests.
+var allowPrivateAddresses = false
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",          // "This" network
+		"10.0.0.0/8",         // Private
+		"100.64.0.0/10",      // Carrier-grade NAT
+		"127.0.0.0/8",        // Loopback
+		"169.254.0.0/16",     // Link-local
+		"172.16.0.0/12",      // Private
+		"192.0.0.0/24",       // IETF protocol assignments
+		"192.168.0.0/16",     // Private
+		"198.18.0.0/15",      // Benchmarking
+		"224.0.0.0/4",        // Multicast
+		"240.0.0.0/4",        // Reserved, and broadcast
+		"::/128",             // Unspecified
+		"::1/128",            // Loopback
+		"fc00::/7",           // Unique local
+		"fe80::/10",          // Link-local
+		"ff00::/8",           // Multicast
+		"64:ff9b::/96",       // IPv4/IPv6 translation
+		"100::/64",           // Discard-only
+		"2002::/16",          // 6to4, which can embed any IPv4 address
+		"2001::/32",          // Teredo, which can embed any IPv4 address
+		"255.255.255.255/32", // Broadcast
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		forbiddenNets = append(forbiddenNets, n)
+	}
+
+	jobs.AddWorker("download-to-vfs", &jobs.WorkerConfig{
+		Concurrency:  4,
+		MaxExecCount: 2,
+		MaxExecTime:  15 * time.Minute,
+		Timeout:      15 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Message is the message of the jobs for downloading a resource in the VFS.
+type Message struct {
+	URL   string `json:"url"`
+	DirID string `json:"dir_id"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Worker is a worker that downloads a remote HTTP(S) resource, and saves it
+// as a file of the VFS. The job is done when the file has been created, and
+// errored with the reason of the failure else.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	msg := &Message{}
+	if err := m.Unmarshal(msg); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	log := logger.WithDomain(domain)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	fs := i.VFS()
+	dir, err := fs.DirByID(msg.DirID)
+	if err != nil {
+		return err
+	}
+
+	res, err := fetch(ctx, msg.URL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// The beginning of the content is used to detect its type, when the
+	// response has no Content-Type
+	body := bufio.NewReader(res.Body)
+	head, _ := body.Peek(512)
+	doc, err := newFileDoc(res, head, dir, msg.Name)
+	if err != nil {
+		return err
+	}
+	if doc.ByteSize > MaxSize {
+		return ErrTooBig
+	}
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	err = copyWithProgress(ctx, file, body, doc.ByteSize)
+	if errc := file.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("[jobs] download-to-vfs: %s saved in %s", msg.URL, path.Join(dir.Fullpath, doc.DocName))
+	return nil
+}
+
+// fetch makes the GET request on the given URL, and returns the response if
+// it is successful.
+func fetch(ctx context.Context, rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	res, err := client.Do(req)
+	if err != nil {
+		if isForbiddenAddress(err) {
+			return nil, ErrForbiddenAddress
+		}
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected response status: %s", res.Status)
+	}
+	return res, nil
+}
+
+// client is the HTTP client used for the downloads. It does not use the
+// proxies of the environment, as the addresses are checked when dialing.
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           dialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("Too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return ErrInvalidURL
+		}
+		return nil
+	},
+}
+
+var dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// dialContext resolves the host and dials one of its addresses, only if none
+// of them is forbidden. The address that has been checked is the one used
+// for the connection, so that a DNS response can't change between the check
+// and the connection.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isForbidden(ip) {
+			return nil, ErrForbiddenAddress
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("No address for %s", host)
+	}
+	return nil, err
+}
+
+func isForbidden(ip net.IP) bool {
+	if allowPrivateAddresses {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newFileDoc returns the document of the file for the downloaded resource.
+// The size, the content-type and the md5sum come from the response headers
+// when they are given.
+func newFileDoc(res *http.Response, head []byte, dir *vfs.DirDoc, name string) (*vfs.FileDoc, error) {
+	if name == "" {
+		name = fileName(res)
+	}
+	size := res.ContentLength
+	if size < 0 {
+		size = -1
+	}
+	var md5sum []byte
+	if h := res.Header.Get("Content-MD5"); h != "" {
+		sum, err := base64.StdEncoding.DecodeString(h)
+		if err == nil && len(sum) == 16 {
+			md5sum = sum
+		}
+	}
+	mime, class := contentType(res, head, name)
+	return vfs.NewFileDoc(name, dir.ID(), size, md5sum, mime, class,
+		time.Now(), false, false, nil)
+}
+
+// fileName returns the name of the file for the downloaded resource, from
+// the Content-Disposition header or from the last segment of the URL path.
+func fileName(res *http.Response) string {
+	if disposition := res.Header.Get("Content-Disposition"); disposition != "" {
+		_, params, err := mime.ParseMediaType(disposition)
+		if err == nil && params["filename"] != "" {
+			if name := cleanName(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	if res.Request != nil && res.Request.URL != nil {
+		if name := cleanName(path.Base(res.Request.URL.Path)); name != "" {
+			return name
+		}
+	}
+	return "download"
+}
+
+// cleanName removes the directories and the characters that are not allowed
+// in the name of a file.
+func cleanName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// contentType returns the mime type and class of the downloaded resource. A
+// missing or generic Content-Type header is replaced by the mime type of the
+// extension of the file name, or else by the type detected from the
+// beginning of the content.
+func contentType(res *http.Response, head []byte, name string) (string, string) {
+	contentType := res.Header.Get("Content-Type")
+	if mediatype, _, err := mime.ParseMediaType(contentType); err == nil &&
+		mediatype != "application/octet-stream" {
+		return vfs.ExtractMimeAndClass(mediatype)
+	}
+	if mime, class := vfs.ExtractMimeAndClassFromFilename(name); mime != vfs.DefaultContentType {
+		return mime, class
+	}
+	return vfs.ExtractMimeAndClass(http.DetectContentType(head))
+}
+
+// copyWithProgress copies the body of the response in the file, in the
+// limit of MaxSize, and reports the progress in the job.
+func copyWithProgress(ctx context.Context, dst io.Writer, src io.Reader, total int64) error {
+	src = io.LimitReader(src, MaxSize+1)
+	buf := make([]byte, 32*1024)
+	var done int64
+	var last time.Time
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, errw := dst.Write(buf[:n]); errw != nil {
+				return errw
+			}
+			done += int64(n)
+			if done > MaxSize {
+				return ErrTooBig
+			}
+			if total > 0 && time.Since(last) >= progressInterval {
+				last = time.Now()
+				if errp := jobs.SetProgress(ctx, done, total); errp != nil {
+					return errp
+				}
+			}
+		}
+		if err == io.EOF {
+			if total > 0 {
+				return jobs.SetProgress(ctx, done, total)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsForbidden(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1",
+		"10.1.2.3",
+		"172.20.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"0.0.0.0",
+		"::1",
+		"fd00::1",
+		"fe80::1",
+		"::ffff:127.0.0.1",
+	} {
+		assert.True(t, isForbidden(net.ParseIP(addr)), addr)
+	}
+	for _, addr := range []string{
+		"93.184.216.34",
+		"172.32.0.1",
+		"2606:2800:220:1:248:1893:25c8:1946",
+	} {
+		assert.False(t, isForbidden(net.ParseIP(addr)), addr)
+	}
+}
+
+func TestFetchForbidden(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer ts.Close()
+
+	_, err := fetch(context.Background(), ts.URL)
+	assert.Equal(t, ErrForbiddenAddress, err)
+
+	u, _ := url.Parse(ts.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	_, err = fetch(context.Background(), "http://localhost:"+port+"/")
+	assert.Equal(t, ErrForbiddenAddress, err)
+
+	wrapped := &url.Error{Op: "Get", URL: ts.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: ErrForbiddenAddress}}
+	assert.True(t, isForbiddenAddress(wrapped))
+	assert.False(t, isForbiddenAddress(&url.Error{Op: "Get", URL: ts.URL, Err: ErrInvalidURL}))
+
+	_, err = fetch(context.Background(), "file:///etc/passwd")
+	assert.Equal(t, ErrInvalidURL, err)
+	_, err = fetch(context.Background(), "/relative/path")
+	assert.Equal(t, ErrInvalidURL, err)
+}
+
+func TestFetch(t *testing.T) {
+	allowPrivateAddresses = true
+	defer func() { allowPrivateAddresses = false }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/statements/2017-08.pdf", http.StatusFound)
+		case "/statements/2017-08.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write([]byte("%PDF-1.4"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := fetch(context.Background(), ts.URL+"/redirect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "2017-08.pdf", fileName(res))
+	mime, class := contentType(res, nil, "2017-08.pdf")
+	assert.Equal(t, "application/pdf", mime)
+	assert.Equal(t, "application", class)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4", string(body))
+
+	_, err = fetch(context.Background(), ts.URL+"/not-found")
+	assert.Error(t, err)
+}
+
+func TestFileName(t *testing.T) {
+	u, _ := url.Parse("https://bank.example.com/download/")
+	res := &http.Response{
+		Header:  http.Header{},
+		Request: &http.Request{URL: u},
+	}
+	assert.Equal(t, "download", fileName(res))
+
+	res.Header.Set("Content-Disposition", `attachment; filename="../statement.pdf"`)
+	assert.Equal(t, "statement.pdf", fileName(res))
+}
+
+func TestContentType(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	mime, class := contentType(res, nil, "notes")
+	assert.Equal(t, "text/plain", mime)
+	assert.Equal(t, "text", class)
+
+	res.Header.Set("Content-Type", "application/octet-stream")
+	mime, _ = contentType(res, nil, "photo.png")
+	assert.Equal(t, "image/png", mime)
+
+	mime, class = contentType(res, []byte("\x89PNG\r\n\x1a\n"), "photo")
+	assert.Equal(t, "image/png", mime)
+	assert.Equal(t, "image", class)
+}
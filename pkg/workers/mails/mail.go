@@ -19,6 +19,7 @@ import (
 func init() {
 	jobs.AddWorker("sendmail", &jobs.WorkerConfig{
 		Concurrency: runtime.NumCPU(),
+		RetryDelay:  1 * time.Second,
 		WorkerFunc:  SendMail,
 	})
 }
@@ -76,7 +77,7 @@ func SendMail(ctx context.Context, m *jobs.Message) error {
 	opts := Options{}
 	err := m.Unmarshal(&opts)
 	if err != nil {
-		return err
+		return jobs.Permanent(err)
 	}
 	domain := ctx.Value(jobs.ContextDomainKey).(string)
 	switch opts.Mode {
@@ -101,7 +102,7 @@ func SendMail(ctx context.Context, m *jobs.Message) error {
 		}
 		opts.From = fromAddr
 	default:
-		return fmt.Errorf("Mail sent with unknown mode %s", opts.Mode)
+		return jobs.Permanent(fmt.Errorf("Mail sent with unknown mode %s", opts.Mode))
 	}
 	return sendMail(ctx, &opts)
 }
@@ -127,13 +128,13 @@ func addressFromDomain(domain string) (*Address, error) {
 
 func doSendMail(ctx context.Context, opts *Options) error {
 	if opts.Subject == "" {
-		return errors.New("Missing mail subject")
+		return jobs.Permanent(errors.New("Missing mail subject"))
 	}
 	if len(opts.To) == 0 {
-		return errors.New("Missing mail recipient")
+		return jobs.Permanent(errors.New("Missing mail recipient"))
 	}
 	if opts.From == nil {
-		return errors.New("Missing mail sender")
+		return jobs.Permanent(errors.New("Missing mail sender"))
 	}
 	mail := gomail.NewMessage()
 	dialerOptions := opts.Dialer
@@ -188,7 +189,7 @@ func doSendMail(ctx context.Context, opts *Options) error {
 func addPart(mail *gomail.Message, part *Part) error {
 	contentType := part.Type
 	if contentType != "text/plain" && contentType != "text/html" {
-		return fmt.Errorf("Unknown body content-type %s", contentType)
+		return jobs.Permanent(fmt.Errorf("Unknown body content-type %s", contentType))
 	}
 	mail.AddAlternative(contentType, part.Body)
 	return nil
@@ -0,0 +1,57 @@
+package metadata
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("metadata", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  1 * time.Hour,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that extracts again the metadata of the files whose
+// metadata have been extracted by an older version of the extractor.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	log := logger.WithDomain(domain)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	fs := i.VFS()
+	_, files, err := fs.AllDirsAndFiles()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, file := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if file.Trashed || !vfs.NeedsMetadataUpdate(file) {
+			continue
+		}
+		// A file that can't be read should not prevent the other files to
+		// have their metadata updated
+		if err = vfs.UpdateMetadata(fs, file); err != nil {
+			log.Warnf("[jobs] metadata: cannot update %s: %s", file.ID(), err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Infof("[jobs] metadata: %d files updated", n)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package scrub
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("files-scrub", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  6 * time.Hour,
+		Timeout:      6 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that re-reads the contents of the files of an instance,
+// and flags the files whose stored content no longer matches their checksums.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	res, err := vfs.ScrubFiles(i.VFS())
+	if res != nil {
+		log := logger.WithDomain(domain)
+		log.Infof("[jobs] files-scrub: %d files checked, %d corrupted",
+			res.Checked, len(res.Corrupted))
+		for _, file := range res.Corrupted {
+			log.Warnf("[jobs] files-scrub: the content of %s is corrupted", file.ID())
+		}
+	}
+	return err
+}
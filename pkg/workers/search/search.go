@@ -0,0 +1,58 @@
+package search
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+type fileMessage struct {
+	Event *struct {
+		Type string      `json:"Type"`
+		Doc  vfs.FileDoc `json:"Doc"`
+	} `json:"event"`
+}
+
+func init() {
+	jobs.AddWorker("search-index", &jobs.WorkerConfig{
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		MaxExecTime:  10 * time.Minute,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that keeps the full-text search index of the files up
+// to date. It is triggered by the events on the files, and a job without
+// event indexes again all the files of the instance.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	msg := &fileMessage{}
+	if err := m.Unmarshal(msg); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if msg.Event == nil {
+		logger.WithDomain(domain).Infof("[jobs] search-index: index all the files")
+		return search.IndexAll(ctx, i, i.VFS())
+	}
+	doc := &msg.Event.Doc
+	if doc.Type != consts.FileType {
+		return nil
+	}
+	if msg.Event.Type == "DELETED" || doc.Trashed {
+		return search.Remove(i, doc.ID())
+	}
+	return search.Index(ctx, i, i.VFS(), doc)
+}
@@ -32,6 +32,7 @@ import (
 func init() {
 	jobs.AddWorker("sharedata", &jobs.WorkerConfig{
 		Concurrency: runtime.NumCPU(),
+		RetryDelay:  1 * time.Second,
 		WorkerFunc:  SendData,
 	})
 }
@@ -208,16 +209,16 @@ func SendData(ctx context.Context, m *jobs.Message) error {
 			opts.Type = consts.DirType
 			ins.Logger().Debugf("[sharings] share_data: Sending directory: %v",
 				dirDoc)
-			return SendDir(ins, opts, dirDoc)
+			return withRetryAfter(SendDir(ins, opts, dirDoc))
 		}
 		opts.Type = consts.FileType
 		ins.Logger().Debugf("[sharings] share_data: Sending file: %v", fileDoc)
-		return SendFile(ins, opts, fileDoc)
+		return withRetryAfter(SendFile(ins, opts, fileDoc))
 	}
 
 	ins.Logger().Debugf("[sharings] share_data: Sending %s: %s", opts.DocType,
 		opts.DocID)
-	return SendDoc(ins, opts)
+	return withRetryAfter(SendDoc(ins, opts))
 }
 
 // DeleteDoc asks the recipients to delete the shared document which id was
@@ -950,10 +951,40 @@ func parseError(err error) error {
 		errReq.Title == "Forbidden" {
 		return ErrForbidden
 	}
+	// Keep the delay asked by the recipient before sending it another request
+	if errReq.RetryAfter > 0 {
+		return errReq
+	}
 
 	return errors.New(errReq.Error())
 }
 
+// withRetryAfter wraps the error of a request to a remote cozy with
+// jobs.RetryAfter when the remote cozy has asked, with a Retry-After header,
+// to wait before sending it another request.
+func withRetryAfter(err error) error {
+	if delay := retryAfterOf(err); delay > 0 {
+		return jobs.RetryAfter(err, delay)
+	}
+	return err
+}
+
+func retryAfterOf(err error) time.Duration {
+	switch e := err.(type) {
+	case *request.Error:
+		return e.RetryAfter
+	case *multierror.Error:
+		var delay time.Duration
+		for _, err := range e.Errors {
+			if d := retryAfterOf(err); d > delay {
+				delay = d
+			}
+		}
+		return delay
+	}
+	return 0
+}
+
 // filehasChanges checks that the local file do have changes compared to the
 // remote one.
 // This is done to prevent infinite loops after a PUT/PATCH in master-master:
@@ -15,6 +15,7 @@ import (
 
 	"net/url"
 
+	"github.com/cozy/cozy-stack/client/request"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -26,6 +27,7 @@ import (
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/files"
 	"github.com/cozy/cozy-stack/web/jsonapi"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 	"reflect"
@@ -895,6 +897,32 @@ func TestFindMissingRefs(t *testing.T) {
 	}))
 }
 
+func TestRetryAfterOf(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	_, err = request.Req(&request.Options{
+		Method: http.MethodGet,
+		Domain: u.Host,
+		Path:   "/sharings/doc/io.cozy.tests/123",
+	})
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Equal(t, 120*time.Second, retryAfterOf(err))
+	assert.Equal(t, err.Error(), withRetryAfter(err).Error())
+	assert.Equal(t, err, parseError(err))
+
+	errs := multierror.Append(nil, fmt.Errorf("other error"), err)
+	assert.Equal(t, 120*time.Second, retryAfterOf(errs))
+	assert.Equal(t, time.Duration(0), retryAfterOf(fmt.Errorf("other error")))
+}
+
 func TestGetParentDirID(t *testing.T) {
 	optsRoot := SendOptions{
 		Selector: "",
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 	"runtime"
+	"time"
 
 	"github.com/cozy/cozy-stack/client/auth"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -21,6 +22,7 @@ import (
 func init() {
 	jobs.AddWorker("sharingupdates", &jobs.WorkerConfig{
 		Concurrency: runtime.NumCPU(),
+		RetryDelay:  1 * time.Second,
 		WorkerFunc:  SharingUpdates,
 	})
 }
@@ -119,7 +121,8 @@ func SharingUpdates(ctx context.Context, m *jobs.Message) error {
 		return ErrDocumentNotLegitimate
 	}
 
-	return sendToRecipients(i, domain, sharing, &rule, docID, event.Event.Type)
+	err = sendToRecipients(i, domain, sharing, &rule, docID, event.Event.Type)
+	return withRetryAfter(err)
 }
 
 // sendToRecipients sends the document to the recipient, or sharer.
@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/previews"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
@@ -21,7 +22,7 @@ var formats = map[string]string{
 	"large":  "1920x1080",
 }
 
-type imageMessage struct {
+type fileMessage struct {
 	Event struct {
 		Type string      `json:"Type"`
 		Doc  vfs.FileDoc `json:"Doc"`
@@ -32,14 +33,16 @@ func init() {
 	jobs.AddWorker("thumbnail", &jobs.WorkerConfig{
 		Concurrency:  (runtime.NumCPU() + 1) / 2,
 		MaxExecCount: 2,
-		Timeout:      15 * time.Second,
+		MaxExecTime:  5 * time.Minute,
+		Timeout:      5 * time.Minute,
 		WorkerFunc:   Worker,
 	})
 }
 
-// Worker is a worker that creates thumbnails for photos and images.
+// Worker is a worker that creates thumbnails for the files that have a
+// preview generator: photos, images, PDFs, videos, etc.
 func Worker(ctx context.Context, m *jobs.Message) error {
-	msg := &imageMessage{}
+	msg := &fileMessage{}
 	if err := m.Unmarshal(msg); err != nil {
 		return err
 	}
@@ -61,26 +64,55 @@ func Worker(ctx context.Context, m *jobs.Message) error {
 	case "DELETED":
 		return removeThumbnails(i, &msg.Event.Doc)
 	}
-	return fmt.Errorf("Unknown type %s for image event", msg.Event.Type)
+	return fmt.Errorf("Unknown type %s for file event", msg.Event.Type)
 }
 
-func generateThumbnails(ctx context.Context, i *instance.Instance, img *vfs.FileDoc) error {
-	fs := i.ThumbsFS()
-	var in io.Reader
-	in, err := i.VFS().OpenFile(img)
+func generateThumbnails(ctx context.Context, i *instance.Instance, doc *vfs.FileDoc) error {
+	gen := previews.Find(doc.Mime)
+	if gen == nil || doc.Trashed {
+		return nil
+	}
+	if !gen.Allow(doc.ByteSize) {
+		logger.WithDomain(i.Domain).Infof("[jobs] thumbnail: %s is too big for a preview (%d bytes)",
+			doc.ID(), doc.ByteSize)
+		return nil
+	}
+	if gen.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gen.Timeout)
+		defer cancel()
+	}
+
+	fs, err := i.ThumbsFS()
 	if err != nil {
 		return err
 	}
-	in, err = recGenerateThub(ctx, in, fs, img, "large")
+	content, err := i.VFS().OpenFile(doc)
 	if err != nil {
 		return err
 	}
-	in, err = recGenerateThub(ctx, in, fs, img, "medium")
+	// The preview is rendered in a pipe, from which the large thumbnail is
+	// made, and the smaller ones are made from the larger ones.
+	pr, pw := io.Pipe()
+	go func() {
+		err := gen.Render(ctx, content, pw)
+		if errc := content.Close(); errc != nil && err == nil {
+			err = errc
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var in io.Reader = pr
+	in, err = recGenerateThub(ctx, in, fs, doc, "large")
+	if err != nil {
+		return err
+	}
+	in, err = recGenerateThub(ctx, in, fs, doc, "medium")
 	if err != nil {
 		return err
 	}
 	// TODO(optim): no need for the last output
-	_, err = recGenerateThub(ctx, in, fs, img, "small")
+	_, err = recGenerateThub(ctx, in, fs, doc, "small")
 	return err
 }
 
@@ -131,10 +163,14 @@ func generateThumb(ctx context.Context, in io.Reader, out io.Writer, format stri
 	return cmd.Run()
 }
 
-func removeThumbnails(i *instance.Instance, img *vfs.FileDoc) error {
+func removeThumbnails(i *instance.Instance, doc *vfs.FileDoc) error {
+	fs, err := i.ThumbsFS()
+	if err != nil {
+		return err
+	}
 	var e error
 	for format := range formats {
-		if err := i.ThumbsFS().RemoveThumb(img, format); err != nil {
+		if err := fs.RemoveThumb(doc, format); err != nil {
 			e = err
 		}
 	}
@@ -0,0 +1,40 @@
+package trash
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("trash-purge", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  30 * time.Minute,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that destroys the files and directories that have been
+// in the trash for longer than the retention of the instance.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	retention := i.TrashRetention()
+	if retention <= 0 {
+		return nil
+	}
+	n, err := vfs.PurgeTrash(i.VFS(), time.Now().Add(-retention))
+	if n > 0 {
+		logger.WithDomain(domain).Infof("[jobs] trash-purge: %d items destroyed", n)
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package uploads
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("uploads-gc", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  5 * time.Minute,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that removes the upload sessions that have expired,
+// with the chunks that have been received for them.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	n, err := vfs.PurgeExpiredUploadSessions(i.VFS(), time.Now())
+	if n > 0 {
+		logger.WithDomain(domain).Infof("[jobs] uploads-gc: %d expired sessions removed", n)
+	}
+	return err
+}
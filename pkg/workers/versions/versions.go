@@ -0,0 +1,37 @@
+package versions
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("versions-purge", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 2,
+		MaxExecTime:  30 * time.Minute,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that destroys the old versions of the files that are
+// older than the max age of the retention policy of the instance. Without
+// it, the max age would only be enforced when a file is updated again.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	n, err := vfs.PurgeVersions(i.VFS(), i.VersionsRetention(), time.Now())
+	if n > 0 {
+		logger.WithDomain(domain).Infof("[jobs] versions-purge: %d versions destroyed", n)
+	}
+	return err
+}
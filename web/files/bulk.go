@@ -0,0 +1,290 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// maxBulkOperations is the maximal number of operations in a request on
+// POST /files/_bulk
+const maxBulkOperations = 1000
+
+// The operations of a bulk request
+const (
+	bulkMove       = "move"
+	bulkRename     = "rename"
+	bulkAddTags    = "add_tags"
+	bulkRemoveTags = "remove_tags"
+	bulkTrash      = "trash"
+	bulkRestore    = "restore"
+	bulkDestroy    = "destroy"
+)
+
+type bulkOperation struct {
+	Op    string   `json:"op"`
+	ID    string   `json:"id"`
+	Rev   string   `json:"rev,omitempty"`
+	DirID string   `json:"dir_id,omitempty"`
+	Name  string   `json:"name,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+type bulkResult struct {
+	ID     string         `json:"id"`
+	Op     string         `json:"op"`
+	Status int            `json:"status"`
+	Rev    string         `json:"rev,omitempty"`
+	Error  *jsonapi.Error `json:"error,omitempty"`
+}
+
+func (r *bulkResult) fail(err error) {
+	r.Error = bulkError(err)
+	r.Status = r.Error.Status
+}
+
+// bulk applies the operations of a bulk request, in order. The consecutive
+// changes of tags on files are saved together, with a single bulk update of
+// their documents.
+type bulk struct {
+	c       echo.Context
+	fs      vfs.VFS
+	results []*bulkResult
+
+	pending []*bulkResult
+	olddocs []*vfs.FileDoc
+	patches []*vfs.DocPatch
+}
+
+// BulkHandler handles POST requests on /files/_bulk. It applies a list of
+// operations (move, rename, add or remove tags, trash, restore and destroy)
+// on files and directories, and returns the result of each operation.
+func BulkHandler(c echo.Context) error {
+	var body struct {
+		Operations []*bulkOperation `json:"operations"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if len(body.Operations) == 0 {
+		return jsonapi.BadRequest(errors.New("No operations"))
+	}
+	if len(body.Operations) > maxBulkOperations {
+		return jsonapi.BadRequest(fmt.Errorf("Too many operations (max %d)", maxBulkOperations))
+	}
+
+	b := &bulk{
+		c:       c,
+		fs:      middlewares.GetInstance(c).VFS(),
+		results: make([]*bulkResult, len(body.Operations)),
+	}
+	for i, op := range body.Operations {
+		b.results[i] = b.apply(op)
+	}
+	b.flush()
+
+	return c.JSON(http.StatusOK, echo.Map{"results": b.results})
+}
+
+func (b *bulk) apply(op *bulkOperation) *bulkResult {
+	res := &bulkResult{ID: op.ID, Op: op.Op}
+
+	var verb pkgperm.Verb
+	switch op.Op {
+	case bulkMove, bulkRename, bulkAddTags, bulkRemoveTags:
+		verb = permissions.PATCH
+	case bulkTrash, bulkRestore:
+		verb = permissions.PUT
+	case bulkDestroy:
+		verb = permissions.DELETE
+	default:
+		res.fail(jsonapi.InvalidParameter("op", fmt.Errorf("Unknown operation %q", op.Op)))
+		return res
+	}
+	if op.ID == "" {
+		res.fail(jsonapi.InvalidParameter("id", errors.New("Missing id")))
+		return res
+	}
+
+	// Only the consecutive changes of tags on distinct files are batched
+	isTags := op.Op == bulkAddTags || op.Op == bulkRemoveTags
+	if !isTags || b.isPending(op.ID) {
+		b.flush()
+	}
+
+	dir, file, err := b.fs.DirOrFileByID(op.ID)
+	if err != nil {
+		res.fail(wrapVfsError(err))
+		return res
+	}
+	var rev string
+	if dir != nil {
+		rev = dir.Rev()
+	} else {
+		rev = file.Rev()
+	}
+	if op.Rev != "" && op.Rev != rev {
+		res.fail(jsonapi.PreconditionFailed("rev", errors.New("Revision does not match")))
+		return res
+	}
+	if err = checkPerm(b.c, verb, dir, file); err != nil {
+		res.fail(err)
+		return res
+	}
+	if op.Op == bulkMove || op.Op == bulkRename || op.Op == bulkTrash {
+		if err = checkEditLock(b.c, file); err != nil {
+			res.fail(err)
+			return res
+		}
+	}
+
+	patch := &vfs.DocPatch{}
+	switch op.Op {
+	case bulkMove:
+		if op.DirID == "" {
+			res.fail(jsonapi.InvalidParameter("dir_id", errors.New("Missing dir_id")))
+			return res
+		}
+		patch.DirID = &op.DirID
+	case bulkRename:
+		if op.Name == "" {
+			res.fail(jsonapi.InvalidParameter("name", errors.New("Missing name")))
+			return res
+		}
+		patch.Name = &op.Name
+	case bulkAddTags, bulkRemoveTags:
+		var tags []string
+		if dir != nil {
+			tags = dir.Tags
+		} else {
+			tags = file.Tags
+		}
+		if op.Op == bulkAddTags {
+			tags = append(append([]string{}, tags...), op.Tags...)
+		} else {
+			tags = removeTags(tags, op.Tags)
+		}
+		patch.Tags = &tags
+		if file != nil {
+			b.pending = append(b.pending, res)
+			b.olddocs = append(b.olddocs, file)
+			b.patches = append(b.patches, patch)
+			return res
+		}
+	}
+
+	switch {
+	case op.Op == bulkTrash && dir != nil:
+		dir, err = vfs.TrashDir(b.fs, dir)
+	case op.Op == bulkTrash:
+		file, err = vfs.TrashFile(b.fs, file)
+	case op.Op == bulkRestore && dir != nil:
+		dir, err = vfs.RestoreDir(b.fs, dir)
+	case op.Op == bulkRestore:
+		file, err = vfs.RestoreFile(b.fs, file)
+	case op.Op == bulkDestroy && dir != nil:
+		err = b.fs.DestroyDirAndContent(dir)
+	case op.Op == bulkDestroy:
+		err = b.fs.DestroyFile(file)
+	case dir != nil:
+		dir, err = vfs.ModifyDirMetadata(b.fs, dir, patch)
+	default:
+		file, err = vfs.ModifyFileMetadata(b.fs, file, patch)
+	}
+	if err != nil {
+		res.fail(wrapVfsError(err))
+		return res
+	}
+
+	if op.Op == bulkDestroy {
+		res.Status = http.StatusNoContent
+	} else if dir != nil {
+		res.Status = http.StatusOK
+		res.Rev = dir.Rev()
+	} else {
+		res.Status = http.StatusOK
+		res.Rev = file.Rev()
+	}
+	return res
+}
+
+func (b *bulk) isPending(id string) bool {
+	for _, doc := range b.olddocs {
+		if doc.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// flush saves the pending changes of tags on files.
+func (b *bulk) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+	newdocs, err := vfs.ModifyFilesMetadata(b.fs, b.olddocs, b.patches)
+	for i, res := range b.pending {
+		// When some documents can't be updated, the other ones are saved
+		// anyway, and they can be recognized by their new revision.
+		if err == nil || (newdocs != nil && newdocs[i].Rev() != b.olddocs[i].Rev()) {
+			res.Status = http.StatusOK
+			res.Rev = newdocs[i].Rev()
+		} else {
+			res.fail(wrapVfsError(err))
+		}
+	}
+	b.pending = nil
+	b.olddocs = nil
+	b.patches = nil
+}
+
+func removeTags(tags, removed []string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		found := false
+		for _, r := range removed {
+			if tag == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// bulkError returns the JSON-API error for the result of an operation, like
+// the error handler does for the responses.
+func bulkError(err error) *jsonapi.Error {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return jsonapi.NewError(he.Code, he.Message)
+	}
+	if je, ok := err.(*jsonapi.Error); ok {
+		return je
+	}
+	if ce, ok := err.(*couchdb.Error); ok {
+		return &jsonapi.Error{
+			Status: ce.StatusCode,
+			Title:  ce.Name,
+			Detail: ce.Reason,
+		}
+	}
+	if os.IsExist(err) {
+		return jsonapi.Conflict(err)
+	}
+	if os.IsNotExist(err) {
+		return jsonapi.NotFound(err)
+	}
+	return jsonapi.InternalServerError(err)
+}
@@ -0,0 +1,360 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+const (
+	// changesPollTimeout is the timeout of a longpoll request to couchdb. It
+	// must be lower than the timeout of the couchdb client, so the longer
+	// feeds are made of several requests.
+	changesPollTimeout = 3 * time.Second
+	// defaultChangesTimeout is the time to wait for changes in the longpoll
+	// and continuous feeds.
+	defaultChangesTimeout = 60 * time.Second
+	maxChangesTimeout     = 5 * time.Minute
+)
+
+type apiChange struct {
+	ID      string           `json:"id"`
+	Seq     string           `json:"seq"`
+	Deleted bool             `json:"deleted,omitempty"`
+	Doc     *couchdb.JSONDoc `json:"doc,omitempty"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+}
+
+type apiChanges struct {
+	LastSeq string       `json:"last_seq"`
+	Pending int          `json:"pending"`
+	Results []*apiChange `json:"results"`
+}
+
+// changesFeed reads the changes feed of the io.cozy.files documents, and
+// keeps only the changes of the documents that the client can see.
+type changesFeed struct {
+	c        echo.Context
+	instance *instance.Instance
+	rootPath string
+	limit    int
+	// wholeType is true if the client can read all the files, and so can
+	// know the destroyed documents.
+	wholeType bool
+	// dirsPaths caches the paths of the directories, by their identifiers,
+	// to compute the paths of the files.
+	dirsPaths map[string]string
+}
+
+// ChangesHandler handles GET requests on /files/_changes. It is like the
+// changes feed of couchdb for the io.cozy.files doctype, but it only has the
+// documents that the client can read inside the DirID directory. The
+// documents that the client could read before their last move are sent as
+// deleted, without their content. This way, a client limited to a
+// directory sees the files moved out of it as deleted.
+func ChangesHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	feed := c.QueryParam("feed")
+	switch feed {
+	case "":
+		feed = "normal"
+	case "normal", "longpoll", "continuous":
+	default:
+		return jsonapi.InvalidParameter("feed", fmt.Errorf("Unsupported feed value '%s'", feed))
+	}
+
+	f := &changesFeed{
+		c:         c,
+		instance:  instance,
+		dirsPaths: make(map[string]string),
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			return jsonapi.InvalidParameter("limit", fmt.Errorf("Invalid limit value '%s'", limit))
+		}
+		f.limit = l
+	}
+
+	timeout := defaultChangesTimeout
+	if param := c.QueryParam("timeout"); param != "" {
+		ms, err := strconv.Atoi(param)
+		if err != nil || ms < 0 {
+			return jsonapi.InvalidParameter("timeout", fmt.Errorf("Invalid timeout value '%s'", param))
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		if timeout > maxChangesTimeout {
+			timeout = maxChangesTimeout
+		}
+	}
+
+	if dirID := c.QueryParam("DirID"); dirID != "" {
+		dir, err := instance.VFS().DirByID(dirID)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.GET, dir, nil); err != nil {
+			return err
+		}
+		if dir.ID() != consts.RootDirID {
+			f.rootPath = dir.Fullpath
+		}
+		f.wholeType = permissions.AllowWholeType(c, permissions.GET, consts.Files) == nil
+	} else if err := permissions.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	} else {
+		f.wholeType = true
+	}
+
+	since := c.QueryParam("since")
+	deadline := time.Now().Add(timeout)
+	switch feed {
+	case "longpoll":
+		return f.longpoll(since, deadline)
+	case "continuous":
+		return f.continuous(since, deadline)
+	}
+	res, err := f.fetch(since, 0)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// longpoll waits for the first changes visible by the client, or the
+// deadline, before sending the response.
+func (f *changesFeed) longpoll(since string, deadline time.Time) error {
+	for {
+		res, err := f.fetch(since, pollTimeout(deadline))
+		if err != nil {
+			return err
+		}
+		if len(res.Results) > 0 || time.Now().After(deadline) {
+			return f.c.JSON(http.StatusOK, res)
+		}
+		select {
+		case <-f.c.Request().Context().Done():
+			return nil
+		default:
+		}
+		since = res.LastSeq
+	}
+}
+
+// continuous sends the changes, one JSON object by line, until the deadline.
+// An empty line is sent as a heartbeat when there is no change.
+func (f *changesFeed) continuous(since string, deadline time.Time) error {
+	w := f.c.Response()
+	w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for time.Now().Before(deadline) {
+		res, err := f.fetch(since, pollTimeout(deadline))
+		if err != nil {
+			// The response has already started, so the error can only be
+			// logged, and the client can continue from the last sequence.
+			f.instance.Logger().Errorf("[changes] Cannot fetch the changes since %s: %s", since, err)
+			break
+		}
+		since = res.LastSeq
+		for _, change := range res.Results {
+			if err = enc.Encode(change); err != nil {
+				return nil
+			}
+		}
+		if len(res.Results) == 0 {
+			if _, err = w.Write([]byte("\n")); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+		select {
+		case <-f.c.Request().Context().Done():
+			return nil
+		default:
+		}
+	}
+	return enc.Encode(struct {
+		LastSeq string `json:"last_seq"`
+	}{since})
+}
+
+// pollTimeout returns how long a request to couchdb can wait for changes.
+func pollTimeout(deadline time.Time) time.Duration {
+	timeout := deadline.Sub(time.Now())
+	if timeout > changesPollTimeout {
+		return changesPollTimeout
+	}
+	if timeout < time.Millisecond {
+		return time.Millisecond
+	}
+	return timeout
+}
+
+// fetch makes a request to the changes feed of couchdb and filters it. If
+// wait is not zero, couchdb waits for a change during this duration.
+func (f *changesFeed) fetch(since string, wait time.Duration) (*apiChanges, error) {
+	req := &couchdb.ChangesRequest{
+		DocType:     consts.Files,
+		IncludeDocs: true,
+		Since:       since,
+		Limit:       f.limit,
+	}
+	if wait > 0 {
+		req.Feed = couchdb.ChangesModeLongpoll
+		req.Timeout = int(wait / time.Millisecond)
+	}
+	res, err := couchdb.GetChanges(f.instance, req)
+	if err != nil {
+		return nil, err
+	}
+	changes := &apiChanges{
+		LastSeq: res.LastSeq,
+		Pending: res.Pending,
+		Results: make([]*apiChange, 0, len(res.Results)),
+	}
+	for i := range res.Results {
+		if change := f.filter(&res.Results[i]); change != nil {
+			changes.Results = append(changes.Results, change)
+		}
+	}
+	return changes, nil
+}
+
+// filter returns the change to send to the client, or nil for the changes
+// that the client must not see. A document that the client can't read is sent
+// as deleted only if the client could read it before its last move, so that
+// the identifiers of the other documents are not leaked.
+func (f *changesFeed) filter(change *couchdb.Change) *apiChange {
+	if strings.HasPrefix(change.DocID, "_design/") {
+		return nil
+	}
+	res := &apiChange{
+		ID:      change.DocID,
+		Seq:     change.Seq,
+		Changes: change.Changes,
+	}
+	if change.Deleted || change.Doc.M == nil || change.Doc.M["_deleted"] == true {
+		// The location of a destroyed document is not known anymore. The
+		// documents are moved to the trash before being destroyed, and this
+		// move is already sent as a deletion to the clients limited to a
+		// directory.
+		if !f.wholeType {
+			return nil
+		}
+		res.Deleted = true
+		return res
+	}
+
+	dir, file := decodeFilesDoc(&change.Doc)
+	var moved *vfs.MovedFrom
+	switch {
+	case dir != nil:
+		f.dirsPaths[dir.ID()] = dir.Fullpath
+		if f.visible(dir, nil, dir.Fullpath) {
+			res.Doc = sanitizeChangeDoc(&change.Doc)
+			return res
+		}
+		moved = dir.MovedFrom
+	case file != nil:
+		if f.visible(nil, file, "") {
+			res.Doc = sanitizeChangeDoc(&change.Doc)
+			return res
+		}
+		moved = file.MovedFrom
+	}
+	if moved == nil {
+		return nil
+	}
+
+	// The document is checked again with its previous location
+	if dir != nil {
+		prev := *dir
+		prev.DirID, prev.Fullpath = moved.DirID, moved.Path
+		dir = &prev
+	} else {
+		prev := *file
+		prev.DirID = moved.DirID
+		file = &prev
+	}
+	if moved.Path == "" || !f.visible(dir, file, moved.Path) {
+		return nil
+	}
+	res.Deleted = true
+	return res
+}
+
+// decodeFilesDoc returns the directory or the file of a document from the
+// changes feed.
+func decodeFilesDoc(doc *couchdb.JSONDoc) (*vfs.DirDoc, *vfs.FileDoc) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil
+	}
+	var dof vfs.DirOrFileDoc
+	if err = json.Unmarshal(raw, &dof); err != nil || dof.DirDoc == nil {
+		return nil, nil
+	}
+	return dof.Refine()
+}
+
+// sanitizeChangeDoc removes the previous location of a document, as the
+// client may not be allowed to see it.
+func sanitizeChangeDoc(doc *couchdb.JSONDoc) *couchdb.JSONDoc {
+	delete(doc.M, "moved_from")
+	return doc
+}
+
+// visible returns true if the directory or the file is in the directory of
+// the feed and the client has the permission to read it. The path of a file
+// is computed from its parent directory when it is not given.
+func (f *changesFeed) visible(dir *vfs.DirDoc, file *vfs.FileDoc, fullpath string) bool {
+	var fd vfs.Validable
+	if dir != nil {
+		fd = dir
+	} else {
+		fd = file
+	}
+	if f.rootPath != "" {
+		if fullpath == "" {
+			parentPath, err := f.dirPath(file.DirID)
+			if err != nil {
+				return false
+			}
+			fullpath = path.Join(parentPath, file.DocName)
+		}
+		if fullpath != f.rootPath && !strings.HasPrefix(fullpath, f.rootPath+"/") {
+			return false
+		}
+	}
+	return permissions.AllowVFS(f.c, permissions.GET, fd) == nil
+}
+
+// dirPath returns the path of the directory with the given identifier.
+func (f *changesFeed) dirPath(dirID string) (string, error) {
+	if fullpath, ok := f.dirsPaths[dirID]; ok {
+		return fullpath, nil
+	}
+	dir, err := f.instance.VFS().DirByID(dirID)
+	if err != nil {
+		return "", err
+	}
+	f.dirsPaths[dirID] = dir.Fullpath
+	return dir.Fullpath, nil
+}
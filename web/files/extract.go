@@ -0,0 +1,48 @@
+package files
+
+import (
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/extract"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// ExtractHandler handles POST requests on /files/:dir-id/extract. It pushes
+// a job that unpacks the zip or tar archive given by the FileID parameter in
+// the directory, and returns this job to follow its progress.
+func ExtractHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	fileID := c.QueryParam("FileID")
+	if fileID == "" {
+		return jsonapi.BadRequest(errors.New("Missing FileID"))
+	}
+	file, err := fs.FileByID(fileID)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+	if file.Trashed {
+		return wrapVfsError(vfs.ErrFileInTrash)
+	}
+
+	dir, err := fs.DirByID(c.Param("dir-id"))
+	if err != nil {
+		return wrapVfsError(vfs.ErrParentDoesNotExist)
+	}
+	if err = checkPerm(c, permissions.POST, dir, nil); err != nil {
+		return err
+	}
+
+	return pushJob(c, "extract", &extract.Message{
+		FileID: file.ID(),
+		DirID:  dir.ID(),
+	})
+}
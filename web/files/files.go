@@ -4,6 +4,7 @@
 package files
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -176,6 +177,10 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return
 	}
 
+	if err = checkEditLock(c, olddoc); err != nil {
+		return
+	}
+
 	file, err := instance.VFS().CreateFile(newdoc, olddoc)
 	if err != nil {
 		return wrapVfsError(err)
@@ -270,6 +275,12 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 		return err
 	}
 
+	if patch.Name != nil || patch.DirID != nil {
+		if err := checkEditLock(c, file); err != nil {
+			return err
+		}
+	}
+
 	if dir != nil {
 		doc, err := vfs.ModifyDirMetadata(instance.VFS(), dir, patch)
 		if err != nil {
@@ -401,7 +412,10 @@ func ThumbnailHandler(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
 
-	fs := instance.ThumbsFS()
+	fs, err := instance.ThumbsFS()
+	if err != nil {
+		return err
+	}
 	return fs.ServeThumbContent(c.Response(), c.Request(), doc, c.Param("format"))
 }
 
@@ -466,6 +480,9 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 	if strings.Contains(archive.Name, "/") {
 		return c.JSON(http.StatusBadRequest, "The archive filename can't contain a /")
 	}
+	if !archive.IsValidFormat() {
+		return c.JSON(http.StatusBadRequest, "The archive format must be zip, tar or tar.gz")
+	}
 	if archive.Name == "" {
 		archive.Name = "archive"
 	}
@@ -484,8 +501,9 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 	}
 
 	// if accept header is application/zip, send the archive immediately
-	if c.Request().Header.Get("Accept") == "application/zip" {
-		return archive.Serve(instance.VFS(), c.Response())
+	if c.Request().Header.Get("Accept") == vfs.ZipMime {
+		archive.Format = vfs.ZipArchive
+		return archive.Serve(instance.VFS(), c.Response(), c.Request())
 	}
 
 	secret, err := vfs.GetStore().AddArchive(instance.Domain, archive)
@@ -497,7 +515,7 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 	fakeName := url.QueryEscape(archive.Name)
 
 	links := &jsonapi.LinksList{
-		Related: "/files/archive/" + secret + "/" + fakeName + ".zip",
+		Related: "/files/archive/" + secret + "/" + fakeName + archive.Extension(),
 	}
 
 	return jsonapi.Data(c, http.StatusOK, &apiArchive{archive}, links)
@@ -542,7 +560,8 @@ func FileDownloadCreateHandler(c echo.Context) error {
 }
 
 // ArchiveDownloadHandler handles requests to /files/archive/:secret/whatever.zip
-// and creates on the fly zip archive from the parameters linked to secret.
+// and creates on the fly zip, tar or tar.gz archive from the parameters linked
+// to secret. The Range requests are supported for the zip and tar archives.
 func ArchiveDownloadHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	secret := c.Param("secret")
@@ -553,7 +572,7 @@ func ArchiveDownloadHandler(c echo.Context) error {
 	if archive == nil {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
-	return archive.Serve(instance.VFS(), c.Response())
+	return archive.Serve(instance.VFS(), c.Response(), c.Request())
 }
 
 // FileDownloadHandler send a file that have previously be defined
@@ -571,6 +590,73 @@ func FileDownloadHandler(c echo.Context) error {
 	return sendFileFromPath(c, path, false)
 }
 
+// CopyHandler handles POST requests on /files/:file-id/copy and duplicates
+// the file or the directory (with its content) in the directory given by the
+// DirID parameter. The copy keeps the same name, unless a new name is given
+// in the Name parameter.
+func CopyHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	dir, file, err := fs.DirOrFileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return err
+	}
+
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		if dir != nil {
+			dirID = dir.DirID
+		} else {
+			dirID = file.DirID
+		}
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return wrapVfsError(vfs.ErrParentDoesNotExist)
+	}
+
+	name := c.QueryParam("Name")
+	if dir != nil {
+		if name == "" {
+			name = dir.DocName
+		}
+		target, errd := vfs.NewDirDocWithParent(name, parent, dir.Tags)
+		if errd != nil {
+			return wrapVfsError(errd)
+		}
+		if err = checkPerm(c, permissions.POST, target, nil); err != nil {
+			return err
+		}
+		doc, errc := vfs.CopyDir(fs, dir, parent, name)
+		if errc != nil {
+			return wrapVfsError(errc)
+		}
+		return dirData(c, http.StatusCreated, doc)
+	}
+
+	if name == "" {
+		name = file.DocName
+	}
+	target, err := vfs.NewFileDoc(name, parent.ID(), file.ByteSize, file.MD5Sum,
+		file.Mime, file.Class, time.Now(), file.Executable, false, file.Tags)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, nil, target); err != nil {
+		return err
+	}
+	doc, err := vfs.CopyFile(fs, file, parent, name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return fileData(c, http.StatusCreated, doc, nil)
+}
+
 // TrashHandler handles all DELETE requests on /files/:file-id and
 // moves the file or directory with the specified file-id to the
 // trash.
@@ -600,6 +686,10 @@ func TrashHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err := checkEditLock(c, file); err != nil {
+		return err
+	}
+
 	if dir != nil {
 		doc, errt := vfs.TrashDir(instance.VFS(), dir)
 		if errt != nil {
@@ -780,10 +870,14 @@ func Routes(router *echo.Group) {
 	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 
 	router.POST("/_find", FindFilesMango)
+	router.POST("/_bulk", BulkHandler)
+	router.GET("/_search", SearchHandler)
+	router.GET("/_changes", ChangesHandler)
 
 	router.GET("/metadata", ReadMetadataFromPathHandler)
 	router.GET("/:file-id", ReadMetadataFromIDHandler)
 	router.GET("/:file-id/relationships/contents", GetChildrenHandler)
+	router.GET("/:file-id/size", DirSizeHandler)
 
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
@@ -791,9 +885,29 @@ func Routes(router *echo.Group) {
 	router.POST("/", CreationHandler)
 	router.POST("/:dir-id", CreationHandler)
 	router.PUT("/:file-id", OverwriteFileContentHandler)
+	router.POST("/:file-id/copy", CopyHandler)
+	router.POST("/:dir-id/extract", ExtractHandler)
+	router.POST("/:dir-id/from-url", FromURLHandler)
 
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
+	router.GET("/:file-id/lock", GetLockHandler)
+	router.POST("/:file-id/lock", AcquireLockHandler)
+	router.PUT("/:file-id/lock", RefreshLockHandler)
+	router.DELETE("/:file-id/lock", ReleaseLockHandler)
+
+	router.GET("/:file-id/versions", ListVersionsHandler)
+	router.HEAD("/:file-id/versions/:version-id/download", ReadVersionContentHandler)
+	router.GET("/:file-id/versions/:version-id/download", ReadVersionContentHandler)
+	router.POST("/:file-id/versions/:version-id/restore", RestoreVersionHandler)
+	router.DELETE("/:file-id/versions/:version-id", DestroyVersionHandler)
+
+	router.POST("/uploads", CreateUploadSessionHandler)
+	router.GET("/uploads/:session-id", ReadUploadSessionHandler)
+	router.PUT("/uploads/:session-id", UploadChunkHandler)
+	router.POST("/uploads/:session-id", CommitUploadSessionHandler)
+	router.DELETE("/uploads/:session-id", AbortUploadSessionHandler)
+
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
@@ -821,14 +935,16 @@ func wrapVfsError(err error) error {
 		return jsonapi.NotFound(err)
 	case vfs.ErrParentInTrash:
 		return jsonapi.NotFound(err)
-	case vfs.ErrForbiddenDocMove:
+	case vfs.ErrForbiddenDocMove, vfs.ErrForbiddenDocCopy:
 		return jsonapi.PreconditionFailed("dir-id", err)
-	case vfs.ErrIllegalFilename:
+	case vfs.ErrIllegalFilename, vfs.ErrReservedFilename:
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalTime:
 		return jsonapi.InvalidParameter("UpdatedAt", err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.PreconditionFailed("Content-MD5", err)
+	case vfs.ErrInvalidDigest:
+		return jsonapi.PreconditionFailed("Digest", err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
 	case vfs.ErrConflict:
@@ -838,6 +954,14 @@ func wrapVfsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
+	case vfs.ErrUploadSessionExpired:
+		return jsonapi.NewError(http.StatusGone, err)
+	case vfs.ErrInvalidChunk:
+		return jsonapi.NewError(http.StatusRequestedRangeNotSatisfiable, err)
+	case vfs.ErrChunkOverlap:
+		return jsonapi.Conflict(err)
+	case vfs.ErrUploadIncomplete:
+		return jsonapi.PreconditionFailed("chunks", err)
 	}
 	return err
 }
@@ -861,6 +985,12 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		return nil, err
 	}
 
+	sha256Sum, err := parseSHA256Digest(header.Get("Digest"))
+	if err != nil {
+		err = jsonapi.InvalidParameter("Digest", err)
+		return nil, err
+	}
+
 	cdate := time.Now()
 	if date := header.Get("Date"); date != "" {
 		if t, err := time.Parse(time.RFC1123, date); err == nil {
@@ -878,7 +1008,7 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 
 	executable := c.QueryParam("Executable") == "true"
 	trashed := false
-	return vfs.NewFileDoc(
+	doc, err := vfs.NewFileDoc(
 		name,
 		dirID,
 		size,
@@ -890,6 +1020,11 @@ func FileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		trashed,
 		tags,
 	)
+	if err != nil {
+		return nil, err
+	}
+	doc.SHA256Sum = sha256Sum
+	return doc, nil
 }
 
 // CheckIfMatch checks if the revision provided matches the revision number
@@ -937,6 +1072,25 @@ func parseMD5Hash(md5B64 string) ([]byte, error) {
 	return md5Sum, nil
 }
 
+// parseSHA256Digest returns the sha256 sum given in a Digest header (RFC
+// 3230), like "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=". The
+// other algorithms of the header are ignored, and nil is returned if there
+// is no sha-256 digest.
+func parseSHA256Digest(digest string) ([]byte, error) {
+	for _, part := range strings.Split(digest, ",") {
+		parts := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "sha-256" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Given sha-256 digest is invalid")
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
 func parseContentLength(contentLength string) (int64, error) {
 	if contentLength == "" {
 		return -1, nil
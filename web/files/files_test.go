@@ -2,6 +2,7 @@ package files
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -19,6 +20,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/search"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -390,6 +392,39 @@ func TestUploadBadHash(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUploadWithDigest(t *testing.T) {
+	body := "foo"
+	for digest, status := range map[string]int{
+		"sha-256=/N4rLtula/QIYB+3If6bXDONEO5CnqBPrlURto+/j7k=":                     412,
+		"sha-256=2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": 422,
+	} {
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=baddigest", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Digest", digest)
+		res, _ := doUploadOrMod(t, req, "text/plain", "")
+		assert.Equal(t, status, res.StatusCode)
+	}
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name=gooddigest", strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Digest", "SHA-256=LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=,md5=rL0Y20zC+Fzt72VPzMSk2A==")
+	res, obj := doUploadOrMod(t, req, "text/plain", "")
+	assert.Equal(t, 201, res.StatusCode)
+	data := obj["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=", attrs["sha256sum"])
+
+	storage := testInstance.VFS()
+	_, err = readFile(storage, "/baddigest")
+	assert.Error(t, err)
+}
+
 func TestUploadAtRootSuccess(t *testing.T) {
 	body := "foo"
 	res, _ := upload(t, "/files/?Type=file&Name=goodhash", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -878,6 +913,530 @@ func TestModifyContentConcurrently(t *testing.T) {
 	assert.True(t, found)
 }
 
+func TestFileVersions(t *testing.T) {
+	testInstance.VersionsMaxCount = 5
+	if !assert.NoError(t, instance.Update(testInstance)) {
+		return
+	}
+	defer func() {
+		testInstance.VersionsMaxCount = 0
+		assert.NoError(t, instance.Update(testInstance))
+	}()
+
+	res1, data1 := upload(t, "/files/?Type=file&Name=versioned", "text/plain", "version 1", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := uploadMod(t, "/files/"+fileID, "text/plain", "version 2", "")
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	listVersions := func() []interface{} {
+		res, err := httpGet(ts.URL + "/files/" + fileID + "/versions")
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data []interface{} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		return v.Data
+	}
+
+	versions := listVersions()
+	if !assert.Len(t, versions, 1) {
+		return
+	}
+	version := versions[0].(map[string]interface{})
+	versionID := version["id"].(string)
+	assert.Equal(t, consts.FilesVersions, version["type"])
+	attrs := version["attributes"].(map[string]interface{})
+	assert.Equal(t, fileID, attrs["file_id"])
+	assert.Equal(t, "9", attrs["size"])
+
+	res3, body := download(t, "/files/"+fileID+"/versions/"+versionID+"/download", "")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.Equal(t, "version 1", string(body))
+
+	res4, _ := download(t, "/files/"+fileID+"/versions/nooop/download", "")
+	assert.Equal(t, 404, res4.StatusCode)
+
+	res5, _ := restore(t, "/files/"+fileID+"/versions/"+versionID+"/restore")
+	assert.Equal(t, 200, res5.StatusCode)
+	buf, err := readFile(testInstance.VFS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", string(buf))
+
+	versions = listVersions()
+	if !assert.Len(t, versions, 1) {
+		return
+	}
+	versionID = versions[0].(map[string]interface{})["id"].(string)
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/"+fileID+"/versions/"+versionID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res6, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 204, res6.StatusCode)
+	assert.Len(t, listVersions(), 0)
+}
+
+func TestUploadSession(t *testing.T) {
+	content := "Hello, I am a file uploaded in chunks"
+	res1, data1 := upload(t, "/files/uploads?Name=chunked&Size=37", "text/plain", "", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	sessionID, data := extractDirData(t, data1)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "chunked", attrs["name"])
+	assert.Equal(t, "37", attrs["size"])
+
+	putChunk := func(contentRange, body string) *http.Response {
+		req, err := http.NewRequest("PUT", ts.URL+"/files/uploads/"+sessionID, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Content-Range", contentRange)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		return res
+	}
+
+	res2 := putChunk("bytes 20-36/37", content[20:])
+	assert.Equal(t, 200, res2.StatusCode)
+	res3 := putChunk("bytes 30-39/37", "0123456789")
+	assert.Equal(t, 416, res3.StatusCode)
+	res4 := putChunk("bytes 10-29/37", content[10:30])
+	assert.Equal(t, 409, res4.StatusCode)
+
+	res5, _ := upload(t, "/files/uploads/"+sessionID, "", "", "")
+	assert.Equal(t, 412, res5.StatusCode)
+
+	res6 := putChunk("bytes 0-19/*", content[:20])
+	assert.Equal(t, 200, res6.StatusCode)
+
+	res7, err := httpGet(ts.URL + "/files/uploads/" + sessionID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res7, &v))
+	res7.Body.Close()
+	_, data = extractDirData(t, v)
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Len(t, attrs["chunks"], 2)
+
+	res8, data8 := upload(t, "/files/uploads/"+sessionID, "", "", "")
+	if !assert.Equal(t, 201, res8.StatusCode) {
+		return
+	}
+	_, data = extractDirData(t, data8)
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, "chunked", attrs["name"])
+	buf, err := readFile(testInstance.VFS(), "/chunked")
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(buf))
+
+	res9, err := httpGet(ts.URL + "/files/uploads/" + sessionID)
+	if assert.NoError(t, err) {
+		res9.Body.Close()
+		assert.Equal(t, 404, res9.StatusCode)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=copydir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=tocopy", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data2)
+
+	res3, data3 := upload(t, "/files/"+fileID+"/copy", "", "", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	copyID, data := extractDirData(t, data3)
+	assert.NotEqual(t, fileID, copyID)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Contains(t, attrs["name"], "tocopy (__cozy__: ")
+
+	res4, _ := upload(t, "/files/"+fileID+"/copy?DirID="+consts.RootDirID+"&Name=copied", "", "", "")
+	assert.Equal(t, 201, res4.StatusCode)
+	buf, err := readFile(testInstance.VFS(), "/copied")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	res5, data5 := upload(t, "/files/"+dirID+"/copy?DirID="+consts.RootDirID+"&Name=copydir2", "", "", "")
+	if !assert.Equal(t, 201, res5.StatusCode) {
+		return
+	}
+	_, data = extractDirData(t, data5)
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, "/copydir2", attrs["path"])
+	buf, err = readFile(testInstance.VFS(), "/copydir2/tocopy")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	res6, _ := upload(t, "/files/"+dirID+"/copy?DirID="+dirID, "", "", "")
+	assert.Equal(t, 412, res6.StatusCode)
+
+	res7, _ := upload(t, "/files/"+fileID+"/copy?DirID=nosuchdir", "", "", "")
+	assert.Equal(t, 404, res7.StatusCode)
+}
+
+func doBulk(t *testing.T, operations []map[string]interface{}) (res *http.Response, results []map[string]interface{}) {
+	body, err := json.Marshal(map[string]interface{}{"operations": operations})
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, err := http.NewRequest("POST", ts.URL+"/files/_bulk", bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	var v struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+	return res, v.Results
+}
+
+func TestBulk(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=bulkdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/?Type=file&Name=bulk1&Tags=foo", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	file1ID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/?Type=file&Name=bulk2", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	file2ID, _ := extractDirData(t, data3)
+
+	res, results := doBulk(t, []map[string]interface{}{
+		{"op": "move", "id": file1ID, "dir_id": dirID},
+		{"op": "add_tags", "id": file1ID, "tags": []string{"bar"}},
+		{"op": "add_tags", "id": file2ID, "tags": []string{"bar"}},
+		{"op": "remove_tags", "id": file1ID, "tags": []string{"foo"}},
+		{"op": "rename", "id": file2ID, "name": "bulk2-renamed"},
+		{"op": "trash", "id": file2ID, "rev": "1-bad"},
+		{"op": "chmod", "id": file2ID},
+		{"op": "trash", "id": "nosuchfile"},
+	})
+	if !assert.Equal(t, 200, res.StatusCode) || !assert.Len(t, results, 8) {
+		return
+	}
+	for i, status := range []float64{200, 200, 200, 200, 200, 412, 422, 404} {
+		assert.Equal(t, status, results[i]["status"])
+	}
+	assert.NotEmpty(t, results[4]["rev"])
+
+	fs := testInstance.VFS()
+	file1, err := fs.FileByPath("/bulkdir/bulk1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"bar"}, file1.Tags)
+	}
+	file2, err := fs.FileByPath("/bulk2-renamed")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"bar"}, file2.Tags)
+		assert.Equal(t, results[4]["rev"], file2.Rev())
+	}
+
+	res, results = doBulk(t, []map[string]interface{}{
+		{"op": "trash", "id": file2ID, "rev": file2.Rev()},
+		{"op": "destroy", "id": file2ID},
+		{"op": "trash", "id": dirID},
+		{"op": "restore", "id": dirID},
+	})
+	if !assert.Equal(t, 200, res.StatusCode) || !assert.Len(t, results, 4) {
+		return
+	}
+	for i, status := range []float64{200, 204, 200, 200} {
+		assert.Equal(t, status, results[i]["status"])
+	}
+	_, err = fs.FileByID(file2ID)
+	assert.Error(t, err)
+	file1, err = fs.FileByPath("/bulkdir/bulk1")
+	if assert.NoError(t, err) {
+		assert.False(t, file1.Trashed)
+	}
+
+	res, _ = doBulk(t, []map[string]interface{}{})
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestExtractErrors(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=extractdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := upload(t, "/files/"+dirID+"/extract", "", "", "")
+	assert.Equal(t, 400, res2.StatusCode)
+
+	res3, _ := upload(t, "/files/"+dirID+"/extract?FileID=nosuchfile", "", "", "")
+	assert.Equal(t, 404, res3.StatusCode)
+
+	res4, data4 := upload(t, "/files/"+dirID+"?Type=file&Name=archive.zip", "application/zip", "foo", "")
+	if !assert.Equal(t, 201, res4.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data4)
+	res5, _ := upload(t, "/files/nosuchdir/extract?FileID="+fileID, "", "", "")
+	assert.Equal(t, 404, res5.StatusCode)
+}
+
+func TestFromURLErrors(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=fromurldir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := upload(t, "/files/"+dirID+"/from-url", "", "", "")
+	assert.Equal(t, 422, res2.StatusCode)
+
+	res3, _ := upload(t, "/files/"+dirID+"/from-url?URL=file%3A%2F%2F%2Fetc%2Fpasswd", "", "", "")
+	assert.Equal(t, 422, res3.StatusCode)
+
+	res4, _ := upload(t, "/files/nosuchdir/from-url?URL=https%3A%2F%2Fcozy.io%2F", "", "", "")
+	assert.Equal(t, 404, res4.StatusCode)
+
+	res5, _ := upload(t, "/files/"+dirID+"/from-url?URL=https%3A%2F%2Fcozy.io%2F&Name=a%2Fb", "", "", "")
+	assert.Equal(t, 422, res5.StatusCode)
+}
+
+func TestDirSize(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=sizedir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, _ := createDir(t, "/files/"+dirID+"?Name=subdir&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	res3, data3 := upload(t, "/files/"+dirID+"?Type=file&Name=sizefile", "text/plain", "foo", "")
+	assert.Equal(t, 201, res3.StatusCode)
+	fileID, _ := extractDirData(t, data3)
+
+	res4, data4 := download(t, "/files/"+dirID+"/size", "")
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data4, &result))
+	data := result["data"].(map[string]interface{})
+	assert.Equal(t, consts.FilesSizes, data["type"])
+	assert.Equal(t, dirID, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "3", attrs["size"])
+	assert.Equal(t, float64(1), attrs["files_count"])
+	assert.Equal(t, float64(1), attrs["dirs_count"])
+
+	res5, _ := download(t, "/files/"+fileID+"/size", "")
+	assert.Equal(t, 404, res5.StatusCode)
+}
+
+func TestChanges(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=changesdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=inside", "text/plain", "foo", "")
+	assert.Equal(t, 201, res2.StatusCode)
+	insideID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/?Type=file&Name=outside-changes", "text/plain", "foo", "")
+	assert.Equal(t, 201, res3.StatusCode)
+	outsideID, _ := extractDirData(t, data3)
+
+	res4, body4 := download(t, "/files/_changes?DirID="+dirID, "")
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+	var changes struct {
+		LastSeq string `json:"last_seq"`
+		Results []struct {
+			ID      string                 `json:"id"`
+			Deleted bool                   `json:"deleted"`
+			Doc     map[string]interface{} `json:"doc"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(body4, &changes))
+	assert.NotEqual(t, "", changes.LastSeq)
+	var seenInside, seenOutside bool
+	for _, change := range changes.Results {
+		assert.False(t, strings.HasPrefix(change.ID, "_design/"))
+		switch change.ID {
+		case insideID:
+			seenInside = true
+			assert.False(t, change.Deleted)
+			assert.Equal(t, "inside", change.Doc["name"])
+		case outsideID:
+			seenOutside = true
+		}
+	}
+	assert.True(t, seenInside)
+	// The documents that have never been inside the directory are not leaked
+	assert.False(t, seenOutside)
+
+	res5, body5 := download(t, "/files/_changes?feed=longpoll&timeout=100&since="+changes.LastSeq, "")
+	assert.Equal(t, 200, res5.StatusCode)
+	assert.NoError(t, json.Unmarshal(body5, &changes))
+	assert.Len(t, changes.Results, 0)
+
+	// A file moved out of the directory is sent as deleted
+	since := changes.LastSeq
+	inside, err := testInstance.VFS().FileByID(insideID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rootID := consts.RootDirID
+	moved, err := vfs.ModifyFileMetadata(testInstance.VFS(), inside, &vfs.DocPatch{DirID: &rootID})
+	assert.NoError(t, err)
+	if assert.NotNil(t, moved.MovedFrom) {
+		assert.Equal(t, dirID, moved.MovedFrom.DirID)
+		assert.Equal(t, "/changesdir/inside", moved.MovedFrom.Path)
+	}
+	res7, body7 := download(t, "/files/_changes?DirID="+dirID+"&since="+since, "")
+	assert.Equal(t, 200, res7.StatusCode)
+	assert.NoError(t, json.Unmarshal(body7, &changes))
+	if assert.Len(t, changes.Results, 1) {
+		assert.Equal(t, insideID, changes.Results[0].ID)
+		assert.True(t, changes.Results[0].Deleted)
+		assert.Nil(t, changes.Results[0].Doc)
+	}
+
+	// The previous location of a file moved back is not sent
+	since = changes.LastSeq
+	_, err = vfs.ModifyFileMetadata(testInstance.VFS(), moved, &vfs.DocPatch{DirID: &dirID})
+	assert.NoError(t, err)
+	res8, body8 := download(t, "/files/_changes?DirID="+dirID+"&since="+since, "")
+	assert.Equal(t, 200, res8.StatusCode)
+	assert.NoError(t, json.Unmarshal(body8, &changes))
+	if assert.Len(t, changes.Results, 1) {
+		assert.False(t, changes.Results[0].Deleted)
+		_, ok := changes.Results[0].Doc["moved_from"]
+		assert.False(t, ok)
+	}
+
+	res6, _ := download(t, "/files/_changes?feed=eventsource", "")
+	assert.Equal(t, 422, res6.StatusCode)
+}
+
+func lockFile(t *testing.T, method, path, lockToken string) (res *http.Response, v map[string]interface{}) {
+	req, err := http.NewRequest(method, ts.URL+path, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	if lockToken != "" {
+		req.Header.Add(LockTokenHeader, lockToken)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		err = extractJSONRes(res, &v)
+		assert.NoError(t, err)
+	}
+	return
+}
+
+func TestEditLock(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=lockme", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+
+	res2, _ := lockFile(t, "GET", "/files/"+fileID+"/lock", "")
+	assert.Equal(t, 404, res2.StatusCode)
+
+	res3, data3 := lockFile(t, "POST", "/files/"+fileID+"/lock?TTL=60", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	attrs3 := data3["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	lockToken, ok := attrs3["token"].(string)
+	assert.True(t, ok)
+
+	res4, _ := lockFile(t, "POST", "/files/"+fileID+"/lock", "")
+	assert.Equal(t, 423, res4.StatusCode)
+
+	res5, data5 := lockFile(t, "GET", "/files/"+fileID+"/lock", "")
+	assert.Equal(t, 200, res5.StatusCode)
+	attrs5 := data5["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	_, ok = attrs5["token"]
+	assert.False(t, ok)
+
+	res6, _ := uploadMod(t, "/files/"+fileID, "text/plain", "bar", "")
+	assert.Equal(t, 423, res6.StatusCode)
+	res7, _ := trash(t, "/files/"+fileID)
+	assert.Equal(t, 423, res7.StatusCode)
+	attrs := map[string]interface{}{"name": "renamed"}
+	res8, _ := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 423, res8.StatusCode)
+
+	req9, err := http.NewRequest("PUT", ts.URL+"/files/"+fileID, strings.NewReader("bar"))
+	assert.NoError(t, err)
+	req9.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req9.Header.Add(LockTokenHeader, lockToken)
+	res9, _ := doUploadOrMod(t, req9, "text/plain", "")
+	assert.Equal(t, 200, res9.StatusCode)
+
+	res10, _ := lockFile(t, "PUT", "/files/"+fileID+"/lock", "badtoken")
+	assert.Equal(t, 423, res10.StatusCode)
+	res11, _ := lockFile(t, "PUT", "/files/"+fileID+"/lock?TTL=120", lockToken)
+	assert.Equal(t, 200, res11.StatusCode)
+
+	res12, _ := lockFile(t, "DELETE", "/files/"+fileID+"/lock", lockToken)
+	assert.Equal(t, 204, res12.StatusCode)
+	res13, _ := lockFile(t, "DELETE", "/files/"+fileID+"/lock", lockToken)
+	assert.Equal(t, 404, res13.StatusCode)
+
+	res14, _ := lockFile(t, "POST", "/files/"+fileID+"/lock", "")
+	assert.Equal(t, 201, res14.StatusCode)
+	res15, _ := lockFile(t, "DELETE", "/files/"+fileID+"/lock?Force=true", "")
+	assert.Equal(t, 204, res15.StatusCode)
+
+	res16, _ := trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res16.StatusCode)
+}
+
 func TestDownloadFileBadID(t *testing.T) {
 	res, _ := download(t, "/files/download/badid", "")
 	assert.Equal(t, 404, res.StatusCode)
@@ -1107,6 +1666,44 @@ func TestArchiveCreateAndDownload(t *testing.T) {
 	assert.Equal(t, `attachment; filename=archive.zip`, disposition)
 }
 
+func TestArchiveTarFormat(t *testing.T) {
+	for format, status := range map[string]int{"tar": 200, "rar": 400} {
+		body := bytes.NewBufferString(`{
+			"data": {
+				"attributes": {
+					"files": ["/archive/foo.jpg"],
+					"format": "` + format + `"
+				}
+			}
+		}`)
+		req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		if !assert.Equal(t, status, res.StatusCode) || status != 200 {
+			continue
+		}
+		var data map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&data)
+		assert.NoError(t, err)
+
+		related := data["links"].(map[string]interface{})["related"].(string)
+		assert.True(t, strings.HasSuffix(related, "/archive.tar"))
+		res2, err := httpGet(ts.URL + related)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res2.StatusCode)
+		assert.Equal(t, "application/x-tar", res2.Header.Get("Content-Type"))
+		assert.Equal(t, "bytes", res2.Header.Get("Accept-Ranges"))
+	}
+}
+
 func TestFileCreateAndDownloadByPath(t *testing.T) {
 	body := "foo,bar"
 	res1, _ := upload(t, "/files/?Type=file&Name=todownload2steps", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
@@ -1735,6 +2332,23 @@ func TestThumbnail(t *testing.T) {
 	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 }
 
+func TestThumbnailLinks(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=preview.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	links := data1["data"].(map[string]interface{})["links"].(map[string]interface{})
+	assert.NotEmpty(t, links["small"])
+	assert.NotEmpty(t, links["large"])
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=preview.zip", "application/zip", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	links = data2["data"].(map[string]interface{})["links"].(map[string]interface{})
+	assert.Nil(t, links["small"])
+}
+
 func TestFindFiles(t *testing.T) {
 	err := couchdb.DefineIndex(testInstance, mango.IndexOnFields(consts.Files, "by-class", []string{"class"}))
 	if !assert.NoError(t, err) {
@@ -1764,6 +2378,100 @@ func TestFindFiles(t *testing.T) {
 	assert.NotEmpty(t, small)
 }
 
+func TestSearchFiles(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=searchable.txt&Tags=quarterly", "text/plain", "The annual report of the accountant", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+
+	fs := testInstance.VFS()
+	doc, err := fs.FileByID(fileID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = search.Index(context.Background(), testInstance, fs, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	searchFiles := func(q string) []interface{} {
+		res, err := httpGet(ts.URL + "/files/_search?q=" + url.QueryEscape(q))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		var v struct {
+			Data []interface{} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+		return v.Data
+	}
+
+	for _, q := range []string{"searchable", "QUARTERLY", "report account", "annual txt"} {
+		data := searchFiles(q)
+		if assert.Len(t, data, 1, q) {
+			assert.Equal(t, fileID, data[0].(map[string]interface{})["id"])
+		}
+	}
+	assert.Len(t, searchFiles("report unknownword"), 0)
+
+	res, err := httpGet(ts.URL + "/files/_search")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 400, res.StatusCode)
+	}
+	res, err = httpGet(ts.URL + "/files/_search?q=an+re")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 400, res.StatusCode)
+	}
+
+	// The results are paginated with a cursor
+	res2, data2 := upload(t, "/files/?Type=file&Name=searchable-again.txt", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	otherID, _ := extractDirData(t, data2)
+	other, err := fs.FileByID(otherID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = search.Index(context.Background(), testInstance, fs, other)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var page struct {
+		Data  []map[string]interface{} `json:"data"`
+		Links struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+	seen := make(map[string]bool)
+	next := "/files/_search?q=searchable&page[limit]=1"
+	for i := 0; i < 2; i++ {
+		res, err = httpGet(ts.URL + next)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 200, res.StatusCode)
+		page.Links.Next = ""
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+		res.Body.Close()
+		if assert.Len(t, page.Data, 1) {
+			seen[page.Data[0]["id"].(string)] = true
+		}
+		next = page.Links.Next
+		if i == 0 && !assert.NotEmpty(t, next) {
+			return
+		}
+	}
+	assert.Empty(t, next)
+	assert.True(t, seen[fileID])
+	assert.True(t, seen[otherID])
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -0,0 +1,50 @@
+package files
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/fetch"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// FromURLHandler handles POST requests on /files/:dir-id/from-url. It pushes
+// a job that downloads the resource of the URL parameter in the directory,
+// and returns this job, whose state tells if the file has been created.
+func FromURLHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	u, err := url.Parse(c.QueryParam("URL"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return jsonapi.InvalidParameter("URL", fetch.ErrInvalidURL)
+	}
+
+	dir, err := fs.DirByID(c.Param("dir-id"))
+	if err != nil {
+		return wrapVfsError(vfs.ErrParentDoesNotExist)
+	}
+	if err = checkPerm(c, permissions.POST, dir, nil); err != nil {
+		return err
+	}
+
+	name := c.QueryParam("Name")
+	if name != "" {
+		// The name is checked before pushing the job, to report an invalid
+		// name directly to the client
+		_, err = vfs.NewFileDoc(name, dir.ID(), -1, nil, "", "", time.Now(), false, false, nil)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+	}
+
+	return pushJob(c, "download-to-vfs", &fetch.Message{
+		URL:   u.String(),
+		DirID: dir.ID(),
+		Name:  name,
+	})
+}
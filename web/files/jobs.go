@@ -0,0 +1,52 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+type apiJob struct {
+	j *jobs.JobInfos
+}
+
+func (j *apiJob) ID() string                             { return j.j.ID() }
+func (j *apiJob) Rev() string                            { return j.j.Rev() }
+func (j *apiJob) DocType() string                        { return consts.Jobs }
+func (j *apiJob) Clone() couchdb.Doc                     { return j }
+func (j *apiJob) SetID(_ string)                         {}
+func (j *apiJob) SetRev(_ string)                        {}
+func (j *apiJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (j *apiJob) Included() []jsonapi.Object             { return nil }
+func (j *apiJob) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/" + j.j.ID()}
+}
+func (j *apiJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.j)
+}
+
+// pushJob pushes a job for the files of the instance, and responds with this
+// job, that the client can use to follow the operation.
+func pushJob(c echo.Context, workerType string, data interface{}) error {
+	instance := middlewares.GetInstance(c)
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, data)
+	if err != nil {
+		return err
+	}
+	job, err := stack.GetBroker().PushJob(&jobs.JobRequest{
+		Domain:     instance.Domain,
+		WorkerType: workerType,
+		Message:    msg,
+	})
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiJob{job}, nil)
+}
@@ -0,0 +1,193 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// LockTokenHeader is the HTTP header used by the holder of the edit lock of a
+// file to send its token.
+const LockTokenHeader = "X-Lock-Token"
+
+const (
+	defaultLockTTL = 5 * time.Minute
+	maxLockTTL     = 1 * time.Hour
+)
+
+type apiLock struct {
+	fileID string
+	lock   *lock.EditLock
+	// The token is only given to the client that holds the lock
+	withToken bool
+}
+
+func (l *apiLock) ID() string                             { return l.fileID }
+func (l *apiLock) Rev() string                            { return "" }
+func (l *apiLock) DocType() string                        { return consts.FilesLocks }
+func (l *apiLock) Clone() couchdb.Doc                     { return l }
+func (l *apiLock) SetID(_ string)                         {}
+func (l *apiLock) SetRev(_ string)                        {}
+func (l *apiLock) Relationships() jsonapi.RelationshipMap { return nil }
+func (l *apiLock) Included() []jsonapi.Object             { return nil }
+func (l *apiLock) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + l.fileID + "/lock"}
+}
+func (l *apiLock) MarshalJSON() ([]byte, error) {
+	doc := *l.lock
+	if !l.withToken {
+		doc.Token = ""
+	}
+	return json.Marshal(doc)
+}
+
+// GetLockHandler handles GET requests on /files/:file-id/lock and returns the
+// edit lock of the file, without its token.
+func GetLockHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	file, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+	l, err := lock.EditLocks(instance.Domain).Get(file.ID())
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return wrapLockError(lock.ErrNotLocked)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiLock{fileID: file.ID(), lock: l}, nil)
+}
+
+// AcquireLockHandler handles POST requests on /files/:file-id/lock. It takes
+// the edit lock of the file for the duration of the TTL parameter, in
+// seconds, and returns it with its token.
+func AcquireLockHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	file, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+	ttl, err := lockTTL(c)
+	if err != nil {
+		return err
+	}
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	owner := pdoc.SourceID
+	if owner == "" {
+		owner = pdoc.Type
+	}
+	l, err := lock.EditLocks(instance.Domain).Acquire(file.ID(), owner, ttl)
+	if err != nil {
+		return wrapLockError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiLock{fileID: file.ID(), lock: l, withToken: true}, nil)
+}
+
+// RefreshLockHandler handles PUT requests on /files/:file-id/lock. It extends
+// the edit lock held with the token of the request for the duration of the
+// TTL parameter.
+func RefreshLockHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	file, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+	ttl, err := lockTTL(c)
+	if err != nil {
+		return err
+	}
+	token := c.Request().Header.Get(LockTokenHeader)
+	l, err := lock.EditLocks(instance.Domain).Refresh(file.ID(), token, ttl)
+	if err != nil {
+		return wrapLockError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiLock{fileID: file.ID(), lock: l, withToken: true}, nil)
+}
+
+// ReleaseLockHandler handles DELETE requests on /files/:file-id/lock. It
+// releases the edit lock held with the token of the request. With the Force
+// parameter, the lock is broken whatever its holder, which is reserved to the
+// clients that have a permission on all the files.
+func ReleaseLockHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	file, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+	locker := lock.EditLocks(instance.Domain)
+	if force, _ := strconv.ParseBool(c.QueryParam("Force")); force {
+		if err = permissions.AllowWholeType(c, permissions.DELETE, consts.Files); err != nil {
+			return err
+		}
+		err = locker.Break(file.ID())
+	} else {
+		err = locker.Release(file.ID(), c.Request().Header.Get(LockTokenHeader))
+	}
+	if err != nil {
+		return wrapLockError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkEditLock refuses the modification of a file that is locked, when the
+// request does not have the token of the lock.
+func checkEditLock(c echo.Context, file *vfs.FileDoc) error {
+	if file == nil {
+		return nil
+	}
+	instance := middlewares.GetInstance(c)
+	token := c.Request().Header.Get(LockTokenHeader)
+	return wrapLockError(lock.CheckEditLock(instance.Domain, file.ID(), token))
+}
+
+func lockTTL(c echo.Context) (time.Duration, error) {
+	ttl := defaultLockTTL
+	if param := c.QueryParam("TTL"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds <= 0 {
+			return 0, jsonapi.InvalidParameter("TTL", errors.New("Invalid TTL"))
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl > maxLockTTL {
+		ttl = maxLockTTL
+	}
+	return ttl, nil
+}
+
+func wrapLockError(err error) error {
+	switch err {
+	case lock.ErrLocked:
+		return jsonapi.NewError(http.StatusLocked, err)
+	case lock.ErrNotLocked:
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
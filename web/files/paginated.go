@@ -7,6 +7,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/previews"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -195,7 +196,13 @@ func (d *dir) DocType() string                        { return d.doc.DocType() }
 func (d *dir) Clone() couchdb.Doc                     { cloned := *d; return &cloned }
 func (d *dir) Relationships() jsonapi.RelationshipMap { return d.rel }
 func (d *dir) Included() []jsonapi.Object             { return d.included }
-func (d *dir) MarshalJSON() ([]byte, error)           { return json.Marshal(d.doc) }
+func (d *dir) MarshalJSON() ([]byte, error) {
+	moved := d.doc.MovedFrom
+	d.doc.MovedFrom = nil
+	res, err := json.Marshal(d.doc)
+	d.doc.MovedFrom = moved
+	return res, err
+}
 func (d *dir) Links() *jsonapi.LinksList {
 	return &jsonapi.LinksList{Self: "/files/" + d.doc.DocID}
 }
@@ -234,15 +241,15 @@ func (f *file) Relationships() jsonapi.RelationshipMap {
 }
 func (f *file) Included() []jsonapi.Object { return []jsonapi.Object{} }
 func (f *file) MarshalJSON() ([]byte, error) {
-	ref := f.doc.ReferencedBy
-	f.doc.ReferencedBy = nil
+	ref, moved := f.doc.ReferencedBy, f.doc.MovedFrom
+	f.doc.ReferencedBy, f.doc.MovedFrom = nil, nil
 	res, err := json.Marshal(f.doc)
-	f.doc.ReferencedBy = ref
+	f.doc.ReferencedBy, f.doc.MovedFrom = ref, moved
 	return res, err
 }
 func (f *file) Links() *jsonapi.LinksList {
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
-	if f.doc.Class == "image" {
+	if previews.Find(f.doc.Mime) != nil {
 		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
 			if secret, err := vfs.GetStore().AddFile(f.instance.Domain, path); err == nil {
 				links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
@@ -0,0 +1,104 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultSearchLimit = 30
+	maxSearchLimit     = 100
+)
+
+// SearchHandler handles GET requests on /files/_search and returns the files
+// matching all the words of the q parameter, in their name, tags, metadata
+// or content. Only the files the client is allowed to read are returned. The
+// results are sorted by identifier, and the cursor for the next page is the
+// identifier of the last file of the page.
+func SearchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	query := c.QueryParam("q")
+	if strings.TrimSpace(query) == "" {
+		return jsonapi.BadRequest(errors.New("Missing query"))
+	}
+
+	limit := defaultSearchLimit
+	if l := c.QueryParam("page[limit]"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return jsonapi.BadRequest(errors.New("Invalid page[limit]"))
+		}
+		limit = n
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	var prefix string
+	if dirID := c.QueryParam("DirID"); dirID != "" {
+		dir, err := fs.DirByID(dirID)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		prefix = dir.Fullpath
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+
+	ids, err := search.Search(instance, query)
+	if err == search.ErrQueryTooShort {
+		return jsonapi.BadRequest(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	cursor := c.QueryParam("page[cursor]")
+	objs := make([]jsonapi.Object, 0, limit)
+	var last string
+	var more bool
+	for _, id := range ids {
+		if id <= cursor {
+			continue
+		}
+		if len(objs) >= limit {
+			more = true
+			break
+		}
+		file, err := fs.FileByID(id)
+		if err != nil || file.Trashed {
+			continue
+		}
+		if prefix != "" {
+			fullpath, err := file.Path(fs)
+			if err != nil || !strings.HasPrefix(fullpath, prefix) {
+				continue
+			}
+		}
+		if checkPerm(c, permissions.GET, nil, file) != nil {
+			continue
+		}
+		objs = append(objs, newFile(file, instance))
+		last = id
+	}
+
+	links := &jsonapi.LinksList{}
+	if more {
+		// Keep the query and the filters for the next page
+		params := c.QueryParams()
+		params.Set("page[cursor]", last)
+		links.Next = c.Request().URL.Path + "?" + params.Encode()
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
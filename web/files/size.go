@@ -0,0 +1,53 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type apiDirStats struct {
+	dirID string
+	*vfs.DirStats
+}
+
+func (s *apiDirStats) ID() string                             { return s.dirID }
+func (s *apiDirStats) Rev() string                            { return "" }
+func (s *apiDirStats) DocType() string                        { return consts.FilesSizes }
+func (s *apiDirStats) Clone() couchdb.Doc                     { return s }
+func (s *apiDirStats) SetID(_ string)                         {}
+func (s *apiDirStats) SetRev(_ string)                        {}
+func (s *apiDirStats) Relationships() jsonapi.RelationshipMap { return nil }
+func (s *apiDirStats) Included() []jsonapi.Object             { return nil }
+func (s *apiDirStats) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + s.dirID + "/size"}
+}
+
+// DirSizeHandler handles GET requests on /files/:file-id/size and returns
+// the recursive statistics of a directory: the size and number of the files
+// in its tree, the number of its sub-directories and the date of the last
+// modification.
+func DirSizeHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	dir, err := fs.DirByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, dir, nil); err != nil {
+		return err
+	}
+
+	stats, err := fs.DirStats(dir)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiDirStats{dir.ID(), stats}, nil)
+}
@@ -0,0 +1,231 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type apiUploadSession struct {
+	*vfs.UploadSession
+}
+
+func (s *apiUploadSession) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"parent": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + s.DirID,
+			},
+			Data: couchdb.DocReference{
+				ID:   s.DirID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (s *apiUploadSession) Included() []jsonapi.Object   { return nil }
+func (s *apiUploadSession) MarshalJSON() ([]byte, error) { return json.Marshal(s.UploadSession) }
+func (s *apiUploadSession) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/uploads/" + s.DocID}
+}
+
+var _ jsonapi.Object = (*apiUploadSession)(nil)
+
+// uploadSession returns the upload session from the parameters of the
+// request, after checking that the request is allowed to create its file.
+func uploadSession(c echo.Context, fs vfs.VFS) (*vfs.UploadSession, error) {
+	session, err := fs.UploadSessionByID(c.Param("session-id"))
+	if err != nil {
+		return nil, wrapVfsError(err)
+	}
+	doc, err := session.FileDoc()
+	if err != nil {
+		return nil, wrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, nil, doc); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateUploadSessionHandler handles POST requests on /files/uploads and
+// creates a new session for uploading a large file in several chunks.
+func CreateUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	size, err := strconv.ParseInt(c.QueryParam("Size"), 10, 64)
+	if err != nil || size < 0 {
+		return jsonapi.InvalidParameter("Size", fmt.Errorf("Invalid size"))
+	}
+
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	name := c.QueryParam("Name")
+	tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+
+	// The Content-Length of the request is not the size of the file, so the
+	// document is built with the size given in the query string.
+	doc, err := FileDocFromReq(c, name, dirID, tags)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.POST, nil, doc); err != nil {
+		return err
+	}
+
+	session := &vfs.UploadSession{
+		Name:       doc.DocName,
+		DirID:      doc.DirID,
+		ByteSize:   size,
+		MD5Sum:     doc.MD5Sum,
+		SHA256Sum:  doc.SHA256Sum,
+		Mime:       doc.Mime,
+		Class:      doc.Class,
+		Executable: doc.Executable,
+		Tags:       doc.Tags,
+	}
+	if err = vfs.CreateUploadSession(fs, session); err != nil {
+		return wrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiUploadSession{session}, nil)
+}
+
+// ReadUploadSessionHandler handles GET requests on
+// /files/uploads/:session-id and returns the chunks that have been received.
+func ReadUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	session, err := uploadSession(c, instance.VFS())
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiUploadSession{session}, nil)
+}
+
+// UploadChunkHandler handles PUT requests on /files/uploads/:session-id and
+// stores a chunk of the file. The position of the chunk is given by the
+// Content-Range header, or by the Offset parameter of the query string.
+func UploadChunkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	session, err := uploadSession(c, fs)
+	if err != nil {
+		return err
+	}
+
+	offset, size, err := parseChunkRange(c, session.ByteSize)
+	if err != nil {
+		return err
+	}
+
+	session, err = vfs.AddUploadChunk(fs, session, offset, size, c.Request().Body)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiUploadSession{session}, nil)
+}
+
+// CommitUploadSessionHandler handles POST requests on
+// /files/uploads/:session-id and creates the file from the received chunks.
+func CommitUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	session, err := uploadSession(c, fs)
+	if err != nil {
+		return err
+	}
+
+	var md5Sum []byte
+	if md5Str := c.Request().Header.Get("Content-MD5"); md5Str != "" {
+		if md5Sum, err = parseMD5Hash(md5Str); err != nil {
+			return jsonapi.InvalidParameter("Content-MD5", err)
+		}
+	}
+
+	sha256Sum, err := parseSHA256Digest(c.Request().Header.Get("Digest"))
+	if err != nil {
+		return jsonapi.InvalidParameter("Digest", err)
+	}
+
+	doc, err := vfs.CommitUploadSession(fs, session, md5Sum, sha256Sum)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return fileData(c, http.StatusCreated, doc, nil)
+}
+
+// AbortUploadSessionHandler handles DELETE requests on
+// /files/uploads/:session-id and removes the session and its chunks.
+func AbortUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	session, err := uploadSession(c, fs)
+	if err != nil {
+		return err
+	}
+	if err = vfs.DestroyUploadSession(fs, session); err != nil {
+		return wrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// parseChunkRange returns the offset and the size of a chunk, from a header
+// like "Content-Range: bytes 0-1023/4096", or from the Offset parameter of
+// the query string and the Content-Length of the request.
+func parseChunkRange(c echo.Context, total int64) (int64, int64, error) {
+	header := c.Request().Header
+	errRange := jsonapi.InvalidParameter("Content-Range", fmt.Errorf("Invalid content range"))
+
+	contentRange := header.Get("Content-Range")
+	if contentRange == "" {
+		offset, err := strconv.ParseInt(c.QueryParam("Offset"), 10, 64)
+		if err != nil {
+			return 0, 0, jsonapi.InvalidParameter("Offset", fmt.Errorf("Invalid offset"))
+		}
+		size, err := parseContentLength(header.Get("Content-Length"))
+		if err != nil || size < 0 {
+			return 0, 0, jsonapi.InvalidParameter("Content-Length", fmt.Errorf("Invalid content length"))
+		}
+		return offset, size, nil
+	}
+
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, errRange
+	}
+	parts := strings.SplitN(contentRange[len("bytes "):], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errRange
+	}
+	if parts[1] != "*" && parts[1] != strconv.FormatInt(total, 10) {
+		return 0, 0, errRange
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errRange
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, errRange
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, errRange
+	}
+	return start, end - start + 1, nil
+}
@@ -0,0 +1,164 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type apiVersion struct {
+	*vfs.Version
+}
+
+func (v *apiVersion) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + v.FileID,
+			},
+			Data: couchdb.DocReference{
+				ID:   v.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (v *apiVersion) Included() []jsonapi.Object   { return nil }
+func (v *apiVersion) MarshalJSON() ([]byte, error) { return json.Marshal(v.Version) }
+func (v *apiVersion) Links() *jsonapi.LinksList {
+	self := "/files/" + v.FileID + "/versions/" + v.DocID
+	return &jsonapi.LinksList{Self: self, Related: self + "/download"}
+}
+
+var _ jsonapi.Object = (*apiVersion)(nil)
+
+// fileAndVersion returns the file and the version from the parameters of the
+// request, after checking that the version belongs to the file.
+func fileAndVersion(c echo.Context, fs vfs.VFS) (*vfs.FileDoc, *vfs.Version, error) {
+	file, err := fs.FileByID(c.Param("file-id"))
+	if err != nil {
+		return nil, nil, wrapVfsError(err)
+	}
+	version, err := fs.VersionByID(c.Param("version-id"))
+	if err != nil {
+		return nil, nil, wrapVfsError(err)
+	}
+	if version.FileID != file.ID() {
+		return nil, nil, wrapVfsError(os.ErrNotExist)
+	}
+	return file, version, nil
+}
+
+// ListVersionsHandler handles GET requests on /files/:file-id/versions and
+// returns the list of the old versions of a file, the most recent first.
+func ListVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	file, err := fs.FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+
+	versions, err := fs.VersionsFor(file.ID())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = &apiVersion{v}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// ReadVersionContentHandler handles GET requests on
+// /files/:file-id/versions/:version-id/download and serves the content of
+// an old version of a file.
+func ReadVersionContentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	file, version, err := fileAndVersion(c, fs)
+	if err != nil {
+		return err
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, file); err != nil {
+		return err
+	}
+
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeVersionContent(fs, file, version, disposition, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return nil
+}
+
+// RestoreVersionHandler handles POST requests on
+// /files/:file-id/versions/:version-id/restore and replaces the content of
+// the file by the content of the given version.
+func RestoreVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	file, version, err := fileAndVersion(c, fs)
+	if err != nil {
+		return err
+	}
+
+	if err = CheckIfMatch(c, file.Rev()); err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+
+	if err = checkEditLock(c, file); err != nil {
+		return err
+	}
+
+	doc, err := vfs.RevertFileVersion(fs, file, version)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, doc, nil)
+}
+
+// DestroyVersionHandler handles DELETE requests on
+// /files/:file-id/versions/:version-id and removes an old version of a file.
+func DestroyVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	file, version, err := fileAndVersion(c, fs)
+	if err != nil {
+		return err
+	}
+
+	if err = checkPerm(c, permissions.PUT, nil, file); err != nil {
+		return err
+	}
+
+	if err = fs.DestroyVersion(version); err != nil {
+		return wrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
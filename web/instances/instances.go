@@ -7,11 +7,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/scheduler"
+	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/labstack/echo"
 )
@@ -113,6 +118,30 @@ func modifyHandler(c echo.Context) error {
 	if locale := c.QueryParam("Locale"); locale != "" {
 		i.Locale = locale
 	}
+	if count := c.QueryParam("VersionsMaxCount"); count != "" {
+		var maxCount int
+		maxCount, err = strconv.Atoi(count)
+		if err != nil {
+			return wrapError(err)
+		}
+		i.VersionsMaxCount = maxCount
+	}
+	if age := c.QueryParam("VersionsMaxAge"); age != "" {
+		var maxAge time.Duration
+		maxAge, err = time.ParseDuration(age)
+		if err != nil {
+			return wrapError(err)
+		}
+		i.VersionsMaxAge = maxAge
+	}
+	if age := c.QueryParam("TrashMaxAge"); age != "" {
+		var maxAge time.Duration
+		maxAge, err = time.ParseDuration(age)
+		if err != nil {
+			return wrapError(err)
+		}
+		i.TrashMaxAge = maxAge
+	}
 	if err = instance.Update(i); err != nil {
 		return wrapError(err)
 	}
@@ -198,6 +227,116 @@ func registerClient(c echo.Context) error {
 	return c.String(http.StatusOK, client.ClientID)
 }
 
+func createAppPassword(c echo.Context) error {
+	in, err := instance.Get(c.QueryParam("Domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	doc, password, err := permissions.CreateAppPassword(in, c.QueryParam("Label"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, echo.Map{
+		"username": doc.ID(),
+		"password": password,
+	})
+}
+
+func destroyAppPassword(c echo.Context) error {
+	in, err := instance.Get(c.QueryParam("Domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	err = permissions.DestroyAppPassword(in, c.Param("id"))
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return jsonapi.NotFound(err)
+	}
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// fsckHandler checks the filesystem of an instance without modifying it. The
+// inconsistencies are repaired with a POST on the same route.
+func fsckHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	repair := c.Request().Method == http.MethodPost
+	logs, err := in.VFS().Fsck(repair)
+	if err != nil {
+		return err
+	}
+	if logs == nil {
+		logs = []*vfs.FsckLog{}
+	}
+	return c.JSON(http.StatusOK, logs)
+}
+
+// addTriggersHandler creates the default triggers that an instance does not
+// have yet, and returns them.
+func addTriggersHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	added, err := in.AddMissingTriggers()
+	if err != nil {
+		return err
+	}
+	if added == nil {
+		added = []*scheduler.TriggerInfos{}
+	}
+	return c.JSON(http.StatusOK, added)
+}
+
+type apiJob struct {
+	j *jobs.JobInfos
+}
+
+func (j *apiJob) ID() string                             { return j.j.ID() }
+func (j *apiJob) Rev() string                            { return j.j.Rev() }
+func (j *apiJob) DocType() string                        { return consts.Jobs }
+func (j *apiJob) Clone() couchdb.Doc                     { return j }
+func (j *apiJob) SetID(_ string)                         {}
+func (j *apiJob) SetRev(_ string)                        {}
+func (j *apiJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (j *apiJob) Included() []jsonapi.Object             { return nil }
+func (j *apiJob) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/" + j.j.ID()}
+}
+func (j *apiJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.j)
+}
+
+// encryptFilesHandler enables the encryption of the files of an instance, so
+// that the new contents are encrypted, and pushes a job to encrypt the
+// contents already stored.
+func encryptFilesHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = in.EnableEncryption(); err != nil {
+		return wrapError(err)
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, echo.Map{})
+	if err != nil {
+		return err
+	}
+	job, err := stack.GetBroker().PushJob(&jobs.JobRequest{
+		Domain:     in.Domain,
+		WorkerType: "encrypt-files",
+		Message:    msg,
+	})
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiJob{job}, nil)
+}
+
 func wrapError(err error) error {
 	switch err {
 	case instance.ErrNotFound:
@@ -214,6 +353,8 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrInvalidPassphrase:
 		return jsonapi.BadRequest(err)
+	case instance.ErrMissingEncryptionKey:
+		return jsonapi.BadRequest(err)
 	}
 	return err
 }
@@ -225,6 +366,12 @@ func Routes(router *echo.Group) {
 	router.GET("/:domain", showHandler)
 	router.PATCH("/:domain", modifyHandler)
 	router.DELETE("/:domain", deleteHandler)
+	router.GET("/:domain/fsck", fsckHandler)
+	router.POST("/:domain/fsck", fsckHandler)
+	router.POST("/:domain/encrypt-files", encryptFilesHandler)
+	router.POST("/:domain/triggers", addTriggersHandler)
 	router.POST("/token", createToken)
 	router.POST("/oauth_client", registerClient)
+	router.POST("/app_passwords", createAppPassword)
+	router.DELETE("/app_passwords/:id", destroyAppPassword)
 }
@@ -2,7 +2,10 @@ package jobs
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -15,11 +18,20 @@ import (
 	"github.com/labstack/echo"
 
 	// import workers
+	_ "github.com/cozy/cozy-stack/pkg/workers/encrypt"
+	_ "github.com/cozy/cozy-stack/pkg/workers/extract"
+	_ "github.com/cozy/cozy-stack/pkg/workers/fetch"
 	_ "github.com/cozy/cozy-stack/pkg/workers/konnectors"
 	_ "github.com/cozy/cozy-stack/pkg/workers/log"
 	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
+	_ "github.com/cozy/cozy-stack/pkg/workers/metadata"
+	_ "github.com/cozy/cozy-stack/pkg/workers/scrub"
+	_ "github.com/cozy/cozy-stack/pkg/workers/search"
 	_ "github.com/cozy/cozy-stack/pkg/workers/sharings"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
+	_ "github.com/cozy/cozy-stack/pkg/workers/trash"
+	_ "github.com/cozy/cozy-stack/pkg/workers/uploads"
+	_ "github.com/cozy/cozy-stack/pkg/workers/versions"
 )
 
 type (
@@ -37,6 +49,9 @@ type (
 	apiTrigger struct {
 		t scheduler.Trigger
 	}
+	apiDeadLetter struct {
+		dl *jobs.DeadLetter
+	}
 	apiTriggerRequest struct {
 		Type            string           `json:"type"`
 		Arguments       string           `json:"arguments"`
@@ -95,6 +110,21 @@ func (t *apiTrigger) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.t.Infos())
 }
 
+func (d *apiDeadLetter) ID() string                             { return d.dl.JobID }
+func (d *apiDeadLetter) Rev() string                            { return "" }
+func (d *apiDeadLetter) DocType() string                        { return consts.JobDeadLetters }
+func (d *apiDeadLetter) Clone() couchdb.Doc                     { return d }
+func (d *apiDeadLetter) SetID(_ string)                         {}
+func (d *apiDeadLetter) SetRev(_ string)                        {}
+func (d *apiDeadLetter) Relationships() jsonapi.RelationshipMap { return nil }
+func (d *apiDeadLetter) Included() []jsonapi.Object             { return nil }
+func (d *apiDeadLetter) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/dead-letters/" + d.dl.WorkerType + "/" + d.dl.JobID}
+}
+func (d *apiDeadLetter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.dl)
+}
+
 func getQueue(c echo.Context) error {
 	workerType := c.Param("worker-type")
 	count, err := stack.GetBroker().QueueLen(workerType)
@@ -236,6 +266,149 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
 }
 
+const (
+	// listJobsLimit is the default number of jobs per page for GET /jobs
+	listJobsLimit = 20
+	// listJobsMaxLimit is the maximal number of jobs per page for GET /jobs
+	listJobsMaxLimit = 1000
+)
+
+func listJobs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	filter := &jobs.Filter{
+		WorkerType: c.QueryParam("worker"),
+		State:      jobs.State(c.QueryParam("state")),
+	}
+	if filter.State != "" && !jobs.IsValidState(filter.State) {
+		return jsonapi.InvalidParameter("state", errors.New("Unknown state"))
+	}
+	dates := []struct {
+		param string
+		date  *time.Time
+	}{
+		{"queued_after", &filter.QueuedAfter},
+		{"queued_before", &filter.QueuedBefore},
+		{"started_after", &filter.StartedAfter},
+		{"started_before", &filter.StartedBefore},
+	}
+	for _, d := range dates {
+		if v := c.QueryParam(d.param); v != "" {
+			date, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return jsonapi.InvalidParameter(d.param, err)
+			}
+			*d.date = date
+		}
+	}
+
+	if filter.WorkerType != "" {
+		o := &jobs.JobInfos{WorkerType: filter.WorkerType}
+		if err := permissions.Allow(c, permissions.GET, o); err != nil {
+			return err
+		}
+	} else {
+		if err := permissions.AllowWholeType(c, permissions.GET, consts.Jobs); err != nil {
+			return err
+		}
+	}
+
+	cur, err := jsonapi.ExtractPaginationCursor(c, listJobsLimit)
+	if err != nil {
+		return err
+	}
+	cursor, ok := cur.(*couchdb.StartKeyCursor)
+	if !ok {
+		return jsonapi.BadRequest(errors.New("Only page[cursor] can be used for the pagination of the jobs"))
+	}
+	if cursor.Limit <= 0 || cursor.Limit > listJobsMaxLimit {
+		return jsonapi.InvalidParameter("page[limit]",
+			fmt.Errorf("The limit must be between 1 and %d", listJobsMaxLimit))
+	}
+	list, err := stack.GetBroker().ListJobs(instance.Domain, filter, cursor)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(list))
+	for i, job := range list {
+		objs[i] = &apiJob{job}
+	}
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		// Keep the filters for the next page
+		query := c.QueryParams()
+		for k, v := range params {
+			query[k] = v
+		}
+		links.Next = "/jobs?" + query.Encode()
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func cancelJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	broker := stack.GetBroker()
+	job, err := broker.GetJobInfos(instance.Domain, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := permissions.Allow(c, permissions.DELETE, job); err != nil {
+		return err
+	}
+	if err := broker.CancelJob(instance.Domain, job.ID()); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func listDeadLetters(c echo.Context) error {
+	list, err := stack.GetBroker().DeadLetters(c.Param("worker-type"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, dl := range list {
+		objs[i] = &apiDeadLetter{dl}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func getDeadLetter(c echo.Context) error {
+	dl, err := stack.GetBroker().GetDeadLetter(c.Param("worker-type"), c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiDeadLetter{dl}, nil)
+}
+
+func retryDeadLetter(c echo.Context) error {
+	job, err := stack.GetBroker().RetryDeadLetter(c.Param("worker-type"), c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, &apiJob{job}, nil)
+}
+
+func discardDeadLetter(c echo.Context) error {
+	err := stack.GetBroker().DiscardDeadLetter(c.Param("worker-type"), c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminRoutes sets the routing for the administration of the jobs
+func AdminRoutes(router *echo.Group) {
+	router.GET("/dead-letters/:worker-type", listDeadLetters)
+	router.GET("/dead-letters/:worker-type/:job-id", getDeadLetter)
+	router.POST("/dead-letters/:worker-type/:job-id/retry", retryDeadLetter)
+	router.DELETE("/dead-letters/:worker-type/:job-id", discardDeadLetter)
+}
+
 // Routes sets the routing for the jobs service
 func Routes(router *echo.Group) {
 	router.GET("/queue/:worker-type", getQueue)
@@ -246,17 +419,23 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id", getTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
+	router.GET("", listJobs)
+	router.GET("/", listJobs)
 	router.GET("/:job-id", getJob)
+	router.DELETE("/:job-id", cancelJob)
 }
 
 func wrapJobsError(err error) error {
 	switch err {
 	case scheduler.ErrNotFoundTrigger,
 		jobs.ErrNotFoundJob,
+		jobs.ErrNotFoundDeadLetter,
 		jobs.ErrUnknownWorker:
 		return jsonapi.NotFound(err)
 	case scheduler.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
+	case jobs.ErrFinishedJob:
+		return jsonapi.Conflict(err)
 	}
 	return err
 }
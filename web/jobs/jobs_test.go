@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -22,6 +23,7 @@ import (
 )
 
 var ts *httptest.Server
+var adminTS *httptest.Server
 var testInstance *instance.Instance
 var token string
 
@@ -89,6 +91,217 @@ func TestCreateJobNotExist(t *testing.T) {
 	assert.Equal(t, 404, res.StatusCode)
 }
 
+func TestCancelJob(t *testing.T) {
+	push := func() string {
+		body, _ := json.Marshal(&jsonapiReq{
+			Data: &jsonapiData{
+				Attributes: &jobRequest{Arguments: "foobar"},
+			},
+		})
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/wait", bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, 202, res.StatusCode)
+		var result struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return result.Data.ID
+	}
+	cancel := func(id string) int {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/jobs/"+id, nil)
+		assert.NoError(t, err)
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	state := func(id string) jobs.State {
+		infos, err := stack.GetBroker().GetJobInfos(testInstance.Domain, id)
+		assert.NoError(t, err)
+		return infos.State
+	}
+
+	running := push()
+	queued := push()
+	for i := 0; i < 100 && state(running) != jobs.Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Running, state(running))
+	assert.Equal(t, jobs.Queued, state(queued))
+
+	assert.Equal(t, 204, cancel(queued))
+	assert.Equal(t, jobs.Cancelled, state(queued))
+
+	assert.Equal(t, 204, cancel(running))
+	for i := 0; i < 100 && state(running) != jobs.Cancelled; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Cancelled, state(running))
+	assert.Equal(t, 204, cancel(running))
+
+	assert.Equal(t, 404, cancel("not-a-job"))
+}
+
+func TestListJobs(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		body, _ := json.Marshal(&jsonapiReq{
+			Data: &jsonapiData{
+				Attributes: &jobRequest{Arguments: "foobar"},
+			},
+		})
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/print", bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, 202, res.StatusCode)
+	}
+
+	type listResult struct {
+		Data []struct {
+			ID         string         `json:"id"`
+			Attributes *jobs.JobInfos `json:"attributes"`
+		} `json:"data"`
+		Links struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+	list := func(path string) (int, *listResult) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var result listResult
+		if res.StatusCode == 200 {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		}
+		return res.StatusCode, &result
+	}
+
+	var last time.Time
+	seen := make(map[string]bool)
+	path := "/jobs?worker=print&page[limit]=1"
+	for path != "" {
+		status, result := list(path)
+		if !assert.Equal(t, 200, status) {
+			return
+		}
+		if !assert.Len(t, result.Data, 1) {
+			return
+		}
+		job := result.Data[0]
+		assert.False(t, seen[job.ID])
+		seen[job.ID] = true
+		assert.Equal(t, "print", job.Attributes.WorkerType)
+		if !last.IsZero() {
+			assert.False(t, job.Attributes.QueuedAt.After(last))
+		}
+		last = job.Attributes.QueuedAt
+		path = result.Links.Next
+	}
+	assert.True(t, len(seen) >= 3)
+
+	status, result := list("/jobs?worker=print&queued_after=2000-01-01T00:00:00Z&queued_before=2001-01-01T00:00:00Z")
+	assert.Equal(t, 200, status)
+	assert.Len(t, result.Data, 0)
+
+	status, _ = list("/jobs?state=foobar")
+	assert.Equal(t, 400, status)
+	status, _ = list("/jobs?queued_after=yesterday")
+	assert.Equal(t, 400, status)
+	status, _ = list("/jobs?page[limit]=1001")
+	assert.Equal(t, 400, status)
+}
+
+func TestDeadLetters(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: &jobRequest{Arguments: "foobar"},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/fail", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+
+	type deadLetter struct {
+		ID         string           `json:"id"`
+		Type       string           `json:"type"`
+		Attributes *jobs.DeadLetter `json:"attributes"`
+	}
+	do := func(method, path string) (int, []byte) {
+		req, err := http.NewRequest(method, adminTS.URL+path, nil)
+		assert.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(res.Body)
+		assert.NoError(t, err)
+		return res.StatusCode, buf.Bytes()
+	}
+	waitDeadLetter := func() *deadLetter {
+		for i := 0; i < 100; i++ {
+			status, body := do(http.MethodGet, "/jobs/dead-letters/fail")
+			assert.Equal(t, 200, status)
+			var result struct {
+				Data []*deadLetter `json:"data"`
+			}
+			assert.NoError(t, json.Unmarshal(body, &result))
+			if len(result.Data) > 0 {
+				return result.Data[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+
+	dl := waitDeadLetter()
+	if !assert.NotNil(t, dl) {
+		return
+	}
+	assert.Equal(t, consts.JobDeadLetters, dl.Type)
+	assert.Equal(t, "fail", dl.Attributes.WorkerType)
+	assert.Equal(t, "failed", dl.Attributes.Error)
+	assert.Equal(t, 1, dl.Attributes.Attempts)
+
+	status, _ := do(http.MethodGet, "/jobs/dead-letters/fail/"+dl.ID)
+	assert.Equal(t, 200, status)
+	status, _ = do(http.MethodGet, "/jobs/dead-letters/fail/not-a-job")
+	assert.Equal(t, 404, status)
+	status, _ = do(http.MethodGet, "/jobs/dead-letters/not-a-worker")
+	assert.Equal(t, 404, status)
+
+	// The retried job fails again, and goes back in the dead letters
+	status, _ = do(http.MethodPost, "/jobs/dead-letters/fail/"+dl.ID+"/retry")
+	assert.Equal(t, 202, status)
+	status, _ = do(http.MethodGet, "/jobs/dead-letters/fail/"+dl.ID)
+	assert.Equal(t, 404, status)
+	retried := waitDeadLetter()
+	if !assert.NotNil(t, retried) {
+		return
+	}
+	assert.NotEqual(t, dl.ID, retried.ID)
+
+	status, _ = do(http.MethodDelete, "/jobs/dead-letters/fail/"+retried.ID)
+	assert.Equal(t, 204, status)
+	status, _ = do(http.MethodDelete, "/jobs/dead-letters/fail/"+retried.ID)
+	assert.Equal(t, 404, status)
+}
+
 func TestAddGetAndDeleteTriggerAt(t *testing.T) {
 	at := time.Now().Add(1100 * time.Millisecond).Format(time.RFC3339)
 	body, _ := json.Marshal(&jsonapiReq{
@@ -289,8 +502,9 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	// The instance already has a trigger for thumbnails
-	assert.Len(t, v.Data, 1)
+	// The instance already has triggers for thumbnails, search, uploads, trash,
+	// versions and scrub
+	assert.Len(t, v.Data, 6)
 
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -325,12 +539,12 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	if assert.Len(t, v.Data, 2) {
+	if assert.Len(t, v.Data, 7) {
 		var index int
-		if v.Data[1].Attributes.Type == "@in" {
-			index = 1
-		} else {
-			index = 0
+		for i, d := range v.Data {
+			if d.Attributes.Type == "@in" {
+				index = i
+			}
 		}
 		assert.Equal(t, consts.Triggers, v.Data[index].Type)
 		assert.Equal(t, "@in", v.Data[index].Attributes.Type)
@@ -392,6 +606,24 @@ func TestMain(m *testing.M) {
 		},
 	})
 
+	jobs.AddWorker("wait", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Minute,
+		WorkerFunc: func(ctx context.Context, m *jobs.Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	jobs.AddWorker("fail", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		WorkerFunc: func(ctx context.Context, m *jobs.Message) error {
+			return errors.New("failed")
+		},
+	})
+
 	testInstance = setup.GetTestInstance()
 	if err := stack.Start(); err != nil {
 		testutils.Fatal(err)
@@ -401,5 +633,6 @@ func TestMain(m *testing.M) {
 	_, token = setup.GetTestClient(scope)
 
 	ts = setup.GetTestServer("/jobs", Routes)
+	adminTS = setup.GetTestServer("/jobs", AdminRoutes)
 	os.Exit(setup.Run())
 }
@@ -117,6 +117,24 @@ func TestBadPermissionsBearer(t *testing.T) {
 	assert.Equal(t, res.StatusCode, http.StatusBadRequest)
 }
 
+func TestAppPasswordRejectedOutsideWebDAV(t *testing.T) {
+	doc, password, err := permissions.CreateAppPassword(testInstance, "webdav")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer permissions.DestroyAppPassword(testInstance, doc.ID())
+
+	// The app passwords are only accepted by the WebDAV endpoint
+	req, _ := http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.SetBasicAuth(doc.ID(), password)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
 func TestCreateSubPermission(t *testing.T) {
 	_, codes, err := createTestSubPermissions(token, "alice,bob")
 	if !assert.NoError(t, err) {
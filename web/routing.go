@@ -29,6 +29,7 @@ import (
 	_ "github.com/cozy/cozy-stack/web/statik" // Generated file with the packed assets
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webdav"
 	"github.com/labstack/echo"
 	"github.com/rakyll/statik/fs"
 )
@@ -171,6 +172,7 @@ func SetupRoutes(router *echo.Echo) error {
 	sharings.Routes(router.Group("/sharings", mws...))
 	status.Routes(router.Group("/status"))
 	version.Routes(router.Group("/version"))
+	webdav.Routes(router, middlewares.NeedInstance)
 
 	setupRecover(router)
 
@@ -185,6 +187,7 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	}
 
 	instances.Routes(router.Group("/instances"))
+	jobs.AdminRoutes(router.Group("/jobs"))
 	version.Routes(router.Group("/version"))
 
 	setupRecover(router)
@@ -208,6 +211,22 @@ func CreateSubdomainProxy(router *echo.Echo, serveApps echo.HandlerFunc) (*echo.
 	serveApps = SetupAppsHandler(serveApps)
 
 	main := echo.New()
+	// The WebDAV methods are not known by echo, so the WebDAV requests are
+	// forwarded to the router before the routing.
+	main.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !webdav.IsWebDAVPath(c.Request().URL.Path) {
+				return next(c)
+			}
+			if parent, slug, _ := middlewares.SplitHost(c.Request().Host); slug != "" {
+				if _, err := instance.Get(parent); err == nil {
+					return next(c)
+				}
+			}
+			router.ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
+	})
 	main.Any("/*", func(c echo.Context) error {
 		// TODO(optim): minimize the number of instance requests
 		if parent, slug, _ := middlewares.SplitHost(c.Request().Host); slug != "" {
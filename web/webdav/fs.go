@@ -0,0 +1,376 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"golang.org/x/net/webdav"
+)
+
+// fileSystem implements the webdav.FileSystem interface on top of the VFS of
+// an instance. The permissions of the request are checked for each operation.
+type fileSystem struct {
+	fs     vfs.VFS
+	perms  permissions.Set
+	domain string
+}
+
+var _ webdav.FileSystem = (*fileSystem)(nil)
+
+func (f *fileSystem) allow(v permissions.Verb, doc vfs.Validable) error {
+	if err := vfs.Allows(f.fs, f.perms, v, doc); err != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// checkEditLock refuses the changes of a file locked by a collaborative
+// editor: the WebDAV clients can't know the token of an edit lock.
+func (f *fileSystem) checkEditLock(file *vfs.FileDoc) error {
+	return lock.CheckEditLock(f.domain, file.ID(), "")
+}
+
+// Mkdir creates a new directory (MKCOL).
+func (f *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return os.ErrExist
+	}
+	parent, err := f.fs.DirByPath(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	dir, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+	if err != nil {
+		return err
+	}
+	if err = f.allow(permissions.POST, dir); err != nil {
+		return err
+	}
+	return f.fs.CreateDir(dir)
+}
+
+// OpenFile opens a file or a directory. A file opened with the O_TRUNC flag
+// is opened for replacing its content (PUT).
+func (f *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanPath(name)
+	dir, file, err := f.fs.DirOrFileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if dir != nil {
+		if err = f.allow(permissions.GET, dir); err != nil {
+			return nil, err
+		}
+		return &davDir{fs: f.fs, doc: dir}, nil
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		return f.createFile(name, file, flag)
+	}
+
+	if file == nil {
+		return nil, os.ErrNotExist
+	}
+	if err = f.allow(permissions.GET, file); err != nil {
+		return nil, err
+	}
+
+	// Without O_TRUNC, a file opened for writing is only used to read and
+	// patch its properties, its content is left untouched.
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return &davFile{doc: file}, nil
+	}
+
+	content, err := f.fs.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{doc: file, content: content}, nil
+}
+
+func (f *fileSystem) createFile(name string, olddoc *vfs.FileDoc, flag int) (webdav.File, error) {
+	var dirID string
+	var tags []string
+	var exec bool
+	if olddoc != nil {
+		if err := f.allow(permissions.PUT, olddoc); err != nil {
+			return nil, err
+		}
+		if err := f.checkEditLock(olddoc); err != nil {
+			return nil, err
+		}
+		dirID, tags, exec = olddoc.DirID, olddoc.Tags, olddoc.Executable
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		parent, err := f.fs.DirByPath(path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		dirID, tags = parent.ID(), []string{}
+	}
+
+	filename := path.Base(name)
+	mime, class := vfs.ExtractMimeAndClassFromFilename(filename)
+	newdoc, err := vfs.NewFileDoc(filename, dirID, -1, nil, mime, class, time.Now(), exec, false, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if olddoc != nil {
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+	} else if err = f.allow(permissions.POST, newdoc); err != nil {
+		return nil, err
+	}
+
+	content, err := f.fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{doc: newdoc, content: content, writing: true}, nil
+}
+
+// RemoveAll puts a file or a directory in the trash (DELETE). If it is
+// already in the trash, it is destroyed.
+func (f *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return os.ErrPermission
+	}
+	dir, file, err := f.fs.DirOrFileByPath(name)
+	if err != nil {
+		return err
+	}
+
+	if dir != nil {
+		if err = f.allow(permissions.PUT, dir); err != nil {
+			return err
+		}
+		_, err = vfs.TrashDir(f.fs, dir)
+		if err == vfs.ErrFileInTrash {
+			if err = f.allow(permissions.DELETE, dir); err != nil {
+				return err
+			}
+			return f.fs.DestroyDirAndContent(dir)
+		}
+		return err
+	}
+
+	if err = f.allow(permissions.PUT, file); err != nil {
+		return err
+	}
+	if err = f.checkEditLock(file); err != nil {
+		return err
+	}
+	_, err = vfs.TrashFile(f.fs, file)
+	if err == vfs.ErrFileInTrash {
+		if err = f.allow(permissions.DELETE, file); err != nil {
+			return err
+		}
+		return f.fs.DestroyFile(file)
+	}
+	return err
+}
+
+// Rename moves and/or renames a file or a directory (MOVE). The destination
+// has already been removed by the webdav handler if it existed.
+func (f *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	if oldName == "/" || newName == "/" {
+		return os.ErrPermission
+	}
+	dir, file, err := f.fs.DirOrFileByPath(oldName)
+	if err != nil {
+		return err
+	}
+
+	newname := path.Base(newName)
+	patch := &vfs.DocPatch{Name: &newname}
+	if path.Dir(oldName) != path.Dir(newName) {
+		var parent *vfs.DirDoc
+		parent, err = f.fs.DirByPath(path.Dir(newName))
+		if err != nil {
+			return err
+		}
+		if err = f.allow(permissions.PATCH, parent); err != nil {
+			return err
+		}
+		parentID := parent.ID()
+		patch.DirID = &parentID
+	}
+
+	if dir != nil {
+		if err = f.allow(permissions.PATCH, dir); err != nil {
+			return err
+		}
+		_, err = vfs.ModifyDirMetadata(f.fs, dir, patch)
+		return err
+	}
+	if err = f.allow(permissions.PATCH, file); err != nil {
+		return err
+	}
+	if err = f.checkEditLock(file); err != nil {
+		return err
+	}
+	_, err = vfs.ModifyFileMetadata(f.fs, file, patch)
+	return err
+}
+
+// Stat returns the informations about a file or a directory.
+func (f *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	dir, file, err := f.fs.DirOrFileByPath(cleanPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if err = f.allow(permissions.GET, dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+	if err = f.allow(permissions.GET, file); err != nil {
+		return nil, err
+	}
+	return &fileInfo{file}, nil
+}
+
+// davFile is a webdav.File for a file of the VFS. The content is nil when the
+// file has been opened only for its properties.
+type davFile struct {
+	doc     *vfs.FileDoc
+	content vfs.File
+	writing bool
+	written int64
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.content == nil || f.writing {
+		return 0, os.ErrInvalid
+	}
+	return f.content.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.content == nil || f.writing {
+		return 0, os.ErrInvalid
+	}
+	return f.content.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, os.ErrPermission
+	}
+	n, err := f.content.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	if f.writing {
+		// The size of the new content is only known by the VFS when the file
+		// is closed.
+		doc := *f.doc
+		doc.ByteSize = f.written
+		return &fileInfo{&doc}, nil
+	}
+	return &fileInfo{f.doc}, nil
+}
+
+func (f *davFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+// davDir is a webdav.File for a directory of the VFS.
+type davDir struct {
+	fs   vfs.VFS
+	doc  *vfs.DirDoc
+	iter vfs.DirIterator
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.iter == nil {
+		d.iter = d.fs.DirIterator(d.doc, nil)
+	}
+	var infos []os.FileInfo
+	for count <= 0 || len(infos) < count {
+		dir, file, err := d.iter.Next()
+		if err == vfs.ErrIteratorDone {
+			if count > 0 && len(infos) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dir != nil {
+			infos = append(infos, dir)
+		} else {
+			infos = append(infos, &fileInfo{file})
+		}
+	}
+	return infos, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.doc, nil
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+// fileInfo gives the content type and the etag of a file to the webdav
+// handler, which would otherwise have to read the content of the file to
+// compute them.
+type fileInfo struct {
+	*vfs.FileDoc
+}
+
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.Mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.Mime, nil
+}
+
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if len(fi.MD5Sum) == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	return fmt.Sprintf(`"%x"`, fi.MD5Sum), nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
@@ -0,0 +1,143 @@
+// Package webdav exposes the VFS of an instance with the WebDAV protocol, so
+// that it can be mounted by the desktop file managers and office suites.
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+	"golang.org/x/net/webdav"
+)
+
+// Prefix is the path prefix of the WebDAV endpoint.
+const Prefix = "/dav"
+
+// The locks are kept in memory, one lock system by instance. The WebDAV locks
+// are only advisory and short-lived, so the lock systems that have not been
+// used for locksIdleTTL are dropped, and at most maxLockSystems are kept.
+const (
+	locksIdleTTL   = 1 * time.Hour
+	maxLockSystems = 10000
+)
+
+type instanceLocks struct {
+	ls       webdav.LockSystem
+	lastUsed time.Time
+}
+
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*instanceLocks)
+)
+
+func lockSystem(domain string) webdav.LockSystem {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	now := time.Now()
+	il, ok := locks[domain]
+	if !ok {
+		pruneLockSystems(now)
+		il = &instanceLocks{ls: webdav.NewMemLS()}
+		locks[domain] = il
+	}
+	il.lastUsed = now
+	return il.ls
+}
+
+// pruneLockSystems removes the lock systems that are idle, and the least
+// recently used one if there is still no room for a new one. It must be
+// called with locksMu held.
+func pruneLockSystems(now time.Time) {
+	var oldest string
+	for domain, il := range locks {
+		if now.Sub(il.lastUsed) > locksIdleTTL {
+			delete(locks, domain)
+			continue
+		}
+		if oldest == "" || il.lastUsed.Before(locks[oldest].lastUsed) {
+			oldest = domain
+		}
+	}
+	if len(locks) >= maxLockSystems && oldest != "" {
+		delete(locks, oldest)
+	}
+}
+
+// IsWebDAVPath returns true if the given path is served by the WebDAV
+// endpoint.
+func IsWebDAVPath(p string) bool {
+	return p == Prefix || strings.HasPrefix(p, Prefix+"/")
+}
+
+// serveWebDAV handles a WebDAV request. The client is authenticated with an
+// OAuth access token (as a bearer token or as the password of HTTP basic
+// authentication) or with an app password.
+func serveWebDAV(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+
+	var perms permissions.Set
+	if c.Request().Method != http.MethodOptions {
+		pdoc, err := getPermission(c, i)
+		if err == permissions.ErrTooManyAttempts {
+			return err
+		}
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Cozy"`)
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		perms = pdoc.Permissions
+	}
+
+	h := &webdav.Handler{
+		Prefix:     Prefix,
+		FileSystem: &fileSystem{fs: i.VFS(), perms: perms, domain: i.Domain},
+		LockSystem: lockSystem(i.Domain),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				logger.WithDomain(i.Domain).Debugf("[webdav] %s %s: %s",
+					req.Method, req.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// getPermission returns the permissions of a WebDAV request. The app passwords
+// are checked only here, and not by the permissions extractor of the other
+// routes: they are made for the WebDAV clients, and they must not give access
+// to the rest of the API.
+func getPermission(c echo.Context, i *instance.Instance) (*permissions.Permission, error) {
+	// The app passwords are sent with HTTP basic authentication, with the
+	// identifier of the app password as the username.
+	if user, pass, ok := c.Request().BasicAuth(); ok && user != "" {
+		pdoc, err := permissions.GetForAppPassword(i, user, pass, c.RealIP())
+		if err != permissions.ErrInvalidToken {
+			return pdoc, err
+		}
+	}
+	return webpermissions.GetPermission(c)
+}
+
+// Routes sets the routing for the WebDAV service. WebDAV uses some HTTP
+// methods (MKCOL, MOVE, COPY, LOCK, etc.) that the echo router doesn't know,
+// so the requests are dispatched by a middleware before the routing.
+func Routes(router *echo.Echo, mws ...echo.MiddlewareFunc) {
+	handler := middlewares.Compose(serveWebDAV, mws...)
+	router.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if IsWebDAVPath(c.Request().URL.Path) {
+				return handler(c)
+			}
+			return next(c)
+		}
+	})
+}
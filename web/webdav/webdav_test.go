@@ -0,0 +1,365 @@
+package webdav
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+
+func davRequest(method, path, body string, headers map[string]string) (*http.Response, string, error) {
+	req, err := http.NewRequest(method, ts.URL+Prefix+path, strings.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, string(b), nil
+}
+
+func TestUnauthorized(t *testing.T) {
+	res, err := http.Get(ts.URL + Prefix + "/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, `Basic realm="Cozy"`, res.Header.Get(echo.HeaderWWWAuthenticate))
+}
+
+func TestMkcolPutGet(t *testing.T) {
+	res, _, err := davRequest("MKCOL", "/webdav-dir", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, _, err = davRequest("MKCOL", "/no-such-dir/child", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, _, err = davRequest("PUT", "/webdav-dir/hello.txt", "Hello WebDAV", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body, err := davRequest("GET", "/webdav-dir/hello.txt", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "Hello WebDAV", body)
+	assert.NotEmpty(t, res.Header.Get("Etag"))
+
+	res, _, err = davRequest("PUT", "/webdav-dir/hello.txt", "Hello again", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	doc, err := testInstance.VFS().FileByPath("/webdav-dir/hello.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(len("Hello again")), doc.ByteSize)
+	assert.Equal(t, "text/plain", doc.Mime)
+}
+
+func TestPropfind(t *testing.T) {
+	res, _, err := davRequest("MKCOL", "/propfind-dir", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _, err = davRequest("PUT", "/propfind-dir/foo.txt", "foo", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, body, err := davRequest("PROPFIND", "/propfind-dir", "", map[string]string{
+		"Depth": "1",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+	assert.Contains(t, body, "<D:href>/dav/propfind-dir/</D:href>")
+	assert.Contains(t, body, "<D:href>/dav/propfind-dir/foo.txt</D:href>")
+	assert.Contains(t, body, "<D:getcontentlength>3</D:getcontentlength>")
+	assert.Contains(t, body, "<D:getcontenttype>text/plain</D:getcontenttype>")
+}
+
+func TestMoveAndCopy(t *testing.T) {
+	res, _, err := davRequest("MKCOL", "/move-dir", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _, err = davRequest("PUT", "/move-dir/foo.txt", "foo", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, _, err = davRequest("MOVE", "/move-dir/foo.txt", "", map[string]string{
+		"Destination": ts.URL + Prefix + "/bar.txt",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	doc, err := testInstance.VFS().FileByPath("/bar.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, consts.RootDirID, doc.DirID)
+	}
+	_, err = testInstance.VFS().FileByPath("/move-dir/foo.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	res, _, err = davRequest("COPY", "/bar.txt", "", map[string]string{
+		"Destination": ts.URL + Prefix + "/move-dir/baz.txt",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, body, err := davRequest("GET", "/move-dir/baz.txt", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "foo", body)
+}
+
+func TestDeleteTrashesFile(t *testing.T) {
+	res, _, err := davRequest("PUT", "/to-delete.txt", "bye", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, _, err = davRequest("DELETE", "/to-delete.txt", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	_, err = testInstance.VFS().FileByPath("/to-delete.txt")
+	assert.True(t, os.IsNotExist(err))
+	doc, err := testInstance.VFS().FileByPath("/.cozy_trash/to-delete.txt")
+	if assert.NoError(t, err) {
+		assert.True(t, doc.Trashed)
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	res, _, err := davRequest("PUT", "/locked.txt", "lock", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	lockBody := `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>test</D:owner>
+</D:lockinfo>`
+	res, _, err = davRequest("LOCK", "/locked.txt", lockBody, map[string]string{
+		"Timeout": "Second-60",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	lockToken := res.Header.Get("Lock-Token")
+	assert.NotEmpty(t, lockToken)
+
+	res, _, err = davRequest("PUT", "/locked.txt", "no lock", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res, _, err = davRequest("UNLOCK", "/locked.txt", "", map[string]string{
+		"Lock-Token": lockToken,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, _, err = davRequest("PUT", "/locked.txt", "unlocked", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+}
+
+func TestEditLockedFile(t *testing.T) {
+	res, _, err := davRequest("PUT", "/edit-locked.txt", "v1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	doc, err := testInstance.VFS().FileByPath("/edit-locked.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := lock.EditLocks(testInstance.Domain).Acquire(doc.ID(), "editor", time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, _, err = davRequest("PUT", "/edit-locked.txt", "v2", nil)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, http.StatusCreated, res.StatusCode)
+	}
+	res, _, err = davRequest("DELETE", "/edit-locked.txt", "", nil)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, http.StatusNoContent, res.StatusCode)
+	}
+	res, _, err = davRequest("MOVE", "/edit-locked.txt", "", map[string]string{
+		"Destination": ts.URL + Prefix + "/edit-moved.txt",
+	})
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, http.StatusCreated, res.StatusCode)
+	}
+	current, err := testInstance.VFS().FileByPath("/edit-locked.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, doc.Rev(), current.Rev())
+	}
+
+	assert.NoError(t, lock.EditLocks(testInstance.Domain).Release(doc.ID(), l.Token))
+	res, _, err = davRequest("DELETE", "/edit-locked.txt", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	}
+}
+
+func TestAppPassword(t *testing.T) {
+	doc, password, err := permissions.CreateAppPassword(testInstance, "webdav test")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req, _ := http.NewRequest("PROPFIND", ts.URL+Prefix+"/", nil)
+	req.Header.Add("Depth", "0")
+	req.SetBasicAuth(doc.ID(), password)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+
+	req, _ = http.NewRequest("PROPFIND", ts.URL+Prefix+"/", nil)
+	req.Header.Add("Depth", "0")
+	req.SetBasicAuth(doc.ID(), "wrong")
+	res2, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res2.StatusCode)
+
+	// The successful verification is cached, but a revoked app password is
+	// rejected anyway
+	assert.NoError(t, permissions.DestroyAppPassword(testInstance, doc.ID()))
+	req, _ = http.NewRequest("PROPFIND", ts.URL+Prefix+"/", nil)
+	req.Header.Add("Depth", "0")
+	req.SetBasicAuth(doc.ID(), password)
+	res3, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res3.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res3.StatusCode)
+}
+
+func TestAppPasswordTooManyAttempts(t *testing.T) {
+	doc, password, err := permissions.CreateAppPassword(testInstance, "brute-force test")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	propfind := func(pass, ip string) int {
+		req, _ := http.NewRequest("PROPFIND", ts.URL+Prefix+"/", nil)
+		req.Header.Add("Depth", "0")
+		req.Header.Add("X-Real-IP", ip)
+		req.SetBasicAuth(doc.ID(), pass)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusUnauthorized, propfind("wrong", "192.0.2.1"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, propfind(password, "192.0.2.1"))
+	// The other clients are not locked out
+	assert.Equal(t, http.StatusMultiStatus, propfind(password, "192.0.2.2"))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "webdav_test")
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		fmt.Println("Could not create temporary directory.")
+		os.Exit(1)
+	}
+	setup.AddCleanup(func() error { return os.RemoveAll(tempdir) })
+
+	config.GetConfig().Fs.URL = fmt.Sprintf("file://localhost%s", tempdir)
+
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+	ts = setup.GetTestServerMultipleRoutes(nil, func(r *echo.Echo) *echo.Echo {
+		Routes(r, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("instance", testInstance)
+				return next(c)
+			}
+		})
+		return r
+	})
+
+	os.Exit(setup.Run())
+}